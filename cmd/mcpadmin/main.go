@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+const usage = `Usage: mcpadmin [-admin URL] COMMAND [ARGS]
+
+Commands:
+  history                         list the snapshots kept in the history
+  show VERSION [COLLECTION]       show the resources of a snapshot
+  diff FROM TO [COLLECTION]       show the resources which differ between two snapshots
+  pin VERSION                     serve a snapshot until it is unpinned
+  unpin                           serve the snapshots built from the config directory again
+`
+
+func main() {
+	var adminURL string
+	flag.StringVar(&adminURL, "admin", "http://127.0.0.1:18081", "URL of the admin API")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	method, path, query, err := request(args[0], args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := call(method, adminURL+path+"?"+query.Encode(), os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+//request maps a command to the admin API call
+func request(command string, args []string) (method string, path string, query url.Values, err error) {
+	query = url.Values{}
+	optional := func(index int, name string) {
+		if len(args) > index {
+			query.Set(name, args[index])
+		}
+	}
+	switch {
+	case command == "history" && len(args) == 0:
+		return http.MethodGet, "/admin/history", query, nil
+	case command == "show" && (len(args) == 1 || len(args) == 2):
+		query.Set("version", args[0])
+		optional(1, "collection")
+		return http.MethodGet, "/admin/history/show", query, nil
+	case command == "diff" && (len(args) == 2 || len(args) == 3):
+		query.Set("from", args[0])
+		query.Set("to", args[1])
+		optional(2, "collection")
+		return http.MethodGet, "/admin/history/diff", query, nil
+	case command == "pin" && len(args) == 1:
+		query.Set("version", args[0])
+		return http.MethodPost, "/admin/history/pin", query, nil
+	case command == "unpin" && len(args) == 0:
+		return http.MethodPost, "/admin/history/unpin", query, nil
+	}
+	return "", "", nil, fmt.Errorf("invalid command: %s %v", command, args)
+}
+
+//call sends a request to the admin API and copies the response to out
+func call(method string, url string, out io.Writer) error {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
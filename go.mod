@@ -5,7 +5,8 @@ go 1.12
 require (
 	github.com/envoyproxy/go-control-plane v0.6.7 // indirect
 	github.com/fsnotify/fsnotify v1.4.7
-	github.com/gogo/googleapis v1.1.0 // indirect
+	github.com/ghodss/yaml v1.0.0
+	github.com/gogo/googleapis v1.1.0
 	github.com/gogo/protobuf v1.2.0
 	github.com/gogo/status v1.0.3 // indirect
 	github.com/google/btree v1.0.0 // indirect
@@ -26,30 +27,31 @@ require (
 	github.com/onsi/gomega v1.4.3
 	github.com/petar/GoLLRB v0.0.0-20130427215148-53be0d36a84c // indirect
 	github.com/peterbourgon/diskv v2.0.1+incompatible // indirect
-	github.com/prometheus/client_golang v0.9.2 // indirect
+	github.com/prometheus/client_golang v0.9.2
 	github.com/prometheus/client_model v0.0.0-20190115171406-56726106282f // indirect
 	github.com/prometheus/common v0.1.0 // indirect
 	github.com/prometheus/procfs v0.0.0-20190117184657-bf6a532e95b1 // indirect
 	github.com/spf13/cobra v0.0.3 // indirect
 	github.com/spf13/pflag v1.0.3 // indirect
 	github.com/yl2chen/cidranger v0.0.0-20180214081945-928b519e5268 // indirect
-	go.opencensus.io v0.18.0 // indirect
+	go.opencensus.io v0.18.0
 	go.uber.org/atomic v1.3.2 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
-	go.uber.org/zap v1.9.1 // indirect
-	golang.org/x/crypto v0.0.0-20190122013713-64072686203f // indirect
+	go.uber.org/zap v1.9.1
+	golang.org/x/crypto v0.0.0-20190122013713-64072686203f
 	golang.org/x/net v0.0.0-20190119204137-ed066c81e75e // indirect
 	golang.org/x/oauth2 v0.0.0-20190115181402-5dab4167f31c // indirect
 	golang.org/x/sys v0.0.0-20190121090251-770c60269bf0 // indirect
-	golang.org/x/time v0.0.0-20181108054448-85acf8d2951c // indirect
+	golang.org/x/time v0.0.0-20181108054448-85acf8d2951c
 	google.golang.org/genproto v0.0.0-20190111180523-db91494dd46c // indirect
 	google.golang.org/grpc v1.18.0
 	gopkg.in/inf.v0 v0.9.1 // indirect
-	gopkg.in/yaml.v2 v2.2.2 // indirect
+	gopkg.in/square/go-jose.v2 v2.3.1
+	gopkg.in/yaml.v2 v2.2.2
 	istio.io/api v0.0.0-20190213184321-d817a1a3e29a
 	istio.io/istio v0.0.0-20190215011119-58186e1dc339
 	k8s.io/api v0.0.0-20190118113203-912cbe2bfef3 // indirect
 	k8s.io/apiextensions-apiserver v0.0.0-20181204003618-e419c5771cdc // indirect
-	k8s.io/apimachinery v0.0.0-20190118094746-1525e4dadd2d // indirect
-	k8s.io/client-go v8.0.0+incompatible // indirect
+	k8s.io/apimachinery v0.0.0-20190118094746-1525e4dadd2d
+	k8s.io/client-go v8.0.0+incompatible
 )
@@ -3,91 +3,446 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/admin"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/api"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/auth"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/broker"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/bundle"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/canary"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/certs"
 	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/git"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/health"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/kube"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	serverMonitoring "github.com/Peripli/service-manager-istio-mcp-server/pkg/monitoring"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/rollback"
+	mcpserver "github.com/Peripli/service-manager-istio-mcp-server/pkg/server"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/settings"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/store"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/upstream"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/vcap"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
 	"io/ioutil"
 	"istio.io/api/mcp/v1alpha1"
 	"istio.io/istio/galley/pkg/metadata"
+	"istio.io/istio/pkg/log"
 	"istio.io/istio/pkg/mcp/monitoring"
 	"istio.io/istio/pkg/mcp/server"
 	"istio.io/istio/pkg/mcp/source"
-	"log"
 	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
 func main() {
 
-	var configDir string
-	var tlsMode string
-	flag.StringVar(&configDir, "configDir", "", "istio config directory")
-	flag.StringVar(&tlsMode, "tlsMode", "MUTUAL", "tls mode. Possible values: NONE, MUTUAL.")
-
+	serverFlags := settings.RegisterFlags(flag.CommandLine)
+	printSettings := flag.Bool("printSettings", false, "print the resolved settings as YAML and exit")
 	flag.Parse()
+	serverSettings, err := serverFlags.Resolve(os.LookupEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *printSettings {
+		out, err := serverSettings.YAML()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(out)
+		return
+	}
+	if err := logging.Configure(&logging.Options{JSON: serverSettings.Logging.JSON, Levels: serverSettings.Logging.Levels}); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid log options: %v\n", err)
+		os.Exit(2)
+	}
+	defer log.Sync()
+
+	serverHealth := health.NewHealth(
+		"istio.mcp.v1alpha1.AggregatedMeshConfigService",
+		"istio.mcp.v1alpha1.ResourceSource")
+	go serverHealth.Run(time.Second, make(chan struct{}))
+	mux := http.NewServeMux()
+	serverHealth.RegisterHandlers(mux)
+	go func() {
+		log.Fatal("Http server failed", zap.String("address", serverSettings.HTTP.Address), logging.Error(http.ListenAndServe(serverSettings.HTTP.Address, mux)))
+	}()
 
-	watcher, err := config.NewConfigWatcher(configDir)
+	canarySelector, err := canary.NewSelector(serverSettings.Canary.NodeID, serverSettings.Canary.Annotations)
+	if err != nil {
+		log.Fatal("Invalid canary selector", logging.Error(err))
+	}
+	watcherOptions := config.Options{
+		HistorySize:        serverSettings.Watcher.HistorySize,
+		MinPublishInterval: time.Duration(serverSettings.Watcher.MinPublishInterval),
+		PublishRate:        serverSettings.Watcher.PublishRate,
+		PublishBurst:       serverSettings.Watcher.PublishBurst,
+		StateFile:          serverSettings.Watcher.StateFile,
+	}
+	if !canarySelector.Empty() {
+		watcherOptions.Canary = canarySelector.Matches
+	}
+	if serverSettings.Watcher.MutationPolicyFile != "" {
+		watcherOptions.MutationPolicies, err = config.LoadMutationPolicies(serverSettings.Watcher.MutationPolicyFile)
+		if err != nil {
+			log.Fatal("Can't read the mutation policies", logging.Error(err))
+		}
+	}
+	var sources []config.Source
+	if serverSettings.ConfigDir != "" {
+		if serverSettings.API.Address != "" && serverSettings.API.StoreDir == "" {
+			// the configs written through the API are provided by the store
+			sources = append(sources, config.NewFileSourceExcluding(serverSettings.ConfigDir, store.FileSuffix))
+		} else {
+			sources = append(sources, config.NewFileSource(serverSettings.ConfigDir))
+		}
+	}
+	if serverSettings.Git.URL != "" {
+		gitSource, err := git.NewSource(&git.Options{
+			URL:          serverSettings.Git.URL,
+			Ref:          serverSettings.Git.Ref,
+			Dir:          serverSettings.Git.Dir,
+			CacheDir:     serverSettings.Git.CacheDir,
+			PollInterval: time.Duration(serverSettings.Git.PollInterval),
+		})
+		if err != nil {
+			log.Fatal("Can't create the git source", zap.String("url", serverSettings.Git.URL), logging.Error(err))
+		}
+		sources = append(sources, gitSource)
+	}
+	if serverSettings.Bundle.URL != "" {
+		publicKey, err := bundle.LoadPublicKey(serverSettings.Bundle.PublicKeyFile)
+		if err != nil {
+			log.Fatal("Can't load the bundle public key", logging.Error(err))
+		}
+		bundleSource, err := bundle.NewSource(&bundle.Options{
+			URL:          serverSettings.Bundle.URL,
+			SignatureURL: serverSettings.Bundle.SignatureURL,
+			PublicKey:    publicKey,
+			PollInterval: time.Duration(serverSettings.Bundle.PollInterval),
+		})
+		if err != nil {
+			log.Fatal("Can't create the bundle source", logging.Error(err))
+		}
+		if serverSettings.Readiness.NotReadyIfUnreadable {
+			// the configs of the latest verified bundle are served while it can't be fetched
+			maxFetchFailure := time.Duration(serverSettings.Bundle.MaxFetchFailure)
+			serverHealth.AddReadinessCheck("bundle", func() error {
+				return bundleSource.Ready(maxFetchFailure, time.Now())
+			})
+		}
+		sources = append(sources, bundleSource)
+	}
+	if serverSettings.Kubernetes.Enabled {
+		kubeSource, err := kube.NewSource(&kube.Options{
+			Kubeconfig:    serverSettings.Kubernetes.Kubeconfig,
+			Context:       serverSettings.Kubernetes.Context,
+			Namespace:     serverSettings.Kubernetes.Namespace,
+			LabelSelector: serverSettings.Kubernetes.LabelSelector,
+			ResyncPeriod:  time.Duration(serverSettings.Kubernetes.ResyncPeriod),
+		})
+		if err != nil {
+			log.Fatal("Can't create the kubernetes source", logging.Error(err))
+		}
+		sources = append(sources, kubeSource)
+	}
+	if serverSettings.VCAP.Dir != "" {
+		sources = append(sources, vcap.NewSource(serverSettings.VCAP.Dir, serverSettings.VCAP.TemplateDir))
+	}
+	if len(serverSettings.Upstream.Addresses) > 0 {
+		dialOptions, err := upstreamDialOptions(serverSettings.Upstream)
+		if err != nil {
+			log.Fatal("Can't set up the upstream connections", logging.Error(err))
+		}
+		reporter := monitoring.NewStatsContext("upstream")
+		for _, address := range serverSettings.Upstream.Addresses {
+			upstreamSource, err := upstream.NewSource(&upstream.Options{
+				Address:     address,
+				DialOptions: dialOptions,
+				NodeID:      serverSettings.Upstream.NodeID,
+				Reporter:    reporter,
+			})
+			if err != nil {
+				log.Fatal("Can't create the upstream source", zap.String("address", address), logging.Error(err))
+			}
+			sources = append(sources, config.WithPrecedence(upstreamSource, serverSettings.Upstream.PrecedenceOf(address)))
+		}
+	}
+	var configStore *store.Store
+	if serverSettings.API.Address != "" {
+		storeDir := serverSettings.API.StoreDir
+		if storeDir == "" {
+			storeDir = serverSettings.ConfigDir
+		}
+		configStore, err = store.Open(storeDir)
+		if err != nil {
+			log.Fatal("Can't open the config store", zap.String("directory", storeDir), logging.Error(err))
+		}
+		sources = append(sources, configStore)
+	}
+	watcher, err := config.NewWatcher(sources, &watcherOptions)
+	if err != nil {
+		log.Fatal("Can't read the configs", zap.String("directory", serverSettings.ConfigDir),
+			zap.String("git", serverSettings.Git.URL), logging.Error(err))
+	}
+	if configStore != nil {
+		// writes conflicting with the configs of the other sources would stop new versions from being published
+		configStore.SetCheck(func(set *config.ConfigSet) error { return watcher.Check(configStore, set) })
+	}
+	readinessOptions := config.ReadinessOptions{
+		NotReadyIfUnreadable: serverSettings.Readiness.NotReadyIfUnreadable,
+		MaxValidationFailure: time.Duration(serverSettings.Readiness.MaxValidationFailure),
+	}
+	serverHealth.AddReadinessCheck("config", func() error {
+		return watcher.Status().Ready(readinessOptions, time.Now())
+	})
+	metricsHandler, err := serverMonitoring.NewHandler(serverMonitoring.NewAgeCollector(
+		"config_last_reload_age_seconds",
+		"Seconds since the last successful reload of the config directory.",
+		func() time.Time { return watcher.Status().LastSuccess }))
 	if err != nil {
-		panic(err)
+		log.Fatal("Can't set up metrics", logging.Error(err))
 	}
+	mux.Handle("/metrics", metricsHandler)
 
-	options := &source.Options{
-		Watcher:            watcher,
-		Reporter:           monitoring.NewStatsContext("mcp"),
-		CollectionOptions: source.CollectionOptionsFromSlice(metadata.Types.Collections())}
+	collectionNames := metadata.Types.Collections()
+	collections := source.CollectionOptionsFromSlice(collectionNames)
+	for i := range collections {
+		collections[i].Incremental = serverSettings.Watcher.Incremental
+	}
+	var authenticator mcpserver.Authenticator
+	if serverSettings.Auth.TokensEnabled() {
+		tokenAuthenticator, err := auth.NewAuthenticator(&auth.Options{
+			TokenFiles:        serverSettings.Auth.TokenFiles,
+			JWKSFiles:         serverSettings.Auth.JWKSFiles,
+			Issuer:            serverSettings.Auth.JWTIssuer,
+			Audience:          serverSettings.Auth.JWTAudience,
+			RequireToken:      serverSettings.Auth.RequireToken,
+			AllowedIdentities: serverSettings.Auth.AllowedIdentities,
+			AuthChecker:       authChecker(serverSettings.Auth),
+		})
+		if err != nil {
+			log.Fatal("Can't set up token authentication", logging.Error(err))
+		}
+		authenticator = tokenAuthenticator
+	}
+	var authorizer mcpserver.Authorizer
+	if serverSettings.Auth.PolicyFile != "" {
+		policy, err := auth.LoadPolicy(serverSettings.Auth.PolicyFile, collectionNames)
+		if err != nil {
+			log.Fatal("Can't read the authorization policy", logging.Error(err))
+		}
+		authorizer = policy
+	}
+	var mcpServer *mcpserver.Server
+	rollbacks := rollback.NewController(&rollback.Options{NackThreshold: serverSettings.Rollback.NackThreshold}, func() []mcpserver.SinkStatus {
+		return mcpServer.Sinks()
+	}, watcher)
+	mcpServer = mcpserver.New(&mcpserver.Options{
+		Watcher:     watcher,
+		Collections: collections,
+		Reporter:    monitoring.NewStatsContext("mcp"),
+		AuthChecker: authChecker(serverSettings.Auth),
+		Listener:    rollbacks,
 
-	mcpServer := server.New(options,&server.AllowAllChecker{})
+		Authenticator:         authenticator,
+		Authorizer:            authorizer,
+		MaxStreamsPerIdentity: serverSettings.GRPC.MaxStreamsPerIdentity,
+	})
+	var canaries *canary.Controller
+	if !canarySelector.Empty() {
+		canaries = canary.NewController(&canary.Options{Selector: canarySelector, Soak: time.Duration(serverSettings.Canary.Soak)}, mcpServer.Sinks, watcher)
+		go canaries.Run(time.Second, make(chan struct{}))
+	}
+
+	adminMux := http.NewServeMux()
+	admin.NewAdmin(&admin.Options{
+		Server:      mcpServer,
+		Watcher:     watcher,
+		Collections: collectionNames,
+		Groups:      []string{config.DefaultGroup, config.CanaryGroup},
+		Rollbacks:   rollbacks,
+		Canary:      canaries,
+	}).RegisterHandlers(adminMux)
+	go func() {
+		log.Fatal("Admin server failed", zap.String("address", serverSettings.Admin.Address), logging.Error(http.ListenAndServe(serverSettings.Admin.Address, adminMux)))
+	}()
 
 	var grpcOptions []grpc.ServerOption
-	switch tlsMode {
-	case "MUTUAL":
-		grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(tlsConfig())))
-	case "NONE":
-	default:
-		log.Panic(fmt.Sprintf("Invalid TLS mode %s", tlsMode))
-	}
-	grpcOptions = append(grpcOptions, grpc.MaxConcurrentStreams(1024))
-	grpcOptions = append(grpcOptions, grpc.MaxRecvMsgSize(1024*1024))
+	var serverTLS *tls.Config
+	if serverSettings.TLS.Mode != settings.TLSModeNone {
+		log.Info("Setting up tls config", zap.String("tlsMode", serverSettings.TLS.Mode))
+		serverTLS, err = tlsConfig(serverSettings.TLS, serverSettings.GRPC.Address)
+		if err != nil {
+			log.Fatal("Can't set up tls", logging.Error(err))
+		}
+		grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(serverTLS)))
+	}
+	if configStore != nil {
+		serveAPI(serverSettings, configStore, serverTLS)
+	}
+	grpcOptions = append(grpcOptions, grpc.MaxConcurrentStreams(serverSettings.GRPC.MaxConcurrentStreams))
+	grpcOptions = append(grpcOptions, grpc.MaxRecvMsgSize(serverSettings.GRPC.MaxRecvMsgSize))
+	grpcOptions = append(grpcOptions, grpc.KeepaliveParams(keepalive.ServerParameters{
+		Time:                  time.Duration(serverSettings.GRPC.Keepalive.Time),
+		Timeout:               time.Duration(serverSettings.GRPC.Keepalive.Timeout),
+		MaxConnectionIdle:     time.Duration(serverSettings.GRPC.Keepalive.MaxConnectionIdle),
+		MaxConnectionAge:      time.Duration(serverSettings.GRPC.Keepalive.MaxConnectionAge),
+		MaxConnectionAgeGrace: time.Duration(serverSettings.GRPC.Keepalive.MaxConnectionAgeGrace),
+	}))
+	grpcOptions = append(grpcOptions, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		MinTime:             time.Duration(serverSettings.GRPC.Keepalive.Enforcement.MinTime),
+		PermitWithoutStream: serverSettings.GRPC.Keepalive.Enforcement.PermitWithoutStream,
+	}))
 	grpcServer := grpc.NewServer(grpcOptions...)
 
-	log.Println("Setting up tls config")
-
 	v1alpha1.RegisterAggregatedMeshConfigServiceServer(grpcServer, mcpServer)
+	v1alpha1.RegisterResourceSourceServer(grpcServer, mcpServer)
+	healthpb.RegisterHealthServer(grpcServer, serverHealth.GRPCServer())
 
-	serverOptions := &source.ServerOptions{AuthChecker: server.NewAllowAllChecker()}
-	mcpSource := source.NewServer(options, serverOptions)
-	v1alpha1.RegisterResourceSourceServer(grpcServer, mcpSource)
-
-	grpcListener, err := net.Listen("tcp", ":18000")
+	grpcListener, err := net.Listen("tcp", serverSettings.GRPC.Address)
 	if err != nil {
-		panic(err)
+		log.Fatal("Can't listen for MCP connections", logging.Error(err))
 	}
 
+	log.Info("Serving MCP", zap.String("address", grpcListener.Addr().String()))
 	err = grpcServer.Serve(grpcListener)
 	if err != nil {
-		panic(err)
+		log.Fatal("MCP server failed", logging.Error(err))
 	}
 
 }
 
-func tlsConfig() *tls.Config {
-	serverCert, err := tls.LoadX509KeyPair("config/certs/mcp.crt", "config/certs/mcp.key")
+//serveAPI serves the REST API for managing the configs of the store and the binding endpoints of the broker
+//if enabled. Callers are authenticated by bearer tokens, so the API is served with the server certificate
+//unless tls is disabled.
+func serveAPI(serverSettings *settings.Settings, configStore *store.Store, serverTLS *tls.Config) {
+	apiAuthenticator, err := auth.NewAuthenticator(&auth.Options{
+		TokenFiles:        serverSettings.Auth.TokenFiles,
+		JWKSFiles:         serverSettings.Auth.JWKSFiles,
+		Issuer:            serverSettings.Auth.JWTIssuer,
+		Audience:          serverSettings.Auth.JWTAudience,
+		RequireToken:      true,
+		AllowedIdentities: serverSettings.API.Identities,
+	})
+	if err != nil {
+		log.Fatal("Can't set up the authentication of the REST API", logging.Error(err))
+	}
+	apiMux := http.NewServeMux()
+	api.NewAPI(&api.Options{Store: configStore, Authenticator: apiAuthenticator}).RegisterHandlers(apiMux)
+	if serverSettings.Broker.TemplateFile != "" {
+		bindingTemplate, err := broker.LoadTemplate(serverSettings.Broker.TemplateFile)
+		if err != nil {
+			log.Fatal("Can't read the binding template", logging.Error(err))
+		}
+		broker.NewBroker(&broker.Options{
+			Store:         configStore,
+			Template:      bindingTemplate,
+			Authenticator: apiAuthenticator,
+		}).RegisterHandlers(apiMux)
+	}
+	apiServer := &http.Server{Addr: serverSettings.API.Address, Handler: apiMux}
+	go func() {
+		log.Info("Serving REST API", zap.String("address", apiServer.Addr), zap.String("storeDir", configStore.Name()))
+		if serverTLS == nil {
+			err = apiServer.ListenAndServe()
+		} else {
+			apiServer.TLSConfig = &tls.Config{Certificates: serverTLS.Certificates}
+			err = apiServer.ListenAndServeTLS("", "")
+		}
+		log.Fatal("REST API server failed", zap.String("address", apiServer.Addr), logging.Error(err))
+	}()
+}
+
+func tlsConfig(tlsSettings settings.TLSSettings, grpcAddr string) (*tls.Config, error) {
+	if tlsSettings.Mode == settings.TLSModeAuto {
+		files, generated, err := certs.Generate(tlsSettings.AutoDir, tlsSettings.AutoHosts)
+		if err != nil {
+			return nil, fmt.Errorf("could not generate certificates: %v", err)
+		}
+		log.Warn("Using development certificates, don't use the AUTO tls mode in production",
+			zap.String("directory", tlsSettings.AutoDir), zap.Bool("generated", generated))
+		_, port, err := net.SplitHostPort(grpcAddr)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Configure pilot to connect with the generated client certificate:\n%s",
+			files.PilotConfig(net.JoinHostPort(tlsSettings.AutoHosts[0], port)))
+		tlsSettings.CertFile, tlsSettings.KeyFile, tlsSettings.CAFile = files.ServerCert, files.ServerKey, files.CACert
+	}
+	serverCert, err := tls.LoadX509KeyPair(tlsSettings.CertFile, tlsSettings.KeyFile)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if tlsSettings.Mode == settings.TLSModeSimple {
+		return &tls.Config{Certificates: []tls.Certificate{serverCert}}, nil
 	}
 	certPool := x509.NewCertPool()
-	ca, err := ioutil.ReadFile("config/certs/ca.crt")
+	ca, err := ioutil.ReadFile(tlsSettings.CAFile)
 	if err != nil {
-		panic(fmt.Errorf("could not read ca-file: %s", err))
+		return nil, fmt.Errorf("could not read ca-file: %s", err)
 	}
 	ok := certPool.AppendCertsFromPEM(ca)
 	if !ok {
-		panic("Could not append ca cert to cert pool.")
+		return nil, errors.New("could not append ca cert to cert pool")
 	}
 	return &tls.Config{
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 		ClientCAs:    certPool,
 		Certificates: []tls.Certificate{serverCert},
+	}, nil
+}
+
+//upstreamDialOptions returns the transport and token credentials of the upstream connections
+func upstreamDialOptions(upstreamSettings settings.UpstreamSettings) ([]grpc.DialOption, error) {
+	var options []grpc.DialOption
+	if upstreamSettings.CAFile == "" {
+		options = append(options, grpc.WithInsecure())
+	} else {
+		certPool := x509.NewCertPool()
+		ca, err := ioutil.ReadFile(upstreamSettings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ca-file: %s", err)
+		}
+		if !certPool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("could not append ca cert to cert pool")
+		}
+		clientTLS := &tls.Config{RootCAs: certPool}
+		if upstreamSettings.CertFile != "" {
+			clientCert, err := tls.LoadX509KeyPair(upstreamSettings.CertFile, upstreamSettings.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			clientTLS.Certificates = []tls.Certificate{clientCert}
+		}
+		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)))
+	}
+	if upstreamSettings.TokenFile != "" {
+		token, err := ioutil.ReadFile(upstreamSettings.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, upstream.WithToken(strings.TrimSpace(string(token))))
+	}
+	return options, nil
+}
+
+func authChecker(authSettings settings.AuthSettings) server.AuthChecker {
+	if len(authSettings.AllowedIdentities) == 0 {
+		return server.NewAllowAllChecker()
 	}
+	checker := server.NewListAuthChecker(server.DefaultListAuthCheckerOptions())
+	checker.Set(authSettings.AllowedIdentities...)
+	return checker
 }
@@ -0,0 +1,260 @@
+package admin
+
+import (
+	"encoding/json"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/canary"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/rollback"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/server"
+	"github.com/gogo/protobuf/jsonpb"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"istio.io/istio/pkg/mcp/snapshot"
+	"net/http"
+	"time"
+)
+
+//Options configures the admin API
+type Options struct {
+	Server      *server.Server
+	Watcher     config.Watcher
+	Collections []string
+	Groups      []string
+	//Rollbacks is optional and enables the rollback endpoints
+	Rollbacks *rollback.Controller
+	//Canary is optional and enables the canary rollout endpoints
+	Canary *canary.Controller
+}
+
+//Admin serves debug information about connected sinks and the served snapshot as JSON.
+//All endpoints accept an optional collection query parameter to restrict the output to one collection.
+type Admin struct {
+	options Options
+}
+
+//NewAdmin creates an Admin
+func NewAdmin(options *Options) *Admin {
+	return &Admin{options: *options}
+}
+
+type sinksResponse struct {
+	Sinks  []server.SinkStatus     `json:"sinks"`
+	Groups map[string]*groupStatus `json:"groups"`
+}
+
+type groupStatus struct {
+	Watches              int       `json:"watches"`
+	LastWatchRequestTime time.Time `json:"lastWatchRequestTime"`
+}
+
+type rollbacksResponse struct {
+	Rollbacks []config.Rollback `json:"rollbacks"`
+	Events    []rollback.Event  `json:"events"`
+}
+
+type snapshotResponse struct {
+	Version     int                            `json:"version"`
+	LastSuccess time.Time                      `json:"lastSuccess"`
+	LastError   string                         `json:"lastError,omitempty"`
+	Degraded    bool                           `json:"degraded,omitempty"`
+	Collections map[string]*collectionSnapshot `json:"collections"`
+}
+
+type collectionSnapshot struct {
+	Version   string            `json:"version"`
+	Resources []json.RawMessage `json:"resources"`
+}
+
+//RegisterHandlers adds the admin endpoints to mux
+func (a *Admin) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/sinks", a.sinks)
+	mux.HandleFunc("/admin/snapshot", a.snapshot)
+	if a.options.Rollbacks != nil {
+		mux.HandleFunc("/admin/rollbacks", a.rollbacks)
+		mux.HandleFunc("/admin/rollbacks/resume", a.resume)
+	}
+	if a.options.Canary != nil {
+		mux.HandleFunc("/admin/canary", a.canary)
+		mux.HandleFunc("/admin/canary/promote", a.promote)
+		mux.HandleFunc("/admin/canary/halt", a.halt)
+	}
+	mux.HandleFunc("/admin/logging", a.logging)
+	mux.HandleFunc("/admin/history", a.history)
+	mux.HandleFunc("/admin/history/show", a.showHistory)
+	mux.HandleFunc("/admin/history/diff", a.diffHistory)
+	mux.HandleFunc("/admin/history/pin", a.pin)
+	mux.HandleFunc("/admin/history/unpin", a.unpin)
+}
+
+func (a *Admin) sinks(w http.ResponseWriter, r *http.Request) {
+	collection := r.URL.Query().Get("collection")
+	result := sinksResponse{
+		Sinks:  []server.SinkStatus{},
+		Groups: make(map[string]*groupStatus),
+	}
+	for _, sink := range a.options.Server.Sinks() {
+		if collection != "" {
+			status, ok := sink.Collections[collection]
+			if !ok {
+				continue
+			}
+			sink.Collections = map[string]*server.CollectionStatus{collection: status}
+		}
+		result.Sinks = append(result.Sinks, sink)
+	}
+	for _, group := range a.options.Groups {
+		if info := a.options.Watcher.GroupStatus(group); info != nil {
+			result.Groups[group] = &groupStatus{
+				Watches:              info.Watches(),
+				LastWatchRequestTime: info.LastWatchRequestTime(),
+			}
+		}
+	}
+	writeJSON(w, result)
+}
+
+func (a *Admin) snapshot(w http.ResponseWriter, r *http.Request) {
+	collection := r.URL.Query().Get("collection")
+	status := a.options.Watcher.Status()
+	result := snapshotResponse{
+		Version:     status.Version,
+		LastSuccess: status.LastSuccess,
+		Degraded:    status.Degraded,
+	}
+	if status.LastError != nil {
+		result.LastError = status.LastError.Error()
+	}
+	collections, err := a.collectionSnapshots(a.options.Watcher.Snapshot(), collection)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result.Collections = collections
+	writeJSON(w, result)
+}
+
+//collectionSnapshots renders the resources of snapshot, restricted to collection if it isn't empty
+func (a *Admin) collectionSnapshots(snapshot snapshot.Snapshot, collection string) (map[string]*collectionSnapshot, error) {
+	result := make(map[string]*collectionSnapshot)
+	if snapshot == nil {
+		return result, nil
+	}
+	for _, name := range a.options.Collections {
+		if collection != "" && collection != name {
+			continue
+		}
+		resources := snapshot.Resources(name)
+		if len(resources) == 0 {
+			continue
+		}
+		c := &collectionSnapshot{Version: snapshot.Version(name)}
+		for _, resource := range resources {
+			body, err := marshalResource(resource)
+			if err != nil {
+				return nil, err
+			}
+			c.Resources = append(c.Resources, body)
+		}
+		result[name] = c
+	}
+	return result, nil
+}
+
+func marshalResource(resource *mcp.Resource) (json.RawMessage, error) {
+	body, err := (&jsonpb.Marshaler{}).MarshalToString(resource)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(body), nil
+}
+
+func (a *Admin) rollbacks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, rollbacksResponse{
+		Rollbacks: a.options.Rollbacks.Rollbacks(),
+		Events:    a.options.Rollbacks.Events(),
+	})
+}
+
+//resume serves the latest version of the collection given by the collection query parameter again
+func (a *Admin) resume(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	collection := r.URL.Query().Get("collection")
+	if collection == "" {
+		http.Error(w, "missing collection parameter", http.StatusBadRequest)
+		return
+	}
+	if err := a.options.Rollbacks.Resume(collection); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	a.rollbacks(w, r)
+}
+
+func (a *Admin) canary(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.options.Canary.Status())
+}
+
+//promote serves the version of the canary rollout in progress to all sinks
+func (a *Admin) promote(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	if err := a.options.Canary.Promote(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	a.canary(w, r)
+}
+
+//halt stops the canary rollout in progress, the reason query parameter is optional
+func (a *Admin) halt(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "halted by admin"
+	}
+	if err := a.options.Canary.Halt(reason); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	a.canary(w, r)
+}
+
+type loggingResponse struct {
+	Scopes map[string]string `json:"scopes"`
+}
+
+//logging returns the output level of all log scopes. A POST with the scope and level query parameters
+//changes the level of a scope.
+func (a *Admin) logging(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if err := logging.SetScopeLevel(r.URL.Query().Get("scope"), r.URL.Query().Get("level")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, loggingResponse{Scopes: logging.ScopeLevels()})
+}
+
+//requirePost rejects requests with other methods than POST
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		logging.Admin.Warn("Can't write admin response", logging.Error(err))
+	}
+}
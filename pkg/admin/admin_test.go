@@ -0,0 +1,363 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/canary"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/rollback"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/server"
+	"github.com/gogo/googleapis/google/rpc"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	mcp "istio.io/api/mcp/v1alpha1"
+	networking "istio.io/api/networking/v1alpha3"
+	mcpserver "istio.io/istio/pkg/mcp/server"
+	"istio.io/istio/pkg/mcp/snapshot"
+	"istio.io/istio/pkg/mcp/source"
+	mcptestmon "istio.io/istio/pkg/mcp/testing/monitoring"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	gateways        = "istio/networking/v1alpha3/gateways"
+	serviceEntries  = "istio/networking/v1alpha3/serviceentries"
+	virtualServices = "istio/networking/v1alpha3/virtualservices"
+)
+
+//fakeWatcher guards its state with mutex, the rollback controller calls it from the connection goroutines
+type fakeWatcher struct {
+	*snapshot.Cache
+	mutex     sync.Mutex
+	snapshot  snapshot.Snapshot
+	rollbacks []config.Rollback
+	canary    *config.Canary
+	history   []config.HistoryEntry
+	pinned    int
+}
+
+func (f *fakeWatcher) Status() config.Status {
+	return config.Status{Version: 1, LastSuccess: time.Now()}
+}
+
+func (f *fakeWatcher) Snapshot() snapshot.Snapshot {
+	return f.snapshot
+}
+
+func (f *fakeWatcher) GroupStatus(group string) *snapshot.StatusInfo {
+	return f.Cache.Status(group)
+}
+
+func (f *fakeWatcher) Accept(collection string, version string) {
+}
+
+func (f *fakeWatcher) Rollback(collection string, reason string) (config.Rollback, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	rollback := config.Rollback{Collection: collection, RejectedVersion: f.snapshot.Version(collection), Version: "0.9", Reason: reason, Time: time.Now()}
+	f.rollbacks = append(f.rollbacks, rollback)
+	return rollback, nil
+}
+
+func (f *fakeWatcher) Resume(collection string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for i, rollback := range f.rollbacks {
+		if rollback.Collection == collection {
+			f.rollbacks = append(f.rollbacks[:i], f.rollbacks[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("not rolled back")
+}
+
+func (f *fakeWatcher) Rollbacks() []config.Rollback {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]config.Rollback(nil), f.rollbacks...)
+}
+
+func (f *fakeWatcher) Canary() *config.Canary {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.canary
+}
+
+func (f *fakeWatcher) Promote(version int) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.canary == nil {
+		return errors.New("no canary rollout in progress")
+	}
+	f.canary = nil
+	return nil
+}
+
+func (f *fakeWatcher) Halt(version int, reason string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.canary == nil {
+		return errors.New("no canary rollout in progress")
+	}
+	f.canary.Halted = true
+	f.canary.Reason = reason
+	return nil
+}
+
+func (f *fakeWatcher) History() []config.HistoryEntry {
+	return f.history
+}
+
+func (f *fakeWatcher) Pin(version int) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, entry := range f.history {
+		if entry.Version == version {
+			f.pinned = version
+			return nil
+		}
+	}
+	return errors.New("unknown version")
+}
+
+func (f *fakeWatcher) Unpin() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.pinned == 0 {
+		return errors.New("no version is pinned")
+	}
+	f.pinned = 0
+	return nil
+}
+
+func (f *fakeWatcher) Pinned() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.pinned
+}
+
+func (f *fakeWatcher) Check(source config.Source, set *config.ConfigSet) error {
+	return nil
+}
+
+func newTestSnapshot() snapshot.Snapshot {
+	builder := snapshot.NewInMemoryBuilder()
+	err := builder.SetEntry(gateways, "pinger-gateway", "v1", time.Now(), nil, nil, &networking.Gateway{
+		Servers: []*networking.Server{{Hosts: []string{"pinger.example.com"}, Port: &networking.Port{Number: 9000, Name: "tls", Protocol: "TLS"}}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	err = builder.SetEntry(serviceEntries, "pinger", "v1", time.Now(), nil, nil, &networking.ServiceEntry{Hosts: []string{"istio-pinger.istio"}})
+	if err != nil {
+		panic(err)
+	}
+	builder.SetVersion(gateways, "1.0")
+	builder.SetVersion(serviceEntries, "1.0")
+	return builder.Build()
+}
+
+func newTestAdmin(g *GomegaWithT) (*http.ServeMux, *grpc.ClientConn, func()) {
+	mux, conn, _, stop := newTestAdminWithRollbacks(g)
+	return mux, conn, stop
+}
+
+func newTestAdminWithRollbacks(g *GomegaWithT) (*http.ServeMux, *grpc.ClientConn, *rollback.Controller, func()) {
+	watcher := &fakeWatcher{
+		Cache:    snapshot.New(func(string, *mcp.SinkNode) string { return "default" }),
+		snapshot: newTestSnapshot(),
+	}
+	watcher.SetSnapshot("default", watcher.snapshot)
+	collections := []string{gateways, serviceEntries, virtualServices}
+	var mcpServer *server.Server
+	controller := rollback.NewController(&rollback.Options{NackThreshold: 1}, func() []server.SinkStatus {
+		return mcpServer.Sinks()
+	}, watcher)
+	mcpServer = server.New(&server.Options{
+		Watcher:     watcher,
+		Collections: source.CollectionOptionsFromSlice(collections),
+		Reporter:    mcptestmon.NewInMemoryStatsContext(),
+		AuthChecker: mcpserver.NewAllowAllChecker(),
+		Listener:    controller,
+	})
+	grpcServer := grpc.NewServer()
+	mcp.RegisterAggregatedMeshConfigServiceServer(grpcServer, mcpServer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).NotTo(HaveOccurred())
+	go grpcServer.Serve(listener)
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	g.Expect(err).NotTo(HaveOccurred())
+
+	mux := http.NewServeMux()
+	NewAdmin(&Options{
+		Server:      mcpServer,
+		Watcher:     watcher,
+		Collections: collections,
+		Groups:      []string{"default"},
+		Rollbacks:   controller,
+	}).RegisterHandlers(mux)
+	return mux, conn, controller, func() {
+		conn.Close()
+		grpcServer.Stop()
+	}
+}
+
+func get(g *GomegaWithT, mux *http.ServeMux, url string, result interface{}) {
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+	g.Expect(recorder.Code).To(Equal(http.StatusOK))
+	g.Expect(json.Unmarshal(recorder.Body.Bytes(), result)).To(Succeed())
+}
+
+func TestSinks(t *testing.T) {
+	g := NewGomegaWithT(t)
+	mux, conn, stop := newTestAdmin(g)
+	defer stop()
+
+	stream, err := mcp.NewAggregatedMeshConfigServiceClient(conn).StreamAggregatedResources(context.Background())
+	g.Expect(err).NotTo(HaveOccurred())
+	sinkNode := &mcp.SinkNode{Id: "pilot-1"}
+	for _, collection := range []string{gateways, serviceEntries} {
+		g.Expect(stream.Send(&mcp.MeshConfigRequest{TypeUrl: collection, SinkNode: sinkNode})).To(Succeed())
+		resp, err := stream.Recv()
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(stream.Send(&mcp.MeshConfigRequest{TypeUrl: collection, SinkNode: sinkNode, VersionInfo: resp.VersionInfo, ResponseNonce: resp.Nonce})).To(Succeed())
+	}
+
+	var result sinksResponse
+	g.Eventually(func() string {
+		get(g, mux, "/admin/sinks", &result)
+		if len(result.Sinks) != 1 || result.Sinks[0].Collections[serviceEntries] == nil {
+			return ""
+		}
+		return result.Sinks[0].Collections[serviceEntries].AckedVersion
+	}).Should(Equal("1.0"))
+	g.Expect(result.Sinks[0].NodeID).To(Equal("pilot-1"))
+	g.Expect(result.Sinks[0].RemoteAddress).To(HavePrefix("127.0.0.1:"))
+	g.Expect(result.Sinks[0].Collections).To(HaveLen(2))
+	g.Expect(result.Groups).To(HaveKey("default"))
+	g.Expect(result.Groups["default"].Watches).To(Equal(2))
+
+	result = sinksResponse{}
+	get(g, mux, "/admin/sinks?collection="+gateways, &result)
+	g.Expect(result.Sinks[0].Collections).To(HaveLen(1))
+	g.Expect(result.Sinks[0].Collections).To(HaveKey(gateways))
+
+	result = sinksResponse{}
+	get(g, mux, "/admin/sinks?collection="+virtualServices, &result)
+	g.Expect(result.Sinks).To(BeEmpty())
+}
+
+func TestSnapshot(t *testing.T) {
+	g := NewGomegaWithT(t)
+	mux, _, stop := newTestAdmin(g)
+	defer stop()
+
+	var result struct {
+		Version     int
+		Collections map[string]struct {
+			Version   string
+			Resources []struct {
+				Metadata struct{ Name string }
+				Body     struct {
+					Type  string `json:"@type"`
+					Hosts []string
+				}
+			}
+		}
+	}
+	get(g, mux, "/admin/snapshot", &result)
+	g.Expect(result.Version).To(Equal(1))
+	g.Expect(result.Collections).To(HaveLen(2))
+	entries := result.Collections[serviceEntries]
+	g.Expect(entries.Version).To(Equal("1.0"))
+	g.Expect(entries.Resources).To(HaveLen(1))
+	g.Expect(entries.Resources[0].Metadata.Name).To(Equal("pinger"))
+	g.Expect(entries.Resources[0].Body.Type).To(Equal("type.googleapis.com/istio.networking.v1alpha3.ServiceEntry"))
+	g.Expect(entries.Resources[0].Body.Hosts).To(Equal([]string{"istio-pinger.istio"}))
+
+	result.Collections = nil
+	get(g, mux, "/admin/snapshot?collection="+gateways, &result)
+	g.Expect(result.Collections).To(HaveLen(1))
+	g.Expect(result.Collections).To(HaveKey(gateways))
+}
+
+func TestRollbacks(t *testing.T) {
+	g := NewGomegaWithT(t)
+	mux, conn, _, stop := newTestAdminWithRollbacks(g)
+	defer stop()
+
+	stream, err := mcp.NewAggregatedMeshConfigServiceClient(conn).StreamAggregatedResources(context.Background())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(stream.Send(&mcp.MeshConfigRequest{TypeUrl: gateways})).To(Succeed())
+	resp, err := stream.Recv()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(stream.Send(&mcp.MeshConfigRequest{TypeUrl: gateways, VersionInfo: resp.VersionInfo, ResponseNonce: resp.Nonce,
+		ErrorDetail: &rpc.Status{Code: 3, Message: "invalid gateway"}})).To(Succeed())
+
+	var result rollbacksResponse
+	g.Eventually(func() []config.Rollback {
+		result = rollbacksResponse{}
+		get(g, mux, "/admin/rollbacks", &result)
+		return result.Rollbacks
+	}).Should(HaveLen(1))
+	g.Expect(result.Rollbacks[0].Collection).To(Equal(gateways))
+	g.Expect(result.Rollbacks[0].RejectedVersion).To(Equal("1.0"))
+	g.Expect(result.Rollbacks[0].Reason).To(ContainSubstring("invalid gateway"))
+	g.Expect(result.Events).To(HaveLen(1))
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/rollbacks/resume?collection="+gateways, nil))
+	g.Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/rollbacks/resume?collection="+gateways, nil))
+	g.Expect(recorder.Code).To(Equal(http.StatusOK))
+	result = rollbacksResponse{}
+	g.Expect(json.Unmarshal(recorder.Body.Bytes(), &result)).To(Succeed())
+	g.Expect(result.Rollbacks).To(BeEmpty())
+	g.Expect(result.Events).To(HaveLen(2))
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/rollbacks/resume?collection="+gateways, nil))
+	g.Expect(recorder.Code).To(Equal(http.StatusConflict))
+}
+
+func TestCanary(t *testing.T) {
+	g := NewGomegaWithT(t)
+	watcher := &fakeWatcher{canary: &config.Canary{Version: 2, StartedAt: time.Now()}}
+	selector, err := canary.ParseSelector("^canary-", "")
+	g.Expect(err).NotTo(HaveOccurred())
+	controller := canary.NewController(&canary.Options{Selector: selector, Soak: time.Minute}, func() []server.SinkStatus {
+		return []server.SinkStatus{{NodeID: "canary-1"}, {NodeID: "pilot-1"}}
+	}, watcher)
+	mux := http.NewServeMux()
+	NewAdmin(&Options{Watcher: watcher, Canary: controller}).RegisterHandlers(mux)
+
+	var result canary.Status
+	get(g, mux, "/admin/canary", &result)
+	g.Expect(result.Canary.Version).To(Equal(2))
+	g.Expect(result.Sinks).To(HaveLen(1))
+	g.Expect(result.Sinks[0].NodeID).To(Equal("canary-1"))
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/canary/halt?reason=broken", nil))
+	g.Expect(recorder.Code).To(Equal(http.StatusOK))
+	g.Expect(watcher.Canary().Halted).To(BeTrue())
+	g.Expect(watcher.Canary().Reason).To(Equal("broken"))
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/canary/promote", nil))
+	g.Expect(recorder.Code).To(Equal(http.StatusOK))
+	result = canary.Status{}
+	g.Expect(json.Unmarshal(recorder.Body.Bytes(), &result)).To(Succeed())
+	g.Expect(result.Canary).To(BeNil())
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/canary/promote", nil))
+	g.Expect(recorder.Code).To(Equal(http.StatusConflict))
+}
@@ -0,0 +1,162 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"net/http"
+	"strconv"
+)
+
+type historyResponse struct {
+	//Pinned is the pinned version, 0 if none is pinned
+	Pinned  int                   `json:"pinned"`
+	Entries []config.HistoryEntry `json:"entries"`
+}
+
+type showHistoryResponse struct {
+	config.HistoryEntry
+	Collections map[string]*collectionSnapshot `json:"collections"`
+}
+
+type diffResponse struct {
+	From        int                        `json:"from"`
+	To          int                        `json:"to"`
+	Collections map[string]*collectionDiff `json:"collections"`
+}
+
+type collectionDiff struct {
+	Added   []json.RawMessage `json:"added,omitempty"`
+	Removed []json.RawMessage `json:"removed,omitempty"`
+	Changed []changedResource `json:"changed,omitempty"`
+}
+
+type changedResource struct {
+	Name string          `json:"name"`
+	From json.RawMessage `json:"from"`
+	To   json.RawMessage `json:"to"`
+}
+
+func (a *Admin) history(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, historyResponse{
+		Pinned:  a.options.Watcher.Pinned(),
+		Entries: a.options.Watcher.History(),
+	})
+}
+
+//showHistory renders the snapshot of the version query parameter
+func (a *Admin) showHistory(w http.ResponseWriter, r *http.Request) {
+	entry, err := a.historyEntry(r, "version")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	collections, err := a.collectionSnapshots(entry.Snapshot, r.URL.Query().Get("collection"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, showHistoryResponse{HistoryEntry: *entry, Collections: collections})
+}
+
+//diffHistory compares the snapshots of the from and to query parameters
+func (a *Admin) diffHistory(w http.ResponseWriter, r *http.Request) {
+	from, err := a.historyEntry(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	to, err := a.historyEntry(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	collection := r.URL.Query().Get("collection")
+	result := diffResponse{
+		From:        from.Version,
+		To:          to.Version,
+		Collections: make(map[string]*collectionDiff),
+	}
+	for name, diff := range config.DiffSnapshots(from.Snapshot, to.Snapshot) {
+		if collection != "" && collection != name {
+			continue
+		}
+		previous, err := collectionResources(from, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		current, err := collectionResources(to, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c := &collectionDiff{}
+		for _, resource := range diff.Added {
+			c.Added = append(c.Added, current[resource])
+		}
+		for _, resource := range diff.Removed {
+			c.Removed = append(c.Removed, previous[resource])
+		}
+		for _, resource := range diff.Changed {
+			c.Changed = append(c.Changed, changedResource{Name: resource, From: previous[resource], To: current[resource]})
+		}
+		result.Collections[name] = c
+	}
+	writeJSON(w, result)
+}
+
+//pin serves the version of the version query parameter until it is unpinned
+func (a *Admin) pin(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	version, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil {
+		http.Error(w, "invalid version parameter", http.StatusBadRequest)
+		return
+	}
+	if err := a.options.Watcher.Pin(version); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	a.history(w, r)
+}
+
+func (a *Admin) unpin(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	if err := a.options.Watcher.Unpin(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	a.history(w, r)
+}
+
+//historyEntry looks up the history entry of the version in query parameter
+func (a *Admin) historyEntry(r *http.Request, parameter string) (*config.HistoryEntry, error) {
+	version, err := strconv.Atoi(r.URL.Query().Get(parameter))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s parameter", parameter)
+	}
+	for _, entry := range a.options.Watcher.History() {
+		if entry.Version == version {
+			return &entry, nil
+		}
+	}
+	return nil, fmt.Errorf("version %d is not in the history", version)
+}
+
+//collectionResources renders the resources of a collection by name
+func collectionResources(entry *config.HistoryEntry, collection string) (map[string]json.RawMessage, error) {
+	result := make(map[string]json.RawMessage)
+	for _, resource := range entry.Snapshot.Resources(collection) {
+		body, err := marshalResource(resource)
+		if err != nil {
+			return nil, err
+		}
+		result[resource.Metadata.Name] = body
+	}
+	return result, nil
+}
@@ -0,0 +1,122 @@
+package admin
+
+import (
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	. "github.com/onsi/gomega"
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pkg/mcp/snapshot"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestHistoryAdmin() (*http.ServeMux, *fakeWatcher) {
+	first := newTestSnapshot()
+	builder := snapshot.NewInMemoryBuilder()
+	err := builder.SetEntry(serviceEntries, "pinger", "v2", time.Now(), nil, nil, &networking.ServiceEntry{Hosts: []string{"pinger.example.com"}})
+	if err != nil {
+		panic(err)
+	}
+	err = builder.SetEntry(serviceEntries, "other", "v1", time.Now(), nil, nil, &networking.ServiceEntry{Hosts: []string{"other.example.com"}})
+	if err != nil {
+		panic(err)
+	}
+	builder.SetVersion(serviceEntries, "2.0")
+	second := builder.Build()
+	watcher := &fakeWatcher{
+		snapshot: second,
+		history: []config.HistoryEntry{
+			{Version: 1, Time: time.Now(), Snapshot: first, Diff: config.DiffSnapshots(nil, first),
+				Changes: []config.FileChange{{File: "pinger.yaml", Change: "added"}}},
+			{Version: 2, Time: time.Now(), Snapshot: second, Diff: config.DiffSnapshots(first, second),
+				Changes: []config.FileChange{{File: "pinger.yaml", Change: "modified"}}},
+		},
+	}
+	mux := http.NewServeMux()
+	NewAdmin(&Options{
+		Watcher:     watcher,
+		Collections: []string{gateways, serviceEntries, virtualServices},
+	}).RegisterHandlers(mux)
+	return mux, watcher
+}
+
+func TestHistory(t *testing.T) {
+	g := NewGomegaWithT(t)
+	mux, _ := newTestHistoryAdmin()
+
+	var result historyResponse
+	get(g, mux, "/admin/history", &result)
+	g.Expect(result.Pinned).To(BeZero())
+	g.Expect(result.Entries).To(HaveLen(2))
+	g.Expect(result.Entries[1].Changes).To(Equal([]config.FileChange{{File: "pinger.yaml", Change: "modified"}}))
+	g.Expect(result.Entries[1].Diff).To(HaveKey(serviceEntries))
+	g.Expect(result.Entries[1].Diff[serviceEntries].Added).To(Equal([]string{"other"}))
+	g.Expect(result.Entries[1].Diff[serviceEntries].Changed).To(Equal([]string{"pinger"}))
+
+	var show struct {
+		Version     int
+		Collections map[string]struct{ Version string }
+	}
+	get(g, mux, "/admin/history/show?version=1", &show)
+	g.Expect(show.Version).To(Equal(1))
+	g.Expect(show.Collections).To(HaveLen(2))
+	g.Expect(show.Collections[gateways].Version).To(Equal("1.0"))
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/history/show?version=3", nil))
+	g.Expect(recorder.Code).To(Equal(http.StatusNotFound))
+}
+
+func TestHistoryDiff(t *testing.T) {
+	g := NewGomegaWithT(t)
+	mux, _ := newTestHistoryAdmin()
+
+	var result struct {
+		From        int
+		To          int
+		Collections map[string]struct {
+			Added   []struct{ Metadata struct{ Name string } }
+			Removed []struct{ Metadata struct{ Name string } }
+			Changed []struct {
+				Name string
+				From struct{ Body struct{ Hosts []string } }
+				To   struct{ Body struct{ Hosts []string } }
+			}
+		}
+	}
+	get(g, mux, "/admin/history/diff?from=1&to=2", &result)
+	g.Expect(result.From).To(Equal(1))
+	g.Expect(result.To).To(Equal(2))
+	g.Expect(result.Collections).To(HaveLen(2))
+	g.Expect(result.Collections[gateways].Removed).To(HaveLen(1))
+	entries := result.Collections[serviceEntries]
+	g.Expect(entries.Added).To(HaveLen(1))
+	g.Expect(entries.Added[0].Metadata.Name).To(Equal("other"))
+	g.Expect(entries.Changed).To(HaveLen(1))
+	g.Expect(entries.Changed[0].Name).To(Equal("pinger"))
+	g.Expect(entries.Changed[0].From.Body.Hosts).To(Equal([]string{"istio-pinger.istio"}))
+	g.Expect(entries.Changed[0].To.Body.Hosts).To(Equal([]string{"pinger.example.com"}))
+
+	result.Collections = nil
+	get(g, mux, "/admin/history/diff?from=1&to=2&collection="+gateways, &result)
+	g.Expect(result.Collections).To(HaveLen(1))
+}
+
+func TestPin(t *testing.T) {
+	g := NewGomegaWithT(t)
+	mux, watcher := newTestHistoryAdmin()
+
+	post := func(url string) int {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, url, nil))
+		return recorder.Code
+	}
+	g.Expect(post("/admin/history/pin?version=x")).To(Equal(http.StatusBadRequest))
+	g.Expect(post("/admin/history/pin?version=3")).To(Equal(http.StatusNotFound))
+	g.Expect(post("/admin/history/pin?version=1")).To(Equal(http.StatusOK))
+	g.Expect(watcher.Pinned()).To(Equal(1))
+	g.Expect(post("/admin/history/unpin")).To(Equal(http.StatusOK))
+	g.Expect(watcher.Pinned()).To(BeZero())
+	g.Expect(post("/admin/history/unpin")).To(Equal(http.StatusConflict))
+}
@@ -0,0 +1,32 @@
+package admin
+
+import (
+	. "github.com/onsi/gomega"
+	"istio.io/istio/pkg/log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLogging(t *testing.T) {
+	g := NewGomegaWithT(t)
+	mux := http.NewServeMux()
+	NewAdmin(&Options{Watcher: &fakeWatcher{}}).RegisterHandlers(mux)
+	defer log.FindScope("watcher").SetOutputLevel(log.InfoLevel)
+
+	var result loggingResponse
+	get(g, mux, "/admin/logging", &result)
+	g.Expect(result.Scopes).To(HaveKeyWithValue("watcher", "info"))
+	g.Expect(result.Scopes).To(HaveKey("grpc"))
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/logging?scope=watcher&level=debug", nil))
+	g.Expect(recorder.Code).To(Equal(http.StatusOK))
+	g.Expect(log.FindScope("watcher").GetOutputLevel()).To(Equal(log.DebugLevel))
+
+	for _, url := range []string{"/admin/logging?scope=unknown&level=debug", "/admin/logging?scope=watcher&level=verbose"} {
+		recorder = httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, url, nil))
+		g.Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	}
+}
@@ -0,0 +1,312 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/store"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"istio.io/istio/pilot/pkg/config/kube/crd"
+	"istio.io/istio/pilot/pkg/model"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"net/http"
+	"strings"
+)
+
+//maxBodySize limits the size of a config written through the API
+const maxBodySize = 1024 * 1024
+
+//Authenticator authenticates the callers of the API
+type Authenticator interface {
+	//AuthenticateRequest returns the identity of the caller of a request
+	AuthenticateRequest(r *http.Request) (string, error)
+}
+
+//Options configures the API
+type Options struct {
+	Store         *store.Store
+	Authenticator Authenticator
+}
+
+//API manages the istio configs of a store in the style of the kubernetes API, one path per config type
+//as returned by Path and one per config type and namespace as returned by NamespacePath. The path of a config
+//without namespace is the path of its type followed by its name, e.g. /apis/networking.istio.io/v1alpha3/gateways/pinger,
+//the path of a config with namespace is the path of its type in its namespace followed by its name. Listing the path of
+//a type returns the configs of all namespaces. Configs are written as YAML or JSON and validated on write.
+//Replacing and deleting a config is rejected if it has another resource version than given.
+//Writes are rejected with 409 Conflict if the check of the store fails, e.g. because another source of the
+//watcher provides a config of the same name.
+type API struct {
+	options Options
+}
+
+//NewAPI creates an API
+func NewAPI(options *Options) *API {
+	return &API{options: *options}
+}
+
+type listResponse struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Items      []crd.IstioObject `json:"items"`
+}
+
+//RegisterHandlers adds the endpoints of all supported config types to mux
+func (a *API) RegisterHandlers(mux *http.ServeMux) {
+	//namespaced are the config types by group path and plural, the types of a group share the namespaced paths
+	namespaced := make(map[string]map[string]model.ProtoSchema)
+	for _, ctype := range config.Types() {
+		schema, _ := model.IstioConfigTypes.GetByType(ctype)
+		path := Path(schema)
+		mux.Handle(path, a.handler(schema, path))
+		mux.Handle(path+"/", a.handler(schema, path))
+		group := groupPath(schema)
+		if namespaced[group] == nil {
+			namespaced[group] = make(map[string]model.ProtoSchema)
+		}
+		namespaced[group][crd.ResourceName(schema.Plural)] = schema
+	}
+	for group, schemas := range namespaced {
+		mux.Handle(group+"/namespaces/", a.namespacedHandler(group+"/namespaces/", schemas))
+	}
+}
+
+//Path returns the path of the configs of a type, e.g. /apis/networking.istio.io/v1alpha3/gateways
+func Path(schema model.ProtoSchema) string {
+	return groupPath(schema) + "/" + crd.ResourceName(schema.Plural)
+}
+
+//NamespacePath returns the path of the configs of a type in a namespace,
+//e.g. /apis/networking.istio.io/v1alpha3/namespaces/mesh/gateways
+func NamespacePath(schema model.ProtoSchema, namespace string) string {
+	return groupPath(schema) + "/namespaces/" + namespace + "/" + crd.ResourceName(schema.Plural)
+}
+
+func groupPath(schema model.ProtoSchema) string {
+	return fmt.Sprintf("/apis/%s/%s", crd.ResourceGroup(&schema), schema.Version)
+}
+
+func (a *API) handler(schema model.ProtoSchema, path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, path), "/")
+		a.serve(w, r, schema, "", name, false)
+	}
+}
+
+//namespacedHandler serves the paths below prefix of the config types of a group, e.g. mesh/gateways/pinger
+func (a *API) namespacedHandler(prefix string, schemas map[string]model.ProtoSchema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, prefix), "/", 3)
+		if len(parts) < 2 || parts[0] == "" {
+			http.NotFound(w, r)
+			return
+		}
+		schema, ok := schemas[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		name := ""
+		if len(parts) == 3 {
+			name = parts[2]
+		}
+		a.serve(w, r, schema, parts[0], name, true)
+	}
+}
+
+//serve handles a request for the configs of a type. Requests for the path of a type without namespace
+//address the configs without namespace, except for listing and creating configs.
+func (a *API) serve(w http.ResponseWriter, r *http.Request, schema model.ProtoSchema, namespace string, name string, namespaced bool) {
+	identity, err := a.options.Authenticator.AuthenticateRequest(r)
+	if err != nil {
+		logging.API.Debug("Rejected request", zap.String("path", r.URL.Path), logging.Error(err))
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		a.list(w, schema, namespace)
+	case name == "" && r.Method == http.MethodPost:
+		a.create(w, r, schema, namespace, namespaced, identity)
+	case name == "":
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	case r.Method == http.MethodGet:
+		a.get(w, schema, namespace, name)
+	case r.Method == http.MethodPut:
+		a.update(w, r, schema, namespace, name, identity)
+	case r.Method == http.MethodDelete:
+		a.delete(w, r, schema, namespace, name, identity)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+//list returns the configs of a namespace, of all namespaces if it is empty
+func (a *API) list(w http.ResponseWriter, schema model.ProtoSchema, namespace string) {
+	result := listResponse{
+		APIVersion: crd.ResourceGroup(&schema) + "/" + schema.Version,
+		Kind:       crd.KebabCaseToCamelCase(schema.Type) + "List",
+		Items:      []crd.IstioObject{},
+	}
+	for _, c := range a.options.Store.List(schema.Type, namespace) {
+		object, err := store.ConvertConfig(schema, c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.Items = append(result.Items, object)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (a *API) get(w http.ResponseWriter, schema model.ProtoSchema, namespace string, name string) {
+	c, err := a.options.Store.Get(schema.Type, namespace, name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeConfig(w, http.StatusOK, schema, c)
+}
+
+//create adds a config, a resource version of the request is ignored. Configs created in the path of a namespace
+//get its namespace.
+func (a *API) create(w http.ResponseWriter, r *http.Request, schema model.ProtoSchema, namespace string, namespaced bool, identity string) {
+	c, err := readConfig(w, r, schema)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if namespaced {
+		if err := setNamespace(&c, namespace); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	c.ResourceVersion = ""
+	if c, err = a.options.Store.Create(c); err != nil {
+		writeError(w, err)
+		return
+	}
+	logging.API.Info("Created config", changeFields(c, identity)...)
+	writeConfig(w, http.StatusCreated, schema, c)
+}
+
+//update replaces a config. Without resource version in the request the config is replaced unconditionally.
+//The name and namespace of a config can't be changed.
+func (a *API) update(w http.ResponseWriter, r *http.Request, schema model.ProtoSchema, namespace string, name string, identity string) {
+	c, err := readConfig(w, r, schema)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if c.Name != name {
+		http.Error(w, fmt.Sprintf("name %s doesn't match the path", c.Name), http.StatusBadRequest)
+		return
+	}
+	if err := setNamespace(&c, namespace); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if c, err = a.options.Store.Update(c); err != nil {
+		writeError(w, err)
+		return
+	}
+	logging.API.Info("Replaced config", changeFields(c, identity)...)
+	writeConfig(w, http.StatusOK, schema, c)
+}
+
+//delete removes a config. The resourceVersion query parameter is optional.
+func (a *API) delete(w http.ResponseWriter, r *http.Request, schema model.ProtoSchema, namespace string, name string, identity string) {
+	if err := a.options.Store.Delete(schema.Type, namespace, name, r.URL.Query().Get("resourceVersion")); err != nil {
+		writeError(w, err)
+		return
+	}
+	logging.API.Info("Deleted config", zap.String("type", schema.Type), zap.String("namespace", namespace), zap.String("name", name),
+		zap.String("identity", identity))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//readConfig parses and validates the config of a request body
+func readConfig(w http.ResponseWriter, r *http.Request, schema model.ProtoSchema) (model.Config, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		return model.Config{}, err
+	}
+	configs, others, err := crd.ParseInputs(string(body))
+	if err != nil {
+		return model.Config{}, err
+	}
+	if len(others) > 0 {
+		return model.Config{}, fmt.Errorf("kind %s is not supported", others[0].Kind)
+	}
+	if len(configs) != 1 {
+		return model.Config{}, fmt.Errorf("expected one config, found %d", len(configs))
+	}
+	c := configs[0]
+	if c.Type != schema.Type {
+		return model.Config{}, fmt.Errorf("expected kind %s, found %s", crd.KebabCaseToCamelCase(schema.Type), crd.KebabCaseToCamelCase(c.Type))
+	}
+	if problems := validation.IsDNS1123Subdomain(c.Name); len(problems) > 0 {
+		return model.Config{}, fmt.Errorf("invalid name %q: %s", c.Name, strings.Join(problems, ", "))
+	}
+	return c, nil
+}
+
+//setNamespace sets the namespace of the path on a config of a request. Configs of another namespace are rejected.
+func setNamespace(c *model.Config, namespace string) error {
+	if c.Namespace != "" && c.Namespace != namespace {
+		return fmt.Errorf("namespace %s doesn't match the path", c.Namespace)
+	}
+	c.Namespace = namespace
+	return nil
+}
+
+func changeFields(c model.Config, identity string) []zap.Field {
+	return []zap.Field{
+		zap.String("type", c.Type),
+		zap.String("namespace", c.Namespace),
+		zap.String("name", c.Name),
+		zap.String("resourceVersion", c.ResourceVersion),
+		zap.String("identity", identity),
+	}
+}
+
+func writeConfig(w http.ResponseWriter, status int, schema model.ProtoSchema, c model.Config) {
+	object, err := store.ConvertConfig(schema, c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status, object)
+}
+
+//writeError responds with the status matching an error of the store
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case store.IsNotFound(err):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case store.IsConflict(err):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		logging.API.Error("Can't write config", logging.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		logging.API.Warn("Can't write API response", logging.Error(err))
+	}
+}
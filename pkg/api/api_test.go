@@ -0,0 +1,253 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/store"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"istio.io/istio/galley/pkg/metadata"
+	"istio.io/istio/pilot/pkg/model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const pingerGateway = `
+apiVersion: networking.istio.io/v1alpha3
+kind: Gateway
+metadata:
+  name: pinger
+  resourceVersion: "%s"
+spec:
+  servers:
+  - hosts:
+    - %s
+    port:
+      number: 9000
+      name: http
+      protocol: HTTP
+`
+
+type tokenAuthenticator struct{}
+
+func (tokenAuthenticator) AuthenticateRequest(r *http.Request) (string, error) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		return "", errors.New("invalid bearer token")
+	}
+	return "service-manager", nil
+}
+
+type object struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []object `json:"items"`
+}
+
+func gateway(resourceVersion string, host string) string {
+	return strings.NewReplacer(`"%s"`, `"`+resourceVersion+`"`, "%s", host).Replace(pingerGateway)
+}
+
+func TestAPI(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "api")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	configStore, err := store.Open(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	watcher, err := config.NewWatcher([]config.Source{configStore}, &config.Options{})
+	g.Expect(err).NotTo(HaveOccurred())
+	mux := http.NewServeMux()
+	NewAPI(&Options{Store: configStore, Authenticator: tokenAuthenticator{}}).RegisterHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	gateways := server.URL + Path(model.Gateway)
+	g.Expect(gateways).To(HaveSuffix("/apis/networking.istio.io/v1alpha3/gateways"))
+
+	call := func(method string, url string, body string, token string) (int, *object) {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		request, err := http.NewRequest(method, url, reader)
+		g.Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("Authorization", "Bearer "+token)
+		response, err := http.DefaultClient.Do(request)
+		g.Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		result := &object{}
+		if response.Header.Get("Content-Type") == "application/json" {
+			g.Expect(json.NewDecoder(response.Body).Decode(result)).To(Succeed())
+		}
+		return response.StatusCode, result
+	}
+
+	status, _ := call(http.MethodGet, gateways, "", "wrong")
+	g.Expect(status).To(Equal(http.StatusUnauthorized))
+
+	status, created := call(http.MethodPost, gateways, gateway("", "pinger.example.com"), "secret")
+	g.Expect(status).To(Equal(http.StatusCreated))
+	g.Expect(created.Kind).To(Equal("Gateway"))
+	g.Expect(created.Metadata.ResourceVersion).To(Equal("1"))
+	status, _ = call(http.MethodPost, gateways, gateway("", "pinger.example.com"), "secret")
+	g.Expect(status).To(Equal(http.StatusConflict))
+	g.Eventually(func() int {
+		return len(watcher.Snapshot().Resources(metadata.IstioNetworkingV1alpha3Gateways.Collection.String()))
+	}).Should(Equal(1))
+
+	status, list := call(http.MethodGet, gateways, "", "secret")
+	g.Expect(status).To(Equal(http.StatusOK))
+	g.Expect(list.Kind).To(Equal("GatewayList"))
+	g.Expect(list.Items).To(HaveLen(1))
+	g.Expect(list.Items[0].Metadata.Name).To(Equal("pinger"))
+
+	// invalid configs are rejected
+	status, _ = call(http.MethodPost, gateways, gateway("", ""), "secret")
+	g.Expect(status).To(Equal(http.StatusBadRequest))
+	status, _ = call(http.MethodPost, server.URL+Path(model.VirtualService), gateway("", "pinger.example.com"), "secret")
+	g.Expect(status).To(Equal(http.StatusBadRequest))
+	status, _ = call(http.MethodPost, gateways, strings.Replace(gateway("", "a.example.com"), "pinger", "Pinger_1", 1), "secret")
+	g.Expect(status).To(Equal(http.StatusBadRequest))
+
+	// replacing and deleting requires the current resource version
+	status, _ = call(http.MethodPut, gateways+"/pinger", gateway("7", "other.example.com"), "secret")
+	g.Expect(status).To(Equal(http.StatusConflict))
+	status, _ = call(http.MethodPut, gateways+"/other", gateway("1", "other.example.com"), "secret")
+	g.Expect(status).To(Equal(http.StatusBadRequest))
+	status, updated := call(http.MethodPut, gateways+"/pinger", gateway("1", "other.example.com"), "secret")
+	g.Expect(status).To(Equal(http.StatusOK))
+	g.Expect(updated.Metadata.ResourceVersion).To(Equal("2"))
+	status, _ = call(http.MethodDelete, gateways+"/pinger?resourceVersion=1", "", "secret")
+	g.Expect(status).To(Equal(http.StatusConflict))
+	status, _ = call(http.MethodDelete, gateways+"/pinger?resourceVersion=2", "", "secret")
+	g.Expect(status).To(Equal(http.StatusNoContent))
+	status, _ = call(http.MethodGet, gateways+"/pinger", "", "secret")
+	g.Expect(status).To(Equal(http.StatusNotFound))
+	g.Eventually(func() int {
+		return len(watcher.Snapshot().Resources(metadata.IstioNetworkingV1alpha3Gateways.Collection.String()))
+	}).Should(Equal(0))
+
+	status, _ = call(http.MethodPatch, gateways+"/pinger", "", "secret")
+	g.Expect(status).To(Equal(http.StatusMethodNotAllowed))
+}
+
+func TestAPINamespaces(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "api")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	configStore, err := store.Open(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	mux := http.NewServeMux()
+	NewAPI(&Options{Store: configStore, Authenticator: tokenAuthenticator{}}).RegisterHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	gateways := server.URL + Path(model.Gateway)
+	meshGateways := server.URL + NamespacePath(model.Gateway, "mesh")
+	g.Expect(meshGateways).To(HaveSuffix("/apis/networking.istio.io/v1alpha3/namespaces/mesh/gateways"))
+	otherGateways := server.URL + NamespacePath(model.Gateway, "other")
+
+	call := func(method string, url string, body string) (int, *object) {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		request, err := http.NewRequest(method, url, reader)
+		g.Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("Authorization", "Bearer secret")
+		response, err := http.DefaultClient.Do(request)
+		g.Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		result := &object{}
+		if response.Header.Get("Content-Type") == "application/json" {
+			g.Expect(json.NewDecoder(response.Body).Decode(result)).To(Succeed())
+		}
+		return response.StatusCode, result
+	}
+	inNamespace := func(namespace string, body string) string {
+		return strings.Replace(body, "  name: pinger\n", "  name: pinger\n  namespace: "+namespace+"\n", 1)
+	}
+
+	// configs of the same name in different namespaces are different configs
+	status, created := call(http.MethodPost, gateways, gateway("", "pinger.example.com"))
+	g.Expect(status).To(Equal(http.StatusCreated))
+	g.Expect(created.Metadata.Namespace).To(BeEmpty())
+	status, created = call(http.MethodPost, meshGateways, gateway("", "mesh.example.com"))
+	g.Expect(status).To(Equal(http.StatusCreated))
+	g.Expect(created.Metadata.Namespace).To(Equal("mesh"))
+	status, _ = call(http.MethodPost, gateways, inNamespace("other", gateway("", "other.example.com")))
+	g.Expect(status).To(Equal(http.StatusCreated))
+	status, _ = call(http.MethodPost, otherGateways, gateway("", "other.example.com"))
+	g.Expect(status).To(Equal(http.StatusConflict))
+	status, _ = call(http.MethodPost, meshGateways, inNamespace("other", gateway("", "other.example.com")))
+	g.Expect(status).To(Equal(http.StatusBadRequest))
+
+	status, list := call(http.MethodGet, gateways, "")
+	g.Expect(status).To(Equal(http.StatusOK))
+	g.Expect(list.Items).To(HaveLen(3))
+	status, list = call(http.MethodGet, meshGateways, "")
+	g.Expect(status).To(Equal(http.StatusOK))
+	g.Expect(list.Items).To(HaveLen(1))
+	g.Expect(list.Items[0].Metadata.Namespace).To(Equal("mesh"))
+
+	// the namespace of a config can't be changed
+	status, _ = call(http.MethodPut, meshGateways+"/pinger", inNamespace("other", gateway("", "mesh.example.com")))
+	g.Expect(status).To(Equal(http.StatusBadRequest))
+	status, _ = call(http.MethodPut, gateways+"/pinger", inNamespace("mesh", gateway("", "mesh.example.com")))
+	g.Expect(status).To(Equal(http.StatusBadRequest))
+	status, updated := call(http.MethodPut, meshGateways+"/pinger", gateway("", "updated.example.com"))
+	g.Expect(status).To(Equal(http.StatusOK))
+	g.Expect(updated.Metadata.Namespace).To(Equal("mesh"))
+	current, err := configStore.Get(model.Gateway.Type, "", "pinger")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(current.ResourceVersion).To(Equal("1"))
+
+	status, _ = call(http.MethodDelete, otherGateways+"/pinger", "")
+	g.Expect(status).To(Equal(http.StatusNoContent))
+	status, _ = call(http.MethodGet, otherGateways+"/pinger", "")
+	g.Expect(status).To(Equal(http.StatusNotFound))
+	status, _ = call(http.MethodGet, meshGateways+"/pinger", "")
+	g.Expect(status).To(Equal(http.StatusOK))
+	status, _ = call(http.MethodGet, server.URL+NamespacePath(model.Gateway, "mesh")+"s", "")
+	g.Expect(status).To(Equal(http.StatusNotFound))
+}
+
+func TestAPIConflictWithOtherSource(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "api")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	g.Expect(os.Mkdir(filepath.Join(dir, "config"), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "config", "pinger.yaml"), []byte(gateway("", "pinger.example.com")), 0644)).To(Succeed())
+	configStore, err := store.Open(filepath.Join(dir, "store"))
+	g.Expect(err).NotTo(HaveOccurred())
+	watcher, err := config.NewWatcher([]config.Source{config.NewFileSource(filepath.Join(dir, "config")), configStore}, &config.Options{})
+	g.Expect(err).NotTo(HaveOccurred())
+	configStore.SetCheck(func(set *config.ConfigSet) error { return watcher.Check(configStore, set) })
+	mux := http.NewServeMux()
+	NewAPI(&Options{Store: configStore, Authenticator: tokenAuthenticator{}}).RegisterHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// the gateway would stop the watcher from publishing new versions
+	request, err := http.NewRequest(http.MethodPost, server.URL+Path(model.Gateway), strings.NewReader(gateway("", "other.example.com")))
+	g.Expect(err).NotTo(HaveOccurred())
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err := http.DefaultClient.Do(request)
+	g.Expect(err).NotTo(HaveOccurred())
+	defer response.Body.Close()
+	g.Expect(response.StatusCode).To(Equal(http.StatusConflict))
+	body, err := ioutil.ReadAll(response.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(body)).To(ContainSubstring("is also provided by source"))
+	g.Expect(configStore.List(model.Gateway.Type, "")).To(BeEmpty())
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	mcpserver "github.com/Peripli/service-manager-istio-mcp-server/pkg/server"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"istio.io/istio/pkg/mcp/server"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Options configures an Authenticator
+type Options struct {
+	//TokenFiles contain static tokens, one token,subject pair per line
+	TokenFiles []string
+	//JWKSFiles contain the JSON web key sets JWTs are verified with
+	JWKSFiles []string
+	//Issuer must match the iss claim of JWTs if set
+	Issuer string
+	//Audience must be contained in the aud claim of JWTs if set
+	Audience string
+	//RequireToken rejects sinks without bearer token. Otherwise they are authenticated by AuthChecker.
+	RequireToken bool
+	//AllowedIdentities are the token subjects which may connect. All subjects are allowed if empty.
+	AllowedIdentities []string
+	//AuthChecker checks the transport credentials of sinks without bearer token
+	AuthChecker server.AuthChecker
+}
+
+//Authenticator authenticates sinks by a bearer token in the authorization metadata of their stream.
+//The subject of the token is the identity of the sink. Sinks without token are authenticated by their
+//transport credentials unless a token is required.
+type Authenticator struct {
+	options *Options
+	tokens  map[string]string
+	jwt     *jwtVerifier
+	allowed map[string]bool
+}
+
+//Ensure that Authenticator can be used by the server
+var _ mcpserver.Authenticator = &Authenticator{}
+
+//ErrNoToken is returned if a token is required but the stream has none
+var ErrNoToken = errors.New("no bearer token")
+
+//NewAuthenticator creates an Authenticator and reads its token and key files
+func NewAuthenticator(options *Options) (*Authenticator, error) {
+	tokens, err := readTokenFiles(options.TokenFiles)
+	if err != nil {
+		return nil, err
+	}
+	a := &Authenticator{
+		options: options,
+		tokens:  tokens,
+		allowed: make(map[string]bool),
+	}
+	if len(options.JWKSFiles) > 0 {
+		if a.jwt, err = newJWTVerifier(options.JWKSFiles, options.Issuer, options.Audience); err != nil {
+			return nil, err
+		}
+	}
+	for _, identity := range options.AllowedIdentities {
+		a.allowed[identity] = true
+	}
+	logging.Auth.Info("Token authentication enabled", zap.Int("staticTokens", len(tokens)),
+		zap.Int("jwks", len(options.JWKSFiles)), zap.Bool("requireToken", options.RequireToken))
+	return a, nil
+}
+
+//Authenticate returns the identity of the sink of a stream
+func (a *Authenticator) Authenticate(ctx context.Context, authInfo credentials.AuthInfo) (string, error) {
+	token, err := bearerToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		if a.options.RequireToken {
+			return "", ErrNoToken
+		}
+		if err := a.options.AuthChecker.Check(authInfo); err != nil {
+			return "", err
+		}
+		return mcpserver.PeerIdentity(authInfo), nil
+	}
+	return a.authenticateToken(token)
+}
+
+//AuthenticateRequest returns the identity of the bearer token of an http request. Requests without token
+//are rejected.
+func (a *Authenticator) AuthenticateRequest(r *http.Request) (string, error) {
+	token, err := parseBearerToken(r.Header["Authorization"])
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		return "", ErrNoToken
+	}
+	return a.authenticateToken(token)
+}
+
+//authenticateToken returns the subject of a token if it is allowed
+func (a *Authenticator) authenticateToken(token string) (string, error) {
+	subject, err := a.verify(token, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if len(a.allowed) > 0 && !a.allowed[subject] {
+		return "", fmt.Errorf("identity %q is not allowed", subject)
+	}
+	return subject, nil
+}
+
+//verify returns the subject of a token
+func (a *Authenticator) verify(token string, now time.Time) (string, error) {
+	if subject, ok := a.tokens[tokenKey(token)]; ok {
+		return subject, nil
+	}
+	if a.jwt != nil && strings.Count(token, ".") == 2 {
+		return a.jwt.verify(token, now)
+	}
+	return "", errors.New("invalid bearer token")
+}
+
+//bearerToken returns the bearer token of the authorization metadata or an empty string if there is none
+func bearerToken(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", nil
+	}
+	return parseBearerToken(md.Get("authorization"))
+}
+
+//parseBearerToken returns the bearer token of the values of an authorization header or an empty string
+//if there is none
+func parseBearerToken(values []string) (string, error) {
+	if len(values) == 0 {
+		return "", nil
+	}
+	if len(values) > 1 {
+		return "", errors.New("more than one authorization header")
+	}
+	fields := strings.Fields(values[0])
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "bearer") {
+		return "", errors.New("authorization header is no bearer token")
+	}
+	return fields[1], nil
+}
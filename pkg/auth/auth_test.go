@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type denyChecker struct{}
+
+func (denyChecker) Check(credentials.AuthInfo) error { return errors.New("no client certificate") }
+
+type allowChecker struct{}
+
+func (allowChecker) Check(credentials.AuthInfo) error { return nil }
+
+func withToken(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestStaticTokens(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "auth")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	tokens := writeFile(t, dir, "tokens", "# pilots\nsecret-1,pilot-1\n\nsecret-2, pilot-2\n")
+
+	a, err := NewAuthenticator(&Options{TokenFiles: []string{tokens}, AuthChecker: denyChecker{}})
+	g.Expect(err).NotTo(HaveOccurred())
+	identity, err := a.Authenticate(withToken("secret-2"), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(identity).To(Equal("pilot-2"))
+
+	_, err = a.Authenticate(withToken("wrong"), nil)
+	g.Expect(err).To(HaveOccurred())
+	_, err = a.Authenticate(metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Basic abc")), nil)
+	g.Expect(err).To(HaveOccurred())
+	_, err = a.Authenticate(context.Background(), nil)
+	g.Expect(err).To(MatchError("no client certificate"))
+
+	a, err = NewAuthenticator(&Options{TokenFiles: []string{tokens}, AllowedIdentities: []string{"pilot-1"}, AuthChecker: allowChecker{}})
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = a.Authenticate(withToken("secret-2"), nil)
+	g.Expect(err).To(MatchError(ContainSubstring("not allowed")))
+	identity, err = a.Authenticate(context.Background(), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(identity).To(BeEmpty())
+
+	a, err = NewAuthenticator(&Options{TokenFiles: []string{tokens}, RequireToken: true, AuthChecker: allowChecker{}})
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = a.Authenticate(context.Background(), nil)
+	g.Expect(err).To(Equal(ErrNoToken))
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err = a.AuthenticateRequest(request)
+	g.Expect(err).To(Equal(ErrNoToken))
+	request.Header.Set("Authorization", "Bearer secret-1")
+	identity, err = a.AuthenticateRequest(request)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(identity).To(Equal("pilot-1"))
+
+	invalid := writeFile(t, dir, "invalid", "secret-3\n")
+	_, err = NewAuthenticator(&Options{TokenFiles: []string{invalid}})
+	g.Expect(err).To(MatchError(ContainSubstring("invalid:1")))
+}
+
+func TestJWT(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "auth")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "key-1", Algorithm: "ES256", Use: "sig"}}})
+	g.Expect(err).NotTo(HaveOccurred())
+	jwksFile := writeFile(t, dir, "jwks.json", string(jwks))
+
+	a, err := NewAuthenticator(&Options{JWKSFiles: []string{jwksFile}, Issuer: "https://issuer", Audience: "mcp", AuthChecker: denyChecker{}})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	sign := func(signingKey *ecdsa.PrivateKey, claims jwt.Claims) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: signingKey},
+			(&jose.SignerOptions{}).WithHeader("kid", "key-1"))
+		g.Expect(err).NotTo(HaveOccurred())
+		token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+		g.Expect(err).NotTo(HaveOccurred())
+		return token
+	}
+	now := time.Now()
+	valid := jwt.Claims{
+		Issuer:   "https://issuer",
+		Subject:  "spiffe://cluster.local/ns/istio-system/sa/pilot",
+		Audience: jwt.Audience{"mcp"},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+	identity, err := a.Authenticate(withToken(sign(key, valid)), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(identity).To(Equal("spiffe://cluster.local/ns/istio-system/sa/pilot"))
+
+	_, err = a.Authenticate(withToken(sign(otherKey, valid)), nil)
+	g.Expect(err).To(MatchError(ContainSubstring("signature")))
+
+	expired := valid
+	expired.Expiry = jwt.NewNumericDate(now.Add(-time.Hour))
+	_, err = a.Authenticate(withToken(sign(key, expired)), nil)
+	g.Expect(err).To(HaveOccurred())
+
+	wrongIssuer := valid
+	wrongIssuer.Issuer = "https://other"
+	_, err = a.Authenticate(withToken(sign(key, wrongIssuer)), nil)
+	g.Expect(err).To(HaveOccurred())
+
+	wrongAudience := valid
+	wrongAudience.Audience = jwt.Audience{"pilot"}
+	_, err = a.Authenticate(withToken(sign(key, wrongAudience)), nil)
+	g.Expect(err).To(HaveOccurred())
+
+	noSubject := valid
+	noSubject.Subject = ""
+	_, err = a.Authenticate(withToken(sign(key, noSubject)), nil)
+	g.Expect(err).To(MatchError(ContainSubstring("no subject")))
+}
+
+func TestInvalidJWKS(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "auth")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	_, err = NewAuthenticator(&Options{JWKSFiles: []string{writeFile(t, dir, "jwks.json", "{")}})
+	g.Expect(err).To(HaveOccurred())
+	_, err = NewAuthenticator(&Options{JWKSFiles: []string{filepath.Join(dir, "missing.json")}})
+	g.Expect(err).To(HaveOccurred())
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path"
+)
+
+//Policy decides which collections and namespaces sinks may watch by their identity.
+//Identities without matching rule may not watch any collection.
+type Policy struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+//Rule allows the matching identities to watch the matching collections. Identities and collections are
+//patterns as understood by path.Match, e.g. * or istio/networking/v1alpha3/*.
+type Rule struct {
+	Identities  []string `yaml:"identities"`
+	Collections []string `yaml:"collections"`
+	//Namespaces restricts the resources sent to the namespaces if set. Resources are in the namespace of
+	//their metadata, resources without namespace are only sent if "" is listed.
+	Namespaces []string `yaml:"namespaces"`
+}
+
+//LoadPolicy reads a YAML policy file. Every collection pattern must match one of collections.
+func LoadPolicy(file string, collections []string) (*Policy, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict(content, policy); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %v", file, err)
+	}
+	if err := policy.Validate(collections); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %v", file, err)
+	}
+	return policy, nil
+}
+
+//Validate returns an error if a rule is incomplete or a pattern is invalid or matches none of collections
+func (p *Policy) Validate(collections []string) error {
+	for i, rule := range p.Rules {
+		if len(rule.Identities) == 0 || len(rule.Collections) == 0 {
+			return fmt.Errorf("rule %d needs identities and collections", i)
+		}
+		for _, identity := range rule.Identities {
+			if _, err := path.Match(identity, ""); err != nil {
+				return fmt.Errorf("rule %d: invalid identity pattern %q", i, identity)
+			}
+		}
+		for _, pattern := range rule.Collections {
+			matched := false
+			for _, collection := range collections {
+				ok, err := path.Match(pattern, collection)
+				if err != nil {
+					return fmt.Errorf("rule %d: invalid collection pattern %q", i, pattern)
+				}
+				matched = matched || ok
+			}
+			if !matched {
+				return fmt.Errorf("rule %d: collection pattern %q matches no collection", i, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+//Allowed returns true if identity may watch collection. The resources sent are restricted to namespaces
+//unless it is nil.
+func (p *Policy) Allowed(identity string, collection string) (bool, []string) {
+	allowed := false
+	var namespaces []string
+	for _, rule := range p.Rules {
+		if !matchAny(rule.Identities, identity) || !matchAny(rule.Collections, collection) {
+			continue
+		}
+		if len(rule.Namespaces) == 0 {
+			return true, nil
+		}
+		allowed = true
+		namespaces = append(namespaces, rule.Namespaces...)
+	}
+	return allowed, namespaces
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var policyCollections = []string{
+	"istio/networking/v1alpha3/gateways",
+	"istio/networking/v1alpha3/virtualservices",
+	"istio/rbac/v1alpha1/policy",
+}
+
+func TestPolicy(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "auth")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	file := writeFile(t, dir, "policy.yaml", `
+rules:
+- identities: ["spiffe://cluster.local/ns/istio-system/sa/ingress-*"]
+  collections: ["istio/networking/v1alpha3/*"]
+  namespaces: ["istio-system"]
+- identities: ["spiffe://cluster.local/ns/istio-system/sa/ingress-*"]
+  collections: ["istio/networking/v1alpha3/gateways"]
+  namespaces: ["ingress"]
+- identities: ["spiffe://cluster.local/ns/istio-system/sa/pilot"]
+  collections: ["*/*/*/*"]
+`)
+	policy, err := LoadPolicy(file, policyCollections)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	allowed, namespaces := policy.Allowed("spiffe://cluster.local/ns/istio-system/sa/ingress-pilot", "istio/networking/v1alpha3/gateways")
+	g.Expect(allowed).To(BeTrue())
+	g.Expect(namespaces).To(ConsistOf("istio-system", "ingress"))
+	allowed, namespaces = policy.Allowed("spiffe://cluster.local/ns/istio-system/sa/ingress-pilot", "istio/networking/v1alpha3/virtualservices")
+	g.Expect(allowed).To(BeTrue())
+	g.Expect(namespaces).To(ConsistOf("istio-system"))
+	allowed, _ = policy.Allowed("spiffe://cluster.local/ns/istio-system/sa/ingress-pilot", "istio/rbac/v1alpha1/policy")
+	g.Expect(allowed).To(BeFalse())
+
+	allowed, namespaces = policy.Allowed("spiffe://cluster.local/ns/istio-system/sa/pilot", "istio/rbac/v1alpha1/policy")
+	g.Expect(allowed).To(BeTrue())
+	g.Expect(namespaces).To(BeNil())
+	allowed, _ = policy.Allowed("", "istio/networking/v1alpha3/gateways")
+	g.Expect(allowed).To(BeFalse())
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "auth")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"typo":         "rules:\n- identities: [\"*\"]\n  collections: [\"istio/networking/v1alpha3/gateway\"]\n",
+		"incomplete":   "rules:\n- identities: [\"*\"]\n",
+		"bad-pattern":  "rules:\n- identities: [\"[\"]\n  collections: [\"*/*/*/*\"]\n",
+		"unknown-keys": "rules:\n- identity: [\"*\"]\n  collections: [\"*/*/*/*\"]\n",
+	} {
+		_, err := LoadPolicy(writeFile(t, dir, name, content), policyCollections)
+		g.Expect(err).To(HaveOccurred(), name)
+	}
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+//leeway is the clock skew tolerated when validating the time claims of JWTs
+const leeway = time.Minute
+
+//readTokenFiles returns the subjects by token key of static token files.
+//Each line of a file is a token,subject pair. Empty lines and lines starting with # are skipped.
+func readTokenFiles(files []string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, file := range files {
+		if err := readTokenFile(file, tokens); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+func readTokenFile(file string, tokens map[string]string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		pair := strings.SplitN(text, ",", 2)
+		if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" || strings.TrimSpace(pair[1]) == "" {
+			return fmt.Errorf("%s:%d: expected token,subject", file, line)
+		}
+		tokens[tokenKey(strings.TrimSpace(pair[0]))] = strings.TrimSpace(pair[1])
+	}
+	return scanner.Err()
+}
+
+//tokenKey hashes a token, so that static tokens are not kept in memory in plain text
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//jwtVerifier verifies signed JWTs with the keys of JSON web key sets
+type jwtVerifier struct {
+	keys     jose.JSONWebKeySet
+	issuer   string
+	audience string
+}
+
+func newJWTVerifier(files []string, issuer string, audience string) (*jwtVerifier, error) {
+	v := &jwtVerifier{issuer: issuer, audience: audience}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var keys jose.JSONWebKeySet
+		if err := json.Unmarshal(content, &keys); err != nil {
+			return nil, fmt.Errorf("invalid JWKS file %s: %v", file, err)
+		}
+		for _, key := range keys.Keys {
+			if !key.Valid() || !key.IsPublic() {
+				return nil, fmt.Errorf("invalid JWKS file %s: key %q is no valid public key", file, key.KeyID)
+			}
+		}
+		v.keys.Keys = append(v.keys.Keys, keys.Keys...)
+	}
+	return v, nil
+}
+
+//verify returns the subject of a JWT with a valid signature and valid claims
+func (v *jwtVerifier) verify(token string, now time.Time) (string, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid JWT: %v", err)
+	}
+	keys := v.keys.Keys
+	if len(parsed.Headers) > 0 && parsed.Headers[0].KeyID != "" {
+		keys = v.keys.Key(parsed.Headers[0].KeyID)
+	}
+	var claims jwt.Claims
+	verified := false
+	for _, key := range keys {
+		if parsed.Claims(key.Key, &claims) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", errors.New("invalid JWT: signature not verified by any key")
+	}
+	expected := jwt.Expected{Issuer: v.issuer, Time: now}
+	if v.audience != "" {
+		expected.Audience = jwt.Audience{v.audience}
+	}
+	if err := claims.ValidateWithLeeway(expected, leeway); err != nil {
+		return "", fmt.Errorf("invalid JWT: %v", err)
+	}
+	if claims.Subject == "" {
+		return "", errors.New("invalid JWT: no subject")
+	}
+	return claims.Subject, nil
+}
@@ -0,0 +1,206 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/api"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/store"
+	"go.uber.org/zap"
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/model"
+	"net/http"
+	"strings"
+)
+
+//Annotations of the configs generated for a binding. They identify the configs of a binding across restarts.
+const (
+	InstanceAnnotation   = "mcp-server.peripli.io/service-instance"
+	BindingAnnotation    = "mcp-server.peripli.io/service-binding"
+	ParametersAnnotation = "mcp-server.peripli.io/binding-parameters"
+)
+
+//APIVersionHeader is the header of the OSB API version a platform uses
+const APIVersionHeader = "X-Broker-API-Version"
+
+//Options configures the broker
+type Options struct {
+	//Store keeps the configs generated for bindings
+	Store *store.Store
+	//Template renders the configs of a binding
+	Template      *Template
+	Authenticator api.Authenticator
+}
+
+//Broker implements the binding endpoints of the Open Service Broker API. Binding a service instance
+//generates istio configs from a template, unbinding removes them.
+type Broker struct {
+	options Options
+}
+
+//NewBroker creates a Broker
+func NewBroker(options *Options) *Broker {
+	return &Broker{options: *options}
+}
+
+type bindRequest struct {
+	ServiceID  string                 `json:"service_id"`
+	PlanID     string                 `json:"plan_id"`
+	Parameters map[string]interface{} `json:"parameters"`
+	Context    map[string]interface{} `json:"context"`
+}
+
+type bindResponse struct {
+	Credentials map[string]interface{} `json:"credentials"`
+}
+
+type errorResponse struct {
+	Description string `json:"description"`
+}
+
+//RegisterHandlers adds the binding endpoints to mux
+func (b *Broker) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/v2/service_instances/", b.handle)
+}
+
+//handle serves /v2/service_instances/:instance_id/service_bindings/:binding_id
+func (b *Broker) handle(w http.ResponseWriter, r *http.Request) {
+	identity, err := b.options.Authenticator.AuthenticateRequest(r)
+	if err != nil {
+		logging.API.Debug("Rejected broker request", zap.String("path", r.URL.Path), logging.Error(err))
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, errorResponse{Description: err.Error()})
+		return
+	}
+	if r.Header.Get(APIVersionHeader) == "" {
+		writeJSON(w, http.StatusPreconditionFailed, errorResponse{Description: "missing " + APIVersionHeader + " header"})
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/service_instances/"), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] != "service_bindings" || parts[2] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	instanceID, bindingID := parts[0], parts[2]
+	switch r.Method {
+	case http.MethodPut:
+		b.bind(w, r, instanceID, bindingID, identity)
+	case http.MethodDelete:
+		b.unbind(w, r, instanceID, bindingID, identity)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Description: "method not allowed"})
+	}
+}
+
+//bind generates the configs of a binding. Binding again with the same parameters succeeds without changes.
+func (b *Broker) bind(w http.ResponseWriter, r *http.Request, instanceID string, bindingID string, identity string) {
+	var request bindRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Description: "invalid request body: " + err.Error()})
+		return
+	}
+	if request.ServiceID == "" || request.PlanID == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Description: "service_id and plan_id are required"})
+		return
+	}
+	binding := &Binding{
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		ServiceID:  request.ServiceID,
+		PlanID:     request.PlanID,
+		Parameters: request.Parameters,
+		Context:    request.Context,
+	}
+	parameters, err := binding.hash()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Description: err.Error()})
+		return
+	}
+	if existing := b.options.Store.Select(BindingAnnotation, bindingID); len(existing) > 0 {
+		if existing[0].Annotations[InstanceAnnotation] != instanceID || existing[0].Annotations[ParametersAnnotation] != parameters {
+			writeJSON(w, http.StatusConflict, errorResponse{Description: "binding " + bindingID + " already exists with other parameters"})
+			return
+		}
+		writeJSON(w, http.StatusOK, bindResponse{Credentials: credentials(existing)})
+		return
+	}
+	configs, err := Render(b.options.Template, binding)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Description: err.Error()})
+		return
+	}
+	for i := range configs {
+		if configs[i].Annotations == nil {
+			configs[i].Annotations = make(map[string]string)
+		}
+		configs[i].Annotations[InstanceAnnotation] = instanceID
+		configs[i].Annotations[BindingAnnotation] = bindingID
+		configs[i].Annotations[ParametersAnnotation] = parameters
+	}
+	created, err := b.options.Store.CreateAll(configs)
+	if store.IsConflict(err) {
+		writeJSON(w, http.StatusConflict, errorResponse{Description: err.Error()})
+		return
+	}
+	if err != nil {
+		logging.API.Error("Can't store the configs of a binding", zap.String("bindingID", bindingID), logging.Error(err))
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Description: err.Error()})
+		return
+	}
+	logging.API.Info("Created binding", zap.String("instanceID", instanceID), zap.String("bindingID", bindingID),
+		zap.Int("configs", len(created)), zap.String("identity", identity))
+	writeJSON(w, http.StatusCreated, bindResponse{Credentials: credentials(created)})
+}
+
+//unbind removes the configs of a binding
+func (b *Broker) unbind(w http.ResponseWriter, r *http.Request, instanceID string, bindingID string, identity string) {
+	if r.URL.Query().Get("service_id") == "" || r.URL.Query().Get("plan_id") == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Description: "service_id and plan_id are required"})
+		return
+	}
+	configs := b.options.Store.Select(BindingAnnotation, bindingID)
+	if len(configs) == 0 || configs[0].Annotations[InstanceAnnotation] != instanceID {
+		writeJSON(w, http.StatusGone, struct{}{})
+		return
+	}
+	if err := b.options.Store.DeleteAll(configs); err != nil {
+		logging.API.Error("Can't delete the configs of a binding", zap.String("bindingID", bindingID), logging.Error(err))
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Description: err.Error()})
+		return
+	}
+	logging.API.Info("Deleted binding", zap.String("instanceID", instanceID), zap.String("bindingID", bindingID),
+		zap.Int("configs", len(configs)), zap.String("identity", identity))
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+//credentials returns the hosts of the generated configs, so that applications know how to reach the service
+func credentials(configs []model.Config) map[string]interface{} {
+	hosts := []string{}
+	for _, c := range configs {
+		if virtualService, ok := c.Spec.(*networking.VirtualService); ok {
+			hosts = append(hosts, virtualService.Hosts...)
+		}
+	}
+	return map[string]interface{}{"hosts": hosts}
+}
+
+//hash identifies the parameters of a binding
+func (b *Binding) hash() (string, error) {
+	content, err := json.Marshal(b)
+	if err != nil {
+		return "", fmt.Errorf("invalid parameters: %v", err)
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logging.API.Warn("Can't write broker response", logging.Error(err))
+	}
+}
@@ -0,0 +1,177 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/store"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"istio.io/istio/pilot/pkg/model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tokenAuthenticator struct{}
+
+func (tokenAuthenticator) AuthenticateRequest(r *http.Request) (string, error) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		return "", errors.New("invalid bearer token")
+	}
+	return "service-manager", nil
+}
+
+const bindRequestBody = `{
+  "service_id": "pinger-service",
+  "plan_id": "default",
+  "parameters": {"host": "pinger.example.com", "address": "10.0.81.2", "port": 8081}
+}`
+
+func TestRender(t *testing.T) {
+	g := NewGomegaWithT(t)
+	bindingTemplate, err := LoadTemplate("../../test/broker/binding-template.yaml")
+	g.Expect(err).NotTo(HaveOccurred())
+	binding := &Binding{
+		InstanceID: "instance-1",
+		BindingID:  "binding-1",
+		Parameters: map[string]interface{}{"host": "pinger.example.com", "address": "10.0.81.2", "port": 8081},
+	}
+	configs, err := Render(bindingTemplate, binding)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configs).To(HaveLen(3))
+	g.Expect(configs[0].Type).To(Equal(model.Gateway.Type))
+	g.Expect(configs[0].Name).To(Equal("binding-binding-1-gateway"))
+	g.Expect(configs[1].Type).To(Equal(model.VirtualService.Type))
+	g.Expect(configs[2].Type).To(Equal(model.ServiceEntry.Type))
+
+	delete(binding.Parameters, "address")
+	_, err = Render(bindingTemplate, binding)
+	g.Expect(err).To(MatchError(ContainSubstring("address")))
+
+	// parameters are quoted and can't add keys or documents
+	binding.Parameters["address"] = "10.0.81.2"
+	binding.Parameters["host"] = "*"
+	configs, err = Render(bindingTemplate, binding)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configs).To(HaveLen(3))
+	binding.Parameters["host"] = "pinger.example.com\n---\napiVersion: networking.istio.io/v1alpha3\nkind: Gateway"
+	_, err = Render(bindingTemplate, binding)
+	g.Expect(err).To(MatchError(ContainSubstring("parameter host must not contain line breaks")))
+	binding.Parameters["host"] = []interface{}{"pinger.example.com", "other.example.com"}
+	_, err = Render(bindingTemplate, binding)
+	g.Expect(err).To(MatchError(ContainSubstring("parameter host must be a string, number or boolean")))
+	binding.Parameters["host"] = "pinger.example.com"
+	binding.BindingID = "binding-1\n  namespace: istio-system"
+	_, err = Render(bindingTemplate, binding)
+	g.Expect(err).To(MatchError(ContainSubstring("binding_id must not contain line breaks")))
+	binding.BindingID = "Binding_1"
+	_, err = Render(bindingTemplate, binding)
+	g.Expect(err).To(MatchError(ContainSubstring("invalid configs of binding Binding_1")))
+}
+
+func TestRenderDocuments(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "broker")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	load := func(content string) (*Template, error) {
+		file := filepath.Join(dir, "template.yaml")
+		g.Expect(ioutil.WriteFile(file, []byte(content), 0644)).To(Succeed())
+		return LoadTemplate(file)
+	}
+	const serviceEntry = "apiVersion: networking.istio.io/v1alpha3\nkind: ServiceEntry\nmetadata:\n  name: %s\n" +
+		"spec:\n  hosts: [binding.service]\n  ports: [{number: 80, name: http, protocol: HTTP}]\n"
+	document := func(name string) string {
+		return strings.Replace(serviceEntry, "%s", name, 1)
+	}
+
+	_, err = load("# comment\n---\n" + strings.Replace(document("a"), "kind: ServiceEntry", "kind: {{.PlanID}}", 1))
+	g.Expect(err).To(MatchError(ContainSubstring("has no kind")))
+	_, err = load("# comment\n")
+	g.Expect(err).To(MatchError(ContainSubstring("has no documents")))
+
+	// every document must result in one config of its kind
+	conditional, err := load("# comment\n---\n{{if eq .PlanID \"full\"}}\n" + document("a") + "{{end}}\n---\n" + document("b"))
+	g.Expect(err).NotTo(HaveOccurred())
+	configs, err := Render(conditional, &Binding{BindingID: "1", PlanID: "full"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configs).To(HaveLen(2))
+	_, err = Render(conditional, &Binding{BindingID: "1", PlanID: "default"})
+	g.Expect(err).To(MatchError(ContainSubstring("expected 2 configs, found 1")))
+
+	twice, err := load(document("a") + "---\n" + document("a"))
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = Render(twice, &Binding{BindingID: "1"})
+	g.Expect(err).To(MatchError(ContainSubstring("rendered twice")))
+}
+
+func TestBindAndUnbind(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "broker")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	configStore, err := store.Open(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	bindingTemplate, err := LoadTemplate("../../test/broker/binding-template.yaml")
+	g.Expect(err).NotTo(HaveOccurred())
+	mux := http.NewServeMux()
+	NewBroker(&Options{Store: configStore, Template: bindingTemplate, Authenticator: tokenAuthenticator{}}).RegisterHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	binding := server.URL + "/v2/service_instances/instance-1/service_bindings/binding-1"
+
+	call := func(method string, url string, body string, header bool) (int, map[string]interface{}) {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		request, err := http.NewRequest(method, url, reader)
+		g.Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("Authorization", "Bearer secret")
+		if header {
+			request.Header.Set(APIVersionHeader, "2.14")
+		}
+		response, err := http.DefaultClient.Do(request)
+		g.Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		result := make(map[string]interface{})
+		g.Expect(json.NewDecoder(response.Body).Decode(&result)).To(Succeed())
+		return response.StatusCode, result
+	}
+
+	status, _ := call(http.MethodPut, binding, bindRequestBody, false)
+	g.Expect(status).To(Equal(http.StatusPreconditionFailed))
+	status, response := call(http.MethodPut, binding, bindRequestBody, true)
+	g.Expect(status).To(Equal(http.StatusCreated))
+	g.Expect(response["credentials"]).To(Equal(map[string]interface{}{"hosts": []interface{}{"pinger.example.com"}}))
+	g.Expect(configStore.Select(BindingAnnotation, "binding-1")).To(HaveLen(3))
+
+	// binding again is idempotent unless the parameters differ
+	status, _ = call(http.MethodPut, binding, bindRequestBody, true)
+	g.Expect(status).To(Equal(http.StatusOK))
+	status, _ = call(http.MethodPut, binding, strings.Replace(bindRequestBody, "8081", "8082", 1), true)
+	g.Expect(status).To(Equal(http.StatusConflict))
+	status, _ = call(http.MethodPut, binding+"-2", `{"service_id": "pinger-service", "plan_id": "default", "parameters": {}}`, true)
+	g.Expect(status).To(Equal(http.StatusBadRequest))
+	g.Expect(configStore.Select(BindingAnnotation, "binding-1-2")).To(BeEmpty())
+
+	// bindings survive restarts
+	configStore, err = store.Open(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.Select(BindingAnnotation, "binding-1")).To(HaveLen(3))
+	mux = http.NewServeMux()
+	NewBroker(&Options{Store: configStore, Template: bindingTemplate, Authenticator: tokenAuthenticator{}}).RegisterHandlers(mux)
+	server.Config.Handler = mux
+
+	status, _ = call(http.MethodDelete, binding, "", true)
+	g.Expect(status).To(Equal(http.StatusBadRequest))
+	status, _ = call(http.MethodDelete, binding+"?service_id=pinger-service&plan_id=default", "", true)
+	g.Expect(status).To(Equal(http.StatusOK))
+	g.Expect(configStore.List(model.Gateway.Type, "")).To(BeEmpty())
+	status, _ = call(http.MethodDelete, binding+"?service_id=pinger-service&plan_id=default", "", true)
+	g.Expect(status).To(Equal(http.StatusGone))
+}
@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"io/ioutil"
+	"istio.io/istio/pilot/pkg/config/kube/crd"
+	"istio.io/istio/pilot/pkg/model"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+//kindPattern matches the kind of a YAML document of a template
+var kindPattern = regexp.MustCompile(`(?m)^kind:\s*(\S+)\s*$`)
+
+//Binding is the data the template of a binding is executed with
+type Binding struct {
+	InstanceID string
+	BindingID  string
+	ServiceID  string
+	PlanID     string
+	//Parameters are the arbitrary parameters of the bind request
+	Parameters map[string]interface{}
+	//Context is the platform specific context of the bind request, e.g. the space_guid in Cloud Foundry
+	Context map[string]interface{}
+}
+
+//Template renders the YAML documents of the configs of a binding
+type Template struct {
+	template *template.Template
+	//kinds are the kinds of the documents of the template in their order
+	kinds []string
+}
+
+//LoadTemplate reads a template rendering the YAML documents of the configs of a binding. Every document must
+//have a kind which isn't rendered. Referring to a missing parameter is an error.
+//Parameters must be inserted with the quote function, e.g. {{quote .Parameters.host}}.
+func LoadTemplate(file string) (*Template, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	t, err := template.New(filepath.Base(file)).Funcs(template.FuncMap{"quote": quote}).Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	var kinds []string
+	for i, document := range strings.Split("\n"+string(content), "\n---") {
+		if isEmptyDocument(document) {
+			continue
+		}
+		match := kindPattern.FindStringSubmatch(document)
+		if match == nil || strings.Contains(match[1], "{{") {
+			return nil, fmt.Errorf("template %s: document %d has no kind", file, i+1)
+		}
+		kinds = append(kinds, match[1])
+	}
+	if len(kinds) == 0 {
+		return nil, fmt.Errorf("template %s has no documents", file)
+	}
+	return &Template{template: t.Option("missingkey=error"), kinds: kinds}, nil
+}
+
+//Render executes the template with a binding and parses the resulting configs. Every document of the template
+//must result in one config of its kind, the configs must be valid and of the supported types.
+func Render(t *Template, binding *Binding) ([]model.Config, error) {
+	if err := binding.validate(); err != nil {
+		return nil, fmt.Errorf("invalid binding %s: %v", binding.BindingID, err)
+	}
+	var out bytes.Buffer
+	if err := t.template.Execute(&out, binding); err != nil {
+		return nil, fmt.Errorf("can't render the configs of binding %s: %v", binding.BindingID, err)
+	}
+	configs, others, err := crd.ParseInputs(out.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid configs of binding %s: %v", binding.BindingID, err)
+	}
+	if len(others) > 0 {
+		return nil, fmt.Errorf("invalid configs of binding %s: kind %s is not supported", binding.BindingID, others[0].Kind)
+	}
+	if len(configs) != len(t.kinds) {
+		return nil, fmt.Errorf("invalid configs of binding %s: expected %d configs, found %d", binding.BindingID, len(t.kinds), len(configs))
+	}
+	supported := make(map[string]bool)
+	for _, ctype := range config.Types() {
+		supported[ctype] = true
+	}
+	names := make(map[string]bool)
+	for i, c := range configs {
+		if !supported[c.Type] {
+			return nil, fmt.Errorf("invalid configs of binding %s: type %s is not supported", binding.BindingID, c.Type)
+		}
+		if kind := crd.KebabCaseToCamelCase(c.Type); kind != t.kinds[i] {
+			return nil, fmt.Errorf("invalid configs of binding %s: expected kind %s, found %s", binding.BindingID, t.kinds[i], kind)
+		}
+		if problems := validation.IsDNS1123Subdomain(c.Name); len(problems) > 0 {
+			return nil, fmt.Errorf("invalid configs of binding %s: invalid name %q: %s", binding.BindingID, c.Name, strings.Join(problems, ", "))
+		}
+		if names[c.Type+"/"+c.Name] {
+			return nil, fmt.Errorf("invalid configs of binding %s: %s %s is rendered twice", binding.BindingID, c.Type, c.Name)
+		}
+		names[c.Type+"/"+c.Name] = true
+	}
+	return configs, nil
+}
+
+//validate returns an error if a value of the binding could change the structure of the rendered documents.
+//Parameters and context values must be scalars, no value must contain line breaks.
+func (b *Binding) validate() error {
+	ids := map[string]string{"instance_id": b.InstanceID, "binding_id": b.BindingID, "service_id": b.ServiceID, "plan_id": b.PlanID}
+	for name, id := range ids {
+		if strings.ContainsAny(id, "\r\n") {
+			return fmt.Errorf("%s must not contain line breaks", name)
+		}
+	}
+	for _, values := range []struct {
+		name   string
+		values map[string]interface{}
+	}{{"parameter", b.Parameters}, {"context value", b.Context}} {
+		for key, value := range values.values {
+			switch v := value.(type) {
+			case string:
+				if strings.ContainsAny(v, "\r\n") {
+					return fmt.Errorf("%s %s must not contain line breaks", values.name, key)
+				}
+			case bool, float64, int, nil:
+			default:
+				return fmt.Errorf("%s %s must be a string, number or boolean", values.name, key)
+			}
+		}
+	}
+	return nil
+}
+
+//quote encodes a scalar as JSON, which is a YAML scalar of the same value
+func quote(value interface{}) (string, error) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+//isEmptyDocument returns true if a YAML document consists of comments and blank lines only
+func isEmptyDocument(document string) bool {
+	for _, line := range strings.Split(document, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
+}
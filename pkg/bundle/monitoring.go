@@ -0,0 +1,59 @@
+package bundle
+
+import (
+	"context"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"time"
+)
+
+//Results of a fetch of the bundle
+const (
+	resultUpdated          = "updated"
+	resultNotModified      = "not_modified"
+	resultFailed           = "failed"
+	resultInvalidSignature = "invalid_signature"
+)
+
+var (
+	fetches = stats.Int64(
+		"bundle/fetches_total",
+		"Number of fetches of the config bundle by result.",
+		stats.UnitDimensionless)
+
+	lastVerified = stats.Int64(
+		"bundle/last_verified_timestamp_seconds",
+		"Unix time of the latest fetch which returned a verified or unmodified bundle.",
+		"s")
+
+	//ResultTag holds the result of a fetch for the context
+	ResultTag tag.Key
+)
+
+func init() {
+	var err error
+	if ResultTag, err = tag.NewKey("result"); err != nil {
+		panic(err)
+	}
+	err = view.Register(
+		&view.View{Measure: fetches, Name: fetches.Name(), Description: fetches.Description(), Aggregation: view.Count(), TagKeys: []tag.Key{ResultTag}},
+		&view.View{Measure: lastVerified, Name: lastVerified.Name(), Description: lastVerified.Description(), Aggregation: view.LastValue()},
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func recordFetch(result string, now time.Time) {
+	ctx, err := tag.New(context.Background(), tag.Insert(ResultTag, result))
+	if err != nil {
+		logging.Watcher.Error("Can't create monitoring context", logging.Error(err))
+		return
+	}
+	stats.Record(ctx, fetches.M(1))
+	if result == resultUpdated || result == resultNotModified {
+		stats.Record(context.Background(), lastVerified.M(now.Unix()))
+	}
+}
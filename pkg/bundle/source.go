@@ -0,0 +1,357 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//maxBundleSize limits the size of a bundle, both compressed and unpacked
+	maxBundleSize = 64 * 1024 * 1024
+	//maxSignatureSize limits the size of a signature, which is 64 bytes raw or 88 bytes base64 encoded
+	maxSignatureSize = 1024
+	//requestTimeout limits the duration of a request for the bundle or its signature
+	requestTimeout = time.Minute
+)
+
+//Options configures a bundle Source
+type Options struct {
+	//URL of the bundle, either a tar.gz archive of YAML and JSON files or a multi-document YAML file
+	URL string
+	//SignatureURL of the detached ed25519 signature of the bundle, URL with suffix .sig if empty
+	SignatureURL string
+	//PublicKey the signature is verified with
+	PublicKey ed25519.PublicKey
+	//PollInterval is the interval in which the bundle is fetched
+	PollInterval time.Duration
+}
+
+//Source reads istio configs from a bundle served over http. A bundle is only read if its signature is valid,
+//the configs of the latest verified bundle are kept while the bundle can't be fetched or verified.
+//Unmodified bundles are detected with ETag and Last-Modified headers.
+type Source struct {
+	options Options
+	name    string
+	client  *http.Client
+
+	//mutex serializes the fetches and guards the fields below
+	mutex        sync.Mutex
+	fetched      bool
+	etag         string
+	lastModified string
+	//set and setErr are the result of parsing the latest verified bundle
+	set    *config.ConfigSet
+	setErr error
+	//err is the error of the latest fetch and failingSince the time of the first failed fetch after the last
+	//successful one. They are written with errMutex held too, so that Err and Ready don't wait for a fetch.
+	err          error
+	failingSince time.Time
+	errMutex     sync.Mutex
+}
+
+//Ensure that Source can be served by a config watcher
+var _ config.Source = &Source{}
+
+//NewSource creates a Source. The bundle is fetched on the first Read.
+func NewSource(options *Options) (*Source, error) {
+	u, err := url.Parse(options.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("bundle url must be an http or https url")
+	}
+	if len(options.PublicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("bundle public key is required")
+	}
+	if options.PollInterval <= 0 {
+		return nil, errors.New("bundle poll interval must be positive")
+	}
+	s := &Source{
+		options: *options,
+		client:  &http.Client{Timeout: requestTimeout},
+	}
+	if s.options.SignatureURL == "" {
+		// the suffix belongs to the path, the query is kept
+		signatureURL := *u
+		signatureURL.Path += ".sig"
+		if signatureURL.RawPath != "" {
+			signatureURL.RawPath += ".sig"
+		}
+		s.options.SignatureURL = signatureURL.String()
+	}
+	// credentials of the url must not be logged
+	u.User = nil
+	s.name = u.String()
+	return s, nil
+}
+
+//LoadPublicKey reads a base64 encoded ed25519 public key from a file
+func LoadPublicKey(filename string) (ed25519.PublicKey, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key file %s: %v", filename, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key file %s: expected %d bytes, found %d", filename, ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+//Name returns the URL of the bundle without credentials
+func (s *Source) Name() string {
+	return s.name
+}
+
+//Read returns the configs of the latest verified bundle, they are kept while the bundle can't be fetched or
+//verified. The error of the latest fetch is only returned until a bundle was verified, failed fetches are
+//reported by Err and the fetch metrics instead.
+func (s *Source) Read() (*config.ConfigSet, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.fetched {
+		s.fetch()
+	}
+	if s.set == nil && s.setErr == nil {
+		return nil, s.err
+	}
+	return s.set, s.setErr
+}
+
+//Err returns the error of the latest fetch, nil if it succeeded or no fetch was done yet
+func (s *Source) Err() error {
+	s.errMutex.Lock()
+	defer s.errMutex.Unlock()
+	return s.err
+}
+
+//Ready returns an error if the bundle couldn't be fetched for longer than maxFailure. Zero fails on the first
+//failed fetch.
+func (s *Source) Ready(maxFailure time.Duration, now time.Time) error {
+	s.errMutex.Lock()
+	defer s.errMutex.Unlock()
+	if s.err == nil || now.Sub(s.failingSince) < maxFailure {
+		return nil
+	}
+	return fmt.Errorf("bundle can't be fetched since %s: %v", s.failingSince.Format(time.RFC3339), s.err)
+}
+
+//Watch fetches the bundle in the poll interval and calls changed if a new bundle was verified or if the
+//first bundle can't be fetched
+func (s *Source) Watch(changed func(), stop <-chan struct{}) error {
+	go func() {
+		ticker := time.NewTicker(s.options.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.mutex.Lock()
+				updated := s.fetch()
+				s.mutex.Unlock()
+				if updated {
+					changed()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+//fetch requests the bundle and returns true if the result of Read changed. It must be called with the mutex held.
+func (s *Source) fetch() bool {
+	s.fetched = true
+	previous := s.err
+	result, err := s.download()
+	recordFetch(result, time.Now())
+	s.errMutex.Lock()
+	if err != nil && s.err == nil {
+		s.failingSince = time.Now()
+	}
+	s.err = err
+	s.errMutex.Unlock()
+	if err != nil {
+		logging.Watcher.Warn("Can't fetch config bundle", zap.String("url", s.name), zap.String("result", result), logging.Error(err))
+	}
+	verified := s.set != nil || s.setErr != nil
+	return result == resultUpdated || !verified && (previous == nil) != (err == nil)
+}
+
+//download fetches and verifies the bundle and its signature. Verified bundles are parsed and returned by Read.
+func (s *Source) download() (string, error) {
+	request, err := http.NewRequest(http.MethodGet, s.options.URL, nil)
+	if err != nil {
+		return resultFailed, err
+	}
+	if s.set != nil || s.setErr != nil {
+		if s.etag != "" {
+			request.Header.Set("If-None-Match", s.etag)
+		}
+		if s.lastModified != "" {
+			request.Header.Set("If-Modified-Since", s.lastModified)
+		}
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return resultFailed, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified {
+		return resultNotModified, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return resultFailed, fmt.Errorf("bundle request failed with status %s", response.Status)
+	}
+	content, err := readAll(response.Body, maxBundleSize)
+	if err != nil {
+		return resultFailed, fmt.Errorf("can't read bundle: %v", err)
+	}
+	signature, err := s.signature()
+	if err != nil {
+		return resultFailed, err
+	}
+	if !ed25519.Verify(s.options.PublicKey, content, signature) {
+		return resultInvalidSignature, errors.New("signature of the bundle is invalid")
+	}
+	s.etag = response.Header.Get("ETag")
+	s.lastModified = response.Header.Get("Last-Modified")
+	sum := sha256.Sum256(content)
+	revision := hex.EncodeToString(sum[:6])
+	if s.set != nil && s.set.Revision == revision {
+		return resultNotModified, nil
+	}
+	s.set, s.setErr = parseBundle(s.bundleName(), content)
+	if s.set != nil {
+		s.set.Revision = revision
+	}
+	logging.Watcher.Info("Fetched config bundle", zap.String("url", s.name), zap.String("revision", revision),
+		zap.Int("size", len(content)))
+	return resultUpdated, nil
+}
+
+//signature fetches the detached signature, either raw or base64 encoded
+func (s *Source) signature() ([]byte, error) {
+	response, err := s.client.Get(s.options.SignatureURL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("signature request failed with status %s", response.Status)
+	}
+	content, err := readAll(response.Body, maxSignatureSize)
+	if err != nil {
+		return nil, fmt.Errorf("can't read signature: %v", err)
+	}
+	if len(content) == ed25519.SignatureSize {
+		return content, nil
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return nil, errors.New("signature of the bundle is malformed")
+	}
+	return signature, nil
+}
+
+//bundleName is the file name configs of a multi-document YAML bundle are reported with
+func (s *Source) bundleName() string {
+	if u, err := url.Parse(s.options.URL); err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+		return path.Base(u.Path)
+	}
+	return "bundle.yaml"
+}
+
+//parseBundle parses a tar.gz archive or a multi-document YAML file. The configs are only returned if all files are valid.
+func parseBundle(name string, content []byte) (*config.ConfigSet, error) {
+	set := &config.ConfigSet{Files: make(map[string]string)}
+	add := func(file string, content []byte) error {
+		sum := sha256.Sum256(content)
+		set.Files[file] = hex.EncodeToString(sum[:])
+		configs, err := config.ParseConfigs(file, content)
+		if err != nil {
+			return err
+		}
+		set.Configs = append(set.Configs, configs...)
+		return nil
+	}
+	if !bytes.HasPrefix(content, []byte{0x1f, 0x8b}) {
+		if err := add(name, content); err != nil {
+			return nil, err
+		}
+		return set, nil
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, config.NewValidationError(name, fmt.Errorf("invalid bundle archive: %v", err))
+	}
+	archive := tar.NewReader(&io.LimitedReader{R: gzipReader, N: maxBundleSize})
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return set, nil
+		}
+		if err != nil {
+			return nil, config.NewValidationError(name, fmt.Errorf("invalid bundle archive: %v", err))
+		}
+		file := strings.TrimPrefix(path.Clean(header.Name), "/")
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA || !isConfigFile(file) {
+			continue
+		}
+		fileContent, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, config.NewValidationError(file, fmt.Errorf("invalid bundle archive: %v", err))
+		}
+		if err := add(file, fileContent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+//isConfigFile returns true for YAML and JSON files which aren't hidden
+func isConfigFile(file string) bool {
+	for _, part := range strings.Split(file, "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	switch path.Ext(file) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+//readAll reads at most limit bytes and fails if the reader has more
+func readAll(reader io.Reader, limit int64) ([]byte, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > limit {
+		return nil, fmt.Errorf("exceeds %d bytes", limit)
+	}
+	return content, nil
+}
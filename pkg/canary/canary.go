@@ -0,0 +1,160 @@
+package canary
+
+import (
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/server"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"sync"
+	"time"
+)
+
+//Options configures a Controller
+type Options struct {
+	Selector *Selector
+	//Soak is the time all canaries must have ACKed a version before it is promoted
+	Soak time.Duration
+}
+
+//Target serves new versions to canaries first
+type Target interface {
+	Canary() *config.Canary
+	Promote(version int) error
+	Halt(version int, reason string) error
+}
+
+//Status describes the canary rollout in progress
+type Status struct {
+	//Canary is the rollout in progress, nil if there is none
+	Canary *config.Canary `json:"canary"`
+	//Sinks are the connected canaries
+	Sinks []server.SinkStatus `json:"sinks"`
+	//AckedAt is the time since which all canaries have ACKed the version, nil if they haven't
+	AckedAt *time.Time `json:"ackedAt,omitempty"`
+}
+
+//Controller promotes a canary rollout once all connected canary sinks ACKed it, or skipped it because it didn't
+//change their resources, and the soak time passed.
+//It halts the rollout as soon as a canary NACKs it. Without connected canaries a version is promoted after the soak time.
+type Controller struct {
+	options Options
+	sinks   func() []server.SinkStatus
+	target  Target
+
+	mutex        sync.Mutex
+	ackedVersion int
+	ackedAt      time.Time
+}
+
+//NewController creates a Controller evaluating the sink status returned by sinks
+func NewController(options *Options, sinks func() []server.SinkStatus, target Target) *Controller {
+	return &Controller{
+		options: *options,
+		sinks:   sinks,
+		target:  target,
+	}
+}
+
+//Run evaluates the rollout every interval until stop is closed
+func (c *Controller) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.evaluate(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (c *Controller) evaluate(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	canary := c.target.Canary()
+	if canary == nil || canary.Halted {
+		return
+	}
+	acked := true
+	for _, sink := range c.canaries() {
+		for collection, status := range sink.Collections {
+			version := canary.Snapshot.Version(collection)
+			if version == "" {
+				continue
+			}
+			if status.LastNack != nil && status.LastNack.Version == version && status.AckedVersion != version {
+				reason := fmt.Sprintf("sink %s NACKed version %s of collection %s: %s", sink.NodeID, version, collection, status.LastNack.Message)
+				if err := c.target.Halt(canary.Version, reason); err != nil {
+					logging.Snapshot.Error("Can't halt canary rollout", logging.Version(canary.Version), logging.Error(err))
+				}
+				return
+			}
+			if status.AckedVersion != version && status.SkippedVersion != version {
+				acked = false
+			}
+		}
+	}
+	if !acked {
+		c.ackedVersion = 0
+		return
+	}
+	if c.ackedVersion != canary.Version {
+		c.ackedVersion = canary.Version
+		c.ackedAt = now
+	}
+	if now.Sub(c.ackedAt) < c.options.Soak {
+		return
+	}
+	if err := c.target.Promote(canary.Version); err != nil {
+		logging.Snapshot.Error("Can't promote canary rollout", logging.Version(canary.Version), logging.Error(err))
+	}
+}
+
+//canaries returns the status of the connected sinks matching the selector
+func (c *Controller) canaries() []server.SinkStatus {
+	var result []server.SinkStatus
+	for _, sink := range c.sinks() {
+		if c.options.Selector.Matches(&mcp.SinkNode{Id: sink.NodeID, Annotations: sink.Annotations}) {
+			result = append(result, sink)
+		}
+	}
+	return result
+}
+
+//Status returns the rollout in progress and the connected canaries
+func (c *Controller) Status() Status {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	status := Status{
+		Canary: c.target.Canary(),
+		Sinks:  c.canaries(),
+	}
+	if status.Sinks == nil {
+		status.Sinks = []server.SinkStatus{}
+	}
+	if status.Canary != nil && c.ackedVersion == status.Canary.Version {
+		ackedAt := c.ackedAt
+		status.AckedAt = &ackedAt
+	}
+	return status
+}
+
+//Promote serves the version of the rollout in progress to all sinks without waiting for the canaries
+func (c *Controller) Promote() error {
+	canary := c.target.Canary()
+	if canary == nil {
+		return fmt.Errorf("no canary rollout in progress")
+	}
+	return c.target.Promote(canary.Version)
+}
+
+//Halt stops the rollout in progress
+func (c *Controller) Halt(reason string) error {
+	canary := c.target.Canary()
+	if canary == nil {
+		return fmt.Errorf("no canary rollout in progress")
+	}
+	return c.target.Halt(canary.Version, reason)
+}
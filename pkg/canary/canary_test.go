@@ -0,0 +1,112 @@
+package canary
+
+import (
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/server"
+	. "github.com/onsi/gomega"
+	"istio.io/istio/pkg/mcp/snapshot"
+	"testing"
+	"time"
+)
+
+const collection = "test/collection"
+
+type fakeTarget struct {
+	canary   *config.Canary
+	promoted int
+}
+
+func (f *fakeTarget) Canary() *config.Canary {
+	return f.canary
+}
+
+func (f *fakeTarget) Promote(version int) error {
+	f.promoted = version
+	f.canary = nil
+	return nil
+}
+
+func (f *fakeTarget) Halt(version int, reason string) error {
+	f.canary.Halted = true
+	f.canary.Reason = reason
+	return nil
+}
+
+func newFakeTarget(version int) *fakeTarget {
+	builder := snapshot.NewInMemoryBuilder()
+	builder.SetVersion(collection, "2.0")
+	return &fakeTarget{canary: &config.Canary{Version: version, StartedAt: time.Now(), Snapshot: builder.Build()}}
+}
+
+func sink(nodeID string, acked string, nacked string) server.SinkStatus {
+	status := &server.CollectionStatus{AckedVersion: acked}
+	if nacked != "" {
+		status.LastNack = &server.Nack{Version: nacked, Message: "invalid"}
+	}
+	return server.SinkStatus{NodeID: nodeID, Collections: map[string]*server.CollectionStatus{collection: status}}
+}
+
+func newTestController(g *GomegaWithT, target Target, sinks *[]server.SinkStatus) *Controller {
+	selector, err := ParseSelector("^canary-", "")
+	g.Expect(err).NotTo(HaveOccurred())
+	return NewController(&Options{Selector: selector, Soak: time.Minute}, func() []server.SinkStatus { return *sinks }, target)
+}
+
+func TestPromoteAfterSoak(t *testing.T) {
+	g := NewGomegaWithT(t)
+	target := newFakeTarget(2)
+	sinks := []server.SinkStatus{sink("canary-1", "1.0", ""), sink("pilot-1", "1.0", "")}
+	controller := newTestController(g, target, &sinks)
+	now := time.Now()
+
+	controller.evaluate(now)
+	g.Expect(controller.Status().AckedAt).To(BeNil())
+	sinks[0] = sink("canary-1", "2.0", "")
+	controller.evaluate(now)
+	g.Expect(controller.Status().AckedAt).NotTo(BeNil())
+	g.Expect(controller.Status().Sinks).To(HaveLen(1))
+	controller.evaluate(now.Add(30 * time.Second))
+	g.Expect(target.promoted).To(BeZero())
+	controller.evaluate(now.Add(time.Minute))
+	g.Expect(target.promoted).To(Equal(2))
+}
+
+func TestPromoteSkippedByCanaries(t *testing.T) {
+	g := NewGomegaWithT(t)
+	target := newFakeTarget(2)
+	sinks := []server.SinkStatus{sink("canary-1", "1.0", ""), sink("canary-2", "2.0", "")}
+	controller := newTestController(g, target, &sinks)
+	now := time.Now()
+
+	controller.evaluate(now)
+	g.Expect(controller.Status().AckedAt).To(BeNil())
+	sinks[0].Collections[collection].SkippedVersion = "2.0"
+	controller.evaluate(now)
+	controller.evaluate(now.Add(time.Minute))
+	g.Expect(target.promoted).To(Equal(2))
+}
+
+func TestHaltOnNack(t *testing.T) {
+	g := NewGomegaWithT(t)
+	target := newFakeTarget(2)
+	sinks := []server.SinkStatus{sink("canary-1", "1.0", "2.0"), sink("pilot-1", "1.0", "")}
+	controller := newTestController(g, target, &sinks)
+
+	controller.evaluate(time.Now())
+	g.Expect(target.canary.Halted).To(BeTrue())
+	g.Expect(target.canary.Reason).To(ContainSubstring("canary-1"))
+	controller.evaluate(time.Now().Add(time.Hour))
+	g.Expect(target.promoted).To(BeZero())
+}
+
+func TestIgnoreNacksOfOtherSinks(t *testing.T) {
+	g := NewGomegaWithT(t)
+	target := newFakeTarget(2)
+	sinks := []server.SinkStatus{sink("canary-1", "2.0", ""), sink("pilot-1", "1.0", "2.0")}
+	controller := newTestController(g, target, &sinks)
+
+	now := time.Now()
+	controller.evaluate(now)
+	controller.evaluate(now.Add(time.Minute))
+	g.Expect(target.promoted).To(Equal(2))
+}
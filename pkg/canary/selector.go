@@ -0,0 +1,72 @@
+package canary
+
+import (
+	"fmt"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"regexp"
+	"strings"
+)
+
+//Selector selects canary sinks by their node id and annotations
+type Selector struct {
+	//NodeID must match the node id of a canary if set
+	NodeID *regexp.Regexp
+	//Annotations must all be set on the node of a canary
+	Annotations map[string]string
+}
+
+//ParseSelector creates a Selector from a node id regular expression and a comma separated list of
+//key=value annotations. Both may be empty.
+func ParseSelector(nodeID string, annotations string) (*Selector, error) {
+	pairs := make(map[string]string)
+	for _, annotation := range strings.Split(annotations, ",") {
+		annotation = strings.TrimSpace(annotation)
+		if annotation == "" {
+			continue
+		}
+		pair := strings.SplitN(annotation, "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return nil, fmt.Errorf("invalid annotation %q, expected key=value", annotation)
+		}
+		pairs[pair[0]] = pair[1]
+	}
+	return NewSelector(nodeID, pairs)
+}
+
+//NewSelector creates a Selector from a node id regular expression and the annotations a canary must have.
+//Both may be empty.
+func NewSelector(nodeID string, annotations map[string]string) (*Selector, error) {
+	selector := &Selector{Annotations: make(map[string]string)}
+	if nodeID != "" {
+		expression, err := regexp.Compile(nodeID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node id expression %q: %v", nodeID, err)
+		}
+		selector.NodeID = expression
+	}
+	for key, value := range annotations {
+		selector.Annotations[key] = value
+	}
+	return selector, nil
+}
+
+//Empty returns true if the selector selects no sink at all
+func (s *Selector) Empty() bool {
+	return s.NodeID == nil && len(s.Annotations) == 0
+}
+
+//Matches returns true if node is a canary
+func (s *Selector) Matches(node *mcp.SinkNode) bool {
+	if node == nil || s.Empty() {
+		return false
+	}
+	if s.NodeID != nil && !s.NodeID.MatchString(node.Id) {
+		return false
+	}
+	for key, value := range s.Annotations {
+		if node.Annotations[key] != value {
+			return false
+		}
+	}
+	return true
+}
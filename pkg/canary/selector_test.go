@@ -0,0 +1,53 @@
+package canary
+
+import (
+	. "github.com/onsi/gomega"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	g := NewGomegaWithT(t)
+	selector, err := ParseSelector("^pilot-canary-", "canary=true, zone=eu-1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(selector.Empty()).To(BeFalse())
+	g.Expect(selector.Annotations).To(Equal(map[string]string{"canary": "true", "zone": "eu-1"}))
+
+	selector, err = ParseSelector("", "")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(selector.Empty()).To(BeTrue())
+
+	_, err = ParseSelector("(", "")
+	g.Expect(err).To(HaveOccurred())
+	_, err = ParseSelector("", "canary")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestSelectorMatches(t *testing.T) {
+	g := NewGomegaWithT(t)
+	selector, err := ParseSelector("^pilot-canary-", "canary=true")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(selector.Matches(&mcp.SinkNode{Id: "pilot-canary-1", Annotations: map[string]string{"canary": "true"}})).To(BeTrue())
+	g.Expect(selector.Matches(&mcp.SinkNode{Id: "pilot-canary-1"})).To(BeFalse())
+	g.Expect(selector.Matches(&mcp.SinkNode{Id: "pilot-1", Annotations: map[string]string{"canary": "true"}})).To(BeFalse())
+	g.Expect(selector.Matches(nil)).To(BeFalse())
+
+	empty, err := ParseSelector("", "")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(empty.Matches(&mcp.SinkNode{Id: "pilot-1"})).To(BeFalse())
+}
+
+func TestNewSelector(t *testing.T) {
+	g := NewGomegaWithT(t)
+	annotations := map[string]string{"canary": "true"}
+	selector, err := NewSelector("^pilot-canary-", annotations)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(selector.Matches(&mcp.SinkNode{Id: "pilot-canary-1", Annotations: annotations})).To(BeTrue())
+
+	selector, err = NewSelector("", nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(selector.Empty()).To(BeTrue())
+
+	_, err = NewSelector("(", nil)
+	g.Expect(err).To(HaveOccurred())
+}
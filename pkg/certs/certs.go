@@ -0,0 +1,197 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//ClientIdentity is the SAN URI of the generated client certificate
+const ClientIdentity = "spiffe://cluster.local/ns/istio-system/sa/istio-pilot-service-account"
+
+const validity = 365 * 24 * time.Hour
+
+//Files are the paths of a generated CA and the server and client certificates it issued
+type Files struct {
+	CACert     string
+	CAKey      string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+}
+
+//NewFiles returns the paths of the certificates in dir
+func NewFiles(dir string) *Files {
+	return &Files{
+		CACert:     filepath.Join(dir, "ca.crt"),
+		CAKey:      filepath.Join(dir, "ca.key"),
+		ServerCert: filepath.Join(dir, "mcp.crt"),
+		ServerKey:  filepath.Join(dir, "mcp.key"),
+		ClientCert: filepath.Join(dir, "client.crt"),
+		ClientKey:  filepath.Join(dir, "client.key"),
+	}
+}
+
+//Generate creates a throwaway CA and server and client certificates issued by it in dir.
+//The server certificate is valid for hosts, which may be DNS names or IP addresses.
+//Certificates generated before are kept as long as they are valid for at least another day,
+//so that configured clients keep working across restarts.
+//It returns true if new certificates were generated.
+func Generate(dir string, hosts []string) (*Files, bool, error) {
+	files := NewFiles(dir)
+	if files.valid(hosts, time.Now().Add(24*time.Hour)) {
+		return files, false, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, false, err
+	}
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, false, err
+	}
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "service-manager-istio-mcp-server development CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caCert, err := create(caTemplate, caTemplate, caKey, caKey, files.CACert, files.CAKey)
+	if err != nil {
+		return nil, false, err
+	}
+
+	serverTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "mcp-server"},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+		} else {
+			serverTemplate.DNSNames = append(serverTemplate.DNSNames, host)
+		}
+	}
+	if _, err := issue(serverTemplate, caCert, caKey, files.ServerCert, files.ServerKey); err != nil {
+		return nil, false, err
+	}
+
+	clientID, err := url.Parse(ClientIdentity)
+	if err != nil {
+		return nil, false, err
+	}
+	clientTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "istio-pilot"},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		URIs:        []*url.URL{clientID},
+	}
+	if _, err := issue(clientTemplate, caCert, caKey, files.ClientCert, files.ClientKey); err != nil {
+		return nil, false, err
+	}
+	return files, true, nil
+}
+
+//PilotConfig returns the config source of a pilot mesh config for the MCP server at address using the
+//client certificate
+func (f *Files) PilotConfig(address string) string {
+	return strings.Join([]string{
+		"config_sources:",
+		"- address: " + address,
+		"  tls_settings:",
+		"    mode: MUTUAL",
+		"    client_certificate: " + f.ClientCert,
+		"    private_key: " + f.ClientKey,
+		"    ca_certificates: " + f.CACert,
+		"",
+	}, "\n")
+}
+
+//valid returns true if all certificates exist, chain up to the CA and are valid until notAfter
+func (f *Files) valid(hosts []string, notAfter time.Time) bool {
+	ca, err := tls.LoadX509KeyPair(f.CACert, f.CAKey)
+	if err != nil {
+		return false
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return false
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	verify := func(certFile string, keyFile string, usage x509.ExtKeyUsage, hosts []string) bool {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return false
+		}
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil || cert.NotAfter.Before(notAfter) {
+			return false
+		}
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{usage}}); err != nil {
+			return false
+		}
+		for _, host := range hosts {
+			if cert.VerifyHostname(host) != nil {
+				return false
+			}
+		}
+		return true
+	}
+	return caCert.NotAfter.After(notAfter) &&
+		verify(f.ServerCert, f.ServerKey, x509.ExtKeyUsageServerAuth, hosts) &&
+		verify(f.ClientCert, f.ClientKey, x509.ExtKeyUsageClientAuth, nil)
+}
+
+func issue(template *x509.Certificate, ca *x509.Certificate, caKey *ecdsa.PrivateKey, certFile string, keyFile string) (*x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return create(template, ca, key, caKey, certFile, keyFile)
+}
+
+func create(template *x509.Certificate, parent *x509.Certificate, key *ecdsa.PrivateKey, parentKey *ecdsa.PrivateKey,
+	certFile string, keyFile string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't create certificate %s: %v", certFile, err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
@@ -0,0 +1,68 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "certs")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	dir = filepath.Join(dir, "certs")
+
+	files, generated, err := Generate(dir, []string{"localhost", "127.0.0.1"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(generated).To(BeTrue())
+	info, err := os.Stat(files.ServerKey)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+	ca, err := ioutil.ReadFile(files.CACert)
+	g.Expect(err).NotTo(HaveOccurred())
+	roots := x509.NewCertPool()
+	g.Expect(roots.AppendCertsFromPEM(ca)).To(BeTrue())
+
+	server := leaf(g, files.ServerCert, files.ServerKey)
+	_, err = server.Verify(x509.VerifyOptions{Roots: roots, DNSName: "localhost"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(server.IPAddresses[0].Equal(net.ParseIP("127.0.0.1"))).To(BeTrue())
+
+	client := leaf(g, files.ClientCert, files.ClientKey)
+	_, err = client.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(client.URIs[0].String()).To(Equal(ClientIdentity))
+
+	_, generated, err = Generate(dir, []string{"localhost"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(generated).To(BeFalse())
+	g.Expect(leaf(g, files.ServerCert, files.ServerKey).SerialNumber).To(Equal(server.SerialNumber))
+
+	_, generated, err = Generate(dir, []string{"mcp.example.com"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(generated).To(BeTrue())
+	g.Expect(leaf(g, files.ServerCert, files.ServerKey).DNSNames).To(Equal([]string{"mcp.example.com"}))
+}
+
+func TestPilotConfig(t *testing.T) {
+	g := NewGomegaWithT(t)
+	config := NewFiles("/certs").PilotConfig("host.docker.internal:18000")
+	g.Expect(config).To(ContainSubstring("- address: host.docker.internal:18000"))
+	g.Expect(config).To(ContainSubstring("client_certificate: /certs/client.crt"))
+	g.Expect(config).To(ContainSubstring("ca_certificates: /certs/ca.crt"))
+}
+
+func leaf(g *GomegaWithT, certFile string, keyFile string) *x509.Certificate {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	g.Expect(err).NotTo(HaveOccurred())
+	return cert
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"go.uber.org/zap"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"istio.io/istio/pkg/mcp/snapshot"
+	"time"
+)
+
+const (
+	//DefaultGroup is the group of all sinks which are no canaries
+	DefaultGroup = "default"
+	//CanaryGroup is the group of the sinks selected by Options.Canary
+	CanaryGroup = "canary"
+)
+
+//Canary describes a new version of the config directory which is only served to the canary sinks
+type Canary struct {
+	//Version of the config directory served to the canaries
+	Version   int       `json:"version"`
+	StartedAt time.Time `json:"startedAt"`
+	//Halted is set if the rollout was stopped. The canaries are served the stable snapshot again.
+	Halted bool   `json:"halted"`
+	Reason string `json:"reason,omitempty"`
+	//Snapshot is the snapshot of the new version
+	Snapshot snapshot.Snapshot `json:"-"`
+}
+
+//groupIndex assigns sinks matching the canary selector to the CanaryGroup
+func (o *Options) groupIndex(collection string, node *mcp.SinkNode) string {
+	if o.Canary != nil && o.Canary(node) {
+		return CanaryGroup
+	}
+	return DefaultGroup
+}
+
+//Canary returns the rollout in progress, nil if all sinks are served the same snapshot
+func (c *configWatcher) Canary() *Canary {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.canary == nil {
+		return nil
+	}
+	canary := *c.canary
+	return &canary
+}
+
+//Promote serves version of a canary rollout to all sinks
+func (c *configWatcher) Promote(version int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.checkCanary(version); err != nil {
+		return err
+	}
+	logging.Snapshot.Info("Promoting canary version to all sinks", logging.Version(version))
+	c.stable = c.latest
+	c.canary = nil
+	c.publish()
+	return nil
+}
+
+//Halt stops the canary rollout of version until a new version is read or it is promoted manually
+func (c *configWatcher) Halt(version int, reason string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.checkCanary(version); err != nil {
+		return err
+	}
+	if c.canary.Halted {
+		return nil
+	}
+	logging.Snapshot.Warn("Halting canary rollout", logging.Version(version), zap.String("reason", reason))
+	c.canary.Halted = true
+	c.canary.Reason = reason
+	c.publish()
+	return nil
+}
+
+func (c *configWatcher) checkCanary(version int) error {
+	if c.canary == nil {
+		return fmt.Errorf("no canary rollout in progress")
+	}
+	if c.canary.Version != version {
+		return fmt.Errorf("canary rollout of version %d was replaced by version %d", version, c.canary.Version)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"istio.io/istio/galley/pkg/metadata"
+	"istio.io/istio/pkg/mcp/source"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCanaryRollout(t *testing.T) {
+	g := NewGomegaWithT(t)
+	serviceEntries := metadata.IstioNetworkingV1alpha3Serviceentries.Collection.String()
+	cwd, err := os.Getwd()
+	g.Expect(err).NotTo(HaveOccurred())
+	dir, err := ioutil.TempDir(cwd, "service-manager-istio-mcp-server")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	err = os.Link("../../test/config/istio-pinger.yaml", path.Join(dir, "istio-pinger.yaml"))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	configWatcher, err := newConfigWatcher(dir, &Options{Canary: func(node *mcp.SinkNode) bool {
+		return node.Id == "canary"
+	}})
+	g.Expect(err).NotTo(HaveOccurred())
+	defer configWatcher.Stop()
+	g.Expect(configWatcher.Canary()).To(BeNil())
+	stable := configWatcher.Snapshot().Version(serviceEntries)
+
+	watch := func(nodeID string) chan *source.WatchResponse {
+		channel := make(chan *source.WatchResponse, 10)
+		configWatcher.Watch(&source.Request{Collection: serviceEntries, VersionInfo: stable, SinkNode: &mcp.SinkNode{Id: nodeID}}, func(response *source.WatchResponse) {
+			channel <- response
+		})
+		return channel
+	}
+	canaries, others := watch("canary"), watch("pilot")
+
+	err = os.Link("../../test/config/sub/istio-test.yaml", path.Join(dir, "istio-test.yaml"))
+	g.Expect(err).NotTo(HaveOccurred())
+	response := <-canaries
+	g.Expect(response.Resources).To(HaveLen(2))
+	g.Expect(others).To(BeEmpty())
+	canary := configWatcher.Canary()
+	g.Expect(canary).NotTo(BeNil())
+	g.Expect(canary.Snapshot.Version(serviceEntries)).To(Equal(response.Version))
+	g.Expect(configWatcher.Snapshot().Version(serviceEntries)).To(Equal(stable))
+
+	// halting serves the stable snapshot to the canaries again
+	canaries = make(chan *source.WatchResponse, 10)
+	configWatcher.Watch(&source.Request{Collection: serviceEntries, VersionInfo: response.Version, SinkNode: &mcp.SinkNode{Id: "canary"}}, func(response *source.WatchResponse) {
+		canaries <- response
+	})
+	g.Expect(configWatcher.Halt(canary.Version+1, "wrong version")).To(HaveOccurred())
+	g.Expect(configWatcher.Halt(canary.Version, "NACKed")).To(Succeed())
+	g.Expect((<-canaries).Version).To(Equal(stable))
+	g.Expect(configWatcher.Canary().Halted).To(BeTrue())
+
+	g.Expect(configWatcher.Promote(canary.Version)).To(Succeed())
+	g.Expect(configWatcher.Canary()).To(BeNil())
+	response = <-others
+	g.Expect(response.Version).To(Equal(canary.Snapshot.Version(serviceEntries)))
+	g.Expect(response.Resources).To(HaveLen(2))
+	g.Expect(configWatcher.Promote(canary.Version)).To(HaveOccurred())
+}
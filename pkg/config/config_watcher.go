@@ -1,70 +1,203 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"github.com/fsnotify/fsnotify"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
 	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/types"
-	"io/ioutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/time/rate"
 	mcp "istio.io/api/mcp/v1alpha1"
 	"istio.io/istio/galley/pkg/metadata"
-	"istio.io/istio/pilot/pkg/config/kube/crd"
 	"istio.io/istio/pkg/mcp/snapshot"
 	"istio.io/istio/pkg/mcp/source"
-	"log"
-	"os"
-	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 )
 
+//Watcher is a source.Watcher that serves the configs of one or more Sources and reports their state
+type Watcher interface {
+	source.Watcher
+	Status() Status
+	//Snapshot returns the snapshot currently served to the default group, nil if none was built yet
+	Snapshot() snapshot.Snapshot
+	//GroupStatus returns the watch status of a group of sinks, nil if no sink of the group is known
+	GroupStatus(group string) *snapshot.StatusInfo
+	//Accept records that all sinks applied a version of a collection
+	Accept(collection string, version string)
+	//Rollback serves the last accepted version of a collection until it is resumed
+	Rollback(collection string, reason string) (Rollback, error)
+	//Resume serves the latest version of a rolled back collection again
+	Resume(collection string) error
+	//Rollbacks returns the collections currently rolled back
+	Rollbacks() []Rollback
+	//Canary returns the canary rollout in progress, nil if there is none
+	Canary() *Canary
+	//Promote serves the version of a canary rollout to all sinks
+	Promote(version int) error
+	//Halt stops the canary rollout of a version and serves the stable snapshot to the canaries again
+	Halt(version int, reason string) error
+	//History returns the latest snapshots built from the sources, oldest first
+	History() []HistoryEntry
+	//Pin serves a version from the history to all sinks until it is unpinned
+	Pin(version int) error
+	//Unpin serves the snapshots built from the sources again
+	Unpin() error
+	//Pinned returns the pinned version, 0 if none is pinned
+	Pinned() int
+	//Check builds a snapshot from the configs last read from the other sources and set in place of the configs of
+	//source without serving it. It returns the error the next reload would fail with if source provided set.
+	Check(source Source, set *ConfigSet) error
+}
+
+//Options configures a config watcher
+type Options struct {
+	//Canary selects the sinks which are served new versions first. Nil disables canary rollouts.
+	Canary func(node *mcp.SinkNode) bool
+	//HistorySize is the number of snapshots kept in the history, 16 if not set
+	HistorySize int
+	//MinPublishInterval is the minimum time between two published versions of the configs
+	MinPublishInterval time.Duration
+	//PublishRate limits the average number of versions published per second. Zero disables the limit.
+	PublishRate float64
+	//PublishBurst is the number of versions which may be published at once within PublishRate, at least 1
+	PublishBurst int
+	//StateFile is the file the latest snapshot is persisted to. It is served if the sources
+	//can't be read at startup. Empty disables persistence.
+	StateFile string
+	//MutationPolicies inject defaults into the configs when the snapshot is built, in their order
+	MutationPolicies []MutationPolicy
+}
+
+//Status describes the outcome of the latest attempts to read the sources
+type Status struct {
+	//Version of the latest snapshot published or restored from the state file, 0 if there is none yet.
+	//Snapshots waiting for the publish limits aren't reported.
+	Version int
+	//LastSuccess is the time the served snapshot was built
+	LastSuccess time.Time
+	//FailingSince is the time of the first failed read after the last successful one
+	FailingSince time.Time
+	//LastError is the error of the latest read, nil if it succeeded
+	LastError error
+	//Unreadable is set if the latest read failed because a source could not be read
+	Unreadable bool
+	//Degraded is set while the snapshot restored from the state file is served because the
+	//sources couldn't be read since startup
+	Degraded bool
+}
+
 type configWatcher struct {
 	*snapshot.Cache
-	watcher     *fsnotify.Watcher
+	options     Options
+	sources     []Source
 	doneChannel chan struct{}
+
+	mutex     sync.RWMutex
+	status    Status
+	snapshot  snapshot.Snapshot
+	latest    snapshot.Snapshot
+	stable    snapshot.Snapshot
+	canary    *Canary
+	files     map[string]string
+	history   []HistoryEntry
+	pinned    *HistoryEntry
+	accepted  map[string]acceptedCollection
+	rollbacks map[string]Rollback
+
+	//sets are the configs last read from each source, nil until a source was read. They are guarded by setsMutex
+	//instead of mutex, which is held while the sources are read.
+	setsMutex sync.Mutex
+	sets      []*ConfigSet
+
+	//built is the version of the latest snapshot built, it may be pending
+	built int
+	//pending is the latest snapshot built which is waiting for the publish limits
+	pending       *pendingSnapshot
+	limiter       *rate.Limiter
+	lastPublished time.Time
+	publishTimer  *time.Timer
 }
 
-//Ensure that configWatcher implements source.Watcher
-var _ source.Watcher = &configWatcher{}
+//Ensure that configWatcher implements Watcher
+var _ Watcher = &configWatcher{}
+
+//NewConfigWatcher creates a Watcher serving the configs of a directory
+func NewConfigWatcher(dirname string, options *Options) (Watcher, error) {
+	return newConfigWatcher(dirname, options)
+}
 
-//NewConfigWatcher creates a configWatcher
-func NewConfigWatcher(dirname string) (source.Watcher, error) {
-	return newConfigWatcher(dirname)
+//NewWatcher creates a Watcher serving the configs of all sources. A config must only be provided by one source.
+func NewWatcher(sources []Source, options *Options) (Watcher, error) {
+	return newWatcher(sources, options)
 }
 
 //Use an unexported constructor to call stop() in tests
-func newConfigWatcher(dirname string) (*configWatcher, error) {
-	var version = 1
+func newConfigWatcher(dirname string, options *Options) (*configWatcher, error) {
+	return newWatcher([]Source{NewFileSource(dirname)}, options)
+}
+
+func newWatcher(sources []Source, options *Options) (*configWatcher, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no config source")
+	}
 	result := &configWatcher{
-		Cache: snapshot.New(func(collection string, node *mcp.SinkNode) string {
-			return "default"
-		}),
+		options:     *options,
+		sources:     sources,
+		sets:        make([]*ConfigSet, len(sources)),
 		doneChannel: make(chan struct{}),
+		accepted:    make(map[string]acceptedCollection),
+		rollbacks:   make(map[string]Rollback),
 	}
-	snapshot, err := readSnapshotFromDirectory(dirname, version)
-	if err != nil {
-		return nil, err
+	result.Cache = snapshot.New(result.options.groupIndex)
+	if result.options.PublishRate > 0 {
+		burst := result.options.PublishBurst
+		if burst < 1 {
+			burst = 1
+		}
+		result.limiter = rate.NewLimiter(rate.Limit(result.options.PublishRate), burst)
 	}
-	result.SetSnapshot("default", snapshot)
-	result.watcher, err = fsnotify.NewWatcher()
-	result.watcher.Add(dirname)
+	// sources are synced before the mutex is held by the first reload
+	waitForSync(sources)
+	if err := result.reload(); err != nil {
+		if err := result.restore(err); err != nil {
+			return nil, err
+		}
+	}
+	changes := make(chan struct{}, 1)
+	changed := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+			// a reload is already due
+		}
+	}
+	for _, source := range sources {
+		if err := source.Watch(changed, result.doneChannel); err != nil {
+			close(result.doneChannel)
+			return nil, err
+		}
+	}
+	retry := time.NewTicker(degradedRetryInterval)
 	go func() {
+		defer retry.Stop()
 		for {
 			select {
-			// watch for events
-			case event, more := <-result.watcher.Events:
-				if event.Op == fsnotify.Create || event.Op == fsnotify.Remove || event.Op == fsnotify.Write {
-					if !more {
-						break
-					}
-					version++
-					snapshot, err := readSnapshotFromDirectory(dirname, version)
-					if err != nil {
-						log.Printf("Can't read configuration from directory %s: %s", dirname, err.Error())
-					} else {
-						result.SetSnapshot("default", snapshot)
+			case <-changes:
+				if err := result.reload(); err != nil {
+					logging.Watcher.Error("Can't read configuration", result.errorFields(err)...)
+				}
+			case <-retry.C:
+				if result.Status().Degraded {
+					if err := result.reload(); err == nil {
+						logging.Watcher.Info("Read configuration, leaving degraded mode", zap.Strings("sources", result.sourceNames()))
 					}
 				}
-				break
 			case <-result.doneChannel:
 				return
 			}
@@ -74,9 +207,228 @@ func newConfigWatcher(dirname string) (*configWatcher, error) {
 	return result, nil
 }
 
+//reload reads all sources and serves the resulting snapshot.
+//On failure the previous snapshot stays in place.
+func (c *configWatcher) reload() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	version := c.built + 1
+	start := time.Now()
+	snapshot, set, err := c.read(version)
+	if err != nil {
+		if c.status.LastError == nil {
+			c.status.FailingSince = time.Now()
+		}
+		c.status.LastError = err
+		validationErr, invalid := err.(*ValidationError)
+		c.status.Unreadable = !invalid
+		if invalid {
+			recordParseFailure(validationErr.File)
+		}
+		return err
+	}
+	recordSnapshot(snapshot, version, time.Since(start))
+	logging.Watcher.Debug("Built snapshot", logging.Version(version), zap.String("revision", set.Revision),
+		zap.Duration("duration", time.Since(start)), zap.Int("files", len(set.Files)))
+	if c.pending != nil {
+		logging.Snapshot.Info("Skipping version replaced before it was published", logging.Version(c.pending.version), zap.Int("replacedBy", version))
+		recordSkippedVersion()
+	}
+	c.built = version
+	c.status.LastError = nil
+	c.status.Unreadable = false
+	c.status.FailingSince = time.Time{}
+	c.pending = &pendingSnapshot{version: version, revision: set.Revision, snapshot: snapshot, files: set.Files, builtAt: time.Now()}
+	c.flush(time.Now())
+	return nil
+}
+
+//read builds a snapshot from the configs of all sources and returns it with the merged config set
+func (c *configWatcher) read(version int) (snapshot.Snapshot, *ConfigSet, error) {
+	sets := make([]*ConfigSet, len(c.sources))
+	for i, source := range c.sources {
+		set, err := source.Read()
+		if err != nil {
+			return nil, nil, err
+		}
+		sets[i] = set
+		c.setsMutex.Lock()
+		c.sets[i] = set
+		c.setsMutex.Unlock()
+	}
+	merged, err := mergeConfigSets(c.sources, sets)
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshot, err := buildSnapshot(merged, version, c.options.MutationPolicies)
+	return snapshot, merged, err
+}
+
+//Check doesn't read the other sources, so that a write checked against them neither fails nor waits while a source
+//is unreadable. Sources which haven't been read yet are left out.
+func (c *configWatcher) Check(source Source, set *ConfigSet) error {
+	c.setsMutex.Lock()
+	sets := append([]*ConfigSet(nil), c.sets...)
+	c.setsMutex.Unlock()
+	found := false
+	for i, s := range c.sources {
+		if p, ok := s.(*precedenceSource); s == source || ok && p.Source == source {
+			sets[i] = set
+			found = true
+			continue
+		}
+		if sets[i] == nil {
+			logging.Watcher.Warn("Checking configs without the configs of a source which hasn't been read", zap.String("source", s.Name()))
+			sets[i] = &ConfigSet{}
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s is no source of the watcher", source.Name())
+	}
+	merged, err := mergeConfigSets(c.sources, sets)
+	if err != nil {
+		return err
+	}
+	_, err = buildSnapshot(merged, 0, c.options.MutationPolicies)
+	return err
+}
+
+//apply makes a snapshot built from the sources the latest one and serves it.
+//It must be called with the mutex held.
+func (c *configWatcher) apply(pending *pendingSnapshot) {
+	if c.options.StateFile != "" {
+		if err := saveSnapshot(c.options.StateFile, pending.snapshot); err != nil {
+			logging.Snapshot.Error("Can't persist snapshot", logging.Version(pending.version), logging.File(c.options.StateFile), logging.Error(err))
+		}
+	}
+	c.record(pending.version, pending.revision, pending.snapshot, pending.files)
+	logging.Snapshot.Info("Publishing version", logging.Version(pending.version), zap.String("revision", pending.revision))
+	c.latest = pending.snapshot
+	if c.options.Canary != nil && c.stable != nil && !c.status.Degraded {
+		logging.Snapshot.Info("Starting canary rollout", logging.Version(pending.version))
+		c.canary = &Canary{Version: pending.version, StartedAt: time.Now()}
+	} else {
+		c.stable = pending.snapshot
+	}
+	c.status.Version = pending.version
+	c.status.LastSuccess = pending.builtAt
+	c.status.Degraded = false
+	recordDegraded(false)
+	c.publish()
+}
+
+//restore serves the snapshot persisted to the state file after the sources failed to load at startup.
+//The versions built afterwards continue the numbering of the persisted snapshot, so that sinks which
+//ACKed it are sent the first snapshot read from the sources. That one is published without canary rollout.
+//The persisted snapshot is recorded in the history like the snapshots built from the sources, its files are unknown.
+func (c *configWatcher) restore(cause error) error {
+	if c.options.StateFile == "" {
+		return cause
+	}
+	persisted, err := loadSnapshot(c.options.StateFile)
+	if err != nil {
+		return fmt.Errorf("%v, can't restore snapshot from %s: %v", cause, c.options.StateFile, err)
+	}
+	logging.Watcher.Warn("Can't read configuration, serving the persisted snapshot",
+		append(c.errorFields(cause), zap.String("stateFile", c.options.StateFile))...)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	version := persistedVersion(persisted)
+	c.record(version, "", persisted, nil)
+	c.latest = persisted
+	c.stable = persisted
+	c.status.Version = version
+	c.built = version
+	c.status.Degraded = true
+	recordDegraded(true)
+	c.publish()
+	return nil
+}
+
+//publish serves the stable snapshot to the default group and the latest snapshot to the canary group,
+//both with rolled back collections replaced by their accepted version. A pinned version is served to
+//both groups as is. It must be called with the mutex held.
+func (c *configWatcher) publish() {
+	if c.pinned != nil {
+		c.SetSnapshot(DefaultGroup, c.pinned.Snapshot)
+		c.SetSnapshot(CanaryGroup, c.pinned.Snapshot)
+		c.snapshot = c.pinned.Snapshot
+		return
+	}
+	served := c.withRollbacks(c.stable)
+	c.SetSnapshot(DefaultGroup, served)
+	c.snapshot = served
+	if c.canary == nil {
+		c.SetSnapshot(CanaryGroup, served)
+		return
+	}
+	c.canary.Snapshot = c.withRollbacks(c.latest)
+	if c.canary.Halted {
+		c.SetSnapshot(CanaryGroup, served)
+	} else {
+		c.SetSnapshot(CanaryGroup, c.canary.Snapshot)
+	}
+}
+
+func (c *configWatcher) withRollbacks(base snapshot.Snapshot) snapshot.Snapshot {
+	if len(c.rollbacks) == 0 {
+		return base
+	}
+	builder := snapshot.NewInMemoryBuilder()
+	for _, collection := range collections {
+		if _, ok := c.rollbacks[collection]; ok {
+			accepted := c.accepted[collection]
+			builder.Set(collection, accepted.version, accepted.resources)
+		} else if version := base.Version(collection); version != "" {
+			builder.Set(collection, version, base.Resources(collection))
+		}
+	}
+	return builder.Build()
+}
+
+//Snapshot returns the snapshot currently served to the default group
+func (c *configWatcher) Snapshot() snapshot.Snapshot {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.snapshot
+}
+
+//GroupStatus returns the watch status of a group of sinks
+func (c *configWatcher) GroupStatus(group string) *snapshot.StatusInfo {
+	return c.Cache.Status(group)
+}
+
+//Status returns the state of the sources
+func (c *configWatcher) Status() Status {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.status
+}
+
 func (c *configWatcher) Stop() {
 	close(c.doneChannel)
-	c.watcher.Close()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.publishTimer != nil {
+		c.publishTimer.Stop()
+	}
+}
+
+//errorFields describes a failed read of the sources, including the invalid file if known
+func (c *configWatcher) errorFields(err error) []zapcore.Field {
+	fields := []zapcore.Field{zap.Strings("sources", c.sourceNames()), logging.Error(err)}
+	if validationErr, ok := err.(*ValidationError); ok && validationErr.File != "" {
+		fields = append(fields, logging.File(validationErr.File))
+	}
+	return fields
+}
+
+func (c *configWatcher) sourceNames() []string {
+	names := make([]string, len(c.sources))
+	for i, source := range c.sources {
+		names[i] = source.Name()
+	}
+	return names
 }
 
 type resourceWrapper struct {
@@ -85,14 +437,18 @@ type resourceWrapper struct {
 }
 
 type namedSpec struct {
-	name string
-	spec proto.Message
+	name        string
+	spec        proto.Message
+	annotations map[string]string
 }
 
 func (r *resourceWrapper) wrapMultiple(specs []namedSpec) []*mcp.Resource {
 	resources := make([]*mcp.Resource, len(specs))
 	for i, spec := range specs {
 		resources[i] = r.wrap(spec.spec, spec.name)
+		if resources[i] != nil {
+			resources[i].Metadata.Annotations = spec.annotations
+		}
 	}
 	return resources
 }
@@ -117,65 +473,67 @@ func (r *resourceWrapper) wrap(message proto.Message, name string) *mcp.Resource
 		Metadata: &mcp.Metadata{
 			Name:       name,
 			CreateTime: r.createTime,
+			Version:    resourceVersion(body),
 		},
 		Body: body,
 	}
 
 }
 
-func readSnapshotFromDirectory(dirname string, version int) (snapshot.Snapshot, error) {
-	configs := make(map[string][]namedSpec)
-	err := filepath.Walk(dirname, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			return readConfigMapFromFile(path, configs)
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
+//resourceVersion derives the version of a resource from its content, so that
+//unchanged resources keep their version across snapshots
+func resourceVersion(body *types.Any) string {
+	hash := sha256.Sum256(body.Value)
+	return hex.EncodeToString(hash[:8])
+}
 
-	return configMapToSnapshot(configs, version)
+//collections maps the supported istio config types to their MCP collection
+var collections = map[string]string{
+	"gateway":          metadata.IstioNetworkingV1alpha3Gateways.Collection.String(),
+	"virtual-service":  metadata.IstioNetworkingV1alpha3Virtualservices.Collection.String(),
+	"service-entry":    metadata.IstioNetworkingV1alpha3Serviceentries.Collection.String(),
+	"destination-rule": metadata.IstioNetworkingV1alpha3Destinationrules.Collection.String(),
 }
 
-func readConfigMapFromFile(fileName string, configs map[string][]namedSpec) error {
-	content, err := ioutil.ReadFile(fileName)
-	if err != nil {
-		return fmt.Errorf("unable to read file %s: %v", fileName, err)
+//Types returns the supported istio config types ordered by name
+func Types() []string {
+	types := make([]string, 0, len(collections))
+	for ctype := range collections {
+		types = append(types, ctype)
 	}
+	sort.Strings(types)
+	return types
+}
 
-	istioConfigs, _, err := crd.ParseInputs(string(content))
-	if err != nil {
-		return fmt.Errorf("unable to parse content of file %s: %v", fileName, err)
-	}
+//Collection returns the MCP collection of a supported istio config type
+func Collection(ctype string) (string, bool) {
+	collection, ok := collections[ctype]
+	return collection, ok
+}
 
-	for _, config := range istioConfigs {
-		configs[config.Type] = append(configs[config.Type], namedSpec{config.Name, config.Spec})
+//TypeOfCollection returns the istio config type of a supported MCP collection
+func TypeOfCollection(collection string) (string, bool) {
+	for ctype, c := range collections {
+		if c == collection {
+			return ctype, true
+		}
 	}
-	return nil
+	return "", false
 }
 
-func configMapToSnapshot(configs map[string][]namedSpec, version int) (snapshot.Snapshot, error) {
+func configMapToSnapshot(configs map[string][]namedSpec, stringVersion string) (snapshot.Snapshot, error) {
 	resourceWrapper := resourceWrapper{}
 
-	stringVersion := fmt.Sprintf("%d.0", version)
 	snapshot := snapshot.NewInMemoryBuilder()
 	for ctype, config := range configs {
-
-		switch ctype {
-		case "gateway":
-			snapshot.Set(metadata.IstioNetworkingV1alpha3Gateways.Collection.String(), stringVersion, resourceWrapper.wrapMultiple(config))
-		case "virtual-service":
-			snapshot.Set(metadata.IstioNetworkingV1alpha3Virtualservices.Collection.String(), stringVersion, resourceWrapper.wrapMultiple(config))
-		case "service-entry":
-			snapshot.Set(metadata.IstioNetworkingV1alpha3Serviceentries.Collection.String(), stringVersion, resourceWrapper.wrapMultiple(config))
-		default:
-			return nil, fmt.Errorf("proto format error: config type %s unknown", ctype)
+		collection, ok := collections[ctype]
+		if !ok {
+			return nil, NewValidationError("", fmt.Errorf("proto format error: config type %s unknown", ctype))
 		}
-
+		snapshot.Set(collection, stringVersion, resourceWrapper.wrapMultiple(config))
+	}
+	if resourceWrapper.err != nil {
+		return nil, resourceWrapper.err
 	}
 
 	return snapshot.Build(), nil
@@ -4,6 +4,7 @@ import (
 	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/types"
 	. "github.com/onsi/gomega"
+	"go.opencensus.io/stats/view"
 	"io/ioutil"
 	mcp "istio.io/api/mcp/v1alpha1"
 	networking "istio.io/api/networking/v1alpha3"
@@ -16,12 +17,23 @@ import (
 )
 
 func readSnapshotFromFile(filename string) (snapshot.Snapshot, error) {
-	configs := make(map[string][]namedSpec)
-	err := readConfigMapFromFile(filename, configs)
+	content, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	return configMapToSnapshot(configs, 1)
+	configs, err := ParseConfigs(filename, content)
+	if err != nil {
+		return nil, err
+	}
+	return buildSnapshot(&ConfigSet{Configs: configs}, 1, nil)
+}
+
+func readSnapshotFromDirectory(dirname string, version int) (snapshot.Snapshot, error) {
+	set, err := NewFileSource(dirname).Read()
+	if err != nil {
+		return nil, err
+	}
+	return buildSnapshot(set, version, nil)
 }
 
 func TestReadSnapshotFromFile(t *testing.T) {
@@ -98,7 +110,7 @@ func TestConfigWatcher(t *testing.T) {
 	g.Expect(err).NotTo(HaveOccurred())
 	defer os.RemoveAll(dir)
 
-	configWatcher, err := newConfigWatcher(dir)
+	configWatcher, err := newConfigWatcher(dir, &Options{})
 	g.Expect(err).NotTo(HaveOccurred())
 	defer configWatcher.Stop()
 
@@ -170,6 +182,43 @@ func TestConfigWatcher(t *testing.T) {
 
 }
 
+func TestConfigWatcherStatus(t *testing.T) {
+	g := NewGomegaWithT(t)
+	cwd, err := os.Getwd()
+	g.Expect(err).NotTo(HaveOccurred())
+	dir, err := ioutil.TempDir(cwd, "service-manager-istio-mcp-server")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	configWatcher, err := newConfigWatcher(dir, &Options{})
+	g.Expect(err).NotTo(HaveOccurred())
+	defer configWatcher.Stop()
+	g.Expect(configWatcher.Status().Version).To(Equal(1))
+	g.Expect(configWatcher.Status().LastError).NotTo(HaveOccurred())
+
+	// move the file in place to get a single event
+	invalidFile := dir + "-invalid.yaml"
+	err = ioutil.WriteFile(invalidFile, []byte("kind: Gateway\napiVersion: networking.istio.io/v1alpha3\nspec: [\n"), 0644)
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.Remove(invalidFile)
+	err = os.Rename(invalidFile, path.Join(dir, "invalid.yaml"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Eventually(func() error { return configWatcher.Status().LastError }).Should(HaveOccurred())
+	status := configWatcher.Status()
+	g.Expect(status.Version).To(Equal(1))
+	g.Expect(status.Unreadable).To(BeFalse())
+	g.Expect(status.FailingSince.IsZero()).To(BeFalse())
+	rows, err := view.RetrieveData(parseFailures.Name())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rows).NotTo(BeEmpty())
+	g.Expect(rows[0].Tags[0].Value).To(Equal(path.Join(dir, "invalid.yaml")))
+
+	err = os.Remove(path.Join(dir, "invalid.yaml"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Eventually(func() int { return configWatcher.Status().Version }).Should(Equal(2))
+	g.Expect(configWatcher.Status().LastError).NotTo(HaveOccurred())
+}
+
 func unWrapResource(resource *mcp.Resource, message proto.Message) error {
 	return types.UnmarshalAny(resource.Body, message)
 }
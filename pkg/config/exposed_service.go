@@ -0,0 +1,182 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/config/kube/crd"
+	"istio.io/istio/pilot/pkg/model"
+)
+
+//ExposedServiceKind is the kind of ExposedService documents
+const ExposedServiceKind = "ExposedService"
+
+//ExposedServiceType is the config type of exposed services. They are expanded into a gateway, a virtual service
+//and a service entry when the snapshot is built and aren't served themselves.
+const ExposedServiceType = "exposed-service"
+
+//ExpandedFromAnnotation is the annotation of resources expanded from another config, e.g. ExposedService/pinger
+const ExpandedFromAnnotation = "mcp-server.peripli.io/expanded-from"
+
+//defaultGatewayPort is the port of the ingress gateway exposed services are served on by default
+const defaultGatewayPort = 9000
+
+//ExposedService is the spec of the boilerplate exposing a service through the ingress gateway: a gateway
+//terminating mutual TLS for the host, a virtual service routing its TCP traffic and a static service entry of
+//the endpoints of the service.
+type ExposedService struct {
+	//Host is the external host name of the service
+	Host string `json:"host"`
+	//GatewayPort is the port of the ingress gateway, 9000 if 0
+	GatewayPort uint32 `json:"gatewayPort,omitempty"`
+	//ServiceHost is the mesh internal host of the endpoints, <name>.service if empty
+	ServiceHost string `json:"serviceHost,omitempty"`
+	//Endpoints are the addresses of the service
+	Endpoints []string `json:"endpoints"`
+	//Port of the endpoints
+	Port              uint32 `json:"port"`
+	ServerCertificate string `json:"serverCertificate"`
+	PrivateKey        string `json:"privateKey"`
+	CACertificates    string `json:"caCertificates"`
+}
+
+//Reset clears the exposed service, it lets ExposedService be the spec of a Config
+func (e *ExposedService) Reset() {
+	*e = ExposedService{}
+}
+
+//String returns the exposed service as JSON
+func (e *ExposedService) String() string {
+	content, _ := json.Marshal(e)
+	return string(content)
+}
+
+//ProtoMessage marks ExposedService as message
+func (*ExposedService) ProtoMessage() {}
+
+//parseExposedService converts an ExposedService document of a file into a config
+func parseExposedService(file string, kind *crd.IstioKind) (Config, error) {
+	invalid := func(err error) (Config, error) {
+		return Config{}, NewValidationError(file, fmt.Errorf("invalid %s %s in file %s: %v", ExposedServiceKind, kind.Name, file, err))
+	}
+	if kind.Name == "" {
+		return invalid(errors.New("name is missing"))
+	}
+	spec, err := json.Marshal(kind.Spec)
+	if err != nil {
+		return invalid(err)
+	}
+	exposedService := &ExposedService{}
+	decoder := json.NewDecoder(bytes.NewReader(spec))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(exposedService); err != nil {
+		return invalid(err)
+	}
+	if exposedService.Host == "" {
+		return invalid(errors.New("host is required"))
+	}
+	if len(exposedService.Endpoints) == 0 {
+		return invalid(errors.New("endpoints are required"))
+	}
+	if exposedService.Port == 0 {
+		return invalid(errors.New("port is required"))
+	}
+	if exposedService.ServerCertificate == "" || exposedService.PrivateKey == "" || exposedService.CACertificates == "" {
+		return invalid(errors.New("serverCertificate, privateKey and caCertificates are required"))
+	}
+	return Config{Type: ExposedServiceType, Name: ConfigName(kind.Namespace, kind.Name), Spec: exposedService, Origin: file, Labels: kind.Labels}, nil
+}
+
+//expandExposedServices replaces the exposed services among configs by their gateway, virtual service and
+//service entry. The expanded configs must be valid and must not replace configs of other origins.
+func expandExposedServices(configs []Config) ([]Config, error) {
+	expanded := make([]Config, 0, len(configs))
+	origins := make(map[string]string)
+	for _, config := range configs {
+		if config.Type != ExposedServiceType {
+			origins[config.Type+"/"+config.Name] = config.Origin
+			expanded = append(expanded, config)
+		}
+	}
+	for _, config := range configs {
+		if config.Type != ExposedServiceType {
+			continue
+		}
+		source := ExposedServiceKind + "/" + config.Name
+		for _, c := range expandExposedService(config.Name, config.Spec.(*ExposedService)) {
+			schema, _ := model.IstioConfigTypes.GetByType(c.Type)
+			namespace, name := splitConfigName(c.Name)
+			if err := schema.Validate(name, namespace, c.Spec); err != nil {
+				return nil, NewValidationError(config.Origin, fmt.Errorf("invalid %s %s in file %s: %s %s is invalid: %v",
+					ExposedServiceKind, config.Name, config.Origin, c.Type, c.Name, err))
+			}
+			key := c.Type + "/" + c.Name
+			if origin, ok := origins[key]; ok {
+				return nil, NewValidationError(config.Origin, fmt.Errorf("invalid %s %s in file %s: %s %s is also defined in %s",
+					ExposedServiceKind, config.Name, config.Origin, c.Type, c.Name, origin))
+			}
+			origins[key] = config.Origin
+			c.Origin = config.Origin
+			c.Labels = config.Labels
+			c.Annotations = map[string]string{ExpandedFromAnnotation: source}
+			for k, v := range config.Annotations {
+				c.Annotations[k] = v
+			}
+			expanded = append(expanded, c)
+		}
+	}
+	return expanded, nil
+}
+
+//expandExposedService returns the gateway <name>-gateway, the virtual service <name> and the service entry <name>
+//of an exposed service, in its namespace
+func expandExposedService(qualifiedName string, e *ExposedService) []Config {
+	namespace, name := splitConfigName(qualifiedName)
+	gatewayName := name + "-gateway"
+	gatewayPort := e.GatewayPort
+	if gatewayPort == 0 {
+		gatewayPort = defaultGatewayPort
+	}
+	serviceHost := e.ServiceHost
+	if serviceHost == "" {
+		serviceHost = name + ".service"
+	}
+	endpoints := make([]*networking.ServiceEntry_Endpoint, len(e.Endpoints))
+	for i, address := range e.Endpoints {
+		endpoints[i] = &networking.ServiceEntry_Endpoint{Address: address}
+	}
+	return []Config{
+		{Type: model.Gateway.Type, Name: ConfigName(namespace, gatewayName), Spec: &networking.Gateway{
+			Servers: []*networking.Server{{
+				Hosts: []string{e.Host},
+				Port:  &networking.Port{Number: gatewayPort, Name: "tls", Protocol: "TLS"},
+				Tls: &networking.Server_TLSOptions{
+					Mode:              networking.Server_TLSOptions_MUTUAL,
+					ServerCertificate: e.ServerCertificate,
+					PrivateKey:        e.PrivateKey,
+					CaCertificates:    e.CACertificates,
+				},
+			}},
+		}},
+		{Type: model.VirtualService.Type, Name: qualifiedName, Spec: &networking.VirtualService{
+			Hosts:    []string{e.Host},
+			Gateways: []string{gatewayName},
+			Tcp: []*networking.TCPRoute{{
+				Route: []*networking.RouteDestination{{
+					Destination: &networking.Destination{
+						Host: serviceHost,
+						Port: &networking.PortSelector{Port: &networking.PortSelector_Number{Number: e.Port}},
+					},
+				}},
+			}},
+		}},
+		{Type: model.ServiceEntry.Type, Name: qualifiedName, Spec: &networking.ServiceEntry{
+			Hosts:      []string{serviceHost},
+			Ports:      []*networking.Port{{Number: e.Port, Name: "tcp", Protocol: "TCP"}},
+			Resolution: networking.ServiceEntry_STATIC,
+			Endpoints:  endpoints,
+		}},
+	}
+}
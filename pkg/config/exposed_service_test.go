@@ -0,0 +1,122 @@
+package config
+
+import (
+	"github.com/gogo/protobuf/types"
+	. "github.com/onsi/gomega"
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/galley/pkg/metadata"
+	"istio.io/istio/pilot/pkg/model"
+	"strings"
+	"testing"
+)
+
+func TestExpandExposedService(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configs := parseFile(t, "../../test/exposed/pinger.yaml")
+	g.Expect(configs).To(HaveLen(1))
+	g.Expect(configs[0].Type).To(Equal(ExposedServiceType))
+	g.Expect(configs[0].Name).To(Equal("pinger"))
+
+	// the expanded configs equal the hand-written boilerplate
+	handWritten := make(map[string]Config)
+	for _, c := range parseFile(t, "../../test/config/istio-pinger.yaml") {
+		handWritten[c.Type+"/"+c.Name] = c
+	}
+	expanded, err := expandExposedServices(configs)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(expanded).To(HaveLen(3))
+	for _, c := range expanded {
+		g.Expect(c.Origin).To(Equal("../../test/exposed/pinger.yaml"))
+		g.Expect(c.Annotations).To(HaveKeyWithValue(ExpandedFromAnnotation, "ExposedService/pinger"))
+		g.Expect(handWritten).To(HaveKey(c.Type + "/" + c.Name))
+		if c.Type == model.ServiceEntry.Type {
+			serviceEntry := c.Spec.(*networking.ServiceEntry)
+			g.Expect(serviceEntry.Hosts).To(Equal([]string{"istio-pinger.istio"}))
+			g.Expect(serviceEntry.Ports[0].Number).To(Equal(uint32(8081)))
+			g.Expect(serviceEntry.Endpoints[0].Address).To(Equal("10.0.81.2"))
+			continue
+		}
+		g.Expect(c.Spec).To(Equal(handWritten[c.Type+"/"+c.Name].Spec))
+	}
+
+	snapshot, err := buildSnapshot(&ConfigSet{Configs: configs}, 1, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	gateways := snapshot.Resources(metadata.IstioNetworkingV1alpha3Gateways.Collection.String())
+	g.Expect(gateways).To(HaveLen(1))
+	g.Expect(gateways[0].Metadata.Name).To(Equal("pinger-gateway"))
+	g.Expect(gateways[0].Metadata.Annotations).To(HaveKeyWithValue(ExpandedFromAnnotation, "ExposedService/pinger"))
+	gateway := &networking.Gateway{}
+	g.Expect(types.UnmarshalAny(gateways[0].Body, gateway)).To(Succeed())
+	g.Expect(gateway.Servers[0].Port.Number).To(Equal(uint32(defaultGatewayPort)))
+
+	// the expanded configs are in the namespace of the exposed service
+	configs[0].Name = "payments/pinger"
+	expanded, err = expandExposedServices(configs)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(expanded[0].Name).To(Equal("payments/pinger-gateway"))
+	g.Expect(expanded[1].Name).To(Equal("payments/pinger"))
+	g.Expect(expanded[1].Spec.(*networking.VirtualService).Gateways).To(Equal([]string{"pinger-gateway"}))
+	g.Expect(expanded[2].Name).To(Equal("payments/pinger"))
+}
+
+func TestExpandExposedServiceInvalid(t *testing.T) {
+	g := NewGomegaWithT(t)
+	exposedService := func(spec string) string {
+		return "apiVersion: mcp-server.peripli.io/v1alpha1\nkind: ExposedService\nmetadata:\n  name: pinger\nspec:\n" + spec
+	}
+	valid := `  host: pinger.example.com
+  endpoints: [10.0.81.2]
+  port: 8081
+  serverCertificate: server.crt
+  privateKey: server.key
+  caCertificates: ca.crt
+`
+	_, err := ParseConfigs("pinger.yaml", []byte(exposedService(strings.Replace(valid, "  host: pinger.example.com\n", "", 1))))
+	g.Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+	g.Expect(err.(*ValidationError).File).To(Equal("pinger.yaml"))
+	g.Expect(err).To(MatchError(ContainSubstring("invalid ExposedService pinger in file pinger.yaml: host is required")))
+
+	_, err = ParseConfigs("pinger.yaml", []byte(exposedService(valid+"  protocol: TCP\n")))
+	g.Expect(err).To(MatchError(ContainSubstring("unknown field")))
+
+	// specs are validated when the snapshot is built
+	configs, err := ParseConfigs("pinger.yaml", []byte(exposedService(strings.Replace(valid, "10.0.81.2", "pinger.internal", 1))))
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = buildSnapshot(&ConfigSet{Configs: configs}, 1, nil)
+	g.Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+	g.Expect(err).To(MatchError(ContainSubstring("invalid ExposedService pinger in file pinger.yaml: service-entry pinger is invalid")))
+
+	configs, err = ParseConfigs("pinger.yaml", []byte(exposedService(valid)))
+	g.Expect(err).NotTo(HaveOccurred())
+	configs = append(configs, parseFile(t, "../../test/config/istio-pinger.yaml")...)
+	_, err = buildSnapshot(&ConfigSet{Configs: configs}, 1, nil)
+	g.Expect(err).To(MatchError(ContainSubstring("gateway pinger-gateway is also defined in ../../test/config/istio-pinger.yaml")))
+}
+
+func TestExpandExposedServiceWithPrecedence(t *testing.T) {
+	g := NewGomegaWithT(t)
+	exposed := &ConfigSet{Configs: parseFile(t, "../../test/exposed/pinger.yaml")}
+	handWritten := &ConfigSet{Configs: parseFile(t, "../../test/config/istio-pinger.yaml")}
+	local, upstream := &memorySource{name: "local"}, &memorySource{name: "upstream"}
+
+	// the configs expanded from an exposed service override the configs of sources with lower precedence
+	merged, err := mergeConfigSets([]Source{local, WithPrecedence(upstream, -1)}, []*ConfigSet{exposed, handWritten})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(merged.Configs).To(HaveLen(3))
+	for _, c := range merged.Configs {
+		g.Expect(c.Annotations).To(HaveKeyWithValue(ExpandedFromAnnotation, "ExposedService/pinger"))
+	}
+	_, err = buildSnapshot(merged, 1, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// and are overridden by the configs of sources with higher precedence
+	merged, err = mergeConfigSets([]Source{WithPrecedence(local, -1), upstream}, []*ConfigSet{exposed, handWritten})
+	g.Expect(err).NotTo(HaveOccurred())
+	for _, c := range merged.Configs {
+		g.Expect(c.Origin).To(Equal("../../test/config/istio-pinger.yaml"))
+	}
+
+	// sources of the same precedence still conflict
+	_, err = mergeConfigSets([]Source{local, upstream}, []*ConfigSet{exposed, handWritten})
+	g.Expect(err).To(MatchError(ContainSubstring("is also provided by source local")))
+}
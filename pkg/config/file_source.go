@@ -0,0 +1,114 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//fileSource reads istio configs from the YAML files of a directory and its subdirectories
+type fileSource struct {
+	dirname string
+	//excludedSuffix is the suffix of the files of the directory itself which are skipped, empty if none are
+	excludedSuffix string
+}
+
+//NewFileSource creates a Source reading the YAML files of a directory
+func NewFileSource(dirname string) Source {
+	return &fileSource{dirname: dirname}
+}
+
+//NewFileSourceExcluding creates a Source reading the YAML files of a directory except the files directly in it
+//ending with suffix, e.g. the files of a store sharing the directory
+func NewFileSourceExcluding(dirname string, suffix string) Source {
+	return &fileSource{dirname: dirname, excludedSuffix: suffix}
+}
+
+//Name returns the directory
+func (s *fileSource) Name() string {
+	return s.dirname
+}
+
+//Read parses all files of the directory. The files are reported by their path relative to the directory.
+//Hidden files are skipped, e.g. temporary files which are renamed once written completely, as are excluded files.
+func (s *fileSource) Read() (*ConfigSet, error) {
+	set := &ConfigSet{Files: make(map[string]string)}
+	err := filepath.Walk(s.dirname, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		if s.excludedSuffix != "" && strings.HasSuffix(info.Name(), s.excludedSuffix) && filepath.Dir(path) == filepath.Clean(s.dirname) {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("unable to read file %s: %v", path, err)
+		}
+		name, err := filepath.Rel(s.dirname, path)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(content)
+		set.Files[name] = hex.EncodeToString(hash[:])
+		configs, err := ParseConfigs(path, content)
+		if err != nil {
+			return err
+		}
+		set.Configs = append(set.Configs, configs...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+//Watch notifies about created, written and removed files. If the directory can't be watched, e.g. because
+//it doesn't exist yet, adding the watch is retried.
+func (s *fileSource) Watch(changed func(), stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	watching := watcher.Add(s.dirname) == nil
+	go func() {
+		defer watcher.Close()
+		retry := time.NewTicker(degradedRetryInterval)
+		defer retry.Stop()
+		for {
+			select {
+			case event, more := <-watcher.Events:
+				if !more {
+					return
+				}
+				if event.Op == fsnotify.Create || event.Op == fsnotify.Remove || event.Op == fsnotify.Write {
+					logging.Watcher.Debug("Config directory changed", logging.File(event.Name), zap.String("op", event.Op.String()))
+					changed()
+				}
+			case <-retry.C:
+				// the directory may not have existed when the watch was added
+				if !watching && watcher.Add(s.dirname) == nil {
+					watching = true
+					changed()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
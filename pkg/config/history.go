@@ -0,0 +1,165 @@
+package config
+
+import (
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"istio.io/istio/pkg/mcp/snapshot"
+	"sort"
+	"time"
+)
+
+//defaultHistorySize is the number of snapshots kept if Options.HistorySize is not set
+const defaultHistorySize = 16
+
+//FileChange describes how a file of the config directory changed compared to the previous version
+type FileChange struct {
+	File string `json:"file"`
+	//Change is one of added, modified or removed
+	Change string `json:"change"`
+}
+
+//HistoryEntry describes a snapshot built from the config directory
+type HistoryEntry struct {
+	Version int `json:"version"`
+	//Revision of the sources the snapshot was built from, e.g. a commit SHA. Empty if they have no revisions.
+	Revision string    `json:"revision,omitempty"`
+	Time     time.Time `json:"time"`
+	//Changes are the files which changed since the previous version
+	Changes []FileChange `json:"changes"`
+	//Diff describes the resources which changed since the previous version
+	Diff Diff `json:"diff"`
+	//Snapshot is the snapshot built from the config directory
+	Snapshot snapshot.Snapshot `json:"-"`
+}
+
+//Diff describes the changed resources of all collections which differ between two snapshots
+type Diff map[string]*CollectionDiff
+
+//CollectionDiff lists the names of the changed resources of a collection
+type CollectionDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+}
+
+//DiffSnapshots compares the resources of two snapshots by name and version. from may be nil.
+func DiffSnapshots(from snapshot.Snapshot, to snapshot.Snapshot) Diff {
+	result := make(Diff)
+	for _, collection := range collections {
+		previous := make(map[string]string)
+		if from != nil {
+			for _, resource := range from.Resources(collection) {
+				previous[resource.Metadata.Name] = resource.Metadata.Version
+			}
+		}
+		diff := &CollectionDiff{}
+		for _, resource := range to.Resources(collection) {
+			version, ok := previous[resource.Metadata.Name]
+			if !ok {
+				diff.Added = append(diff.Added, resource.Metadata.Name)
+			} else if version != resource.Metadata.Version {
+				diff.Changed = append(diff.Changed, resource.Metadata.Name)
+			}
+			delete(previous, resource.Metadata.Name)
+		}
+		for name := range previous {
+			diff.Removed = append(diff.Removed, name)
+		}
+		if len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Changed) == 0 {
+			continue
+		}
+		sort.Strings(diff.Added)
+		sort.Strings(diff.Removed)
+		sort.Strings(diff.Changed)
+		result[collection] = diff
+	}
+	return result
+}
+
+//diffFiles compares the content hashes by file name of two reads of the config directory
+func diffFiles(from map[string]string, to map[string]string) []FileChange {
+	result := []FileChange{}
+	for file, hash := range to {
+		if previous, ok := from[file]; !ok {
+			result = append(result, FileChange{File: file, Change: "added"})
+		} else if previous != hash {
+			result = append(result, FileChange{File: file, Change: "modified"})
+		}
+	}
+	for file := range from {
+		if _, ok := to[file]; !ok {
+			result = append(result, FileChange{File: file, Change: "removed"})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].File < result[j].File
+	})
+	return result
+}
+
+//record adds a snapshot to the history. It must be called with the mutex held.
+func (c *configWatcher) record(version int, revision string, snapshot snapshot.Snapshot, files map[string]string) {
+	entry := HistoryEntry{
+		Version:  version,
+		Revision: revision,
+		Time:     time.Now(),
+		Changes:  diffFiles(c.files, files),
+		Diff:     DiffSnapshots(c.latest, snapshot),
+		Snapshot: snapshot,
+	}
+	c.files = files
+	c.history = append(c.history, entry)
+	size := c.options.HistorySize
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	if len(c.history) > size {
+		c.history = c.history[len(c.history)-size:]
+	}
+}
+
+//History returns the latest snapshots built from the config directory, oldest first
+func (c *configWatcher) History() []HistoryEntry {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return append([]HistoryEntry{}, c.history...)
+}
+
+//Pin serves version from the history to all sinks until Unpin is called
+func (c *configWatcher) Pin(version int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := range c.history {
+		if c.history[i].Version == version {
+			entry := c.history[i]
+			c.pinned = &entry
+			logging.Snapshot.Info("Pinning version", logging.Version(version))
+			c.publish()
+			return nil
+		}
+	}
+	return fmt.Errorf("version %d is not in the history", version)
+}
+
+//Unpin serves the snapshots built from the config directory again
+func (c *configWatcher) Unpin() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.pinned == nil {
+		return fmt.Errorf("no version is pinned")
+	}
+	logging.Snapshot.Info("Unpinning version", logging.Version(c.pinned.Version))
+	c.pinned = nil
+	c.publish()
+	return nil
+}
+
+//Pinned returns the pinned version, 0 if none is pinned
+func (c *configWatcher) Pinned() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.pinned == nil {
+		return 0
+	}
+	return c.pinned.Version
+}
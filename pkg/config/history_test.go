@@ -0,0 +1,92 @@
+package config
+
+import (
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"istio.io/istio/galley/pkg/metadata"
+	"istio.io/istio/pkg/mcp/snapshot"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	g := NewGomegaWithT(t)
+	serviceEntries := metadata.IstioNetworkingV1alpha3Serviceentries.Collection.String()
+	gateways := metadata.IstioNetworkingV1alpha3Gateways.Collection.String()
+	resource := func(name string, version string) *mcp.Resource {
+		return &mcp.Resource{Metadata: &mcp.Metadata{Name: name, Version: version}}
+	}
+	from := snapshot.NewInMemoryBuilder()
+	from.Set(serviceEntries, "1.0", []*mcp.Resource{resource("a", "1"), resource("b", "1"), resource("c", "1")})
+	from.Set(gateways, "1.0", []*mcp.Resource{resource("a", "1")})
+	to := snapshot.NewInMemoryBuilder()
+	to.Set(serviceEntries, "2.0", []*mcp.Resource{resource("a", "1"), resource("b", "2"), resource("d", "1")})
+	to.Set(gateways, "2.0", []*mcp.Resource{resource("a", "1")})
+
+	next := to.Build()
+	diff := DiffSnapshots(from.Build(), next)
+	g.Expect(diff).To(HaveLen(1))
+	g.Expect(diff[serviceEntries]).To(Equal(&CollectionDiff{Added: []string{"d"}, Removed: []string{"c"}, Changed: []string{"b"}}))
+
+	diff = DiffSnapshots(nil, next)
+	g.Expect(diff).To(HaveLen(2))
+	g.Expect(diff[gateways].Added).To(Equal([]string{"a"}))
+}
+
+func TestDiffFiles(t *testing.T) {
+	g := NewGomegaWithT(t)
+	changes := diffFiles(map[string]string{"a.yaml": "1", "b.yaml": "1"}, map[string]string{"a.yaml": "2", "c.yaml": "1"})
+	g.Expect(changes).To(Equal([]FileChange{
+		{File: "a.yaml", Change: "modified"},
+		{File: "b.yaml", Change: "removed"},
+		{File: "c.yaml", Change: "added"},
+	}))
+}
+
+func TestHistoryAndPin(t *testing.T) {
+	g := NewGomegaWithT(t)
+	serviceEntries := metadata.IstioNetworkingV1alpha3Serviceentries.Collection.String()
+	cwd, err := os.Getwd()
+	g.Expect(err).NotTo(HaveOccurred())
+	dir, err := ioutil.TempDir(cwd, "service-manager-istio-mcp-server")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	err = os.Link("../../test/config/istio-pinger.yaml", path.Join(dir, "istio-pinger.yaml"))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	configWatcher, err := newConfigWatcher(dir, &Options{HistorySize: 2})
+	g.Expect(err).NotTo(HaveOccurred())
+	defer configWatcher.Stop()
+	history := configWatcher.History()
+	g.Expect(history).To(HaveLen(1))
+	g.Expect(history[0].Version).To(Equal(1))
+	g.Expect(history[0].Changes).To(Equal([]FileChange{{File: "istio-pinger.yaml", Change: "added"}}))
+	g.Expect(history[0].Diff[serviceEntries].Added).To(Equal([]string{"pinger"}))
+
+	err = os.Link("../../test/config/sub/istio-test.yaml", path.Join(dir, "istio-test.yaml"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Eventually(func() int { return len(configWatcher.Snapshot().Resources(serviceEntries)) }).Should(Equal(2))
+	history = configWatcher.History()
+	g.Expect(history).To(HaveLen(2))
+	g.Expect(history[1].Changes).To(Equal([]FileChange{{File: "istio-test.yaml", Change: "added"}}))
+	g.Expect(history[1].Diff[serviceEntries].Added).To(Equal([]string{"test"}))
+
+	g.Expect(configWatcher.Pin(5)).To(HaveOccurred())
+	g.Expect(configWatcher.Pin(1)).To(Succeed())
+	g.Expect(configWatcher.Pinned()).To(Equal(1))
+	g.Expect(configWatcher.Snapshot().Resources(serviceEntries)).To(HaveLen(1))
+
+	// the pinned version is served regardless of the directory content
+	g.Expect(os.Remove(path.Join(dir, "istio-pinger.yaml"))).To(Succeed())
+	g.Eventually(func() int { return configWatcher.Status().Version }).Should(Equal(3))
+	g.Expect(configWatcher.History()).To(HaveLen(2))
+	g.Expect(configWatcher.History()[0].Version).To(Equal(2))
+	g.Expect(configWatcher.Snapshot().Resources(serviceEntries)[0].Metadata.Name).To(Equal("pinger"))
+
+	g.Expect(configWatcher.Unpin()).To(Succeed())
+	g.Expect(configWatcher.Pinned()).To(BeZero())
+	g.Expect(configWatcher.Snapshot().Resources(serviceEntries)[0].Metadata.Name).To(Equal("test"))
+	g.Expect(configWatcher.Unpin()).To(HaveOccurred())
+}
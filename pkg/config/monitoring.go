@@ -0,0 +1,100 @@
+package config
+
+import (
+	"context"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"istio.io/istio/pkg/mcp/monitoring"
+	"istio.io/istio/pkg/mcp/snapshot"
+	"time"
+)
+
+var (
+	buildDuration = stats.Float64(
+		"config/snapshot_build_duration_seconds",
+		"Time needed to read the config directory and build a snapshot.",
+		"s")
+
+	resourceCount = stats.Int64(
+		"config/snapshot_resources",
+		"Number of resources per collection in the served snapshot.",
+		stats.UnitDimensionless)
+
+	snapshotVersion = stats.Int64(
+		"config/snapshot_version",
+		"Version per collection of the served snapshot.",
+		stats.UnitDimensionless)
+
+	parseFailures = stats.Int64(
+		"config/parse_failures_total",
+		"Number of failed attempts to parse a config file.",
+		stats.UnitDimensionless)
+
+	skippedVersions = stats.Int64(
+		"config/skipped_versions_total",
+		"Number of versions of the config directory which were replaced by a newer one before they were published.",
+		stats.UnitDimensionless)
+
+	degraded = stats.Int64(
+		"config/degraded",
+		"1 while the snapshot restored from the state file is served, 0 otherwise.",
+		stats.UnitDimensionless)
+
+	//FileTag holds the path of the config file for the context
+	FileTag tag.Key
+
+	durationBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10}
+)
+
+func init() {
+	var err error
+	if FileTag, err = tag.NewKey("file"); err != nil {
+		panic(err)
+	}
+	err = view.Register(
+		&view.View{Measure: buildDuration, Name: buildDuration.Name(), Description: buildDuration.Description(), Aggregation: view.Distribution(durationBuckets...)},
+		&view.View{Measure: resourceCount, Name: resourceCount.Name(), Description: resourceCount.Description(), Aggregation: view.LastValue(), TagKeys: []tag.Key{monitoring.CollectionTag}},
+		&view.View{Measure: snapshotVersion, Name: snapshotVersion.Name(), Description: snapshotVersion.Description(), Aggregation: view.LastValue(), TagKeys: []tag.Key{monitoring.CollectionTag}},
+		&view.View{Measure: skippedVersions, Name: skippedVersions.Name(), Description: skippedVersions.Description(), Aggregation: view.Count()},
+		&view.View{Measure: degraded, Name: degraded.Name(), Description: degraded.Description(), Aggregation: view.LastValue()},
+		&view.View{Measure: parseFailures, Name: parseFailures.Name(), Description: parseFailures.Description(), Aggregation: view.Count(), TagKeys: []tag.Key{FileTag}},
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func recordSnapshot(snapshot snapshot.Snapshot, version int, duration time.Duration) {
+	stats.Record(context.Background(), buildDuration.M(duration.Seconds()))
+	for _, collection := range collections {
+		ctx, err := tag.New(context.Background(), tag.Insert(monitoring.CollectionTag, collection))
+		if err != nil {
+			logging.Snapshot.Error("Can't create monitoring context", logging.Error(err))
+			return
+		}
+		stats.Record(ctx, resourceCount.M(int64(len(snapshot.Resources(collection)))), snapshotVersion.M(int64(version)))
+	}
+}
+
+func recordSkippedVersion() {
+	stats.Record(context.Background(), skippedVersions.M(1))
+}
+
+func recordDegraded(isDegraded bool) {
+	value := int64(0)
+	if isDegraded {
+		value = 1
+	}
+	stats.Record(context.Background(), degraded.M(value))
+}
+
+func recordParseFailure(file string) {
+	ctx, err := tag.New(context.Background(), tag.Insert(FileTag, file))
+	if err != nil {
+		logging.Watcher.Error("Can't create monitoring context", logging.Error(err))
+		return
+	}
+	stats.Record(ctx, parseFailures.M(1))
+}
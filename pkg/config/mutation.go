@@ -0,0 +1,260 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ghodss/yaml"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"io/ioutil"
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/model"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//MutatedByAnnotation is the annotation of resources changed or added by mutation policies, listing the policies
+//separated by commas
+const MutatedByAnnotation = "mcp-server.peripli.io/mutated-by"
+
+//policyNamePattern restricts policy names to DNS-1123 labels, they are part of the names of the configs added
+var policyNamePattern = regexp.MustCompile("^[a-z0-9]([-a-z0-9]*[a-z0-9])?$")
+
+//MutationPolicy injects defaults into the configs it selects when the snapshot is built, e.g. the timeouts teams
+//forget to set. Configs which set a value themselves keep it.
+type MutationPolicy struct {
+	Name string
+	//Namespaces restricts the policy to configs named <namespace>/<name> of these namespaces, "" selects configs
+	//without namespace. All namespaces are selected if empty.
+	Namespaces []string
+	//Labels restricts the policy to configs having all of these labels
+	Labels map[string]string
+	//TrafficPolicy of the destination rule added for every host of the selected service entries without
+	//destination rule. Nil if the policy adds no destination rules.
+	TrafficPolicy *networking.TrafficPolicy
+	//Timeout and Retries are set on the http routes of the selected virtual services which have none. Nil if the
+	//policy doesn't set them.
+	Timeout *types.Duration
+	Retries *networking.HTTPRetry
+}
+
+//mutationPolicyFile is the format of mutation policy files. The istio parts are decoded like the specs of configs.
+type mutationPolicyFile struct {
+	Policies []struct {
+		Name            string            `json:"name"`
+		Namespaces      []string          `json:"namespaces"`
+		Labels          map[string]string `json:"labels"`
+		DestinationRule *struct {
+			TrafficPolicy json.RawMessage `json:"trafficPolicy"`
+		} `json:"destinationRule"`
+		HTTPRoute *struct {
+			Timeout string          `json:"timeout"`
+			Retries json.RawMessage `json:"retries"`
+		} `json:"httpRoute"`
+	} `json:"policies"`
+}
+
+//LoadMutationPolicies reads a YAML file of mutation policies. They are applied in the order of the file.
+func LoadMutationPolicies(file string) ([]MutationPolicy, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := parseMutationPolicies(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mutation policy file %s: %v", file, err)
+	}
+	return policies, nil
+}
+
+//parseMutationPolicies parses and validates the content of a mutation policy file
+func parseMutationPolicies(content []byte) ([]MutationPolicy, error) {
+	content, err := yaml.YAMLToJSON(content)
+	if err != nil {
+		return nil, err
+	}
+	var file mutationPolicyFile
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, err
+	}
+	policies := make([]MutationPolicy, len(file.Policies))
+	names := make(map[string]bool)
+	for i, p := range file.Policies {
+		if !policyNamePattern.MatchString(p.Name) {
+			return nil, fmt.Errorf("policy %d: name %q must consist of lower case alphanumeric characters and dashes", i, p.Name)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("policy %s is defined twice", p.Name)
+		}
+		names[p.Name] = true
+		if p.DestinationRule == nil && p.HTTPRoute == nil {
+			return nil, fmt.Errorf("policy %s needs destinationRule or httpRoute", p.Name)
+		}
+		policy := MutationPolicy{Name: p.Name, Namespaces: p.Namespaces, Labels: p.Labels}
+		if p.DestinationRule != nil {
+			if len(p.DestinationRule.TrafficPolicy) == 0 {
+				return nil, fmt.Errorf("policy %s: destinationRule.trafficPolicy is required", p.Name)
+			}
+			policy.TrafficPolicy = &networking.TrafficPolicy{}
+			if err := model.ApplyJSON(string(p.DestinationRule.TrafficPolicy), policy.TrafficPolicy, true); err != nil {
+				return nil, fmt.Errorf("policy %s: invalid destinationRule.trafficPolicy: %v", p.Name, err)
+			}
+			sample := &networking.DestinationRule{Host: "example.com", TrafficPolicy: policy.TrafficPolicy}
+			if err := model.DestinationRule.Validate(p.Name, "", sample); err != nil {
+				return nil, fmt.Errorf("policy %s: invalid destinationRule.trafficPolicy: %v", p.Name, err)
+			}
+		}
+		if p.HTTPRoute != nil {
+			if p.HTTPRoute.Timeout == "" && len(p.HTTPRoute.Retries) == 0 {
+				return nil, fmt.Errorf("policy %s: httpRoute needs timeout or retries", p.Name)
+			}
+			if p.HTTPRoute.Timeout != "" {
+				timeout, err := time.ParseDuration(p.HTTPRoute.Timeout)
+				if err != nil {
+					return nil, fmt.Errorf("policy %s: invalid httpRoute.timeout: %v", p.Name, err)
+				}
+				policy.Timeout = types.DurationProto(timeout)
+			}
+			if len(p.HTTPRoute.Retries) > 0 {
+				policy.Retries = &networking.HTTPRetry{}
+				if err := model.ApplyJSON(string(p.HTTPRoute.Retries), policy.Retries, true); err != nil {
+					return nil, fmt.Errorf("policy %s: invalid httpRoute.retries: %v", p.Name, err)
+				}
+			}
+			sample := &networking.VirtualService{
+				Hosts: []string{"example.com"},
+				Http: []*networking.HTTPRoute{{
+					Route:   []*networking.HTTPRouteDestination{{Destination: &networking.Destination{Host: "example.com"}}},
+					Timeout: policy.Timeout,
+					Retries: policy.Retries,
+				}},
+			}
+			if err := model.VirtualService.Validate(p.Name, "", sample); err != nil {
+				return nil, fmt.Errorf("policy %s: invalid httpRoute: %v", p.Name, err)
+			}
+		}
+		policies[i] = policy
+	}
+	return policies, nil
+}
+
+//selects returns true if the policy applies to a config
+func (p *MutationPolicy) selects(c *Config) bool {
+	if len(p.Namespaces) > 0 {
+		namespace, _ := splitConfigName(c.Name)
+		selected := false
+		for _, n := range p.Namespaces {
+			selected = selected || n == namespace
+		}
+		if !selected {
+			return false
+		}
+	}
+	for key, value := range p.Labels {
+		if v, ok := c.Labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+//applyMutationPolicies returns the configs with the defaults of the policies injected. Mutated configs are
+//copies, the configs of the sources are left unchanged. Added configs have the origin and the labels of the
+//config they were added for.
+func applyMutationPolicies(policies []MutationPolicy, configs []Config) ([]Config, error) {
+	if len(policies) == 0 {
+		return configs, nil
+	}
+	result := make([]Config, len(configs))
+	copy(result, configs)
+	origins := make(map[string]string)
+	hosts := make(map[string]bool)
+	for _, c := range result {
+		origins[c.Type+"/"+c.Name] = c.Origin
+		if c.Type == model.DestinationRule.Type {
+			hosts[c.Spec.(*networking.DestinationRule).Host] = true
+		}
+	}
+	for i := range policies {
+		policy := &policies[i]
+		for j := range result {
+			c := result[j]
+			if !policy.selects(&c) {
+				continue
+			}
+			switch {
+			case c.Type == model.ServiceEntry.Type && policy.TrafficPolicy != nil:
+				for _, host := range c.Spec.(*networking.ServiceEntry).Hosts {
+					if hosts[host] {
+						continue
+					}
+					name := destinationRuleName(c.Name, policy.Name, host)
+					key := model.DestinationRule.Type + "/" + name
+					if origin, ok := origins[key]; ok {
+						return nil, NewValidationError(c.Origin, fmt.Errorf("destination rule %s added by mutation policy %s for host %s is also defined in %s",
+							name, policy.Name, host, origin))
+					}
+					hosts[host] = true
+					origins[key] = c.Origin
+					result = append(result, Config{
+						Type:        model.DestinationRule.Type,
+						Name:        name,
+						Spec:        &networking.DestinationRule{Host: host, TrafficPolicy: proto.Clone(policy.TrafficPolicy).(*networking.TrafficPolicy)},
+						Origin:      c.Origin,
+						Annotations: mutatedBy(c.Annotations, policy.Name),
+						Labels:      c.Labels,
+					})
+				}
+			case c.Type == model.VirtualService.Type && (policy.Timeout != nil || policy.Retries != nil):
+				virtualService := c.Spec.(*networking.VirtualService)
+				var mutated *networking.VirtualService
+				for k, route := range virtualService.Http {
+					if (route.Timeout != nil || policy.Timeout == nil) && (route.Retries != nil || policy.Retries == nil) {
+						continue
+					}
+					if mutated == nil {
+						mutated = proto.Clone(virtualService).(*networking.VirtualService)
+					}
+					if route.Timeout == nil && policy.Timeout != nil {
+						mutated.Http[k].Timeout = proto.Clone(policy.Timeout).(*types.Duration)
+					}
+					if route.Retries == nil && policy.Retries != nil {
+						mutated.Http[k].Retries = proto.Clone(policy.Retries).(*networking.HTTPRetry)
+					}
+				}
+				if mutated != nil {
+					c.Spec = mutated
+					c.Annotations = mutatedBy(c.Annotations, policy.Name)
+					result[j] = c
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+//destinationRuleName returns the name of the destination rule a policy adds for a host of a service entry. It is
+//in the namespace of the service entry.
+func destinationRuleName(serviceEntry string, policy string, host string) string {
+	name := policy + "-" + strings.Replace(strings.ToLower(host), "*", "wildcard", -1)
+	namespace, _ := splitConfigName(serviceEntry)
+	return ConfigName(namespace, name)
+}
+
+//mutatedBy returns a copy of annotations with a policy added to the MutatedByAnnotation
+func mutatedBy(annotations map[string]string, policy string) map[string]string {
+	result := make(map[string]string, len(annotations)+1)
+	for key, value := range annotations {
+		result[key] = value
+	}
+	if policies, ok := result[MutatedByAnnotation]; ok {
+		result[MutatedByAnnotation] = policies + "," + policy
+	} else {
+		result[MutatedByAnnotation] = policy
+	}
+	return result
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"github.com/gogo/protobuf/types"
+	. "github.com/onsi/gomega"
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/galley/pkg/metadata"
+	"istio.io/istio/pilot/pkg/model"
+	"testing"
+	"time"
+)
+
+func httpVirtualService(name string, labels map[string]string, timeout *types.Duration) Config {
+	return Config{
+		Type: model.VirtualService.Type,
+		Name: name,
+		Spec: &networking.VirtualService{
+			Hosts: []string{"payments.example.com"},
+			Http: []*networking.HTTPRoute{
+				{Route: []*networking.HTTPRouteDestination{{Destination: &networking.Destination{Host: "payments.service"}}}},
+				{Route: []*networking.HTTPRouteDestination{{Destination: &networking.Destination{Host: "payments.service"}}}, Timeout: timeout},
+			},
+		},
+		Origin: "payments.yaml",
+		Labels: labels,
+	}
+}
+
+func TestLoadMutationPolicies(t *testing.T) {
+	g := NewGomegaWithT(t)
+	policies, err := LoadMutationPolicies("../../test/mutation-policies.yaml")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(policies).To(HaveLen(2))
+	g.Expect(policies[0].Name).To(Equal("default-traffic-policy"))
+	g.Expect(policies[0].TrafficPolicy.ConnectionPool.Tcp.MaxConnections).To(Equal(int32(100)))
+	g.Expect(policies[1].Labels).To(Equal(map[string]string{"team": "payments"}))
+	g.Expect(policies[1].Timeout).To(Equal(types.DurationProto(15 * time.Second)))
+	g.Expect(policies[1].Retries.Attempts).To(Equal(int32(3)))
+
+	for _, invalid := range []struct{ content, problem string }{
+		{"policies:\n- name: Default\n  httpRoute: {timeout: 1s}\n", "lower case"},
+		{"policies:\n- name: a\n  httpRoute: {timeout: 1s}\n- name: a\n  httpRoute: {timeout: 1s}\n", "defined twice"},
+		{"policies:\n- name: a\n", "needs destinationRule or httpRoute"},
+		{"policies:\n- name: a\n  httpRoute: {timeout: 1s}\n  scope: mesh\n", "unknown field"},
+		{"policies:\n- name: a\n  httpRoute: {timeout: soon}\n", "invalid httpRoute.timeout"},
+		{"policies:\n- name: a\n  httpRoute: {retries: {tries: 3}}\n", "invalid httpRoute.retries"},
+		{"policies:\n- name: a\n  destinationRule: {trafficPolicy: {outlierDetection: {consecutiveErrors: -1}}}\n", "invalid destinationRule.trafficPolicy"},
+	} {
+		_, err := parseMutationPolicies([]byte(invalid.content))
+		g.Expect(err).To(MatchError(ContainSubstring(invalid.problem)), invalid.content)
+	}
+}
+
+func TestApplyMutationPolicies(t *testing.T) {
+	g := NewGomegaWithT(t)
+	policies, err := LoadMutationPolicies("../../test/mutation-policies.yaml")
+	g.Expect(err).NotTo(HaveOccurred())
+	pinger := parseFile(t, "../../test/config/istio-pinger.yaml")
+	payments := httpVirtualService("mesh/payments", map[string]string{"team": "payments"}, types.DurationProto(time.Minute))
+	orders := httpVirtualService("mesh/orders", map[string]string{"team": "orders"}, nil)
+	configs := append(pinger, payments, orders)
+
+	mutated, err := applyMutationPolicies(policies, configs)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mutated).To(HaveLen(len(configs) + 1))
+	destinationRule := mutated[len(configs)]
+	g.Expect(destinationRule.Type).To(Equal(model.DestinationRule.Type))
+	g.Expect(destinationRule.Name).To(Equal("default-traffic-policy-istio-pinger.istio"))
+	g.Expect(destinationRule.Origin).To(Equal("../../test/config/istio-pinger.yaml"))
+	g.Expect(destinationRule.Annotations).To(Equal(map[string]string{MutatedByAnnotation: "default-traffic-policy"}))
+	g.Expect(destinationRule.Spec.(*networking.DestinationRule).Host).To(Equal("istio-pinger.istio"))
+	g.Expect(destinationRule.Spec.(*networking.DestinationRule).TrafficPolicy.OutlierDetection.ConsecutiveErrors).To(Equal(int32(5)))
+
+	// only the routes of the payments team without value are mutated, the configs of the sources stay unchanged
+	mutatedPayments := mutated[len(pinger)]
+	g.Expect(mutatedPayments.Annotations).To(HaveKeyWithValue(MutatedByAnnotation, "payments-http-defaults"))
+	routes := mutatedPayments.Spec.(*networking.VirtualService).Http
+	g.Expect(routes[0].Timeout).To(Equal(types.DurationProto(15 * time.Second)))
+	g.Expect(routes[0].Retries.Attempts).To(Equal(int32(3)))
+	g.Expect(routes[1].Timeout).To(Equal(types.DurationProto(time.Minute)))
+	g.Expect(payments.Spec.(*networking.VirtualService).Http[0].Timeout).To(BeNil())
+	g.Expect(payments.Annotations).To(BeNil())
+	g.Expect(mutated[len(pinger)+1]).To(Equal(orders))
+
+	// hosts with destination rule keep it
+	withRule := append(configs, parseFile(t, "../../test/config/istio-pinger-destination-rule.yaml")...)
+	mutated, err = applyMutationPolicies(policies, withRule)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mutated).To(HaveLen(len(withRule)))
+
+	// policies are scoped by namespace
+	policies[1].Namespaces = []string{"payments"}
+	mutated, err = applyMutationPolicies(policies[1:], []Config{payments})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mutated[0]).To(Equal(payments))
+
+	snapshot, err := buildSnapshot(&ConfigSet{Configs: pinger}, 1, policies)
+	g.Expect(err).NotTo(HaveOccurred())
+	destinationRules := snapshot.Resources(metadata.IstioNetworkingV1alpha3Destinationrules.Collection.String())
+	g.Expect(destinationRules).To(HaveLen(1))
+	g.Expect(destinationRules[0].Metadata.Annotations).To(HaveKeyWithValue(MutatedByAnnotation, "default-traffic-policy"))
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+//ReadinessOptions configures when a config directory is considered not ready to be served
+type ReadinessOptions struct {
+	//NotReadyIfUnreadable turns readiness off as soon as the directory can't be read. It doesn't apply while
+	//the snapshot restored from the state file is served.
+	NotReadyIfUnreadable bool
+	//MaxValidationFailure is the time the directory content may be invalid before readiness
+	//is turned off. Zero keeps serving the last valid snapshot without limit.
+	MaxValidationFailure time.Duration
+}
+
+//Ready returns an error describing why a snapshot built from the directory must not be considered ready
+func (s Status) Ready(options ReadinessOptions, now time.Time) error {
+	if s.Version == 0 && !s.Degraded {
+		if s.LastError != nil {
+			return fmt.Errorf("no snapshot built yet: %v", s.LastError)
+		}
+		return errors.New("no snapshot built yet")
+	}
+	if s.LastError == nil {
+		return nil
+	}
+	if s.Unreadable && options.NotReadyIfUnreadable && !s.Degraded {
+		return fmt.Errorf("config directory unreadable: %v", s.LastError)
+	}
+	if !s.Unreadable && options.MaxValidationFailure > 0 && now.Sub(s.FailingSince) > options.MaxValidationFailure {
+		return fmt.Errorf("config directory invalid since %s: %v", s.FailingSince.Format(time.RFC3339), s.LastError)
+	}
+	return nil
+}
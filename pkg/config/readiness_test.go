@@ -0,0 +1,46 @@
+package config
+
+import (
+	"errors"
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+func TestReadinessBeforeFirstSnapshot(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(Status{}.Ready(ReadinessOptions{}, time.Now())).To(HaveOccurred())
+	g.Expect(Status{LastError: errors.New("boom"), Unreadable: true}.Ready(ReadinessOptions{}, time.Now())).To(HaveOccurred())
+}
+
+func TestReadinessAfterSuccess(t *testing.T) {
+	g := NewGomegaWithT(t)
+	status := Status{Version: 1, LastSuccess: time.Now()}
+	g.Expect(status.Ready(ReadinessOptions{NotReadyIfUnreadable: true, MaxValidationFailure: time.Second}, time.Now())).To(Succeed())
+}
+
+func TestReadinessUnreadable(t *testing.T) {
+	g := NewGomegaWithT(t)
+	now := time.Now()
+	status := Status{Version: 2, LastError: errors.New("no such directory"), FailingSince: now, Unreadable: true}
+	g.Expect(status.Ready(ReadinessOptions{NotReadyIfUnreadable: true}, now)).To(HaveOccurred())
+	g.Expect(status.Ready(ReadinessOptions{NotReadyIfUnreadable: false}, now)).To(Succeed())
+}
+
+func TestReadinessValidationFailure(t *testing.T) {
+	g := NewGomegaWithT(t)
+	now := time.Now()
+	status := Status{Version: 2, LastError: errors.New("invalid yaml"), FailingSince: now.Add(-time.Minute)}
+	options := ReadinessOptions{NotReadyIfUnreadable: true, MaxValidationFailure: 2 * time.Minute}
+	g.Expect(status.Ready(options, now)).To(Succeed())
+	g.Expect(status.Ready(options, now.Add(2*time.Minute))).To(HaveOccurred())
+	g.Expect(status.Ready(ReadinessOptions{}, now.Add(time.Hour))).To(Succeed())
+}
+
+func TestReadinessDegraded(t *testing.T) {
+	g := NewGomegaWithT(t)
+	now := time.Now()
+	status := Status{LastError: errors.New("no such directory"), FailingSince: now, Unreadable: true, Degraded: true}
+	g.Expect(status.Ready(ReadinessOptions{}, now)).To(Succeed())
+	g.Expect(status.Ready(ReadinessOptions{NotReadyIfUnreadable: true}, now)).To(Succeed())
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"go.uber.org/zap"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"sort"
+	"time"
+)
+
+//Rollback describes a collection served at its last accepted version instead of the latest one
+type Rollback struct {
+	Collection      string    `json:"collection"`
+	RejectedVersion string    `json:"rejectedVersion"`
+	Version         string    `json:"version"`
+	Reason          string    `json:"reason"`
+	Time            time.Time `json:"time"`
+}
+
+type acceptedCollection struct {
+	version   string
+	resources []*mcp.Resource
+}
+
+//Accept records version as the last version of collection applied by all sinks
+func (c *configWatcher) Accept(collection string, version string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.accepted[collection].version == version {
+		return
+	}
+	for i := len(c.history) - 1; i >= 0; i-- {
+		if c.history[i].Snapshot.Version(collection) == version {
+			c.accepted[collection] = acceptedCollection{version, c.history[i].Snapshot.Resources(collection)}
+			return
+		}
+	}
+}
+
+//Rollback serves the last accepted version of collection until Resume is called
+func (c *configWatcher) Rollback(collection string, reason string) (Rollback, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if rollback, ok := c.rollbacks[collection]; ok {
+		return rollback, nil
+	}
+	accepted, ok := c.accepted[collection]
+	if !ok {
+		return Rollback{}, fmt.Errorf("no accepted version of collection %s", collection)
+	}
+	if c.stable.Version(collection) == accepted.version {
+		return Rollback{}, fmt.Errorf("collection %s is already served at its accepted version %s", collection, accepted.version)
+	}
+	rollback := Rollback{
+		Collection:      collection,
+		RejectedVersion: c.stable.Version(collection),
+		Version:         accepted.version,
+		Reason:          reason,
+		Time:            time.Now(),
+	}
+	c.rollbacks[collection] = rollback
+	logging.Snapshot.Warn("Rolling back collection", logging.Collection(collection), zap.String("rejectedVersion", rollback.RejectedVersion),
+		logging.CollectionVersion(rollback.Version), zap.String("reason", reason))
+	c.publish()
+	return rollback, nil
+}
+
+//Resume serves the latest version of a rolled back collection again
+func (c *configWatcher) Resume(collection string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.rollbacks[collection]; !ok {
+		return fmt.Errorf("collection %s is not rolled back", collection)
+	}
+	delete(c.rollbacks, collection)
+	logging.Snapshot.Info("Resuming collection", logging.Collection(collection), logging.CollectionVersion(c.stable.Version(collection)))
+	c.publish()
+	return nil
+}
+
+//Rollbacks returns the collections currently rolled back ordered by name
+func (c *configWatcher) Rollbacks() []Rollback {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	result := make([]Rollback, 0, len(c.rollbacks))
+	for _, rollback := range c.rollbacks {
+		result = append(result, rollback)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Collection < result[j].Collection
+	})
+	return result
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"istio.io/istio/galley/pkg/metadata"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	g := NewGomegaWithT(t)
+	serviceEntries := metadata.IstioNetworkingV1alpha3Serviceentries.Collection.String()
+	virtualServices := metadata.IstioNetworkingV1alpha3Virtualservices.Collection.String()
+	cwd, err := os.Getwd()
+	g.Expect(err).NotTo(HaveOccurred())
+	dir, err := ioutil.TempDir(cwd, "service-manager-istio-mcp-server")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	err = os.Link("../../test/config/istio-pinger.yaml", path.Join(dir, "istio-pinger.yaml"))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	configWatcher, err := newConfigWatcher(dir, &Options{})
+	g.Expect(err).NotTo(HaveOccurred())
+	defer configWatcher.Stop()
+	accepted := configWatcher.Snapshot().Version(serviceEntries)
+
+	_, err = configWatcher.Rollback(serviceEntries, "no accepted version")
+	g.Expect(err).To(HaveOccurred())
+	configWatcher.Accept(serviceEntries, accepted)
+	_, err = configWatcher.Rollback(serviceEntries, "latest version is accepted")
+	g.Expect(err).To(HaveOccurred())
+
+	err = os.Link("../../test/config/sub/istio-test.yaml", path.Join(dir, "istio-test.yaml"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Eventually(func() int {
+		return len(configWatcher.Snapshot().Resources(serviceEntries))
+	}).Should(Equal(2))
+	rejected := configWatcher.Snapshot().Version(serviceEntries)
+
+	rollback, err := configWatcher.Rollback(serviceEntries, "NACKed")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rollback.Version).To(Equal(accepted))
+	g.Expect(rollback.RejectedVersion).To(Equal(rejected))
+	g.Expect(configWatcher.Rollbacks()).To(Equal([]Rollback{rollback}))
+	served := configWatcher.Snapshot()
+	g.Expect(served.Version(serviceEntries)).To(Equal(accepted))
+	g.Expect(served.Resources(serviceEntries)).To(HaveLen(1))
+	g.Expect(served.Resources(virtualServices)).To(HaveLen(2))
+
+	g.Expect(configWatcher.Resume(serviceEntries)).To(Succeed())
+	g.Expect(configWatcher.Rollbacks()).To(BeEmpty())
+	served = configWatcher.Snapshot()
+	g.Expect(served.Version(serviceEntries)).To(Equal(rejected))
+	g.Expect(served.Resources(serviceEntries)).To(HaveLen(2))
+	g.Expect(configWatcher.Resume(serviceEntries)).To(HaveOccurred())
+}
@@ -0,0 +1,239 @@
+package config
+
+import (
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/zap"
+	"istio.io/istio/pilot/pkg/config/kube/crd"
+	"istio.io/istio/pkg/mcp/snapshot"
+	"strings"
+	"sync"
+)
+
+//RevisionAnnotation is the annotation of resources recording the revision of the source they were read
+//at, e.g. a commit SHA
+const RevisionAnnotation = "mcp-server.peripli.io/revision"
+
+//Source provides istio configs to a Watcher, e.g. the files of a directory
+type Source interface {
+	//Name identifies the source in logs, errors and the history
+	Name() string
+	//Read returns the current configs of the source. A *ValidationError is returned if the
+	//configs could be read but are invalid.
+	Read() (*ConfigSet, error)
+	//Watch starts watching the source and returns. Until stop is closed, changed is called
+	//whenever the configs of the source may have changed.
+	Watch(changed func(), stop <-chan struct{}) error
+}
+
+//Syncer is implemented by sources whose configs are received asynchronously, e.g. by informers. Their Read
+//doesn't wait for the configs, the watcher waits for the initial sync before it reads the sources the first time.
+type Syncer interface {
+	//WaitForSync starts receiving the configs and returns once they were received or a timeout expired
+	WaitForSync() error
+}
+
+//waitForSync waits for the initial sync of all sources which are Syncers in parallel
+func waitForSync(sources []Source) {
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		if p, ok := source.(*precedenceSource); ok {
+			source = p.Source
+		}
+		syncer, ok := source.(Syncer)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := syncer.WaitForSync(); err != nil {
+				logging.Watcher.Warn("Source didn't sync", zap.String("source", name), logging.Error(err))
+			}
+		}(source.Name())
+	}
+	wg.Wait()
+}
+
+//precedenceSource is a Source whose configs override or yield to the configs of the same name of other sources
+type precedenceSource struct {
+	Source
+	precedence int
+}
+
+//WithPrecedence sets the precedence of the configs of a source. If several sources provide a config of the same
+//name, the one with the highest precedence is served. Sources have precedence 0 by default, configs provided by
+//several sources of the same precedence are invalid.
+func WithPrecedence(source Source, precedence int) Source {
+	return &precedenceSource{Source: source, precedence: precedence}
+}
+
+//precedence returns the precedence of a source
+func precedence(source Source) int {
+	if p, ok := source.(*precedenceSource); ok {
+		return p.precedence
+	}
+	return 0
+}
+
+//Config is a parsed istio config
+type Config struct {
+	//Type is the istio config type, e.g. gateway
+	Type string
+	//Name is <namespace>/<name> if the config has a namespace, see ConfigName
+	Name string
+	Spec proto.Message
+	//Origin is the part of the source the config was read from, e.g. a file
+	Origin string
+	//Annotations are added to the metadata of the resource served for the config, e.g. its provenance
+	Annotations map[string]string
+	//Labels of the config, e.g. of its metadata. Mutation policies select configs by them.
+	Labels map[string]string
+}
+
+//ConfigSet is the content of a Source
+type ConfigSet struct {
+	Configs []Config
+	//Files are the content hashes of the parts the configs were read from by name, e.g. of the files of a directory.
+	//The history reports which of them changed between two versions.
+	Files map[string]string
+	//Revision identifies the state of the source, e.g. a commit SHA. It is part of the snapshot version.
+	//Empty if the source has no revisions.
+	Revision string
+}
+
+//ValidationError is returned if the content of a source could be read but is invalid
+type ValidationError struct {
+	//File is the part of the source which is invalid, empty if unknown
+	File string
+	error
+}
+
+//NewValidationError creates a ValidationError of file
+func NewValidationError(file string, err error) error {
+	return &ValidationError{file, err}
+}
+
+//ConfigName returns the name a config is served with: <namespace>/<name> the way sinks name kubernetes
+//resources, the name alone if the config has no namespace
+func ConfigName(namespace string, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+//splitConfigName returns the namespace and the name of a config named by ConfigName
+func splitConfigName(name string) (string, string) {
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+//ParseConfigs parses the YAML documents of a file into istio configs of the supported types and exposed services.
+//The namespace of their metadata is part of their name.
+func ParseConfigs(file string, content []byte) ([]Config, error) {
+	istioConfigs, others, err := crd.ParseInputs(string(content))
+	if err != nil {
+		return nil, NewValidationError(file, fmt.Errorf("unable to parse content of file %s: %v", file, err))
+	}
+	result := make([]Config, 0, len(istioConfigs))
+	for _, config := range istioConfigs {
+		if _, ok := collections[config.Type]; !ok {
+			return nil, NewValidationError(file, fmt.Errorf("proto format error: config type %s unknown in file %s", config.Type, file))
+		}
+		result = append(result, Config{Type: config.Type, Name: ConfigName(config.Namespace, config.Name), Spec: config.Spec, Origin: file, Labels: config.Labels})
+	}
+	for i := range others {
+		if others[i].Kind != ExposedServiceKind {
+			continue
+		}
+		config, err := parseExposedService(file, &others[i])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, config)
+	}
+	return result, nil
+}
+
+//mergeConfigSets combines the config sets of several sources. A config provided by several sources is taken
+//from the source with the highest precedence. The exposed services of each source are expanded before, so that
+//precedence applies to the configs expanded from them. Files are prefixed with the name of their source if there is
+//more than one, the revisions of the sources are joined by commas.
+func mergeConfigSets(sources []Source, sets []*ConfigSet) (*ConfigSet, error) {
+	if len(sets) == 1 {
+		return sets[0], nil
+	}
+	type owner struct {
+		source     string
+		precedence int
+		index      int
+	}
+	merged := &ConfigSet{Files: make(map[string]string)}
+	var revisions []string
+	owners := make(map[string]owner)
+	for i, set := range sets {
+		name := sources[i].Name()
+		sourcePrecedence := precedence(sources[i])
+		configs, err := expandExposedServices(set.Configs)
+		if err != nil {
+			return nil, err
+		}
+		for _, config := range configs {
+			key := config.Type + "/" + config.Name
+			current, ok := owners[key]
+			switch {
+			case !ok:
+				owners[key] = owner{source: name, precedence: sourcePrecedence, index: len(merged.Configs)}
+				merged.Configs = append(merged.Configs, config)
+			case current.source == name:
+				merged.Configs = append(merged.Configs, config)
+			case current.precedence == sourcePrecedence:
+				return nil, NewValidationError(config.Origin,
+					fmt.Errorf("%s %s of source %s is also provided by source %s", config.Type, config.Name, name, current.source))
+			case current.precedence < sourcePrecedence:
+				logging.Watcher.Debug("Overriding config", zap.String("type", config.Type), zap.String("name", config.Name),
+					zap.String("source", name), zap.String("overridden", current.source))
+				owners[key] = owner{source: name, precedence: sourcePrecedence, index: current.index}
+				merged.Configs[current.index] = config
+			default:
+				logging.Watcher.Debug("Overriding config", zap.String("type", config.Type), zap.String("name", config.Name),
+					zap.String("source", current.source), zap.String("overridden", name))
+			}
+		}
+		for file, hash := range set.Files {
+			merged.Files[name+":"+file] = hash
+		}
+		if set.Revision != "" {
+			revisions = append(revisions, set.Revision)
+		}
+	}
+	merged.Revision = strings.Join(revisions, ",")
+	return merged, nil
+}
+
+//buildSnapshot wraps the configs of a set into the resources of a snapshot. Exposed services which haven't been
+//expanded by mergeConfigSets are expanded into their istio configs, then the mutation policies are applied. The collections get the version <version>.0,
+//followed by -<revision> if the set has a revision.
+func buildSnapshot(set *ConfigSet, version int, policies []MutationPolicy) (snapshot.Snapshot, error) {
+	configs, err := expandExposedServices(set.Configs)
+	if err != nil {
+		return nil, err
+	}
+	configs, err = applyMutationPolicies(policies, configs)
+	if err != nil {
+		return nil, err
+	}
+	byType := make(map[string][]namedSpec)
+	for _, config := range configs {
+		byType[config.Type] = append(byType[config.Type], namedSpec{config.Name, config.Spec, config.Annotations})
+	}
+	stringVersion := fmt.Sprintf("%d.0", version)
+	if set.Revision != "" {
+		stringVersion += "-" + set.Revision
+	}
+	return configMapToSnapshot(byType, stringVersion)
+}
@@ -0,0 +1,272 @@
+package config
+
+import (
+	"errors"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"istio.io/istio/galley/pkg/metadata"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//memorySource is a Source serving configs set by the test
+type memorySource struct {
+	name    string
+	mutex   sync.Mutex
+	set     *ConfigSet
+	err     error
+	changed func()
+}
+
+func (s *memorySource) Name() string {
+	return s.name
+}
+
+func (s *memorySource) Read() (*ConfigSet, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.set, s.err
+}
+
+func (s *memorySource) Watch(changed func(), stop <-chan struct{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.changed = changed
+	return nil
+}
+
+func (s *memorySource) update(set *ConfigSet, err error) {
+	s.mutex.Lock()
+	s.set, s.err = set, err
+	changed := s.changed
+	s.mutex.Unlock()
+	changed()
+}
+
+//syncingSource is a memorySource whose configs are received by WaitForSync
+type syncingSource struct {
+	memorySource
+	configs *ConfigSet
+}
+
+func (s *syncingSource) WaitForSync() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.set, s.err = s.configs, nil
+	return nil
+}
+
+func fileContent(t *testing.T, filename string) string {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func parseFile(t *testing.T, filename string) []Config {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs, err := ParseConfigs(filename, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configs
+}
+
+func TestParseConfigs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configs := parseFile(t, "../../test/config/istio-pinger.yaml")
+	g.Expect(configs).To(HaveLen(3))
+	g.Expect(configs[0].Origin).To(Equal("../../test/config/istio-pinger.yaml"))
+
+	_, err := ParseConfigs("invalid.yaml", []byte("kind: Gateway\napiVersion: networking.istio.io/v1alpha3\nspec: [\n"))
+	g.Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+	g.Expect(err.(*ValidationError).File).To(Equal("invalid.yaml"))
+
+	// the namespace is part of the name of the resources, like the sinks name kubernetes resources
+	configs, err = ParseConfigs("namespaced.yaml", []byte(`apiVersion: networking.istio.io/v1alpha3
+kind: ServiceEntry
+metadata:
+  name: pinger
+  namespace: mesh
+spec:
+  hosts: [istio-pinger.istio]
+  ports: [{number: 8081, name: pinger, protocol: TCP}]
+  resolution: STATIC
+  endpoints: [{address: 10.0.81.2}]
+`))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configs[0].Name).To(Equal("mesh/pinger"))
+	s, err := buildSnapshot(&ConfigSet{Configs: configs}, 1, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(s.Resources(metadata.IstioNetworkingV1alpha3Serviceentries.Collection.String())[0].Metadata.Name).To(Equal("mesh/pinger"))
+}
+
+func TestMergeConfigSets(t *testing.T) {
+	g := NewGomegaWithT(t)
+	pinger := &ConfigSet{Configs: parseFile(t, "../../test/config/istio-pinger.yaml"), Files: map[string]string{"istio-pinger.yaml": "1"}}
+	test := &ConfigSet{Configs: parseFile(t, "../../test/config/sub/istio-test.yaml"), Files: map[string]string{"istio-test.yaml": "2"}}
+	first, second := &memorySource{name: "first"}, &memorySource{name: "second"}
+
+	merged, err := mergeConfigSets([]Source{first}, []*ConfigSet{pinger})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(merged).To(Equal(pinger))
+
+	merged, err = mergeConfigSets([]Source{first, second}, []*ConfigSet{pinger, test})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(merged.Configs).To(HaveLen(len(pinger.Configs) + len(test.Configs)))
+	g.Expect(merged.Files).To(Equal(map[string]string{"first:istio-pinger.yaml": "1", "second:istio-test.yaml": "2"}))
+
+	_, err = mergeConfigSets([]Source{first, second}, []*ConfigSet{pinger, pinger})
+	g.Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+	g.Expect(err).To(MatchError(ContainSubstring("also provided by source first")))
+
+	// configs of a source with higher precedence override the others regardless of the order
+	central := &ConfigSet{Configs: parseFile(t, "../../test/config/istio-pinger.yaml")}
+	for i := range central.Configs {
+		central.Configs[i].Origin = "central"
+	}
+	for _, sources := range [][]Source{{first, WithPrecedence(second, -1)}, {WithPrecedence(second, -1), first}} {
+		sets := []*ConfigSet{pinger, central}
+		if sources[0] != first {
+			sets = []*ConfigSet{central, pinger}
+		}
+		merged, err = mergeConfigSets(sources, sets)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(merged.Configs).To(HaveLen(len(pinger.Configs)))
+		for _, config := range merged.Configs {
+			g.Expect(config.Origin).NotTo(Equal("central"))
+		}
+	}
+
+	// configs of files with namespace override the resources of that namespace of other sources
+	galley := &ConfigSet{Configs: []Config{{Type: pinger.Configs[0].Type, Name: "istio/" + pinger.Configs[0].Name, Spec: pinger.Configs[0].Spec, Origin: "galley"}}}
+	local, err := ParseConfigs("local.yaml", []byte(strings.Replace(fileContent(t, "../../test/config/istio-pinger.yaml"), "metadata:\n", "metadata:\n  namespace: istio\n", 1)))
+	g.Expect(err).NotTo(HaveOccurred())
+	merged, err = mergeConfigSets([]Source{first, WithPrecedence(second, -1)}, []*ConfigSet{{Configs: local[:1]}, galley})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(merged.Configs).To(HaveLen(1))
+	g.Expect(merged.Configs[0].Origin).To(Equal("local.yaml"))
+}
+
+func TestBuildSnapshotWithRevision(t *testing.T) {
+	g := NewGomegaWithT(t)
+	gateways := metadata.IstioNetworkingV1alpha3Gateways.Collection.String()
+	configs := parseFile(t, "../../test/config/istio-pinger.yaml")
+	for i := range configs {
+		configs[i].Annotations = map[string]string{RevisionAnnotation: "0a1b2c"}
+	}
+	s, err := buildSnapshot(&ConfigSet{Configs: configs}, 3, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(s.Version(gateways)).To(Equal("3.0"))
+
+	s, err = buildSnapshot(&ConfigSet{Configs: configs, Revision: "0a1b2c"}, 3, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(s.Version(gateways)).To(Equal("3.0-0a1b2c"))
+	g.Expect(s.Resources(gateways)[0].Metadata.Annotations).To(Equal(map[string]string{RevisionAnnotation: "0a1b2c"}))
+}
+
+func TestWatcherWithSources(t *testing.T) {
+	g := NewGomegaWithT(t)
+	serviceEntries := metadata.IstioNetworkingV1alpha3Serviceentries.Collection.String()
+	first := &memorySource{name: "first", set: &ConfigSet{Configs: parseFile(t, "../../test/config/istio-pinger.yaml")}}
+	second := &memorySource{name: "second", set: &ConfigSet{}}
+
+	_, err := newWatcher(nil, &Options{})
+	g.Expect(err).To(HaveOccurred())
+
+	configWatcher, err := newWatcher([]Source{first, second}, &Options{})
+	g.Expect(err).NotTo(HaveOccurred())
+	defer configWatcher.Stop()
+	g.Expect(configWatcher.Snapshot().Resources(serviceEntries)).To(HaveLen(1))
+
+	second.update(&ConfigSet{Configs: parseFile(t, "../../test/config/sub/istio-test.yaml")}, nil)
+	g.Eventually(func() int { return configWatcher.Status().Version }).Should(Equal(2))
+	g.Expect(configWatcher.Snapshot().Resources(serviceEntries)).To(HaveLen(2))
+
+	second.update(nil, errors.New("unavailable"))
+	g.Eventually(func() error { return configWatcher.Status().LastError }).Should(HaveOccurred())
+	g.Expect(configWatcher.Status().Unreadable).To(BeTrue())
+	g.Expect(configWatcher.Snapshot().Resources(serviceEntries)).To(HaveLen(2))
+
+	second.update(&ConfigSet{Configs: parseFile(t, "../../test/config/istio-pinger.yaml")}, nil)
+	g.Eventually(func() bool { return configWatcher.Status().Unreadable }).Should(BeFalse())
+	g.Expect(configWatcher.Status().LastError).To(BeAssignableToTypeOf(&ValidationError{}))
+	g.Expect(configWatcher.Status().Version).To(Equal(2))
+}
+
+func TestWatcherWaitsForSync(t *testing.T) {
+	g := NewGomegaWithT(t)
+	serviceEntries := metadata.IstioNetworkingV1alpha3Serviceentries.Collection.String()
+	source := &syncingSource{
+		memorySource: memorySource{name: "syncing", err: errors.New("not synced")},
+		configs:      &ConfigSet{Configs: parseFile(t, "../../test/config/istio-pinger.yaml")},
+	}
+	configWatcher, err := newWatcher([]Source{WithPrecedence(source, 1)}, &Options{})
+	g.Expect(err).NotTo(HaveOccurred())
+	defer configWatcher.Stop()
+	g.Expect(configWatcher.Snapshot().Resources(serviceEntries)).To(HaveLen(1))
+}
+
+func TestWatcherCheck(t *testing.T) {
+	g := NewGomegaWithT(t)
+	pinger := parseFile(t, "../../test/config/istio-pinger.yaml")
+	first := &memorySource{name: "first", set: &ConfigSet{Configs: pinger}}
+	second := &memorySource{name: "second", set: &ConfigSet{}}
+	configWatcher, err := newWatcher([]Source{first, WithPrecedence(second, 0)}, &Options{})
+	g.Expect(err).NotTo(HaveOccurred())
+	defer configWatcher.Stop()
+
+	g.Expect(configWatcher.Check(second, &ConfigSet{Configs: parseFile(t, "../../test/config/sub/istio-test.yaml")})).To(Succeed())
+	err = configWatcher.Check(second, &ConfigSet{Configs: pinger})
+	g.Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+	g.Expect(err).To(MatchError(ContainSubstring("is also provided by source first")))
+	g.Expect(configWatcher.Check(&memorySource{name: "other"}, &ConfigSet{})).To(MatchError(ContainSubstring("no source")))
+
+	// the snapshot isn't served
+	g.Expect(configWatcher.Status().Version).To(Equal(1))
+
+	// an unreadable source is checked with the configs last read from it
+	first.update(nil, errors.New("unavailable"))
+	g.Eventually(func() error { return configWatcher.Status().LastError }).Should(HaveOccurred())
+	g.Expect(configWatcher.Check(second, &ConfigSet{})).To(Succeed())
+	err = configWatcher.Check(second, &ConfigSet{Configs: pinger})
+	g.Expect(err).To(MatchError(ContainSubstring("is also provided by source first")))
+}
+
+func TestFileSourceSkipsHiddenFiles(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "service-manager-istio-mcp-server")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	g.Expect(ioutil.WriteFile(path.Join(dir, ".tmp-1"), []byte("kind: Gateway\nspec: [\n"), 0644)).To(Succeed())
+
+	set, err := NewFileSource(dir).Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Configs).To(BeEmpty())
+	g.Expect(set.Files).To(BeEmpty())
+}
+
+func TestFileSourceExcluding(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "service-manager-istio-mcp-server")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	content, err := ioutil.ReadFile("../../test/config/istio-pinger.yaml")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(os.Mkdir(path.Join(dir, "sub"), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(path.Join(dir, "pinger.api.yaml"), content, 0644)).To(Succeed())
+	g.Expect(ioutil.WriteFile(path.Join(dir, "sub", "pinger.api.yaml"), content, 0644)).To(Succeed())
+
+	// only the files of the directory itself are excluded
+	set, err := NewFileSourceExcluding(dir, ".api.yaml").Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Files).To(HaveLen(1))
+	g.Expect(set.Files).To(HaveKey(path.Join("sub", "pinger.api.yaml")))
+}
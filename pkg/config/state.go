@@ -0,0 +1,92 @@
+package config
+
+import (
+	"fmt"
+	protoio "github.com/gogo/protobuf/io"
+	"io"
+	"io/ioutil"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"istio.io/istio/pkg/mcp/snapshot"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+	"unicode"
+)
+
+//degradedRetryInterval is the interval in which the config directory is read again while serving the persisted snapshot
+const degradedRetryInterval = 10 * time.Second
+
+//maxStateMessageSize limits the size of a single collection in the state file
+const maxStateMessageSize = 64 * 1024 * 1024
+
+//saveSnapshot writes the collections of snapshot to filename as length delimited mcp.Resources messages.
+//The file is replaced atomically.
+func saveSnapshot(filename string, snapshot snapshot.Snapshot) error {
+	file, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	writer := protoio.NewDelimitedWriter(file)
+	for _, collection := range collections {
+		version := snapshot.Version(collection)
+		if version == "" {
+			continue
+		}
+		resources := &mcp.Resources{Collection: collection, SystemVersionInfo: version}
+		for _, resource := range snapshot.Resources(collection) {
+			resources.Resources = append(resources.Resources, *resource)
+		}
+		if err := writer.WriteMsg(resources); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+//loadSnapshot reads a snapshot written by saveSnapshot
+func loadSnapshot(filename string) (snapshot.Snapshot, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := protoio.NewDelimitedReader(file, maxStateMessageSize)
+	builder := snapshot.NewInMemoryBuilder()
+	for {
+		resources := &mcp.Resources{}
+		if err := reader.ReadMsg(resources); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid state file %s: %v", filename, err)
+		}
+		entries := make([]*mcp.Resource, len(resources.Resources))
+		for i := range resources.Resources {
+			entries[i] = &resources.Resources[i]
+		}
+		builder.Set(resources.Collection, resources.SystemVersionInfo, entries)
+	}
+	return builder.Build(), nil
+}
+
+//persistedVersion returns the highest version number of the collections of a snapshot built from the sources,
+//which are versioned <number>.0 followed by the revision of the sources
+func persistedVersion(snapshot snapshot.Snapshot) int {
+	result := 0
+	for _, collection := range collections {
+		version := snapshot.Version(collection)
+		end := 0
+		for end < len(version) && unicode.IsDigit(rune(version[end])) {
+			end++
+		}
+		if number, err := strconv.Atoi(version[:end]); err == nil && number > result {
+			result = number
+		}
+	}
+	return result
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"istio.io/istio/galley/pkg/metadata"
+	"istio.io/istio/pkg/mcp/snapshot"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSaveAndLoadSnapshot(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "service-manager-istio-mcp-server")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	saved, err := readSnapshotFromDirectory("../../test/config", 7)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	filename := path.Join(dir, "state")
+	g.Expect(saveSnapshot(filename, saved)).To(Succeed())
+	loaded, err := loadSnapshot(filename)
+	g.Expect(err).NotTo(HaveOccurred())
+	for _, collection := range collections {
+		g.Expect(loaded.Version(collection)).To(Equal("7.0"))
+		g.Expect(loaded.Resources(collection)).To(Equal(saved.Resources(collection)))
+	}
+
+	g.Expect(ioutil.WriteFile(filename, []byte{0xff, 0xff}, 0644)).To(Succeed())
+	_, err = loadSnapshot(filename)
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestRestoreOnStartup(t *testing.T) {
+	g := NewGomegaWithT(t)
+	serviceEntries := metadata.IstioNetworkingV1alpha3Serviceentries.Collection.String()
+	cwd, err := os.Getwd()
+	g.Expect(err).NotTo(HaveOccurred())
+	dir, err := ioutil.TempDir(cwd, "service-manager-istio-mcp-server")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	configDir := path.Join(dir, "config")
+	g.Expect(os.Mkdir(configDir, 0755)).To(Succeed())
+	err = os.Link("../../test/config/istio-pinger.yaml", path.Join(configDir, "istio-pinger.yaml"))
+	g.Expect(err).NotTo(HaveOccurred())
+	options := &Options{StateFile: path.Join(dir, "state")}
+
+	configWatcher, err := newConfigWatcher(configDir, options)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configWatcher.reload()).To(Succeed())
+	configWatcher.Stop()
+	g.Expect(os.RemoveAll(configDir)).To(Succeed())
+
+	_, err = newConfigWatcher(configDir, &Options{})
+	g.Expect(err).To(HaveOccurred())
+	options.Canary = func(*mcp.SinkNode) bool { return false }
+	configWatcher, err = newConfigWatcher(configDir, options)
+	g.Expect(err).NotTo(HaveOccurred())
+	defer configWatcher.Stop()
+	status := configWatcher.Status()
+	g.Expect(status.Degraded).To(BeTrue())
+	g.Expect(status.Unreadable).To(BeTrue())
+	g.Expect(status.Version).To(Equal(2))
+	g.Expect(status.Ready(ReadinessOptions{NotReadyIfUnreadable: true}, status.FailingSince)).To(Succeed())
+	g.Expect(configWatcher.Snapshot().Resources(serviceEntries)).To(HaveLen(1))
+	g.Expect(configWatcher.Snapshot().Version(serviceEntries)).To(Equal("2.0"))
+	history := configWatcher.History()
+	g.Expect(history).To(HaveLen(1))
+	g.Expect(history[0].Version).To(Equal(2))
+	g.Expect(history[0].Snapshot.Resources(serviceEntries)).To(HaveLen(1))
+
+	// the numbering continues after the persisted version and the first snapshot read isn't rolled out to canaries
+	g.Expect(os.Mkdir(configDir, 0755)).To(Succeed())
+	err = os.Link("../../test/config/istio-pinger.yaml", path.Join(configDir, "istio-pinger.yaml"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configWatcher.reload()).To(Succeed())
+	g.Expect(configWatcher.Status().Version).To(Equal(3))
+	g.Expect(configWatcher.Status().Degraded).To(BeFalse())
+	g.Expect(configWatcher.Canary()).To(BeNil())
+	g.Expect(configWatcher.Snapshot().Version(serviceEntries)).To(Equal("3.0"))
+
+	// the restored version can be pinned like the versions read from the sources
+	g.Expect(configWatcher.History()).To(HaveLen(2))
+	g.Expect(configWatcher.Pin(2)).To(Succeed())
+	g.Expect(configWatcher.Snapshot().Version(serviceEntries)).To(Equal("2.0"))
+}
+
+func TestPersistedVersion(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(persistedVersion(snapshot.NewInMemoryBuilder().Build())).To(BeZero())
+	builder := snapshot.NewInMemoryBuilder()
+	builder.SetVersion(metadata.IstioNetworkingV1alpha3Gateways.Collection.String(), "12.0-f00ba4")
+	builder.SetVersion(metadata.IstioNetworkingV1alpha3Serviceentries.Collection.String(), "9.0")
+	g.Expect(persistedVersion(builder.Build())).To(Equal(12))
+}
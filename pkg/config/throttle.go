@@ -0,0 +1,57 @@
+package config
+
+import (
+	"istio.io/istio/pkg/mcp/snapshot"
+	"time"
+)
+
+//pendingSnapshot is a snapshot built from the config directory which isn't published yet
+type pendingSnapshot struct {
+	version  int
+	revision string
+	snapshot snapshot.Snapshot
+	files    map[string]string
+	builtAt  time.Time
+}
+
+//flush publishes the pending snapshot if the publish limits allow it, otherwise it schedules another
+//attempt. Snapshots built in the meantime replace the pending one, so the latest state is always published
+//eventually. It must be called with the mutex held.
+func (c *configWatcher) flush(now time.Time) {
+	if c.pending == nil {
+		return
+	}
+	if wait := c.publishDelay(now); wait > 0 {
+		if c.publishTimer == nil {
+			c.publishTimer = time.AfterFunc(wait, func() {
+				c.mutex.Lock()
+				defer c.mutex.Unlock()
+				c.publishTimer = nil
+				c.flush(time.Now())
+			})
+		}
+		return
+	}
+	pending := c.pending
+	c.pending = nil
+	c.lastPublished = now
+	c.apply(pending)
+}
+
+//publishDelay returns the time until the next version may be published. If it may be published
+//immediately, a token of the rate limit is consumed.
+func (c *configWatcher) publishDelay(now time.Time) time.Duration {
+	if !c.lastPublished.IsZero() {
+		if wait := c.lastPublished.Add(c.options.MinPublishInterval).Sub(now); wait > 0 {
+			return wait
+		}
+	}
+	if c.limiter != nil {
+		reservation := c.limiter.ReserveN(now, 1)
+		if wait := reservation.DelayFrom(now); wait > 0 {
+			reservation.CancelAt(now)
+			return wait
+		}
+	}
+	return 0
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	. "github.com/onsi/gomega"
+	"go.opencensus.io/stats/view"
+	"golang.org/x/time/rate"
+	"io/ioutil"
+	"istio.io/istio/galley/pkg/metadata"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func skippedVersionsCount(g *GomegaWithT) int64 {
+	rows, err := view.RetrieveData(skippedVersions.Name())
+	g.Expect(err).NotTo(HaveOccurred())
+	if len(rows) == 0 {
+		return 0
+	}
+	return rows[0].Data.(*view.CountData).Value
+}
+
+func TestMinPublishInterval(t *testing.T) {
+	g := NewGomegaWithT(t)
+	serviceEntries := metadata.IstioNetworkingV1alpha3Serviceentries.Collection.String()
+	cwd, err := os.Getwd()
+	g.Expect(err).NotTo(HaveOccurred())
+	dir, err := ioutil.TempDir(cwd, "service-manager-istio-mcp-server")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	err = os.Link("../../test/config/istio-pinger.yaml", path.Join(dir, "istio-pinger.yaml"))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	configWatcher, err := newConfigWatcher(dir, &Options{MinPublishInterval: 300 * time.Millisecond})
+	g.Expect(err).NotTo(HaveOccurred())
+	defer configWatcher.Stop()
+	g.Expect(configWatcher.Snapshot().Version(serviceEntries)).To(Equal("1.0"))
+	skipped := skippedVersionsCount(g)
+
+	g.Expect(configWatcher.reload()).To(Succeed())
+	g.Expect(configWatcher.reload()).To(Succeed())
+	// the status reports the published version
+	g.Expect(configWatcher.Status().Version).To(Equal(1))
+	g.Expect(configWatcher.Snapshot().Version(serviceEntries)).To(Equal("1.0"))
+	g.Eventually(func() string {
+		return configWatcher.Snapshot().Version(serviceEntries)
+	}).Should(Equal("3.0"))
+	g.Expect(configWatcher.Status().Version).To(Equal(3))
+	g.Expect(configWatcher.History()).To(HaveLen(2))
+	g.Eventually(func() int64 { return skippedVersionsCount(g) }, 2*time.Second).Should(Equal(skipped + 1))
+}
+
+func TestPublishDelay(t *testing.T) {
+	g := NewGomegaWithT(t)
+	now := time.Now()
+	c := &configWatcher{limiter: rate.NewLimiter(rate.Every(time.Minute), 2)}
+	g.Expect(c.publishDelay(now)).To(BeZero())
+	g.Expect(c.publishDelay(now)).To(BeZero())
+	g.Expect(c.publishDelay(now)).To(BeNumerically("~", time.Minute, time.Second))
+	// a denied attempt doesn't consume a token
+	g.Expect(c.publishDelay(now.Add(time.Minute))).To(BeZero())
+
+	c = &configWatcher{options: Options{MinPublishInterval: time.Minute}, lastPublished: now}
+	g.Expect(c.publishDelay(now.Add(20 * time.Second))).To(Equal(40 * time.Second))
+	g.Expect(c.publishDelay(now.Add(time.Minute))).To(BeZero())
+}
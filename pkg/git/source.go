@@ -0,0 +1,252 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//commandTimeout limits the duration of a git command, e.g. a fetch of a remote repository
+const commandTimeout = 2 * time.Minute
+
+//Options configures a git Source
+type Options struct {
+	//URL of the repository, a remote URL or the path of a local repository. Remote repositories are
+	//authenticated by the usual git means, e.g. ssh keys or credential helpers.
+	URL string
+	//Ref is the branch or tag the configs are read from
+	Ref string
+	//Dir is the directory of the repository the configs are read from, the root if empty
+	Dir string
+	//CacheDir is the directory the repository is fetched to
+	CacheDir string
+	//PollInterval is the interval in which the repository is fetched
+	PollInterval time.Duration
+}
+
+//Source reads istio configs from the YAML and JSON files of a directory of a git repository at the latest
+//commit of a branch or tag. The commit SHA is the revision of the configs.
+type Source struct {
+	options Options
+	//localRef is the ref of the cache the branch or tag is fetched to. Sources sharing a cache directory
+	//get distinct refs.
+	localRef string
+	//mutex serializes the git commands
+	mutex  sync.Mutex
+	commit string
+}
+
+//Ensure that Source can be served by a config watcher
+var _ config.Source = &Source{}
+
+//NewSource creates a Source. The repository is fetched on the first Read.
+func NewSource(options *Options) (*Source, error) {
+	if options.URL == "" || options.Ref == "" || options.CacheDir == "" {
+		return nil, errors.New("git url, ref and cache directory are required")
+	}
+	if options.PollInterval <= 0 {
+		return nil, errors.New("git poll interval must be positive")
+	}
+	s := &Source{options: *options}
+	s.options.Dir = strings.Trim(path.Clean("/"+options.Dir), "/")
+	sum := sha256.Sum256([]byte(options.URL + "\x00" + options.Ref))
+	s.localRef = "refs/mcp-server/" + hex.EncodeToString(sum[:8])
+	if _, err := os.Stat(path.Join(options.CacheDir, "HEAD")); os.IsNotExist(err) {
+		if _, err := run(nil, "", "init", "--bare", "-q", options.CacheDir); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+//Name returns the URL of the repository
+func (s *Source) Name() string {
+	return s.options.URL
+}
+
+//Read returns the configs of the latest commit fetched. The files are reported by their path relative to
+//the directory with their blob id as hash.
+func (s *Source) Read() (*config.ConfigSet, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.commit == "" {
+		if _, err := s.fetch(); err != nil {
+			return nil, err
+		}
+	}
+	return s.readCommit(s.commit)
+}
+
+//Watch fetches the repository in the poll interval and calls changed if the branch or tag moved to another commit
+func (s *Source) Watch(changed func(), stop <-chan struct{}) error {
+	go func() {
+		ticker := time.NewTicker(s.options.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.mutex.Lock()
+				moved, err := s.fetch()
+				s.mutex.Unlock()
+				if err != nil {
+					logging.Watcher.Warn("Can't fetch git repository", zap.String("url", s.options.URL), zap.String("ref", s.options.Ref), logging.Error(err))
+				} else if moved {
+					changed()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+//fetch updates the commit of the ref and returns true if it changed. It must be called with the mutex held.
+func (s *Source) fetch() (bool, error) {
+	if _, err := s.git(nil, "fetch", "-q", "--force", "--no-tags", s.options.URL, "+"+s.options.Ref+":"+s.localRef); err != nil {
+		return false, err
+	}
+	out, err := s.git(nil, "rev-parse", "--verify", s.localRef+"^{commit}")
+	if err != nil {
+		return false, err
+	}
+	commit := strings.TrimSpace(string(out))
+	if commit == s.commit {
+		return false, nil
+	}
+	logging.Watcher.Info("Fetched git commit", zap.String("url", s.options.URL), zap.String("ref", s.options.Ref),
+		zap.String("commit", commit), zap.String("previous", s.commit))
+	s.commit = commit
+	return true, nil
+}
+
+//readCommit parses the files of the directory at a commit. The configs are only returned if all files are valid.
+func (s *Source) readCommit(commit string) (*config.ConfigSet, error) {
+	args := []string{"ls-tree", "-r", "-z", commit}
+	if s.options.Dir != "" {
+		args = append(args, "--", s.options.Dir+"/")
+	}
+	out, err := s.git(nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	var names, blobs []string
+	for _, entry := range strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00") {
+		// <mode> SP <type> SP <object> TAB <file>
+		tab := strings.Index(entry, "\t")
+		if tab < 0 {
+			continue
+		}
+		fields := strings.Fields(entry[:tab])
+		if len(fields) != 3 || fields[1] != "blob" || !isConfigFile(entry[tab+1:]) {
+			continue
+		}
+		names = append(names, strings.TrimPrefix(entry[tab+1:], s.options.Dir+"/"))
+		blobs = append(blobs, fields[2])
+	}
+	if s.options.Dir != "" && len(out) == 0 {
+		return nil, config.NewValidationError("", fmt.Errorf("directory %s not found in commit %s", s.options.Dir, commit))
+	}
+	contents, err := s.readBlobs(blobs)
+	if err != nil {
+		return nil, err
+	}
+	set := &config.ConfigSet{Files: make(map[string]string), Revision: commit}
+	for i, name := range names {
+		set.Files[name] = blobs[i]
+		configs, err := config.ParseConfigs(name, contents[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range configs {
+			c.Annotations = map[string]string{config.RevisionAnnotation: commit}
+			set.Configs = append(set.Configs, c)
+		}
+	}
+	return set, nil
+}
+
+//readBlobs returns the contents of blobs with a single git process
+func (s *Source) readBlobs(blobs []string) ([][]byte, error) {
+	if len(blobs) == 0 {
+		return nil, nil
+	}
+	out, err := s.git(strings.NewReader(strings.Join(blobs, "\n")+"\n"), "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(bytes.NewReader(out))
+	contents := make([][]byte, len(blobs))
+	for i := range blobs {
+		// <object> SP <type> SP <size> LF <content> LF
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("unexpected output of git cat-file: %v", err)
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 || fields[1] != "blob" {
+			return nil, fmt.Errorf("unexpected output of git cat-file: %q", header)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected output of git cat-file: %q", header)
+		}
+		contents[i] = make([]byte, size+1)
+		if _, err := io.ReadFull(reader, contents[i]); err != nil {
+			return nil, fmt.Errorf("unexpected output of git cat-file: %v", err)
+		}
+		contents[i] = contents[i][:size]
+	}
+	return contents, nil
+}
+
+func (s *Source) git(stdin io.Reader, args ...string) ([]byte, error) {
+	return run(stdin, s.options.CacheDir, args...)
+}
+
+//isConfigFile returns true for YAML and JSON files which aren't hidden
+func isConfigFile(file string) bool {
+	if strings.HasPrefix(path.Base(file), ".") {
+		return false
+	}
+	switch path.Ext(file) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+//run executes a git command on the repository in gitDir, if set, without prompting for credentials
+func run(stdin io.Reader, gitDir string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	command := args
+	if gitDir != "" {
+		command = append([]string{"--git-dir", gitDir}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "git", command...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,109 @@
+package git
+
+import (
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type repository struct {
+	t   *testing.T
+	dir string
+}
+
+func (r *repository) git(args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", r.dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func (r *repository) commit(file string, content string) string {
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(r.dir, file)), 0755); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(r.dir, file), []byte(content), 0644); err != nil {
+		r.t.Fatal(err)
+	}
+	r.git("add", file)
+	r.git("commit", "-q", "-m", "update "+file)
+	return r.git("rev-parse", "HEAD")
+}
+
+func (r *repository) commitFile(file string, source string) string {
+	content, err := ioutil.ReadFile(source)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return r.commit(file, string(content))
+}
+
+func TestSource(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "git")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	repo := &repository{t: t, dir: filepath.Join(dir, "repo")}
+	g.Expect(os.Mkdir(repo.dir, 0755)).To(Succeed())
+	repo.git("init", "-q")
+	repo.git("checkout", "-q", "-b", "mesh")
+	repo.commit("README.md", "# mesh config\n")
+	first := repo.commitFile("istio/istio-pinger.yaml", "../../test/config/istio-pinger.yaml")
+	repo.git("tag", "v1")
+
+	_, err = NewSource(&Options{URL: repo.dir, Ref: "mesh"})
+	g.Expect(err).To(HaveOccurred())
+	source, err := NewSource(&Options{URL: repo.dir, Ref: "mesh", Dir: "istio", CacheDir: filepath.Join(dir, "cache"), PollInterval: 10 * time.Millisecond})
+	g.Expect(err).NotTo(HaveOccurred())
+	set, err := source.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Revision).To(Equal(first))
+	g.Expect(set.Configs).To(HaveLen(3))
+	g.Expect(set.Configs[0].Annotations).To(Equal(map[string]string{config.RevisionAnnotation: first}))
+	g.Expect(set.Files).To(HaveKey("istio-pinger.yaml"))
+	g.Expect(set.Files).NotTo(HaveKey("README.md"))
+
+	changed := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	g.Expect(source.Watch(func() { changed <- struct{}{} }, stop)).To(Succeed())
+
+	second := repo.commitFile("istio/sub/istio-test.yaml", "../../test/config/sub/istio-test.yaml")
+	g.Eventually(changed).Should(Receive())
+	set, err = source.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Revision).To(Equal(second))
+	g.Expect(set.Configs).To(HaveLen(6))
+	g.Expect(set.Files).To(HaveKey("sub/istio-test.yaml"))
+
+	// a commit with an invalid file is rejected as a whole
+	repo.commit("istio/invalid.yaml", "kind: Gateway\napiVersion: networking.istio.io/v1alpha3\nspec: [\n")
+	g.Eventually(changed).Should(Receive())
+	_, err = source.Read()
+	g.Expect(err).To(BeAssignableToTypeOf(&config.ValidationError{}))
+	g.Expect(err.(*config.ValidationError).File).To(Equal("invalid.yaml"))
+
+	tagged, err := NewSource(&Options{URL: repo.dir, Ref: "v1", Dir: "istio", CacheDir: filepath.Join(dir, "cache"), PollInterval: time.Minute})
+	g.Expect(err).NotTo(HaveOccurred())
+	set, err = tagged.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Revision).To(Equal(first))
+
+	missing, err := NewSource(&Options{URL: repo.dir, Ref: "mesh", Dir: "missing", CacheDir: filepath.Join(dir, "cache"), PollInterval: time.Minute})
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = missing.Read()
+	g.Expect(err).To(BeAssignableToTypeOf(&config.ValidationError{}))
+
+	unknown, err := NewSource(&Options{URL: repo.dir, Ref: "unknown", CacheDir: filepath.Join(dir, "cache"), PollInterval: time.Minute})
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = unknown.Read()
+	g.Expect(err).To(MatchError(ContainSubstring("git fetch failed")))
+}
@@ -0,0 +1,104 @@
+package health
+
+import (
+	"fmt"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//ReadinessCheck returns an error if the server should not receive traffic
+type ReadinessCheck func() error
+
+//Health aggregates readiness checks and publishes them over HTTP and the grpc.health.v1 service
+type Health struct {
+	mutex    sync.RWMutex
+	checks   map[string]ReadinessCheck
+	services []string
+	grpc     *health.Server
+}
+
+//NewHealth creates a Health reporting the serving status for the given gRPC service names.
+//The overall server status is always reported under the empty service name.
+func NewHealth(services ...string) *Health {
+	return &Health{
+		checks:   make(map[string]ReadinessCheck),
+		services: append([]string{""}, services...),
+		grpc:     health.NewServer(),
+	}
+}
+
+//AddReadinessCheck registers a named check. The server is ready if all checks pass.
+func (h *Health) AddReadinessCheck(name string, check ReadinessCheck) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.checks[name] = check
+}
+
+//Ready runs all readiness checks and returns the first failure
+func (h *Health) Ready() error {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if len(h.checks) == 0 {
+		return fmt.Errorf("no readiness checks registered")
+	}
+	names := make([]string, 0, len(h.checks))
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := h.checks[name](); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+//GRPCServer returns the grpc.health.v1 implementation to register with a gRPC server
+func (h *Health) GRPCServer() healthpb.HealthServer {
+	return h.grpc
+}
+
+//Run updates the gRPC serving status every interval until stop is closed
+func (h *Health) Run(interval time.Duration, stop <-chan struct{}) {
+	h.update()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.update()
+		case <-stop:
+			h.grpc.Shutdown()
+			return
+		}
+	}
+}
+
+func (h *Health) update() {
+	status := healthpb.HealthCheckResponse_SERVING
+	if h.Ready() != nil {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	for _, service := range h.services {
+		h.grpc.SetServingStatus(service, status)
+	}
+}
+
+//RegisterHandlers adds the /healthz liveness and /readyz readiness endpoints to mux
+func (h *Health) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := h.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
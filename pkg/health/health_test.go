@@ -0,0 +1,70 @@
+package health
+
+import (
+	"context"
+	"errors"
+	. "github.com/onsi/gomega"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyWithoutChecks(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(NewHealth().Ready()).To(HaveOccurred())
+}
+
+func TestReadinessEndpoints(t *testing.T) {
+	g := NewGomegaWithT(t)
+	h := NewHealth()
+	var checkErr error
+	h.AddReadinessCheck("test", func() error { return checkErr })
+	mux := http.NewServeMux()
+	h.RegisterHandlers(mux)
+
+	get := func(path string) int {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code
+	}
+	g.Expect(get("/healthz")).To(Equal(http.StatusOK))
+	g.Expect(get("/readyz")).To(Equal(http.StatusOK))
+
+	checkErr = errors.New("not yet")
+	g.Expect(get("/healthz")).To(Equal(http.StatusOK))
+	g.Expect(get("/readyz")).To(Equal(http.StatusServiceUnavailable))
+}
+
+func TestGRPCServingStatus(t *testing.T) {
+	g := NewGomegaWithT(t)
+	h := NewHealth("test.Service")
+	ready := make(chan error, 1)
+	ready <- errors.New("not yet")
+	var checkErr error
+	h.AddReadinessCheck("test", func() error {
+		select {
+		case checkErr = <-ready:
+		default:
+		}
+		return checkErr
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go h.Run(10*time.Millisecond, stop)
+
+	status := func(service string) func() healthpb.HealthCheckResponse_ServingStatus {
+		return func() healthpb.HealthCheckResponse_ServingStatus {
+			response, err := h.GRPCServer().Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+			if err != nil {
+				return healthpb.HealthCheckResponse_UNKNOWN
+			}
+			return response.Status
+		}
+	}
+	g.Eventually(status("")).Should(Equal(healthpb.HealthCheckResponse_NOT_SERVING))
+	ready <- nil
+	g.Eventually(status("")).Should(Equal(healthpb.HealthCheckResponse_SERVING))
+	g.Eventually(status("test.Service")).Should(Equal(healthpb.HealthCheckResponse_SERVING))
+}
@@ -0,0 +1,246 @@
+package kube
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"istio.io/istio/pilot/pkg/config/kube/crd"
+	"istio.io/istio/pilot/pkg/model"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"sort"
+	"sync"
+	"time"
+)
+
+//syncTimeout limits the time WaitForSync waits for the initial list of the CRDs
+const syncTimeout = 30 * time.Second
+
+//objects are the CRD objects and lists of the supported config types
+var objects = map[string]struct {
+	object runtime.Object
+	list   runtime.Object
+}{
+	model.Gateway.Type:         {&crd.Gateway{}, &crd.GatewayList{}},
+	model.ServiceEntry.Type:    {&crd.ServiceEntry{}, &crd.ServiceEntryList{}},
+	model.VirtualService.Type:  {&crd.VirtualService{}, &crd.VirtualServiceList{}},
+	model.DestinationRule.Type: {&crd.DestinationRule{}, &crd.DestinationRuleList{}},
+}
+
+//Options configures a kubernetes Source
+type Options struct {
+	//Kubeconfig is the kubeconfig file, the in-cluster config is used if empty
+	Kubeconfig string
+	//Context of the kubeconfig, the current context if empty
+	Context string
+	//Namespace the CRDs are read from, all namespaces if empty
+	Namespace string
+	//LabelSelector selects the CRDs which are read, all if empty
+	LabelSelector string
+	//ResyncPeriod is the interval in which the informers resync, 0 disables resyncs
+	ResyncPeriod time.Duration
+}
+
+//Source reads the networking.istio.io CRDs of a kubernetes cluster with informers. The configs are named
+//<namespace>/<name>, the way sinks name kubernetes resources.
+type Source struct {
+	name      string
+	informers map[string]cache.SharedIndexInformer
+
+	mutex   sync.Mutex
+	started bool
+	stop    chan struct{}
+}
+
+//Ensure that Source can be served and synced by a config watcher
+var (
+	_ config.Source = &Source{}
+	_ config.Syncer = &Source{}
+)
+
+//NewSource creates a Source for the API server of a kubeconfig. The informers are started on the first Read,
+//Watch or WaitForSync.
+func NewSource(options *Options) (*Source, error) {
+	if _, err := labels.Parse(options.LabelSelector); err != nil {
+		return nil, fmt.Errorf("invalid label selector: %v", err)
+	}
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = options.Kubeconfig
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules,
+		&clientcmd.ConfigOverrides{CurrentContext: options.Context}).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	groupVersion := schema.GroupVersion{Group: crd.ResourceGroup(&model.Gateway), Version: model.Gateway.Version}
+	scheme := runtime.NewScheme()
+	for _, o := range objects {
+		scheme.AddKnownTypes(groupVersion, o.object, o.list)
+	}
+	metav1.AddToGroupVersion(scheme, groupVersion)
+	restConfig.GroupVersion = &groupVersion
+	restConfig.APIPath = "/apis"
+	restConfig.ContentType = runtime.ContentTypeJSON
+	restConfig.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: serializer.NewCodecFactory(scheme)}
+	client, err := rest.RESTClientFor(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	listWatchers := make(map[string]cache.ListerWatcher)
+	for _, ctype := range config.Types() {
+		listWatchers[ctype] = listWatcher(client, ctype, options)
+	}
+	return newSource(restConfig.Host, listWatchers, options.ResyncPeriod), nil
+}
+
+func newSource(name string, listWatchers map[string]cache.ListerWatcher, resyncPeriod time.Duration) *Source {
+	s := &Source{
+		name:      name,
+		informers: make(map[string]cache.SharedIndexInformer),
+		stop:      make(chan struct{}),
+	}
+	for ctype, lw := range listWatchers {
+		s.informers[ctype] = cache.NewSharedIndexInformer(lw, objects[ctype].object, resyncPeriod, cache.Indexers{})
+	}
+	return s
+}
+
+//listWatcher lists and watches the CRDs of a type with the namespace and label selector of the options
+func listWatcher(client *rest.RESTClient, ctype string, options *Options) cache.ListerWatcher {
+	schema, _ := model.IstioConfigTypes.GetByType(ctype)
+	request := func(opts metav1.ListOptions) *rest.Request {
+		opts.LabelSelector = options.LabelSelector
+		return client.Get().
+			Namespace(options.Namespace).
+			Resource(crd.ResourceName(schema.Plural)).
+			VersionedParams(&opts, metav1.ParameterCodec)
+	}
+	return &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			result := objects[ctype].list.DeepCopyObject()
+			err := request(opts).Do().Into(result)
+			return result, err
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			opts.Watch = true
+			return request(opts).Watch()
+		},
+	}
+}
+
+//Name returns the API server
+func (s *Source) Name() string {
+	return s.name
+}
+
+//Read returns the CRDs of the informer caches. It fails without waiting until the informers listed the CRDs.
+//The files are reported as <type>/<namespace>/<name> with the resource version as hash.
+func (s *Source) Read() (*config.ConfigSet, error) {
+	s.start()
+	if !s.hasSynced() {
+		return nil, errors.New("the CRDs of the API server " + s.name + " haven't been listed yet")
+	}
+	set := &config.ConfigSet{Files: make(map[string]string)}
+	for ctype, informer := range s.informers {
+		schema, _ := model.IstioConfigTypes.GetByType(ctype)
+		for _, item := range informer.GetStore().List() {
+			object, ok := item.(crd.IstioObject)
+			if !ok {
+				continue
+			}
+			meta := object.GetObjectMeta()
+			file := ctype + "/" + meta.Namespace + "/" + meta.Name
+			set.Files[file] = meta.ResourceVersion
+			c, err := crd.ConvertObject(schema, object, "")
+			if err != nil {
+				return nil, config.NewValidationError(file, fmt.Errorf("invalid %s %s/%s: %v", ctype, meta.Namespace, meta.Name, err))
+			}
+			if err := schema.Validate(c.Name, c.Namespace, c.Spec); err != nil {
+				return nil, config.NewValidationError(file, fmt.Errorf("invalid %s %s/%s: %v", ctype, meta.Namespace, meta.Name, err))
+			}
+			set.Configs = append(set.Configs, config.Config{Type: ctype, Name: config.ConfigName(meta.Namespace, meta.Name), Spec: c.Spec, Origin: file, Labels: meta.Labels})
+		}
+	}
+	sort.Slice(set.Configs, func(i, j int) bool { return set.Configs[i].Origin < set.Configs[j].Origin })
+	return set, nil
+}
+
+//Watch calls changed whenever a CRD is added, updated or deleted and once the informers listed the CRDs.
+//The informers are stopped once stop is closed.
+func (s *Source) Watch(changed func(), stop <-chan struct{}) error {
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { changed() },
+		UpdateFunc: func(interface{}, interface{}) { changed() },
+		DeleteFunc: func(interface{}) { changed() },
+	}
+	for _, informer := range s.informers {
+		informer.AddEventHandler(handler)
+	}
+	s.start()
+	go func() {
+		// without CRDs there are no events
+		if cache.WaitForCacheSync(s.stop, s.synced()...) {
+			changed()
+		}
+	}()
+	go func() {
+		<-stop
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		select {
+		case <-s.stop:
+		default:
+			close(s.stop)
+		}
+	}()
+	return nil
+}
+
+//WaitForSync starts the informers and waits until they listed the CRDs
+func (s *Source) WaitForSync() error {
+	s.start()
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(syncTimeout, func() { close(timeout) })
+	defer timer.Stop()
+	if !cache.WaitForCacheSync(timeout, s.synced()...) {
+		return fmt.Errorf("the CRDs of the API server %s haven't been listed within %s", s.name, syncTimeout)
+	}
+	return nil
+}
+
+//start runs the informers once
+func (s *Source) start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.started {
+		s.started = true
+		for _, informer := range s.informers {
+			go informer.Run(s.stop)
+		}
+	}
+}
+
+//synced returns the functions reporting whether the informers listed the CRDs
+func (s *Source) synced() []cache.InformerSynced {
+	synced := make([]cache.InformerSynced, 0, len(s.informers))
+	for _, informer := range s.informers {
+		synced = append(synced, informer.HasSynced)
+	}
+	return synced
+}
+
+//hasSynced returns true if all informers listed the CRDs
+func (s *Source) hasSynced() bool {
+	for _, synced := range s.synced() {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
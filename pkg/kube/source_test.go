@@ -0,0 +1,186 @@
+package kube
+
+import (
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"istio.io/istio/pilot/pkg/config/kube/crd"
+	"istio.io/istio/pilot/pkg/model"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func gateway(namespace string, name string, resourceVersion string, hosts ...string) *crd.Gateway {
+	return &crd.Gateway{
+		TypeMeta:   metav1.TypeMeta{Kind: "Gateway", APIVersion: "networking.istio.io/v1alpha3"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, ResourceVersion: resourceVersion},
+		Spec: map[string]interface{}{
+			"selector": map[string]interface{}{"istio": "ingressgateway"},
+			"servers": []interface{}{map[string]interface{}{
+				"port":  map[string]interface{}{"number": 80, "name": "http", "protocol": "HTTP"},
+				"hosts": hosts,
+			}},
+		},
+	}
+}
+
+//fakeListWatchers serve the given gateways and no other CRDs. Changes are sent through the returned watcher.
+func fakeListWatchers(gateways ...crd.Gateway) (map[string]cache.ListerWatcher, *watch.FakeWatcher) {
+	gatewayWatcher := watch.NewFake()
+	listWatchers := make(map[string]cache.ListerWatcher)
+	for _, ctype := range config.Types() {
+		ctype := ctype
+		listWatchers[ctype] = &cache.ListWatch{
+			ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+				if ctype == model.Gateway.Type {
+					return &crd.GatewayList{ListMeta: metav1.ListMeta{ResourceVersion: "1"}, Items: gateways}, nil
+				}
+				return objects[ctype].list.DeepCopyObject(), nil
+			},
+			WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+				if ctype == model.Gateway.Type {
+					return gatewayWatcher, nil
+				}
+				return watch.NewFake(), nil
+			},
+		}
+	}
+	return listWatchers, gatewayWatcher
+}
+
+func TestSource(t *testing.T) {
+	g := NewGomegaWithT(t)
+	listWatchers, gatewayWatcher := fakeListWatchers(*gateway("default", "pinger", "1", "pinger.example.com"))
+	source := newSource("cluster", listWatchers, 0)
+	changed := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	g.Expect(source.Watch(func() { changed <- struct{}{} }, stop)).To(Succeed())
+	g.Expect(source.WaitForSync()).To(Succeed())
+
+	set, err := source.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Configs).To(HaveLen(1))
+	g.Expect(set.Configs[0].Type).To(Equal(model.Gateway.Type))
+	g.Expect(set.Configs[0].Name).To(Equal("default/pinger"))
+	g.Expect(set.Files).To(Equal(map[string]string{"gateway/default/pinger": "1"}))
+
+	gatewayWatcher.Add(gateway("test", "pinger", "2", "pinger.test.example.com"))
+	g.Eventually(changed).Should(Receive())
+	g.Eventually(func() int { set, _ := source.Read(); return len(set.Configs) }).Should(Equal(2))
+
+	// an invalid CRD is reported as validation error
+	gatewayWatcher.Modify(gateway("test", "pinger", "3"))
+	g.Eventually(func() error { _, err := source.Read(); return err }).Should(BeAssignableToTypeOf(&config.ValidationError{}))
+	_, err = source.Read()
+	g.Expect(err.(*config.ValidationError).File).To(Equal("gateway/test/pinger"))
+
+	gatewayWatcher.Delete(gateway("test", "pinger", "4"))
+	g.Eventually(func() error { _, err := source.Read(); return err }).ShouldNot(HaveOccurred())
+	set, _ = source.Read()
+	g.Expect(set.Configs).To(HaveLen(1))
+}
+
+func TestSourceSync(t *testing.T) {
+	g := NewGomegaWithT(t)
+	listWatchers, _ := fakeListWatchers()
+	listed := make(chan struct{})
+	listGateways := listWatchers[model.Gateway.Type].(*cache.ListWatch).ListFunc
+	listWatchers[model.Gateway.Type].(*cache.ListWatch).ListFunc = func(options metav1.ListOptions) (runtime.Object, error) {
+		<-listed
+		return listGateways(options)
+	}
+	source := newSource("cluster", listWatchers, 0)
+	changed := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	g.Expect(source.Watch(func() { changed <- struct{}{} }, stop)).To(Succeed())
+
+	// reads don't wait for the informers
+	_, err := source.Read()
+	g.Expect(err).To(MatchError(ContainSubstring("haven't been listed yet")))
+	g.Expect(err).NotTo(BeAssignableToTypeOf(&config.ValidationError{}))
+
+	// the watcher is notified once the informers listed the CRDs, even without CRDs
+	close(listed)
+	g.Eventually(changed).Should(Receive())
+	g.Expect(source.WaitForSync()).To(Succeed())
+	set, err := source.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Configs).To(BeEmpty())
+}
+
+func TestNewSource(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var mutex sync.Mutex
+	requests := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "true" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		mutex.Lock()
+		requests[r.URL.Path] = r.URL.Query().Get("labelSelector")
+		mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/apis/networking.istio.io/v1alpha3/namespaces/mesh/gateways" {
+			fmt.Fprint(w, `{"apiVersion": "networking.istio.io/v1alpha3", "kind": "GatewayList", "metadata": {"resourceVersion": "5"},
+				"items": [{"apiVersion": "networking.istio.io/v1alpha3", "kind": "Gateway", "metadata": {"name": "pinger", "namespace": "mesh", "resourceVersion": "5"},
+				"spec": {"selector": {"istio": "ingressgateway"}, "servers": [{"port": {"number": 80, "name": "http", "protocol": "HTTP"}, "hosts": ["pinger.example.com"]}]}}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"metadata": {"resourceVersion": "5"}, "items": []}`)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "kube")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	g.Expect(ioutil.WriteFile(kubeconfig, []byte(fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: %s
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+users:
+- name: test
+  user:
+    token: secret
+current-context: test
+`, server.URL)), 0644)).To(Succeed())
+
+	_, err = NewSource(&Options{Kubeconfig: kubeconfig, LabelSelector: "mesh in ("})
+	g.Expect(err).To(MatchError(ContainSubstring("invalid label selector")))
+	source, err := NewSource(&Options{Kubeconfig: kubeconfig, Namespace: "mesh", LabelSelector: "mesh=public", ResyncPeriod: time.Minute})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(source.Name()).To(Equal(server.URL))
+	stop := make(chan struct{})
+	defer close(stop)
+	g.Expect(source.Watch(func() {}, stop)).To(Succeed())
+	g.Expect(source.WaitForSync()).To(Succeed())
+	set, err := source.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Configs).To(HaveLen(1))
+	g.Expect(set.Configs[0].Name).To(Equal("mesh/pinger"))
+	mutex.Lock()
+	defer mutex.Unlock()
+	g.Expect(requests).To(HaveKeyWithValue("/apis/networking.istio.io/v1alpha3/namespaces/mesh/virtualservices", "mesh=public"))
+}
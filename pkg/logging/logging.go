@@ -0,0 +1,164 @@
+package logging
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"istio.io/istio/pkg/log"
+	"sort"
+	"strings"
+)
+
+//Scopes of the server. Their output level can be configured separately.
+var (
+	Watcher  = log.RegisterScope("watcher", "Reading and watching the config directory", 0)
+	Snapshot = log.RegisterScope("snapshot", "Publishing snapshots, rollbacks and canary rollouts", 0)
+	GRPC     = log.RegisterScope("grpc", "MCP streams of sinks", 0)
+	Auth     = log.RegisterScope("auth", "Authentication and authorization of sinks", 0)
+	API      = log.RegisterScope("api", "Changes of istio configs through the REST API", 0)
+	Admin    = log.RegisterScope("admin", "Requests of the admin endpoints", 0)
+)
+
+var levels = map[string]log.Level{
+	"debug": log.DebugLevel,
+	"info":  log.InfoLevel,
+	"warn":  log.WarnLevel,
+	"error": log.ErrorLevel,
+	"fatal": log.FatalLevel,
+	"none":  log.NoneLevel,
+}
+
+//Options configures the log output
+type Options struct {
+	//JSON formats log lines as JSON instead of console friendly text
+	JSON bool
+	//Levels is a comma separated list of scope:level pairs, e.g. default:info,grpc:debug.
+	//A level without scope applies to the default scope.
+	Levels string
+}
+
+//Configure sets up the log output of all scopes
+func Configure(options *Options) error {
+	scopeLevels, err := ParseLevels(options.Levels)
+	if err != nil {
+		return err
+	}
+	logOptions := log.DefaultOptions()
+	logOptions.JSONEncoding = options.JSON
+	for scope, level := range scopeLevels {
+		logOptions.SetOutputLevel(scope, level)
+	}
+	return log.Configure(logOptions)
+}
+
+//ParseLevels parses a comma separated list of scope:level pairs into the level by scope name.
+//A level without scope applies to the default scope. All scopes must be registered.
+func ParseLevels(levels string) (map[string]log.Level, error) {
+	result := make(map[string]log.Level)
+	for _, pair := range strings.Split(levels, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		scope, name := log.DefaultScopeName, pair
+		if i := strings.LastIndex(pair, ":"); i >= 0 {
+			scope, name = pair[:i], pair[i+1:]
+		}
+		if log.FindScope(scope) == nil {
+			return nil, fmt.Errorf("unknown log scope %q", scope)
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return nil, err
+		}
+		result[scope] = level
+	}
+	return result, nil
+}
+
+//ParseLevel returns the level of its name
+func ParseLevel(name string) (log.Level, error) {
+	level, ok := levels[strings.ToLower(name)]
+	if !ok {
+		return log.NoneLevel, fmt.Errorf("invalid log level %q", name)
+	}
+	return level, nil
+}
+
+//LevelName returns the name of a level
+func LevelName(level log.Level) string {
+	for name, l := range levels {
+		if l == level {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", level)
+}
+
+//ScopeLevels returns the output level by name of all registered scopes
+func ScopeLevels() map[string]string {
+	result := make(map[string]string)
+	for name, scope := range log.Scopes() {
+		result[name] = LevelName(scope.GetOutputLevel())
+	}
+	return result
+}
+
+//SetScopeLevel changes the output level of a registered scope at runtime
+func SetScopeLevel(scope string, level string) error {
+	s := log.FindScope(scope)
+	if s == nil {
+		names := make([]string, 0, len(log.Scopes()))
+		for name := range log.Scopes() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown log scope %q, known scopes are %s", scope, strings.Join(names, ", "))
+	}
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	s.SetOutputLevel(l)
+	return nil
+}
+
+//Version is the version of the config directory
+func Version(version int) zapcore.Field {
+	return zap.Int("version", version)
+}
+
+//File is the path of a config file
+func File(path string) zapcore.Field {
+	return zap.String("file", path)
+}
+
+//Collection is the name of an MCP collection
+func Collection(collection string) zapcore.Field {
+	return zap.String("collection", collection)
+}
+
+//CollectionVersion is the version of an MCP collection
+func CollectionVersion(version string) zapcore.Field {
+	return zap.String("collectionVersion", version)
+}
+
+//NodeID is the id of a sink node
+func NodeID(id string) zapcore.Field {
+	return zap.String("nodeID", id)
+}
+
+//ConnectionID identifies the stream of a sink
+func ConnectionID(id int64) zapcore.Field {
+	return zap.Int64("connectionID", id)
+}
+
+//Peer is the remote address of a sink
+func Peer(address string) zapcore.Field {
+	return zap.String("peer", address)
+}
+
+//Error is the error which caused the log line
+func Error(err error) zapcore.Field {
+	return zap.Error(err)
+}
@@ -0,0 +1,47 @@
+package logging
+
+import (
+	. "github.com/onsi/gomega"
+	"istio.io/istio/pkg/log"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	g := NewGomegaWithT(t)
+	level, err := ParseLevel("DEBUG")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(level).To(Equal(log.DebugLevel))
+	g.Expect(LevelName(level)).To(Equal("debug"))
+	_, err = ParseLevel("verbose")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestConfigure(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer func() {
+		Configure(&Options{})
+		GRPC.SetOutputLevel(log.InfoLevel)
+		Auth.SetOutputLevel(log.InfoLevel)
+	}()
+	g.Expect(Configure(&Options{JSON: true, Levels: "warn, grpc:debug"})).To(Succeed())
+	g.Expect(log.FindScope(log.DefaultScopeName).GetOutputLevel()).To(Equal(log.WarnLevel))
+	g.Expect(GRPC.GetOutputLevel()).To(Equal(log.DebugLevel))
+	g.Expect(ScopeLevels()).To(HaveKeyWithValue("grpc", "debug"))
+
+	g.Expect(Configure(&Options{Levels: "grpc:verbose"})).To(HaveOccurred())
+	g.Expect(SetScopeLevel("auth", "error")).To(Succeed())
+	g.Expect(Auth.GetOutputLevel()).To(Equal(log.ErrorLevel))
+	g.Expect(SetScopeLevel("unknown", "error")).To(HaveOccurred())
+}
+
+func TestParseLevels(t *testing.T) {
+	g := NewGomegaWithT(t)
+	levels, err := ParseLevels("warn, grpc:debug,")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(levels).To(Equal(map[string]log.Level{log.DefaultScopeName: log.WarnLevel, "grpc": log.DebugLevel}))
+
+	_, err = ParseLevels("unknown:debug")
+	g.Expect(err).To(HaveOccurred())
+	_, err = ParseLevels("grpc:verbose")
+	g.Expect(err).To(HaveOccurred())
+}
@@ -0,0 +1,53 @@
+package monitoring
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	ocprometheus "go.opencensus.io/exporter/prometheus"
+	"go.opencensus.io/stats/view"
+	"net/http"
+	"time"
+)
+
+//NewHandler creates a http.Handler exporting all registered OpenCensus views, process and go runtime
+//metrics and the given collectors in the prometheus text format
+func NewHandler(collectors ...prometheus.Collector) (http.Handler, error) {
+	registry := prometheus.NewRegistry()
+	collectors = append(collectors,
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector())
+	for _, collector := range collectors {
+		if err := registry.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	exporter, err := ocprometheus.NewExporter(ocprometheus.Options{Registry: registry})
+	if err != nil {
+		return nil, err
+	}
+	view.RegisterExporter(exporter)
+	view.SetReportingPeriod(time.Second)
+	return exporter, nil
+}
+
+//NewAgeCollector creates a gauge reporting the seconds elapsed since the time returned by since.
+//No sample is reported while since returns the zero time, e.g. before the first reload.
+func NewAgeCollector(name string, help string, since func() time.Time) prometheus.Collector {
+	return &ageCollector{desc: prometheus.NewDesc(name, help, nil, nil), since: since}
+}
+
+type ageCollector struct {
+	desc  *prometheus.Desc
+	since func() time.Time
+}
+
+func (c *ageCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- c.desc
+}
+
+func (c *ageCollector) Collect(metrics chan<- prometheus.Metric) {
+	since := c.since()
+	if since.IsZero() {
+		return
+	}
+	metrics <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(since).Seconds())
+}
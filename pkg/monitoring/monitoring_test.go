@@ -0,0 +1,55 @@
+package monitoring
+
+import (
+	"context"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	g := NewGomegaWithT(t)
+	measure := stats.Int64("test/requests_total", "Test counter.", stats.UnitDimensionless)
+	testView := &view.View{Name: measure.Name(), Measure: measure, Aggregation: view.Count()}
+	g.Expect(view.Register(testView)).To(Succeed())
+	defer view.Unregister(testView)
+
+	handler, err := NewHandler(NewAgeCollector("test_age_seconds", "Test age.", func() time.Time {
+		return time.Now().Add(-time.Minute)
+	}))
+	g.Expect(err).NotTo(HaveOccurred())
+	stats.Record(context.Background(), measure.M(1))
+
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		body, _ := ioutil.ReadAll(recorder.Body)
+		return string(body)
+	}
+	g.Eventually(scrape, 5*time.Second).Should(ContainSubstring("test_requests_total 1"))
+	g.Expect(scrape()).To(MatchRegexp(`test_age_seconds 6\d`))
+	g.Expect(scrape()).To(ContainSubstring("go_goroutines"))
+}
+
+func TestAgeCollectorWithoutTime(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var since time.Time
+	registry := prometheus.NewRegistry()
+	g.Expect(registry.Register(NewAgeCollector("test_age_seconds", "Test age.", func() time.Time { return since }))).To(Succeed())
+
+	// nothing has happened yet, there is no age
+	families, err := registry.Gather()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(families).To(BeEmpty())
+
+	since = time.Now().Add(-time.Minute)
+	families, err = registry.Gather()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(families).To(HaveLen(1))
+	g.Expect(families[0].Metric[0].Gauge.GetValue()).To(BeNumerically("~", 60, 5))
+}
@@ -0,0 +1,168 @@
+package rollback
+
+import (
+	"context"
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/server"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"istio.io/istio/pkg/mcp/monitoring"
+	"istio.io/istio/pkg/mcp/snapshot"
+	"sync"
+	"time"
+)
+
+//maxEvents is the number of rollback events kept for the admin API
+const maxEvents = 100
+
+var rollbacksTotal = stats.Int64(
+	"rollback/rollbacks_total",
+	"Number of collections rolled back because sinks NACKed them.",
+	stats.UnitDimensionless)
+
+func init() {
+	err := view.Register(&view.View{
+		Name:        rollbacksTotal.Name(),
+		Description: rollbacksTotal.Description(),
+		Measure:     rollbacksTotal,
+		TagKeys:     []tag.Key{monitoring.CollectionTag},
+		Aggregation: view.Count(),
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+//Options configures a Controller
+type Options struct {
+	//NackThreshold is the fraction of the sinks watching a collection which must NACK its served
+	//version to roll the collection back, e.g. 1 for all sinks. Zero disables automatic rollbacks.
+	NackThreshold float64
+}
+
+//Target serves snapshots and can roll back single collections
+type Target interface {
+	Snapshot() snapshot.Snapshot
+	Accept(collection string, version string)
+	Rollback(collection string, reason string) (config.Rollback, error)
+	Resume(collection string) error
+	Rollbacks() []config.Rollback
+}
+
+//Event records a rollback or a resume of a collection
+type Event struct {
+	Type       string    `json:"type"`
+	Collection string    `json:"collection"`
+	Version    string    `json:"version"`
+	Reason     string    `json:"reason,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+//Controller tracks the ACKs and NACKs of all sinks. A version ACKed by all sinks watching a collection
+//becomes its accepted version, sinks which skipped the version because it didn't change their resources
+//don't hold it back. If enough sinks NACK the served version, the collection is rolled back to
+//its accepted version until it is resumed manually.
+type Controller struct {
+	options Options
+	sinks   func() []server.SinkStatus
+	target  Target
+
+	mutex  sync.Mutex
+	events []Event
+}
+
+//Ensure that Controller implements server.Listener
+var _ server.Listener = &Controller{}
+
+//NewController creates a Controller evaluating the sink status returned by sinks
+func NewController(options *Options, sinks func() []server.SinkStatus, target Target) *Controller {
+	return &Controller{
+		options: *options,
+		sinks:   sinks,
+		target:  target,
+	}
+}
+
+//Acked implements server.Listener
+func (c *Controller) Acked(collection string, version string) {
+	for _, sink := range c.sinks() {
+		if status, ok := sink.Collections[collection]; ok && status.AckedVersion != version && status.SkippedVersion != version {
+			return
+		}
+	}
+	c.target.Accept(collection, version)
+}
+
+//Nacked implements server.Listener
+func (c *Controller) Nacked(collection string, nack server.Nack) {
+	if c.options.NackThreshold <= 0 {
+		return
+	}
+	if served := c.target.Snapshot(); served == nil || served.Version(collection) != nack.Version {
+		return
+	}
+	watching, nacked := 0, 0
+	for _, sink := range c.sinks() {
+		status, ok := sink.Collections[collection]
+		if !ok {
+			continue
+		}
+		watching++
+		if status.LastNack != nil && status.LastNack.Version == nack.Version && status.AckedVersion != nack.Version {
+			nacked++
+		}
+	}
+	if watching == 0 || float64(nacked)/float64(watching) < c.options.NackThreshold {
+		return
+	}
+	reason := fmt.Sprintf("%d of %d sinks NACKed version %s: %s", nacked, watching, nack.Version, nack.Message)
+	rollback, err := c.target.Rollback(collection, reason)
+	if err != nil {
+		logging.Snapshot.Warn("Can't roll back collection", logging.Collection(collection), logging.Error(err))
+		return
+	}
+	c.record(Event{Type: "rollback", Collection: collection, Version: rollback.Version, Reason: reason, Time: rollback.Time})
+	ctx, err := tag.New(context.Background(), tag.Insert(monitoring.CollectionTag, collection))
+	if err != nil {
+		logging.Snapshot.Error("Can't create monitoring context", logging.Error(err))
+		return
+	}
+	stats.Record(ctx, rollbacksTotal.M(1))
+}
+
+//Resume serves the latest version of a rolled back collection again
+func (c *Controller) Resume(collection string) error {
+	if err := c.target.Resume(collection); err != nil {
+		return err
+	}
+	version := ""
+	if served := c.target.Snapshot(); served != nil {
+		version = served.Version(collection)
+	}
+	c.record(Event{Type: "resume", Collection: collection, Version: version, Time: time.Now()})
+	return nil
+}
+
+//Rollbacks returns the collections currently rolled back
+func (c *Controller) Rollbacks() []config.Rollback {
+	return c.target.Rollbacks()
+}
+
+//Events returns the latest rollback and resume events, oldest first
+func (c *Controller) Events() []Event {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]Event{}, c.events...)
+}
+
+func (c *Controller) record(event Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.events = append(c.events, event)
+	if len(c.events) > maxEvents {
+		c.events = c.events[len(c.events)-maxEvents:]
+	}
+}
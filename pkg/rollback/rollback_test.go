@@ -0,0 +1,118 @@
+package rollback
+
+import (
+	"errors"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/server"
+	. "github.com/onsi/gomega"
+	"istio.io/istio/pkg/mcp/snapshot"
+	"testing"
+	"time"
+)
+
+const collection = "test/collection"
+
+type fakeTarget struct {
+	version   string
+	accepted  string
+	rollbacks []config.Rollback
+}
+
+func (f *fakeTarget) Snapshot() snapshot.Snapshot {
+	builder := snapshot.NewInMemoryBuilder()
+	builder.SetVersion(collection, f.version)
+	return builder.Build()
+}
+
+func (f *fakeTarget) Accept(collection string, version string) {
+	f.accepted = version
+}
+
+func (f *fakeTarget) Rollback(collection string, reason string) (config.Rollback, error) {
+	if f.accepted == "" {
+		return config.Rollback{}, errors.New("no accepted version")
+	}
+	rollback := config.Rollback{Collection: collection, RejectedVersion: f.version, Version: f.accepted, Reason: reason, Time: time.Now()}
+	f.rollbacks = append(f.rollbacks, rollback)
+	f.version = f.accepted
+	return rollback, nil
+}
+
+func (f *fakeTarget) Resume(collection string) error {
+	if len(f.rollbacks) == 0 {
+		return errors.New("not rolled back")
+	}
+	f.version = f.rollbacks[0].RejectedVersion
+	f.rollbacks = nil
+	return nil
+}
+
+func (f *fakeTarget) Rollbacks() []config.Rollback {
+	return f.rollbacks
+}
+
+func sink(acked string, nacked string) server.SinkStatus {
+	status := &server.CollectionStatus{AckedVersion: acked}
+	if nacked != "" {
+		status.LastNack = &server.Nack{Version: nacked, Message: "invalid"}
+	}
+	return server.SinkStatus{Collections: map[string]*server.CollectionStatus{collection: status}}
+}
+
+func TestAcceptWhenAllSinksAcked(t *testing.T) {
+	g := NewGomegaWithT(t)
+	target := &fakeTarget{version: "1"}
+	sinks := []server.SinkStatus{sink("1", ""), sink("", ""), {}}
+	controller := NewController(&Options{NackThreshold: 1}, func() []server.SinkStatus { return sinks }, target)
+
+	controller.Acked(collection, "1")
+	g.Expect(target.accepted).To(BeEmpty())
+	sinks[1] = sink("1", "")
+	controller.Acked(collection, "1")
+	g.Expect(target.accepted).To(Equal("1"))
+
+	// sinks which skipped a version don't hold it back
+	sinks[1].Collections[collection].SkippedVersion = "2"
+	controller.Acked(collection, "2")
+	g.Expect(target.accepted).To(Equal("1"))
+	sinks[0] = sink("2", "")
+	controller.Acked(collection, "2")
+	g.Expect(target.accepted).To(Equal("2"))
+}
+
+func TestRollbackWhenThresholdReached(t *testing.T) {
+	g := NewGomegaWithT(t)
+	target := &fakeTarget{version: "2", accepted: "1"}
+	sinks := []server.SinkStatus{sink("1", "2"), sink("1", ""), sink("1", "")}
+	controller := NewController(&Options{NackThreshold: 0.5}, func() []server.SinkStatus { return sinks }, target)
+
+	controller.Nacked(collection, server.Nack{Version: "2"})
+	g.Expect(target.rollbacks).To(BeEmpty())
+	sinks[1] = sink("1", "2")
+	controller.Nacked(collection, server.Nack{Version: "2"})
+	g.Expect(target.rollbacks).To(HaveLen(1))
+	g.Expect(target.version).To(Equal("1"))
+	g.Expect(controller.Events()).To(HaveLen(1))
+	g.Expect(controller.Events()[0].Type).To(Equal("rollback"))
+	g.Expect(controller.Events()[0].Reason).To(ContainSubstring("2 of 3 sinks"))
+
+	g.Expect(controller.Resume(collection)).To(Succeed())
+	g.Expect(target.version).To(Equal("2"))
+	g.Expect(controller.Events()).To(HaveLen(2))
+	g.Expect(controller.Events()[1].Type).To(Equal("resume"))
+	g.Expect(controller.Resume(collection)).To(HaveOccurred())
+}
+
+func TestNoRollbackForStaleOrDisabled(t *testing.T) {
+	g := NewGomegaWithT(t)
+	target := &fakeTarget{version: "3", accepted: "1"}
+	sinks := []server.SinkStatus{sink("1", "2")}
+	controller := NewController(&Options{NackThreshold: 1}, func() []server.SinkStatus { return sinks }, target)
+	controller.Nacked(collection, server.Nack{Version: "2"})
+	g.Expect(target.rollbacks).To(BeEmpty())
+
+	target.version = "2"
+	controller = NewController(&Options{}, func() []server.SinkStatus { return sinks }, target)
+	controller.Nacked(collection, server.Nack{Version: "2"})
+	g.Expect(target.rollbacks).To(BeEmpty())
+}
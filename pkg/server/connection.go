@@ -0,0 +1,516 @@
+package server
+
+import (
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"istio.io/istio/pkg/mcp/monitoring"
+	"istio.io/istio/pkg/mcp/source"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//watch keeps the push state of a single collection on a connection.
+//It is only accessed from the connection goroutine.
+type watch struct {
+	cancel source.CancelWatchFunc
+	//incremental is set if the collection allows incremental responses
+	incremental bool
+	//request is the most recent request of the sink
+	request *request
+	//pending is the most recent response which is not yet ACKed or NACKed
+	pending *pendingResponse
+	//acked are the versions by resource name of the resources the sink has ACKed
+	acked map[string]string
+	//synced is set once the sink has ACKed a response
+	synced bool
+	//authorized is set once the sink has been authorized to watch the collection
+	authorized bool
+	//denied is set if the sink may not watch the collection, it is refused and not watched
+	denied bool
+	//namespaces restricts the resources sent to the sink unless it is nil
+	namespaces map[string]bool
+}
+
+type pendingResponse struct {
+	nonce       string
+	version     string
+	incremental bool
+	resources   []mcp.Resource
+	removed     []string
+}
+
+//connection maintains the state of a single sink stream
+type connection struct {
+	id       int64
+	peerAddr string
+	identity string
+	//nodeID is the id of the sink node of the latest request
+	nodeID   string
+	stream   stream
+	watcher  source.Watcher
+	reporter monitoring.Reporter
+	listener Listener
+	//authorizer is optional
+	authorizer Authorizer
+	watches    map[string]*watch
+
+	streamNonce int64
+	requests    chan *request
+	reqError    error
+	queue       *responseQueue
+
+	//status is written by the connection goroutine and read by Server.Sinks
+	mutex  sync.RWMutex
+	status SinkStatus
+}
+
+func newConnection(id int64, peerAddr string, identity string, stream stream, options *Options) *connection {
+	con := &connection{
+		id:         id,
+		peerAddr:   peerAddr,
+		identity:   identity,
+		stream:     stream,
+		watcher:    options.Watcher,
+		reporter:   options.Reporter,
+		listener:   options.Listener,
+		authorizer: options.Authorizer,
+		watches:    make(map[string]*watch),
+		requests:   make(chan *request),
+		queue:      newResponseQueue(),
+		status: SinkStatus{
+			ConnectionID:  id,
+			Identity:      identity,
+			RemoteAddress: peerAddr,
+			Protocol:      stream.protocol(),
+			ConnectedAt:   time.Now(),
+			Collections:   make(map[string]*CollectionStatus),
+		},
+	}
+	for _, collection := range options.Collections {
+		con.watches[collection.Name] = &watch{
+			incremental: collection.Incremental,
+			acked:       make(map[string]string),
+		}
+	}
+	logging.GRPC.Info("New connection", con.fields()...)
+	return con
+}
+
+func (con *connection) String() string {
+	return fmt.Sprintf("{addr=%v id=%v}", con.peerAddr, con.id)
+}
+
+//fields returns the log fields identifying the connection followed by fields.
+//It must only be called from the connection goroutine.
+func (con *connection) fields(fields ...zapcore.Field) []zapcore.Field {
+	return append([]zapcore.Field{logging.ConnectionID(con.id), logging.Peer(con.peerAddr), logging.NodeID(con.nodeID)}, fields...)
+}
+
+func (con *connection) process() error {
+	go con.receive()
+	for {
+		select {
+		case <-con.queue.ready:
+			for {
+				resp, ok := con.queue.dequeue()
+				if !ok {
+					break
+				}
+				if err := con.pushResponse(resp); err != nil {
+					return err
+				}
+			}
+		case req, more := <-con.requests:
+			if !more {
+				return con.reqError
+			}
+			if err := con.processRequest(req); err != nil {
+				return err
+			}
+		case <-con.queue.done:
+			return status.Error(codes.Unavailable, "server canceled watch")
+		case <-con.stream.Context().Done():
+			return con.stream.Context().Err()
+		}
+	}
+}
+
+func (con *connection) receive() {
+	defer close(con.requests)
+	for {
+		req, err := con.stream.recv()
+		if err != nil {
+			code := status.Code(err)
+			if code == codes.Canceled || err == io.EOF {
+				logging.GRPC.Info("Connection terminated", logging.ConnectionID(con.id), logging.Peer(con.peerAddr), logging.Error(err))
+				return
+			}
+			con.reporter.RecordRecvError(err, code)
+			logging.GRPC.Warn("Connection terminated with errors", logging.ConnectionID(con.id), logging.Peer(con.peerAddr), logging.Error(err))
+			con.reqError = err
+			return
+		}
+		select {
+		case con.requests <- req:
+		case <-con.queue.done:
+			return
+		case <-con.stream.Context().Done():
+			return
+		}
+	}
+}
+
+func (con *connection) close() {
+	logging.GRPC.Info("Connection closed", con.fields()...)
+	for _, w := range con.watches {
+		if w.cancel != nil {
+			w.cancel()
+		}
+	}
+}
+
+func (con *connection) processRequest(req *request) error {
+	con.reporter.RecordRequestSize(req.collection, con.id, req.size)
+
+	w, ok := con.watches[req.collection]
+	if !ok {
+		return status.Errorf(codes.InvalidArgument, "unsupported collection %q", req.collection)
+	}
+	if err := con.authorize(req.collection, w); err != nil {
+		return err
+	}
+	if w.denied {
+		// the collection has been refused, requests for it are ignored
+		return nil
+	}
+
+	if w.pending != nil && req.nonce != w.pending.nonce {
+		// Skip requests that don't match the most recent response. These could be
+		// duplicate or out-of-order requests from a buggy sink.
+		if req.errorDetail != nil {
+			logging.GRPC.Warn("Stale NACK", con.fields(logging.Collection(req.collection), zap.String("nonce", req.nonce), zap.String("expectedNonce", w.pending.nonce))...)
+			con.reporter.RecordRequestNack(req.collection, con.id, codes.Code(req.errorDetail.Code))
+		} else {
+			con.reporter.RecordRequestAck(req.collection, con.id)
+		}
+		return nil
+	}
+
+	req.sinkNode = con.annotate(req.sinkNode)
+	if req.sinkNode != nil {
+		con.nodeID = req.sinkNode.Id
+	}
+	var nack *Nack
+	if w.pending != nil && req.errorDetail != nil {
+		nack = &Nack{
+			Version: w.pending.version,
+			Code:    req.errorDetail.Code,
+			Message: req.errorDetail.Message,
+			Time:    time.Now(),
+		}
+	}
+	con.updateStatus(req.collection, func(status *CollectionStatus) {
+		if req.sinkNode != nil {
+			con.status.NodeID = req.sinkNode.Id
+			con.status.Annotations = req.sinkNode.Annotations
+		}
+		if w.pending == nil {
+			return
+		}
+		status.SentVersion = ""
+		if nack != nil {
+			status.Nacks++
+			status.LastNack = nack
+		} else {
+			status.AckedVersion = w.pending.version
+			status.AckedAt = time.Now()
+		}
+	})
+	if w.pending != nil && con.listener != nil {
+		if nack != nil {
+			con.listener.Nacked(req.collection, *nack)
+		} else {
+			con.listener.Acked(req.collection, w.pending.version)
+		}
+	}
+
+	versionInfo := req.versionInfo
+	if w.pending == nil {
+		if w.request == nil && req.initialResourceVersions != nil {
+			w.acked = make(map[string]string, len(req.initialResourceVersions))
+			for name, version := range req.initialResourceVersions {
+				w.acked[name] = version
+			}
+		}
+	} else {
+		// An ACK or NACK of the pending response. Watch for versions newer than the
+		// pending one in both cases, a NACKed version is not sent again.
+		versionInfo = w.pending.version
+		if req.errorDetail != nil {
+			logging.GRPC.Warn("NACK", con.fields(logging.Collection(req.collection), logging.CollectionVersion(versionInfo),
+				zap.String("nonce", req.nonce), zap.String("error", req.errorDetail.Message))...)
+			con.reporter.RecordRequestNack(req.collection, con.id, codes.Code(req.errorDetail.Code))
+		} else {
+			logging.GRPC.Debug("ACK", con.fields(logging.Collection(req.collection), logging.CollectionVersion(versionInfo), zap.String("nonce", req.nonce))...)
+			con.reporter.RecordRequestAck(req.collection, con.id)
+			w.ack()
+		}
+		w.pending = nil
+	}
+
+	w.request = req
+	con.watch(w, versionInfo)
+	return nil
+}
+
+//authorize checks once per collection whether the sink may watch it. Collections the sink may not watch are
+//refused, streams which can't refuse a single collection are closed with PermissionDenied.
+func (con *connection) authorize(collection string, w *watch) error {
+	if con.authorizer == nil || w.authorized {
+		return nil
+	}
+	w.authorized = true
+	allowed, namespaces := con.authorizer.Allowed(con.identity, collection)
+	if !allowed {
+		logging.Auth.Warn("Watch not authorized", con.fields(zap.String("identity", con.identity), logging.Collection(collection))...)
+		w.denied = true
+		con.updateStatus(collection, func(status *CollectionStatus) {
+			status.Denied = true
+		})
+		con.streamNonce++
+		if err := con.stream.refuse(collection, strconv.FormatInt(con.streamNonce, 10)); err != nil {
+			if status.Code(err) != codes.PermissionDenied {
+				con.reporter.RecordSendError(err, status.Code(err))
+			}
+			return err
+		}
+		return nil
+	}
+	if namespaces != nil {
+		w.namespaces = make(map[string]bool, len(namespaces))
+		for _, namespace := range namespaces {
+			w.namespaces[namespace] = true
+		}
+	}
+	return nil
+}
+
+//filter returns the resources in the namespaces the sink may watch
+func (w *watch) filter(resources []*mcp.Resource) []*mcp.Resource {
+	if w.namespaces == nil {
+		return resources
+	}
+	filtered := make([]*mcp.Resource, 0, len(resources))
+	for _, resource := range resources {
+		if w.namespaces[resourceNamespace(resource)] {
+			filtered = append(filtered, resource)
+		}
+	}
+	return filtered
+}
+
+//resourceNamespace returns the namespace of a resource named namespace/name. It is empty for cluster scoped resources.
+func resourceNamespace(resource *mcp.Resource) string {
+	if resource.Metadata == nil {
+		return ""
+	}
+	if i := strings.LastIndex(resource.Metadata.Name, "/"); i >= 0 {
+		return resource.Metadata.Name[:i]
+	}
+	return ""
+}
+
+//annotate returns a copy of the sink node with the IdentityAnnotation set to the identity of the sink,
+//so that sinks can be routed to groups by their identity. Annotations sent by the sink with the same key are replaced.
+func (con *connection) annotate(node *mcp.SinkNode) *mcp.SinkNode {
+	if node == nil && con.identity == "" {
+		return nil
+	}
+	annotated := &mcp.SinkNode{Annotations: make(map[string]string)}
+	if node != nil {
+		annotated.Id = node.Id
+		for key, value := range node.Annotations {
+			annotated.Annotations[key] = value
+		}
+	}
+	delete(annotated.Annotations, IdentityAnnotation)
+	if con.identity != "" {
+		annotated.Annotations[IdentityAnnotation] = con.identity
+	}
+	return annotated
+}
+
+func (con *connection) watch(w *watch, versionInfo string) {
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.cancel = con.watcher.Watch(&source.Request{
+		Collection:  w.request.collection,
+		VersionInfo: versionInfo,
+		SinkNode:    w.request.sinkNode,
+	}, con.queue.enqueue)
+}
+
+func (con *connection) pushResponse(resp *source.WatchResponse) error {
+	w, ok := con.watches[resp.Collection]
+	if !ok {
+		logging.GRPC.Error("Unknown collection in watch response", con.fields(logging.Collection(resp.Collection))...)
+		return nil
+	}
+
+	resources := w.filter(resp.Resources)
+	pending := &pendingResponse{
+		version:     resp.Version,
+		incremental: w.incremental && w.request.incremental,
+	}
+	if pending.incremental {
+		pending.resources, pending.removed = calculateDelta(resources, w.acked)
+		if w.synced && len(pending.resources) == 0 && len(pending.removed) == 0 {
+			// nothing changed for the sink, wait for the next version. The version is not ACKed by the sink.
+			con.updateStatus(resp.Collection, func(status *CollectionStatus) {
+				status.SkippedVersion = resp.Version
+			})
+			con.watch(w, resp.Version)
+			return nil
+		}
+	} else {
+		pending.resources = make([]mcp.Resource, 0, len(resources))
+		for _, resource := range resources {
+			pending.resources = append(pending.resources, *resource)
+		}
+	}
+
+	con.streamNonce++
+	pending.nonce = strconv.FormatInt(con.streamNonce, 10)
+	err := con.stream.send(&response{
+		collection:  resp.Collection,
+		version:     pending.version,
+		resources:   pending.resources,
+		removed:     pending.removed,
+		incremental: pending.incremental,
+		nonce:       pending.nonce,
+	})
+	if err != nil {
+		con.reporter.RecordSendError(err, status.Code(err))
+		return err
+	}
+	logging.GRPC.Debug("Sent response", con.fields(logging.Collection(resp.Collection), logging.CollectionVersion(pending.version),
+		zap.String("nonce", pending.nonce), zap.Bool("incremental", pending.incremental), zap.Int("resources", len(pending.resources)))...)
+	w.pending = pending
+	con.updateStatus(resp.Collection, func(status *CollectionStatus) {
+		status.SentVersion = pending.version
+	})
+	return nil
+}
+
+//updateStatus applies update to the status of collection while holding the status lock
+func (con *connection) updateStatus(collection string, update func(status *CollectionStatus)) {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	status, ok := con.status.Collections[collection]
+	if !ok {
+		status = &CollectionStatus{}
+		con.status.Collections[collection] = status
+	}
+	update(status)
+}
+
+//sinkStatus returns a copy of the connection status
+func (con *connection) sinkStatus() SinkStatus {
+	con.mutex.RLock()
+	defer con.mutex.RUnlock()
+	return con.status.clone()
+}
+
+//ack applies the pending response to the resource versions known to the sink
+func (w *watch) ack() {
+	if !w.pending.incremental {
+		w.acked = make(map[string]string, len(w.pending.resources))
+	}
+	for _, name := range w.pending.removed {
+		delete(w.acked, name)
+	}
+	for _, resource := range w.pending.resources {
+		w.acked[resource.Metadata.Name] = resource.Metadata.Version
+	}
+	w.synced = true
+}
+
+//calculateDelta returns the resources which are new or changed compared to the acked resource versions
+//and the names of the acked resources which no longer exist
+func calculateDelta(current []*mcp.Resource, acked map[string]string) (added []mcp.Resource, removed []string) {
+	desired := make(map[string]struct{}, len(current))
+	for _, resource := range current {
+		if version, ok := acked[resource.Metadata.Name]; !ok || version != resource.Metadata.Version {
+			added = append(added, *resource)
+		}
+		desired[resource.Metadata.Name] = struct{}{}
+	}
+	for name := range acked {
+		if _, ok := desired[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	return added, removed
+}
+
+//responseQueue keeps the latest watch response per collection until the connection goroutine sends it
+type responseQueue struct {
+	mutex     sync.Mutex
+	responses map[string]*source.WatchResponse
+	order     []string
+	ready     chan struct{}
+	done      chan struct{}
+	closed    bool
+}
+
+func newResponseQueue() *responseQueue {
+	return &responseQueue{
+		responses: make(map[string]*source.WatchResponse),
+		ready:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+//enqueue implements source.PushResponseFunc. A nil response closes the queue.
+func (q *responseQueue) enqueue(resp *source.WatchResponse) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return
+	}
+	if resp == nil {
+		q.closed = true
+		close(q.done)
+		return
+	}
+	if _, ok := q.responses[resp.Collection]; !ok {
+		q.order = append(q.order, resp.Collection)
+	}
+	q.responses[resp.Collection] = resp
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *responseQueue) dequeue() (*source.WatchResponse, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.order) == 0 {
+		return nil, false
+	}
+	collection := q.order[0]
+	q.order = q.order[1:]
+	resp := q.responses[collection]
+	delete(q.responses, collection)
+	return resp, true
+}
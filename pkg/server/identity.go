@@ -0,0 +1,24 @@
+package server
+
+import (
+	"google.golang.org/grpc/credentials"
+	"istio.io/istio/security/pkg/pki/util"
+)
+
+//IdentityAnnotation is set on the sink node of authenticated sinks to their identity
+const IdentityAnnotation = "mcp-server.peripli.io/identity"
+
+//PeerIdentity returns the identity of a sink authenticated with a client certificate.
+//The SAN URIs (e.g. spiffe ids) of the leaf certificate take precedence over its common name.
+//An empty string is returned if the sink is not authenticated.
+func PeerIdentity(authInfo credentials.AuthInfo) string {
+	tlsInfo, ok := authInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := tlsInfo.State.PeerCertificates[0]
+	if ids, err := util.ExtractIDs(cert.Extensions); err == nil && len(ids) > 0 {
+		return ids[0]
+	}
+	return cert.Subject.CommonName
+}
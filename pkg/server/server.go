@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"istio.io/istio/pkg/mcp/monitoring"
+	"istio.io/istio/pkg/mcp/server"
+	"istio.io/istio/pkg/mcp/source"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+//Options configures a Server
+type Options struct {
+	Watcher     source.Watcher
+	Collections []source.CollectionOptions
+	Reporter    monitoring.Reporter
+	AuthChecker server.AuthChecker
+	//Authenticator is optional and replaces AuthChecker if set
+	Authenticator Authenticator
+	//Authorizer is optional and decides which collections a sink may watch. Collections a sink may not watch
+	//are refused.
+	Authorizer Authorizer
+	//Listener is optional and notified about ACKs and NACKs
+	Listener Listener
+	//MaxStreamsPerIdentity limits the concurrent streams of a sink identity. Sinks without identity aren't
+	//limited, they can't be told apart behind load balancers. 0 disables the limit.
+	MaxStreamsPerIdentity int
+}
+
+//Authenticator authenticates the sink of a new stream by its transport credentials or the metadata of the stream.
+//It returns the identity of the sink, which may be empty if the sink is not identified.
+type Authenticator interface {
+	Authenticate(ctx context.Context, authInfo credentials.AuthInfo) (string, error)
+}
+
+//Authorizer decides which collections and namespaces a sink may watch by its identity
+type Authorizer interface {
+	//Allowed returns true if identity may watch collection. The resources sent are restricted to namespaces
+	//unless it is nil.
+	Allowed(identity string, collection string) (bool, []string)
+}
+
+//Listener is notified when a sink ACKs or NACKs a version of a collection.
+//It is called from the goroutine of the sink connection and must not block.
+type Listener interface {
+	Acked(collection string, version string)
+	Nacked(collection string, nack Nack)
+}
+
+//Server serves MCP resources from a source.Watcher over the AggregatedMeshConfigService
+//(full state and incremental) and the ResourceSource service.
+//Incremental responses are only sent for collections that allow them and only to sinks that ask for them.
+type Server struct {
+	options      Options
+	nextStreamID int64
+
+	mutex       sync.RWMutex
+	connections map[int64]*connection
+	//streams counts the connections by sink identity
+	streams map[string]int
+}
+
+//Ensure that Server implements both MCP source services
+var _ mcp.AggregatedMeshConfigServiceServer = &Server{}
+var _ mcp.ResourceSourceServer = &Server{}
+
+//New creates a Server
+func New(options *Options) *Server {
+	return &Server{
+		options:     *options,
+		connections: make(map[int64]*connection),
+		streams:     make(map[string]int),
+	}
+}
+
+//Sinks returns the status of all connected sinks ordered by connection id
+func (s *Server) Sinks() []SinkStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	result := make([]SinkStatus, 0, len(s.connections))
+	for _, con := range s.connections {
+		result = append(result, con.sinkStatus())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ConnectionID < result[j].ConnectionID
+	})
+	return result
+}
+
+//StreamAggregatedResources implements the full state AggregatedMeshConfigService
+func (s *Server) StreamAggregatedResources(stream mcp.AggregatedMeshConfigService_StreamAggregatedResourcesServer) error {
+	return s.serve(&aggregatedStream{stream})
+}
+
+//IncrementalAggregatedResources implements the incremental AggregatedMeshConfigService. Its responses don't name
+//their collection, a stream watching a second collection is closed with InvalidArgument.
+func (s *Server) IncrementalAggregatedResources(stream mcp.AggregatedMeshConfigService_IncrementalAggregatedResourcesServer) error {
+	return s.serve(&incrementalStream{AggregatedMeshConfigService_IncrementalAggregatedResourcesServer: stream})
+}
+
+//EstablishResourceStream implements the ResourceSource service
+func (s *Server) EstablishResourceStream(stream mcp.ResourceSource_EstablishResourceStreamServer) error {
+	return s.serve(&resourceStream{stream})
+}
+
+func (s *Server) serve(stream stream) error {
+	peerAddr := "0.0.0.0"
+	var authInfo credentials.AuthInfo
+	if peerInfo, ok := peer.FromContext(stream.Context()); ok {
+		peerAddr = peerInfo.Addr.String()
+		authInfo = peerInfo.AuthInfo
+	} else {
+		logging.GRPC.Warn("No peer info found on the incoming stream")
+	}
+	identity, err := s.authenticate(stream.Context(), authInfo)
+	if err != nil {
+		logging.Auth.Warn("Authentication failed", logging.Peer(peerAddr), logging.Error(err))
+		return status.Errorf(codes.Unauthenticated, "Authentication failure: %v", err)
+	}
+
+	if identity != "" {
+		if !s.reserveStream(identity) {
+			logging.GRPC.Warn("Too many concurrent streams", logging.Peer(peerAddr), zap.String("identity", identity),
+				zap.Int("maxStreamsPerIdentity", s.options.MaxStreamsPerIdentity))
+			return status.Errorf(codes.ResourceExhausted, "Too many concurrent streams of %s, at most %d are allowed", identity, s.options.MaxStreamsPerIdentity)
+		}
+		defer s.releaseStream(identity)
+	}
+
+	con := newConnection(atomic.AddInt64(&s.nextStreamID, 1), peerAddr, identity, stream, &s.options)
+	s.addConnection(con)
+	defer s.removeConnection(con)
+
+	err = con.process()
+	code := status.Code(err)
+	if code == codes.OK || code == codes.Canceled || err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) authenticate(ctx context.Context, authInfo credentials.AuthInfo) (string, error) {
+	if s.options.Authenticator != nil {
+		return s.options.Authenticator.Authenticate(ctx, authInfo)
+	}
+	if err := s.options.AuthChecker.Check(authInfo); err != nil {
+		return "", err
+	}
+	return PeerIdentity(authInfo), nil
+}
+
+func (s *Server) reserveStream(identity string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.options.MaxStreamsPerIdentity > 0 && s.streams[identity] >= s.options.MaxStreamsPerIdentity {
+		return false
+	}
+	s.streams[identity]++
+	return true
+}
+
+func (s *Server) releaseStream(identity string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.streams[identity]--; s.streams[identity] <= 0 {
+		delete(s.streams, identity)
+	}
+}
+
+func (s *Server) addConnection(con *connection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.connections[con.id] = con
+	s.options.Reporter.SetStreamCount(int64(len(s.connections)))
+}
+
+func (s *Server) removeConnection(con *connection) {
+	con.close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.connections, con.id)
+	s.options.Reporter.SetStreamCount(int64(len(s.connections)))
+}
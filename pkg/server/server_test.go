@@ -0,0 +1,589 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/gogo/googleapis/google/rpc"
+	"github.com/gogo/protobuf/types"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"istio.io/istio/pkg/mcp/server"
+	"istio.io/istio/pkg/mcp/snapshot"
+	"istio.io/istio/pkg/mcp/source"
+	mcptestmon "istio.io/istio/pkg/mcp/testing/monitoring"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+const testCollection = "test/collection"
+
+type fakeServerStream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newFakeServerStream() fakeServerStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	return fakeServerStream{ctx: ctx, cancel: cancel}
+}
+
+func (s *fakeServerStream) SetHeader(metadata.MD) error  { return nil }
+func (s *fakeServerStream) SendHeader(metadata.MD) error { return nil }
+func (s *fakeServerStream) SetTrailer(metadata.MD)       {}
+func (s *fakeServerStream) Context() context.Context     { return s.ctx }
+func (s *fakeServerStream) SendMsg(m interface{}) error  { return nil }
+func (s *fakeServerStream) RecvMsg(m interface{}) error  { return nil }
+
+var _ grpc.ServerStream = &fakeServerStream{}
+
+type fakeIncrementalStream struct {
+	fakeServerStream
+	requests  chan *mcp.IncrementalMeshConfigRequest
+	responses chan *mcp.IncrementalMeshConfigResponse
+}
+
+func (s *fakeIncrementalStream) Send(resp *mcp.IncrementalMeshConfigResponse) error {
+	s.responses <- resp
+	return nil
+}
+
+func (s *fakeIncrementalStream) Recv() (*mcp.IncrementalMeshConfigRequest, error) {
+	select {
+	case req, ok := <-s.requests:
+		if !ok {
+			return nil, io.EOF
+		}
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+type fakeAggregatedStream struct {
+	fakeServerStream
+	requests  chan *mcp.MeshConfigRequest
+	responses chan *mcp.MeshConfigResponse
+}
+
+func (s *fakeAggregatedStream) Send(resp *mcp.MeshConfigResponse) error {
+	s.responses <- resp
+	return nil
+}
+
+func (s *fakeAggregatedStream) Recv() (*mcp.MeshConfigRequest, error) {
+	select {
+	case req, ok := <-s.requests:
+		if !ok {
+			return nil, io.EOF
+		}
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+type fakeResourceStream struct {
+	fakeServerStream
+	requests  chan *mcp.RequestResources
+	responses chan *mcp.Resources
+}
+
+func (s *fakeResourceStream) Send(resp *mcp.Resources) error {
+	s.responses <- resp
+	return nil
+}
+
+func (s *fakeResourceStream) Recv() (*mcp.RequestResources, error) {
+	select {
+	case req, ok := <-s.requests:
+		if !ok {
+			return nil, io.EOF
+		}
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+func newTestServer(incremental bool) (*Server, *snapshot.Cache) {
+	cache := snapshot.New(func(string, *mcp.SinkNode) string { return "default" })
+	return New(&Options{
+		Watcher:     cache,
+		Collections: []source.CollectionOptions{{Name: testCollection, Incremental: incremental}},
+		Reporter:    mcptestmon.NewInMemoryStatsContext(),
+		AuthChecker: server.NewAllowAllChecker(),
+	}), cache
+}
+
+func newTestSnapshot(version int, contents map[string]string) snapshot.Snapshot {
+	builder := snapshot.NewInMemoryBuilder()
+	var resources []*mcp.Resource
+	for name, content := range contents {
+		body, err := types.MarshalAny(&types.StringValue{Value: content})
+		if err != nil {
+			panic(err)
+		}
+		resources = append(resources, &mcp.Resource{
+			Metadata: &mcp.Metadata{Name: name, Version: content},
+			Body:     body,
+		})
+	}
+	builder.Set(testCollection, fmt.Sprintf("%d", version), resources)
+	return builder.Build()
+}
+
+func resourceNames(resources []mcp.Resource) []string {
+	names := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		names = append(names, resource.Metadata.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestIncrementalDeltasAcrossVersions(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s, cache := newTestServer(true)
+	stream := &fakeIncrementalStream{
+		fakeServerStream: newFakeServerStream(),
+		requests:         make(chan *mcp.IncrementalMeshConfigRequest, 1),
+		responses:        make(chan *mcp.IncrementalMeshConfigResponse, 1),
+	}
+	defer stream.cancel()
+	go s.IncrementalAggregatedResources(stream)
+
+	random := rand.New(rand.NewSource(42))
+	desired := map[string]string{"a": "a1", "b": "b1"}
+	sink := make(map[string]string)
+	cache.SetSnapshot("default", newTestSnapshot(1, desired))
+	stream.requests <- &mcp.IncrementalMeshConfigRequest{TypeUrl: testCollection, SinkNode: &mcp.SinkNode{Id: "sink"}}
+
+	changed := []string{"a", "b"}
+	for version := 1; version <= 100; version++ {
+		var resp *mcp.IncrementalMeshConfigResponse
+		g.Eventually(stream.responses).Should(Receive(&resp))
+		g.Expect(resp.SystemVersionInfo).To(Equal(fmt.Sprintf("%d", version)))
+
+		// only changed resources are sent
+		g.Expect(append(resourceNames(resp.Resources), resp.RemovedResources...)).To(ConsistOf(changed))
+		for _, name := range resp.RemovedResources {
+			delete(sink, name)
+		}
+		for _, resource := range resp.Resources {
+			sink[resource.Metadata.Name] = resource.Metadata.Version
+		}
+		g.Expect(sink).To(Equal(desired))
+		stream.requests <- &mcp.IncrementalMeshConfigRequest{TypeUrl: testCollection, ResponseNonce: resp.Nonce}
+
+		// add, update and remove resources for the next version
+		previous := make(map[string]string, len(desired))
+		for name, content := range desired {
+			previous[name] = content
+		}
+		for changed = nil; len(changed) == 0; changed = diff(previous, desired) {
+			for i := 0; i < 3; i++ {
+				name := fmt.Sprintf("%c", 'a'+random.Intn(10))
+				if random.Intn(3) == 0 {
+					delete(desired, name)
+				} else {
+					desired[name] = fmt.Sprintf("%s%d", name, version+1)
+				}
+			}
+		}
+		cache.SetSnapshot("default", newTestSnapshot(version+1, desired))
+	}
+}
+
+func diff(previous map[string]string, current map[string]string) []string {
+	var changed []string
+	for name, content := range current {
+		if previous[name] != content {
+			changed = append(changed, name)
+		}
+	}
+	for name := range previous {
+		if _, ok := current[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+func TestIncrementalSkipsUnchangedVersions(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s, cache := newTestServer(true)
+	stream := &fakeIncrementalStream{
+		fakeServerStream: newFakeServerStream(),
+		requests:         make(chan *mcp.IncrementalMeshConfigRequest, 1),
+		responses:        make(chan *mcp.IncrementalMeshConfigResponse, 1),
+	}
+	defer stream.cancel()
+	go s.IncrementalAggregatedResources(stream)
+
+	cache.SetSnapshot("default", newTestSnapshot(1, map[string]string{"a": "a1", "b": "b1"}))
+	stream.requests <- &mcp.IncrementalMeshConfigRequest{
+		TypeUrl:                 testCollection,
+		InitialResourceVersions: map[string]string{"a": "a1", "c": "c1"},
+	}
+	var resp *mcp.IncrementalMeshConfigResponse
+	g.Eventually(stream.responses).Should(Receive(&resp))
+	g.Expect(resourceNames(resp.Resources)).To(Equal([]string{"b"}))
+	g.Expect(resp.RemovedResources).To(Equal([]string{"c"}))
+	stream.requests <- &mcp.IncrementalMeshConfigRequest{TypeUrl: testCollection, ResponseNonce: resp.Nonce}
+
+	cache.SetSnapshot("default", newTestSnapshot(2, map[string]string{"a": "a1", "b": "b1"}))
+	g.Consistently(stream.responses, 100*time.Millisecond).ShouldNot(Receive())
+	status := s.Sinks()[0].Collections[testCollection]
+	g.Expect(status.AckedVersion).To(Equal("1"))
+	g.Expect(status.SkippedVersion).To(Equal("2"))
+
+	cache.SetSnapshot("default", newTestSnapshot(3, map[string]string{"a": "a3", "b": "b1"}))
+	g.Eventually(stream.responses).Should(Receive(&resp))
+	g.Expect(resp.SystemVersionInfo).To(Equal("3"))
+	g.Expect(resourceNames(resp.Resources)).To(Equal([]string{"a"}))
+	g.Expect(resp.RemovedResources).To(BeEmpty())
+}
+
+func TestIncrementalNackKeepsAckedState(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s, cache := newTestServer(true)
+	stream := &fakeIncrementalStream{
+		fakeServerStream: newFakeServerStream(),
+		requests:         make(chan *mcp.IncrementalMeshConfigRequest, 1),
+		responses:        make(chan *mcp.IncrementalMeshConfigResponse, 1),
+	}
+	defer stream.cancel()
+	go s.IncrementalAggregatedResources(stream)
+
+	cache.SetSnapshot("default", newTestSnapshot(1, map[string]string{"a": "a1"}))
+	stream.requests <- &mcp.IncrementalMeshConfigRequest{TypeUrl: testCollection}
+	var resp *mcp.IncrementalMeshConfigResponse
+	g.Eventually(stream.responses).Should(Receive(&resp))
+	stream.requests <- &mcp.IncrementalMeshConfigRequest{TypeUrl: testCollection, ResponseNonce: resp.Nonce}
+
+	cache.SetSnapshot("default", newTestSnapshot(2, map[string]string{"b": "b2"}))
+	g.Eventually(stream.responses).Should(Receive(&resp))
+	stream.requests <- &mcp.IncrementalMeshConfigRequest{TypeUrl: testCollection, ResponseNonce: resp.Nonce, ErrorDetail: &rpc.Status{Code: 3, Message: "invalid"}}
+	g.Consistently(stream.responses, 100*time.Millisecond).ShouldNot(Receive())
+
+	// the delta is still calculated against the last ACKed version
+	cache.SetSnapshot("default", newTestSnapshot(3, map[string]string{"b": "b3"}))
+	g.Eventually(stream.responses).Should(Receive(&resp))
+	g.Expect(resourceNames(resp.Resources)).To(Equal([]string{"b"}))
+	g.Expect(resp.RemovedResources).To(Equal([]string{"a"}))
+}
+
+func TestIncrementalStreamRejectsSecondCollection(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s, cache := newTestServer(true)
+	s.options.Collections = append(s.options.Collections, source.CollectionOptions{Name: "test/other", Incremental: true})
+	cache.SetSnapshot("default", newTestSnapshot(1, map[string]string{"a": "a1"}))
+	stream := &fakeIncrementalStream{
+		fakeServerStream: newFakeServerStream(),
+		requests:         make(chan *mcp.IncrementalMeshConfigRequest, 1),
+		responses:        make(chan *mcp.IncrementalMeshConfigResponse, 1),
+	}
+	defer stream.cancel()
+	result := make(chan error, 1)
+	go func() { result <- s.IncrementalAggregatedResources(stream) }()
+
+	stream.requests <- &mcp.IncrementalMeshConfigRequest{TypeUrl: testCollection}
+	var resp *mcp.IncrementalMeshConfigResponse
+	g.Eventually(stream.responses).Should(Receive(&resp))
+
+	// the responses don't name their collection, a second one would be indistinguishable
+	stream.requests <- &mcp.IncrementalMeshConfigRequest{TypeUrl: "test/other"}
+	var err error
+	g.Eventually(result).Should(Receive(&err))
+	g.Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+	g.Expect(err).To(MatchError(ContainSubstring("needs another stream")))
+}
+
+func TestStreamAggregatedResourcesSendsFullState(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s, cache := newTestServer(true)
+	stream := &fakeAggregatedStream{
+		fakeServerStream: newFakeServerStream(),
+		requests:         make(chan *mcp.MeshConfigRequest, 1),
+		responses:        make(chan *mcp.MeshConfigResponse, 1),
+	}
+	defer stream.cancel()
+	go s.StreamAggregatedResources(stream)
+
+	cache.SetSnapshot("default", newTestSnapshot(1, map[string]string{"a": "a1", "b": "b1"}))
+	stream.requests <- &mcp.MeshConfigRequest{TypeUrl: testCollection}
+	var resp *mcp.MeshConfigResponse
+	g.Eventually(stream.responses).Should(Receive(&resp))
+	g.Expect(resp.TypeUrl).To(Equal(testCollection))
+	g.Expect(resourceNames(resp.Resources)).To(Equal([]string{"a", "b"}))
+	stream.requests <- &mcp.MeshConfigRequest{TypeUrl: testCollection, VersionInfo: resp.VersionInfo, ResponseNonce: resp.Nonce}
+
+	cache.SetSnapshot("default", newTestSnapshot(2, map[string]string{"a": "a2", "b": "b1"}))
+	g.Eventually(stream.responses).Should(Receive(&resp))
+	g.Expect(resp.VersionInfo).To(Equal("2"))
+	g.Expect(resourceNames(resp.Resources)).To(Equal([]string{"a", "b"}))
+
+	// a NACKed version is not sent again
+	stream.requests <- &mcp.MeshConfigRequest{TypeUrl: testCollection, VersionInfo: "1", ResponseNonce: resp.Nonce, ErrorDetail: &rpc.Status{Code: 3}}
+	g.Consistently(stream.responses, 100*time.Millisecond).ShouldNot(Receive())
+}
+
+func TestResourceSourceHonorsIncrementalFlag(t *testing.T) {
+	for _, incremental := range []bool{false, true} {
+		g := NewGomegaWithT(t)
+		s, cache := newTestServer(true)
+		stream := &fakeResourceStream{
+			fakeServerStream: newFakeServerStream(),
+			requests:         make(chan *mcp.RequestResources, 1),
+			responses:        make(chan *mcp.Resources, 1),
+		}
+		go s.EstablishResourceStream(stream)
+
+		cache.SetSnapshot("default", newTestSnapshot(1, map[string]string{"a": "a1", "b": "b1"}))
+		stream.requests <- &mcp.RequestResources{Collection: testCollection, Incremental: incremental}
+		var resp *mcp.Resources
+		g.Eventually(stream.responses).Should(Receive(&resp))
+		stream.requests <- &mcp.RequestResources{Collection: testCollection, Incremental: incremental, ResponseNonce: resp.Nonce}
+
+		cache.SetSnapshot("default", newTestSnapshot(2, map[string]string{"a": "a2", "b": "b1"}))
+		g.Eventually(stream.responses).Should(Receive(&resp))
+		g.Expect(resp.Incremental).To(Equal(incremental))
+		if incremental {
+			g.Expect(resourceNames(resp.Resources)).To(Equal([]string{"a"}))
+		} else {
+			g.Expect(resourceNames(resp.Resources)).To(Equal([]string{"a", "b"}))
+		}
+		stream.cancel()
+	}
+}
+
+func TestIncrementalDisabledForCollection(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s, cache := newTestServer(false)
+	stream := &fakeResourceStream{
+		fakeServerStream: newFakeServerStream(),
+		requests:         make(chan *mcp.RequestResources, 1),
+		responses:        make(chan *mcp.Resources, 1),
+	}
+	defer stream.cancel()
+	go s.EstablishResourceStream(stream)
+
+	cache.SetSnapshot("default", newTestSnapshot(1, map[string]string{"a": "a1", "b": "b1"}))
+	stream.requests <- &mcp.RequestResources{Collection: testCollection, Incremental: true, InitialResourceVersions: map[string]string{"a": "a1"}}
+	var resp *mcp.Resources
+	g.Eventually(stream.responses).Should(Receive(&resp))
+	g.Expect(resp.Incremental).To(BeFalse())
+	g.Expect(resourceNames(resp.Resources)).To(Equal([]string{"a", "b"}))
+}
+
+func TestUnsupportedCollection(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s, _ := newTestServer(true)
+	stream := &fakeAggregatedStream{
+		fakeServerStream: newFakeServerStream(),
+		requests:         make(chan *mcp.MeshConfigRequest, 1),
+		responses:        make(chan *mcp.MeshConfigResponse, 1),
+	}
+	defer stream.cancel()
+	stream.requests <- &mcp.MeshConfigRequest{TypeUrl: "unknown"}
+	g.Expect(s.StreamAggregatedResources(stream)).To(HaveOccurred())
+}
+
+func TestSinkStatus(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s, cache := newTestServer(true)
+	stream := &fakeAggregatedStream{
+		fakeServerStream: newFakeServerStream(),
+		requests:         make(chan *mcp.MeshConfigRequest, 1),
+		responses:        make(chan *mcp.MeshConfigResponse, 1),
+	}
+	go s.StreamAggregatedResources(stream)
+
+	cache.SetSnapshot("default", newTestSnapshot(1, map[string]string{"a": "a1"}))
+	sinkNode := &mcp.SinkNode{Id: "pilot-1", Annotations: map[string]string{"zone": "a"}}
+	stream.requests <- &mcp.MeshConfigRequest{TypeUrl: testCollection, SinkNode: sinkNode}
+	var resp *mcp.MeshConfigResponse
+	g.Eventually(stream.responses).Should(Receive(&resp))
+	g.Eventually(func() string { return s.Sinks()[0].Collections[testCollection].SentVersion }).Should(Equal("1"))
+	stream.requests <- &mcp.MeshConfigRequest{TypeUrl: testCollection, SinkNode: sinkNode, VersionInfo: "1", ResponseNonce: resp.Nonce}
+	g.Eventually(func() string { return s.Sinks()[0].Collections[testCollection].AckedVersion }).Should(Equal("1"))
+
+	cache.SetSnapshot("default", newTestSnapshot(2, map[string]string{"a": "a2"}))
+	g.Eventually(stream.responses).Should(Receive(&resp))
+	stream.requests <- &mcp.MeshConfigRequest{TypeUrl: testCollection, SinkNode: sinkNode, VersionInfo: "1", ResponseNonce: resp.Nonce,
+		ErrorDetail: &rpc.Status{Code: 3, Message: "invalid gateway"}}
+	g.Eventually(func() int { return s.Sinks()[0].Collections[testCollection].Nacks }).Should(Equal(1))
+
+	sinks := s.Sinks()
+	g.Expect(sinks).To(HaveLen(1))
+	g.Expect(sinks[0].NodeID).To(Equal("pilot-1"))
+	g.Expect(sinks[0].Annotations).To(HaveKeyWithValue("zone", "a"))
+	g.Expect(sinks[0].Protocol).To(Equal("AggregatedMeshConfigService"))
+	status := sinks[0].Collections[testCollection]
+	g.Expect(status.AckedVersion).To(Equal("1"))
+	g.Expect(status.SentVersion).To(BeEmpty())
+	g.Expect(status.LastNack.Version).To(Equal("2"))
+	g.Expect(status.LastNack.Message).To(Equal("invalid gateway"))
+
+	stream.cancel()
+	g.Eventually(s.Sinks).Should(BeEmpty())
+}
+
+func TestMaxStreamsPerIdentity(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s, _ := newTestServer(true)
+	s.options.MaxStreamsPerIdentity = 1
+	s.options.Authenticator = &fakeAuthenticator{identity: "pilot"}
+	newStream := func() *fakeAggregatedStream {
+		return &fakeAggregatedStream{
+			fakeServerStream: newFakeServerStream(),
+			requests:         make(chan *mcp.MeshConfigRequest, 1),
+			responses:        make(chan *mcp.MeshConfigResponse, 1),
+		}
+	}
+	first := newStream()
+	go s.StreamAggregatedResources(first)
+	g.Eventually(s.Sinks).Should(HaveLen(1))
+
+	second := newStream()
+	err := s.StreamAggregatedResources(second)
+	g.Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+
+	first.cancel()
+	g.Eventually(s.Sinks).Should(BeEmpty())
+	third := newStream()
+	go s.StreamAggregatedResources(third)
+	g.Eventually(s.Sinks).Should(HaveLen(1))
+	third.cancel()
+	g.Eventually(s.Sinks).Should(BeEmpty())
+
+	// sinks without identity aren't limited
+	s.options.Authenticator = nil
+	for _, stream := range []*fakeAggregatedStream{newStream(), newStream()} {
+		defer stream.cancel()
+		go s.StreamAggregatedResources(stream)
+	}
+	g.Eventually(s.Sinks).Should(HaveLen(2))
+}
+
+type fakeAuthenticator struct {
+	identity string
+}
+
+func (a *fakeAuthenticator) Authenticate(context.Context, credentials.AuthInfo) (string, error) {
+	if a.identity == "" {
+		return "", fmt.Errorf("no token")
+	}
+	return a.identity, nil
+}
+
+func TestAuthenticatorIdentityRoutesGroups(t *testing.T) {
+	g := NewGomegaWithT(t)
+	cache := snapshot.New(func(_ string, node *mcp.SinkNode) string {
+		if node != nil && node.Annotations[IdentityAnnotation] == "pilot-canary" {
+			return "canary"
+		}
+		return "default"
+	})
+	authenticator := &fakeAuthenticator{identity: "pilot-canary"}
+	s := New(&Options{
+		Watcher:       cache,
+		Collections:   []source.CollectionOptions{{Name: testCollection}},
+		Reporter:      mcptestmon.NewInMemoryStatsContext(),
+		AuthChecker:   server.NewAllowAllChecker(),
+		Authenticator: authenticator,
+	})
+	cache.SetSnapshot("default", newTestSnapshot(1, map[string]string{"a": "a1"}))
+	cache.SetSnapshot("canary", newTestSnapshot(2, map[string]string{"a": "a2"}))
+
+	stream := &fakeAggregatedStream{
+		fakeServerStream: newFakeServerStream(),
+		requests:         make(chan *mcp.MeshConfigRequest, 1),
+		responses:        make(chan *mcp.MeshConfigResponse, 1),
+	}
+	go s.StreamAggregatedResources(stream)
+	stream.requests <- &mcp.MeshConfigRequest{TypeUrl: testCollection,
+		SinkNode: &mcp.SinkNode{Id: "pilot-1", Annotations: map[string]string{IdentityAnnotation: "spoofed"}}}
+	var resp *mcp.MeshConfigResponse
+	g.Eventually(stream.responses).Should(Receive(&resp))
+	g.Expect(resp.VersionInfo).To(Equal("2"))
+	sinks := s.Sinks()
+	g.Expect(sinks[0].Identity).To(Equal("pilot-canary"))
+	g.Expect(sinks[0].Annotations).To(HaveKeyWithValue(IdentityAnnotation, "pilot-canary"))
+	stream.cancel()
+	g.Eventually(s.Sinks).Should(BeEmpty())
+
+	authenticator.identity = ""
+	err := s.StreamAggregatedResources(&fakeAggregatedStream{fakeServerStream: newFakeServerStream()})
+	g.Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+}
+
+type fakeAuthorizer map[string][]string
+
+func (a fakeAuthorizer) Allowed(identity string, collection string) (bool, []string) {
+	namespaces, ok := a[collection]
+	return ok, namespaces
+}
+
+func TestAuthorizer(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s, cache := newTestServer(false)
+	s.options.Authorizer = fakeAuthorizer{testCollection: {"ns-1", ""}}
+	cache.SetSnapshot("default", newTestSnapshot(1, map[string]string{"ns-1/a": "a1", "ns-2/b": "b1", "c": "c1"}))
+
+	stream := &fakeAggregatedStream{
+		fakeServerStream: newFakeServerStream(),
+		requests:         make(chan *mcp.MeshConfigRequest, 1),
+		responses:        make(chan *mcp.MeshConfigResponse, 1),
+	}
+	go s.StreamAggregatedResources(stream)
+	stream.requests <- &mcp.MeshConfigRequest{TypeUrl: testCollection}
+	var resp *mcp.MeshConfigResponse
+	g.Eventually(stream.responses).Should(Receive(&resp))
+	names := make([]string, 0, len(resp.Resources))
+	for _, resource := range resp.Resources {
+		names = append(names, resource.Metadata.Name)
+	}
+	g.Expect(names).To(ConsistOf("ns-1/a", "c"))
+	stream.cancel()
+	g.Eventually(s.Sinks).Should(BeEmpty())
+
+	// the full state stream refuses the collection with a response without version and stays open
+	s.options.Authorizer = fakeAuthorizer{}
+	denied := &fakeAggregatedStream{
+		fakeServerStream: newFakeServerStream(),
+		requests:         make(chan *mcp.MeshConfigRequest, 1),
+		responses:        make(chan *mcp.MeshConfigResponse, 1),
+	}
+	defer denied.cancel()
+	go s.StreamAggregatedResources(denied)
+	denied.requests <- &mcp.MeshConfigRequest{TypeUrl: testCollection}
+	g.Eventually(denied.responses).Should(Receive(&resp))
+	g.Expect(resp.TypeUrl).To(Equal(testCollection))
+	g.Expect(resp.VersionInfo).To(BeEmpty())
+	g.Expect(resp.Resources).To(BeEmpty())
+	denied.requests <- &mcp.MeshConfigRequest{TypeUrl: testCollection, ResponseNonce: resp.Nonce}
+	g.Consistently(denied.responses).ShouldNot(Receive())
+	g.Expect(s.Sinks()).To(HaveLen(1))
+	g.Expect(s.Sinks()[0].Collections[testCollection].AckedVersion).To(BeEmpty())
+	g.Expect(s.Sinks()[0].Collections[testCollection].Denied).To(BeTrue())
+
+	// streams which can't refuse a single collection are closed
+	resourceStream := &fakeResourceStream{
+		fakeServerStream: newFakeServerStream(),
+		requests:         make(chan *mcp.RequestResources, 1),
+		responses:        make(chan *mcp.Resources, 1),
+	}
+	resourceStream.requests <- &mcp.RequestResources{Collection: testCollection}
+	err := s.EstablishResourceStream(resourceStream)
+	g.Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+	g.Expect(status.Convert(err).Message()).To(ContainSubstring(testCollection))
+}
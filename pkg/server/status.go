@@ -0,0 +1,53 @@
+package server
+
+import (
+	"time"
+)
+
+//SinkStatus describes a sink connected to the server
+type SinkStatus struct {
+	ConnectionID  int64                        `json:"connectionId"`
+	NodeID        string                       `json:"nodeId"`
+	Annotations   map[string]string            `json:"annotations,omitempty"`
+	Identity      string                       `json:"identity,omitempty"`
+	RemoteAddress string                       `json:"remoteAddress"`
+	Protocol      string                       `json:"protocol"`
+	ConnectedAt   time.Time                    `json:"connectedAt"`
+	Collections   map[string]*CollectionStatus `json:"collections"`
+}
+
+//CollectionStatus describes the synchronization of a collection watched by a sink
+type CollectionStatus struct {
+	//SentVersion is the version of the latest response, empty if it was ACKed or NACKed
+	SentVersion  string    `json:"sentVersion,omitempty"`
+	AckedVersion string    `json:"ackedVersion,omitempty"`
+	AckedAt      time.Time `json:"ackedAt,omitempty"`
+	//SkippedVersion is the latest version not sent to the sink because it didn't change its resources
+	SkippedVersion string `json:"skippedVersion,omitempty"`
+	Nacks          int    `json:"nacks"`
+	LastNack       *Nack  `json:"lastNack,omitempty"`
+	//Denied is set if the sink may not watch the collection, it has been refused
+	Denied bool `json:"denied,omitempty"`
+}
+
+//Nack describes a version rejected by a sink
+type Nack struct {
+	Version string    `json:"version"`
+	Code    int32     `json:"code"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+func (s *SinkStatus) clone() SinkStatus {
+	result := *s
+	result.Collections = make(map[string]*CollectionStatus, len(s.Collections))
+	for name, collection := range s.Collections {
+		c := *collection
+		if c.LastNack != nil {
+			nack := *c.LastNack
+			c.LastNack = &nack
+		}
+		result.Collections[name] = &c
+	}
+	return result
+}
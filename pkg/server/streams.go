@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"github.com/gogo/googleapis/google/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mcp "istio.io/api/mcp/v1alpha1"
+)
+
+//request is the protocol independent form of a sink request
+type request struct {
+	collection              string
+	sinkNode                *mcp.SinkNode
+	versionInfo             string
+	nonce                   string
+	errorDetail             *rpc.Status
+	incremental             bool
+	initialResourceVersions map[string]string
+	size                    int
+}
+
+//response is the protocol independent form of a source response
+type response struct {
+	collection  string
+	version     string
+	resources   []mcp.Resource
+	removed     []string
+	incremental bool
+	nonce       string
+}
+
+//stream adapts the different MCP source services to a common request/response exchange
+type stream interface {
+	Context() context.Context
+	recv() (*request, error)
+	send(*response) error
+	//refuse tells the sink that it may not watch collection. Streams which can't refuse a single collection
+	//return an error which closes the stream.
+	refuse(collection string, nonce string) error
+	//protocol names the MCP service of the stream
+	protocol() string
+}
+
+//aggregatedStream exchanges full state over StreamAggregatedResources
+type aggregatedStream struct {
+	mcp.AggregatedMeshConfigService_StreamAggregatedResourcesServer
+}
+
+func (s *aggregatedStream) protocol() string {
+	return "AggregatedMeshConfigService"
+}
+
+func (s *aggregatedStream) recv() (*request, error) {
+	req, err := s.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return &request{
+		collection:  req.TypeUrl,
+		sinkNode:    req.SinkNode,
+		versionInfo: req.VersionInfo,
+		nonce:       req.ResponseNonce,
+		errorDetail: req.ErrorDetail,
+		size:        req.Size(),
+	}, nil
+}
+
+func (s *aggregatedStream) send(resp *response) error {
+	return s.Send(&mcp.MeshConfigResponse{
+		VersionInfo: resp.version,
+		Resources:   resp.resources,
+		TypeUrl:     resp.collection,
+		Nonce:       resp.nonce,
+	})
+}
+
+//refuse sends the collection without version and resources. The full state protocol can't carry an error
+//for a single collection, a response without version is never a version the sink could apply or ACK.
+func (s *aggregatedStream) refuse(collection string, nonce string) error {
+	return s.Send(&mcp.MeshConfigResponse{
+		TypeUrl: collection,
+		Nonce:   nonce,
+	})
+}
+
+//incrementalStream exchanges deltas over IncrementalAggregatedResources.
+//Every request on this stream asks for incremental responses. Its responses don't name their collection,
+//so a stream is limited to the collection of its first request.
+type incrementalStream struct {
+	mcp.AggregatedMeshConfigService_IncrementalAggregatedResourcesServer
+	//collection is the collection of the first request
+	collection string
+}
+
+func (s *incrementalStream) protocol() string {
+	return "IncrementalAggregatedMeshConfigService"
+}
+
+func (s *incrementalStream) recv() (*request, error) {
+	req, err := s.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if s.collection == "" {
+		s.collection = req.TypeUrl
+	} else if req.TypeUrl != s.collection {
+		return nil, status.Errorf(codes.InvalidArgument, "the stream is watching %s, collection %s needs another stream", s.collection, req.TypeUrl)
+	}
+	return &request{
+		collection:              req.TypeUrl,
+		sinkNode:                req.SinkNode,
+		nonce:                   req.ResponseNonce,
+		errorDetail:             req.ErrorDetail,
+		incremental:             true,
+		initialResourceVersions: req.InitialResourceVersions,
+		size:                    req.Size(),
+	}, nil
+}
+
+func (s *incrementalStream) send(resp *response) error {
+	return s.Send(&mcp.IncrementalMeshConfigResponse{
+		SystemVersionInfo: resp.version,
+		Resources:         resp.resources,
+		RemovedResources:  resp.removed,
+		Nonce:             resp.nonce,
+	})
+}
+
+func (s *incrementalStream) refuse(collection string, nonce string) error {
+	return status.Errorf(codes.PermissionDenied, "may not watch %s", collection)
+}
+
+//resourceStream exchanges full state or deltas, as requested per collection, over the ResourceSource service
+type resourceStream struct {
+	mcp.ResourceSource_EstablishResourceStreamServer
+}
+
+func (s *resourceStream) protocol() string {
+	return "ResourceSource"
+}
+
+func (s *resourceStream) recv() (*request, error) {
+	req, err := s.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return &request{
+		collection:              req.Collection,
+		sinkNode:                req.SinkNode,
+		nonce:                   req.ResponseNonce,
+		errorDetail:             req.ErrorDetail,
+		incremental:             req.Incremental,
+		initialResourceVersions: req.InitialResourceVersions,
+		size:                    req.Size(),
+	}, nil
+}
+
+func (s *resourceStream) send(resp *response) error {
+	return s.Send(&mcp.Resources{
+		SystemVersionInfo: resp.version,
+		Collection:        resp.collection,
+		Resources:         resp.resources,
+		RemovedResources:  resp.removed,
+		Incremental:       resp.incremental,
+		Nonce:             resp.nonce,
+	})
+}
+
+func (s *resourceStream) refuse(collection string, nonce string) error {
+	return status.Errorf(codes.PermissionDenied, "may not watch %s", collection)
+}
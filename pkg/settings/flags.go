@@ -0,0 +1,350 @@
+package settings
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//EnvPrefix is the prefix of the environment variables overriding settings
+const EnvPrefix = "MCP_"
+
+//FileFlag is the flag naming the settings file
+const FileFlag = "settings"
+
+//binding maps a setting to its flag and environment variable
+type binding struct {
+	name  string
+	usage string
+	value func(s *Settings) flag.Value
+}
+
+var bindings = []binding{
+	{"configDir", "istio config directory. It may be empty if the configs are read from another source.", func(s *Settings) flag.Value { return (*stringValue)(&s.ConfigDir) }},
+	{"gitURL", "URL or path of a git repository the istio configs are read from. Git is disabled if empty.", func(s *Settings) flag.Value { return (*stringValue)(&s.Git.URL) }},
+	{"gitRef", "branch or tag of the git repository the configs are read from", func(s *Settings) flag.Value { return (*stringValue)(&s.Git.Ref) }},
+	{"gitDir", "directory of the git repository the configs are read from, the root if empty", func(s *Settings) flag.Value { return (*stringValue)(&s.Git.Dir) }},
+	{"gitCacheDir", "directory the git repository is fetched to", func(s *Settings) flag.Value { return (*stringValue)(&s.Git.CacheDir) }},
+	{"gitPollInterval", "interval in which the git repository is fetched", func(s *Settings) flag.Value { return &s.Git.PollInterval }},
+	{"bundleURL", "URL of a signed tar.gz archive or multi-document YAML file the istio configs are read from. Bundles are disabled if empty.", func(s *Settings) flag.Value { return (*stringValue)(&s.Bundle.URL) }},
+	{"bundleSignatureURL", "URL of the detached ed25519 signature of the bundle, the bundle URL with suffix .sig if empty", func(s *Settings) flag.Value { return (*stringValue)(&s.Bundle.SignatureURL) }},
+	{"bundlePublicKeyFile", "file containing the base64 encoded ed25519 public key bundles are verified with", func(s *Settings) flag.Value { return (*stringValue)(&s.Bundle.PublicKeyFile) }},
+	{"bundlePollInterval", "interval in which the bundle is fetched", func(s *Settings) flag.Value { return &s.Bundle.PollInterval }},
+	{"bundleMaxFetchFailure", "time the bundle may fail to be fetched before readiness is turned off if notReadyIfUnreadable is set, 0 turns it off on the first failed fetch", func(s *Settings) flag.Value { return &s.Bundle.MaxFetchFailure }},
+	{"kubernetes", "read the networking.istio.io CRDs of a kubernetes cluster", func(s *Settings) flag.Value { return (*boolValue)(&s.Kubernetes.Enabled) }},
+	{"kubeconfig", "kubeconfig file of the kubernetes cluster, the in-cluster config is used if empty", func(s *Settings) flag.Value { return (*stringValue)(&s.Kubernetes.Kubeconfig) }},
+	{"kubeContext", "context of the kubeconfig, the current context if empty", func(s *Settings) flag.Value { return (*stringValue)(&s.Kubernetes.Context) }},
+	{"kubeNamespace", "namespace the CRDs are read from, all namespaces if empty", func(s *Settings) flag.Value { return (*stringValue)(&s.Kubernetes.Namespace) }},
+	{"kubeLabelSelector", "label selector of the CRDs which are read, e.g. mesh=public", func(s *Settings) flag.Value { return (*stringValue)(&s.Kubernetes.LabelSelector) }},
+	{"kubeResyncPeriod", "interval in which the CRDs are resynced. 0 disables resyncs.", func(s *Settings) flag.Value { return &s.Kubernetes.ResyncPeriod }},
+	{"upstreamAddrs", "comma separated addresses of upstream MCP servers whose resources are served together with the other sources", func(s *Settings) flag.Value { return (*listValue)(&s.Upstream.Addresses) }},
+	{"upstreamPrecedence", "precedence of upstream resources over resources of the same name of other sources, which have precedence 0", func(s *Settings) flag.Value { return (*intValue)(&s.Upstream.Precedence) }},
+	{"upstreamPrecedences", "comma separated address=precedence pairs overriding the precedence of single upstream servers", func(s *Settings) flag.Value { return (*intMapValue)(&s.Upstream.Precedences) }},
+	{"upstreamNodeID", "node id of this server as sink of the upstream servers", func(s *Settings) flag.Value { return (*stringValue)(&s.Upstream.NodeID) }},
+	{"upstreamCAFile", "CA certificate the upstream servers are verified with. The connections are not encrypted if empty.", func(s *Settings) flag.Value { return (*stringValue)(&s.Upstream.CAFile) }},
+	{"upstreamCertFile", "client certificate presented to the upstream servers", func(s *Settings) flag.Value { return (*stringValue)(&s.Upstream.CertFile) }},
+	{"upstreamKeyFile", "private key of the client certificate presented to the upstream servers", func(s *Settings) flag.Value { return (*stringValue)(&s.Upstream.KeyFile) }},
+	{"upstreamTokenFile", "file containing a bearer token sent to the upstream servers, needs upstreamCAFile", func(s *Settings) flag.Value { return (*stringValue)(&s.Upstream.TokenFile) }},
+	{"vcapDir", "directory of VCAP_SERVICES style JSON files istio configs are generated for. The generation is disabled if empty.", func(s *Settings) flag.Value { return (*stringValue)(&s.VCAP.Dir) }},
+	{"vcapTemplateDir", "directory of the templates <label>.yaml rendering the configs of the service instances of a label", func(s *Settings) flag.Value { return (*stringValue)(&s.VCAP.TemplateDir) }},
+	{"grpcAddr", "address of the MCP server", func(s *Settings) flag.Value { return (*stringValue)(&s.GRPC.Address) }},
+	{"maxConcurrentStreams", "maximum number of concurrent streams per connection", func(s *Settings) flag.Value { return (*uint32Value)(&s.GRPC.MaxConcurrentStreams) }},
+	{"maxRecvMsgSize", "maximum size in bytes of a message received from a sink", func(s *Settings) flag.Value { return (*intValue)(&s.GRPC.MaxRecvMsgSize) }},
+	{"maxStreamsPerIdentity", "maximum number of concurrent MCP streams of a sink identity, sinks without identity aren't limited. 0 disables the limit.", func(s *Settings) flag.Value { return (*intValue)(&s.GRPC.MaxStreamsPerIdentity) }},
+	{"keepaliveTime", "time after which an idle connection is pinged. 0 keeps the grpc default.", func(s *Settings) flag.Value { return &s.GRPC.Keepalive.Time }},
+	{"keepaliveTimeout", "time after which a connection is closed if a ping isn't answered. 0 keeps the grpc default.", func(s *Settings) flag.Value { return &s.GRPC.Keepalive.Timeout }},
+	{"keepaliveMaxConnectionIdle", "time after which a connection without streams is closed. 0 keeps the grpc default.", func(s *Settings) flag.Value { return &s.GRPC.Keepalive.MaxConnectionIdle }},
+	{"keepaliveMaxConnectionAge", "time after which a connection is closed so that sinks rebalance across replicas. 0 keeps the grpc default.", func(s *Settings) flag.Value { return &s.GRPC.Keepalive.MaxConnectionAge }},
+	{"keepaliveMaxConnectionAgeGrace", "time streams get to finish after the maximum connection age. 0 keeps the grpc default.", func(s *Settings) flag.Value { return &s.GRPC.Keepalive.MaxConnectionAgeGrace }},
+	{"keepaliveMinTime", "minimum time between two keepalive pings of a sink. 0 keeps the grpc default.", func(s *Settings) flag.Value { return &s.GRPC.Keepalive.Enforcement.MinTime }},
+	{"keepalivePermitWithoutStream", "accept keepalive pings of sinks without streams", func(s *Settings) flag.Value { return (*boolValue)(&s.GRPC.Keepalive.Enforcement.PermitWithoutStream) }},
+	{"tlsMode", "tls mode. Possible values: NONE, SIMPLE, MUTUAL, AUTO. AUTO generates a CA and server and client certificates for development.", func(s *Settings) flag.Value { return (*stringValue)(&s.TLS.Mode) }},
+	{"tlsCertFile", "certificate of the MCP server", func(s *Settings) flag.Value { return (*stringValue)(&s.TLS.CertFile) }},
+	{"tlsKeyFile", "private key of the MCP server", func(s *Settings) flag.Value { return (*stringValue)(&s.TLS.KeyFile) }},
+	{"tlsCAFile", "CA certificate client certificates are verified with", func(s *Settings) flag.Value { return (*stringValue)(&s.TLS.CAFile) }},
+	{"tlsAutoDir", "directory the certificates of the AUTO tls mode are generated in", func(s *Settings) flag.Value { return (*stringValue)(&s.TLS.AutoDir) }},
+	{"tlsAutoHosts", "comma separated DNS names and IP addresses the server certificate of the AUTO tls mode is valid for. The first one is used in the printed pilot config.", func(s *Settings) flag.Value { return (*listValue)(&s.TLS.AutoHosts) }},
+	{"httpAddr", "address of the http server for health checks and metrics", func(s *Settings) flag.Value { return (*stringValue)(&s.HTTP.Address) }},
+	{"adminAddr", "address of the http server for the admin API", func(s *Settings) flag.Value { return (*stringValue)(&s.Admin.Address) }},
+	{"apiAddr", "address of the REST API for managing istio configs. The API is disabled if empty.", func(s *Settings) flag.Value { return (*stringValue)(&s.API.Address) }},
+	{"apiStoreDir", "directory configs written through the REST API are stored in. They are written to the config directory if empty.", func(s *Settings) flag.Value { return (*stringValue)(&s.API.StoreDir) }},
+	{"apiIdentities", "comma separated token identities which may use the REST API", func(s *Settings) flag.Value { return (*listValue)(&s.API.Identities) }},
+	{"brokerTemplateFile", "template of the istio configs generated for Open Service Broker bindings. The binding endpoints are disabled if empty.", func(s *Settings) flag.Value { return (*stringValue)(&s.Broker.TemplateFile) }},
+	{"allowedIdentities", "comma separated certificate or token identities of sinks which may connect. All sinks may connect if empty.", func(s *Settings) flag.Value { return (*listValue)(&s.Auth.AllowedIdentities) }},
+	{"authTokenFiles", "comma separated files of static bearer tokens with one token,subject pair per line", func(s *Settings) flag.Value { return (*listValue)(&s.Auth.TokenFiles) }},
+	{"authJWKSFiles", "comma separated JSON web key set files bearer JWTs are verified with", func(s *Settings) flag.Value { return (*listValue)(&s.Auth.JWKSFiles) }},
+	{"authJWTIssuer", "required iss claim of bearer JWTs", func(s *Settings) flag.Value { return (*stringValue)(&s.Auth.JWTIssuer) }},
+	{"authJWTAudience", "required aud claim of bearer JWTs", func(s *Settings) flag.Value { return (*stringValue)(&s.Auth.JWTAudience) }},
+	{"authRequireToken", "reject sinks without bearer token", func(s *Settings) flag.Value { return (*boolValue)(&s.Auth.RequireToken) }},
+	{"authPolicyFile", "YAML file deciding which collections and namespaces sinks may watch by their identity", func(s *Settings) flag.Value { return (*stringValue)(&s.Auth.PolicyFile) }},
+	{"incremental", "send incremental updates to sinks requesting them", func(s *Settings) flag.Value { return (*boolValue)(&s.Watcher.Incremental) }},
+	{"stateFile", "file the latest snapshot is persisted to and served from if the config directory can't be read at startup", func(s *Settings) flag.Value { return (*stringValue)(&s.Watcher.StateFile) }},
+	{"historySize", "number of snapshots kept in the history", func(s *Settings) flag.Value { return (*intValue)(&s.Watcher.HistorySize) }},
+	{"minPublishInterval", "minimum time between two published versions of the config directory", func(s *Settings) flag.Value { return &s.Watcher.MinPublishInterval }},
+	{"publishRate", "maximum average number of versions published per second. 0 disables the limit.", func(s *Settings) flag.Value { return (*floatValue)(&s.Watcher.PublishRate) }},
+	{"publishBurst", "number of versions which may be published at once within the publish rate", func(s *Settings) flag.Value { return (*intValue)(&s.Watcher.PublishBurst) }},
+	{"mutationPolicyFile", "file of policies injecting defaults like destination rules, timeouts and retries into the configs", func(s *Settings) flag.Value { return (*stringValue)(&s.Watcher.MutationPolicyFile) }},
+	{"notReadyIfUnreadable", "report not ready while the config directory can't be read, unless the persisted snapshot is served, and while the config bundle can't be fetched", func(s *Settings) flag.Value { return (*boolValue)(&s.Readiness.NotReadyIfUnreadable) }},
+	{"maxValidationFailure", "report not ready if the config directory is invalid for longer than this. 0 disables the check.", func(s *Settings) flag.Value { return &s.Readiness.MaxValidationFailure }},
+	{"rollbackNackThreshold", "roll a collection back to its last accepted version if this fraction of the sinks NACK it. 0 disables rollbacks.", func(s *Settings) flag.Value { return (*floatValue)(&s.Rollback.NackThreshold) }},
+	{"canaryNodeID", "regular expression selecting canary sinks by node id", func(s *Settings) flag.Value { return (*stringValue)(&s.Canary.NodeID) }},
+	{"canaryAnnotations", "comma separated key=value annotations selecting canary sinks", func(s *Settings) flag.Value { return (*mapValue)(&s.Canary.Annotations) }},
+	{"canarySoak", "time all canaries must have ACKed a new version before it is served to all sinks", func(s *Settings) flag.Value { return &s.Canary.Soak }},
+	{"logJSON", "format log lines as JSON", func(s *Settings) flag.Value { return (*boolValue)(&s.Logging.JSON) }},
+	{"logLevel", "comma separated scope:level pairs, e.g. info,grpc:debug. Scopes: default, watcher, snapshot, grpc, auth, api, admin.", func(s *Settings) flag.Value { return (*stringValue)(&s.Logging.Levels) }},
+}
+
+//EnvName returns the environment variable overriding the setting of a flag, e.g. MCP_CONFIG_DIR for configDir
+func EnvName(flagName string) string {
+	runes := []rune(flagName)
+	var name strings.Builder
+	name.WriteString(EnvPrefix)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			name.WriteRune('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+//Flags are the command line flags of all settings
+type Flags struct {
+	file  string
+	flags *flag.FlagSet
+	set   map[string]string
+}
+
+//RegisterFlags registers a flag for each setting and the settings file flag
+func RegisterFlags(flags *flag.FlagSet) *Flags {
+	f := &Flags{flags: flags, set: make(map[string]string)}
+	flags.StringVar(&f.file, FileFlag, "", fmt.Sprintf("YAML settings file. Env: %s", EnvName(FileFlag)))
+	defaults := Defaults()
+	for _, b := range bindings {
+		_, isBool := b.value(defaults).(*boolValue)
+		flags.Var(&flagValue{name: b.name, defaultValue: b.value(defaults).String(), isBool: isBool, set: f.set},
+			b.name, fmt.Sprintf("%s Env: %s", usage(b.usage), EnvName(b.name)))
+	}
+	return f
+}
+
+//Resolve returns the validated settings after the flags have been parsed
+func (f *Flags) Resolve(lookupEnv func(string) (string, bool)) (*Settings, error) {
+	s := Defaults()
+	file := f.file
+	if !f.isSet(FileFlag) {
+		if env, ok := lookupEnv(EnvName(FileFlag)); ok {
+			file = env
+		}
+	}
+	if file != "" {
+		if err := s.Load(file); err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range bindings {
+		env, ok := lookupEnv(EnvName(b.name))
+		if !ok {
+			continue
+		}
+		if err := b.value(s).Set(env); err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s: %v", env, EnvName(b.name), err)
+		}
+	}
+	for _, b := range bindings {
+		raw, ok := f.set[b.name]
+		if !ok {
+			continue
+		}
+		if err := b.value(s).Set(raw); err != nil {
+			return nil, fmt.Errorf("invalid value %q for -%s: %v", raw, b.name, err)
+		}
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (f *Flags) isSet(name string) bool {
+	set := false
+	f.flags.Visit(func(fl *flag.Flag) {
+		if fl.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func usage(text string) string {
+	if strings.HasSuffix(text, ".") {
+		return text
+	}
+	return text + "."
+}
+
+//flagValue records the value of a flag. It is applied to the settings after the settings file has been read.
+type flagValue struct {
+	name         string
+	defaultValue string
+	isBool       bool
+	set          map[string]string
+}
+
+func (v *flagValue) String() string {
+	if v == nil {
+		return ""
+	}
+	if value, ok := v.set[v.name]; ok {
+		return value
+	}
+	return v.defaultValue
+}
+
+func (v *flagValue) Set(value string) error {
+	v.set[v.name] = value
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+type stringValue string
+
+func (v *stringValue) String() string { return string(*v) }
+
+func (v *stringValue) Set(value string) error {
+	*v = stringValue(value)
+	return nil
+}
+
+type boolValue bool
+
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+
+func (v *boolValue) Set(value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *intValue) Set(value string) error {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*v = intValue(i)
+	return nil
+}
+
+type uint32Value uint32
+
+func (v *uint32Value) String() string { return strconv.FormatUint(uint64(*v), 10) }
+
+func (v *uint32Value) Set(value string) error {
+	i, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return err
+	}
+	*v = uint32Value(i)
+	return nil
+}
+
+type floatValue float64
+
+func (v *floatValue) String() string { return strconv.FormatFloat(float64(*v), 'g', -1, 64) }
+
+func (v *floatValue) Set(value string) error {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	*v = floatValue(f)
+	return nil
+}
+
+//listValue is a comma separated list
+type listValue []string
+
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+
+func (v *listValue) Set(value string) error {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*v = list
+	return nil
+}
+
+//mapValue is a comma separated list of key=value pairs
+type mapValue map[string]string
+
+func (v *mapValue) String() string {
+	pairs := make([]string, 0, len(*v))
+	for key, value := range *v {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v *mapValue) Set(value string) error {
+	pairs := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) != 2 || keyValue[0] == "" {
+			return fmt.Errorf("invalid pair %q, expected key=value", pair)
+		}
+		pairs[keyValue[0]] = keyValue[1]
+	}
+	*v = pairs
+	return nil
+}
+
+//intMapValue is a comma separated list of key=value pairs with integer values
+type intMapValue map[string]int
+
+func (v *intMapValue) String() string {
+	pairs := make([]string, 0, len(*v))
+	for key, value := range *v {
+		pairs = append(pairs, key+"="+strconv.Itoa(value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v *intMapValue) Set(value string) error {
+	var pairs mapValue
+	if err := pairs.Set(value); err != nil {
+		return err
+	}
+	result := make(map[string]int, len(pairs))
+	for key, value := range pairs {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid value of %s: %v", key, err)
+		}
+		result[key] = i
+	}
+	*v = result
+	return nil
+}
@@ -0,0 +1,465 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//TLS modes of the MCP listener
+const (
+	TLSModeNone   = "NONE"
+	TLSModeSimple = "SIMPLE"
+	TLSModeMutual = "MUTUAL"
+	TLSModeAuto   = "AUTO"
+)
+
+//Settings configures the server. They are resolved from the defaults, the settings file, environment
+//variables and command line flags, in increasing order of precedence.
+type Settings struct {
+	//ConfigDir is the istio config directory. It may be empty if the configs are read from another source.
+	ConfigDir  string             `yaml:"configDir"`
+	Git        GitSettings        `yaml:"git"`
+	Bundle     BundleSettings     `yaml:"bundle"`
+	Kubernetes KubernetesSettings `yaml:"kubernetes"`
+	Upstream   UpstreamSettings   `yaml:"upstream"`
+	VCAP       VCAPSettings       `yaml:"vcap"`
+	GRPC       GRPCSettings       `yaml:"grpc"`
+	TLS        TLSSettings        `yaml:"tls"`
+	HTTP       HTTPSettings       `yaml:"http"`
+	Admin      HTTPSettings       `yaml:"admin"`
+	API        APISettings        `yaml:"api"`
+	Broker     BrokerSettings     `yaml:"broker"`
+	Auth       AuthSettings       `yaml:"auth"`
+	Watcher    WatcherSettings    `yaml:"watcher"`
+	Readiness  ReadinessSettings  `yaml:"readiness"`
+	Rollback   RollbackSettings   `yaml:"rollback"`
+	Canary     CanarySettings     `yaml:"canary"`
+	Logging    LoggingSettings    `yaml:"logging"`
+}
+
+//GitSettings configures a git repository the istio configs are read from. It is disabled if no URL is set.
+type GitSettings struct {
+	//URL of the repository, a remote URL or the path of a local repository
+	URL string `yaml:"url"`
+	//Ref is the branch or tag the configs are read from
+	Ref string `yaml:"ref"`
+	//Dir is the directory of the repository the configs are read from, the root if empty
+	Dir string `yaml:"dir"`
+	//CacheDir is the directory the repository is fetched to
+	CacheDir     string   `yaml:"cacheDir"`
+	PollInterval Duration `yaml:"pollInterval"`
+}
+
+//BundleSettings configures a signed config bundle fetched over http. It is disabled if no URL is set.
+type BundleSettings struct {
+	//URL of a tar.gz archive or a multi-document YAML file
+	URL string `yaml:"url"`
+	//SignatureURL of the detached ed25519 signature, URL with suffix .sig if empty
+	SignatureURL string `yaml:"signatureURL"`
+	//PublicKeyFile contains the base64 encoded ed25519 public key the signature is verified with
+	PublicKeyFile string   `yaml:"publicKeyFile"`
+	PollInterval  Duration `yaml:"pollInterval"`
+	//MaxFetchFailure is the time the bundle may fail to be fetched before readiness is turned off
+	//if readiness.notReadyIfUnreadable is set. Zero turns it off on the first failed fetch.
+	MaxFetchFailure Duration `yaml:"maxFetchFailure"`
+}
+
+//KubernetesSettings configures reading the networking.istio.io CRDs of a kubernetes cluster
+type KubernetesSettings struct {
+	Enabled bool `yaml:"enabled"`
+	//Kubeconfig is the kubeconfig file, the in-cluster config is used if empty
+	Kubeconfig string `yaml:"kubeconfig"`
+	//Context of the kubeconfig, the current context if empty
+	Context string `yaml:"context"`
+	//Namespace the CRDs are read from, all namespaces if empty
+	Namespace string `yaml:"namespace"`
+	//LabelSelector selects the CRDs which are read, all if empty
+	LabelSelector string   `yaml:"labelSelector"`
+	ResyncPeriod  Duration `yaml:"resyncPeriod"`
+}
+
+//UpstreamSettings configures upstream MCP servers whose resources are served together with the other sources.
+//They are disabled if no address is set.
+type UpstreamSettings struct {
+	Addresses []string `yaml:"addresses"`
+	//Precedence of the upstream resources over the resources of other sources with the same name. The other
+	//sources have precedence 0, so that the default of -1 lets local configs override upstream ones.
+	Precedence int `yaml:"precedence"`
+	//Precedences of the resources of single upstream servers by address, overriding Precedence. Upstream servers
+	//serving the same resources need different precedences.
+	Precedences map[string]int `yaml:"precedences"`
+	//NodeID identifies this server as sink of the upstream servers
+	NodeID string `yaml:"nodeID"`
+	//CAFile verifies the certificates of the upstream servers. The connections are not encrypted if empty.
+	CAFile string `yaml:"caFile"`
+	//CertFile and KeyFile are the client certificate presented to the upstream servers, optional
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	//TokenFile contains a bearer token sent to the upstream servers, optional. It needs CAFile.
+	TokenFile string `yaml:"tokenFile"`
+}
+
+//PrecedenceOf returns the precedence of the resources of an upstream server
+func (u *UpstreamSettings) PrecedenceOf(address string) int {
+	if precedence, ok := u.Precedences[address]; ok {
+		return precedence
+	}
+	return u.Precedence
+}
+
+//VCAPSettings configures the generation of istio configs for the service instances of VCAP_SERVICES style
+//JSON files. It is disabled if no directory is set.
+type VCAPSettings struct {
+	//Dir contains the JSON files, VCAP_SERVICES objects or binding credential files
+	Dir string `yaml:"dir"`
+	//TemplateDir contains the templates <label>.yaml rendering the configs of the service instances of a label
+	TemplateDir string `yaml:"templateDir"`
+}
+
+//GRPCSettings configures the MCP listener
+type GRPCSettings struct {
+	Address              string `yaml:"address"`
+	MaxConcurrentStreams uint32 `yaml:"maxConcurrentStreams"`
+	MaxRecvMsgSize       int    `yaml:"maxRecvMsgSize"`
+	//MaxStreamsPerIdentity limits the concurrent MCP streams of a sink identity. Sinks without identity aren't
+	//limited. 0 disables the limit.
+	MaxStreamsPerIdentity int               `yaml:"maxStreamsPerIdentity"`
+	Keepalive             KeepaliveSettings `yaml:"keepalive"`
+}
+
+//KeepaliveSettings configures the keepalive pings and the connection lifetime. 0 keeps the grpc default.
+type KeepaliveSettings struct {
+	//Time after which an idle connection is pinged
+	Time Duration `yaml:"time"`
+	//Timeout after which a connection is closed if the ping isn't answered
+	Timeout Duration `yaml:"timeout"`
+	//MaxConnectionIdle is the time after which a connection without streams is closed
+	MaxConnectionIdle Duration `yaml:"maxConnectionIdle"`
+	//MaxConnectionAge is the time after which a connection is closed, so that sinks reconnect and
+	//rebalance across replicas
+	MaxConnectionAge Duration `yaml:"maxConnectionAge"`
+	//MaxConnectionAgeGrace is the time streams get to finish after MaxConnectionAge before the connection
+	//is closed forcibly
+	MaxConnectionAgeGrace Duration                     `yaml:"maxConnectionAgeGrace"`
+	Enforcement           KeepaliveEnforcementSettings `yaml:"enforcement"`
+}
+
+//KeepaliveEnforcementSettings configures which keepalive pings of sinks are accepted.
+//Connections of sinks violating it are closed.
+type KeepaliveEnforcementSettings struct {
+	//MinTime is the minimum time between two pings of a sink. 0 keeps the grpc default of 5m.
+	MinTime Duration `yaml:"minTime"`
+	//PermitWithoutStream allows pings on connections without streams
+	PermitWithoutStream bool `yaml:"permitWithoutStream"`
+}
+
+//TLSSettings configures the transport security of the MCP listener
+type TLSSettings struct {
+	//Mode is one of NONE, SIMPLE (server certificate only), MUTUAL (client certificates are verified
+	//with the CA) and AUTO (MUTUAL with certificates generated in AutoDir, for development only)
+	Mode     string `yaml:"mode"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	CAFile   string `yaml:"caFile"`
+	//AutoDir is the directory the certificates of the AUTO mode are generated in
+	AutoDir string `yaml:"autoDir"`
+	//AutoHosts are the DNS names and IP addresses the server certificate of the AUTO mode is valid for.
+	//The first one is used in the printed pilot config.
+	AutoHosts []string `yaml:"autoHosts"`
+}
+
+//HTTPSettings configures an http listener
+type HTTPSettings struct {
+	Address string `yaml:"address"`
+}
+
+//APISettings configures the REST API for managing istio configs. It is disabled if no address is set.
+type APISettings struct {
+	//Address of the API. It is served with the server certificate of the MCP listener unless the tls mode is NONE.
+	Address string `yaml:"address"`
+	//StoreDir is the directory configs written through the API are stored in. They are written to the
+	//config directory if empty.
+	StoreDir string `yaml:"storeDir"`
+	//Identities of the bearer tokens which may use the API
+	Identities []string `yaml:"identities"`
+}
+
+//BrokerSettings configures the Open Service Broker binding endpoints of the REST API. They are disabled if no
+//template is set.
+type BrokerSettings struct {
+	//TemplateFile renders the YAML documents of the configs generated for a binding
+	TemplateFile string `yaml:"templateFile"`
+}
+
+//AuthSettings configures which sinks may connect
+type AuthSettings struct {
+	//AllowedIdentities of the client certificates or bearer tokens of sinks. All sinks are allowed if empty.
+	AllowedIdentities []string `yaml:"allowedIdentities"`
+	//TokenFiles contain static bearer tokens, one token,subject pair per line
+	TokenFiles []string `yaml:"tokenFiles"`
+	//JWKSFiles contain the JSON web key sets bearer JWTs are verified with
+	JWKSFiles []string `yaml:"jwksFiles"`
+	//JWTIssuer must match the iss claim of JWTs if set
+	JWTIssuer string `yaml:"jwtIssuer"`
+	//JWTAudience must be contained in the aud claim of JWTs if set
+	JWTAudience string `yaml:"jwtAudience"`
+	//RequireToken rejects sinks without bearer token even if they present a client certificate
+	RequireToken bool `yaml:"requireToken"`
+	//PolicyFile decides which collections and namespaces sinks may watch by their identity.
+	//All sinks may watch all collections if empty.
+	PolicyFile string `yaml:"policyFile"`
+}
+
+//TokensEnabled returns true if sinks may authenticate with bearer tokens
+func (a *AuthSettings) TokensEnabled() bool {
+	return len(a.TokenFiles) > 0 || len(a.JWKSFiles) > 0
+}
+
+//WatcherSettings configures how the config directory is read and published
+type WatcherSettings struct {
+	Incremental        bool     `yaml:"incremental"`
+	StateFile          string   `yaml:"stateFile"`
+	HistorySize        int      `yaml:"historySize"`
+	MinPublishInterval Duration `yaml:"minPublishInterval"`
+	PublishRate        float64  `yaml:"publishRate"`
+	PublishBurst       int      `yaml:"publishBurst"`
+	//MutationPolicyFile contains policies injecting defaults into the configs, e.g. destination rules. Empty
+	//disables them.
+	MutationPolicyFile string `yaml:"mutationPolicyFile"`
+}
+
+//ReadinessSettings configures the readiness check of the config directory
+type ReadinessSettings struct {
+	NotReadyIfUnreadable bool     `yaml:"notReadyIfUnreadable"`
+	MaxValidationFailure Duration `yaml:"maxValidationFailure"`
+}
+
+//RollbackSettings configures rollbacks of NACKed collections
+type RollbackSettings struct {
+	NackThreshold float64 `yaml:"nackThreshold"`
+}
+
+//CanarySettings configures canary rollouts. They are disabled if no canary is selected.
+type CanarySettings struct {
+	NodeID      string            `yaml:"nodeID"`
+	Annotations map[string]string `yaml:"annotations"`
+	Soak        Duration          `yaml:"soak"`
+}
+
+//LoggingSettings configures the log output
+type LoggingSettings struct {
+	JSON   bool   `yaml:"json"`
+	Levels string `yaml:"levels"`
+}
+
+//Duration is a time.Duration written as a duration string, e.g. 1m30s
+type Duration time.Duration
+
+//MarshalYAML writes the duration as string
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+//UnmarshalYAML parses a duration string
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	return d.Set(value)
+}
+
+//String returns the duration string
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+//Set parses a duration string
+func (d *Duration) Set(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+//Defaults returns the settings used if nothing else is configured
+func Defaults() *Settings {
+	return &Settings{
+		Git: GitSettings{
+			Ref:          "master",
+			CacheDir:     "git-cache",
+			PollInterval: Duration(time.Minute),
+		},
+		Bundle: BundleSettings{PollInterval: Duration(time.Minute), MaxFetchFailure: Duration(5 * time.Minute)},
+		Upstream: UpstreamSettings{
+			Precedence: -1,
+			NodeID:     "service-manager-istio-mcp-server",
+		},
+		GRPC: GRPCSettings{
+			Address:              ":18000",
+			MaxConcurrentStreams: 1024,
+			MaxRecvMsgSize:       1024 * 1024,
+		},
+		TLS: TLSSettings{
+			Mode:      TLSModeMutual,
+			CertFile:  "config/certs/mcp.crt",
+			KeyFile:   "config/certs/mcp.key",
+			CAFile:    "config/certs/ca.crt",
+			AutoDir:   "mcp-certs",
+			AutoHosts: []string{"host.docker.internal", "localhost", "127.0.0.1"},
+		},
+		HTTP:  HTTPSettings{Address: ":18080"},
+		Admin: HTTPSettings{Address: "127.0.0.1:18081"},
+		Watcher: WatcherSettings{
+			Incremental:  true,
+			HistorySize:  16,
+			PublishBurst: 1,
+		},
+		Readiness: ReadinessSettings{NotReadyIfUnreadable: true},
+		Rollback:  RollbackSettings{NackThreshold: 1},
+		Canary:    CanarySettings{Soak: Duration(time.Minute)},
+		Logging:   LoggingSettings{Levels: "info"},
+	}
+}
+
+//Load reads a YAML settings file over the settings. Unknown keys are rejected.
+func (s *Settings) Load(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(content, s); err != nil {
+		return fmt.Errorf("invalid settings file %s: %v", filename, err)
+	}
+	return nil
+}
+
+//YAML returns the settings as YAML document
+func (s *Settings) YAML() ([]byte, error) {
+	return yaml.Marshal(s)
+}
+
+//within returns true if path is dir or one of its subdirectories
+func within(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+//contains returns true if list contains value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+//Validate returns an error describing all invalid settings
+func (s *Settings) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(s.ConfigDir != "" || s.Git.URL != "" || s.Bundle.URL != "" || s.Kubernetes.Enabled || len(s.Upstream.Addresses) > 0 ||
+		s.VCAP.Dir != "", "configDir is required unless git.url, bundle.url, kubernetes.enabled, upstream.addresses or vcap.dir are set")
+	if s.Git.URL != "" {
+		check(s.Git.Ref != "", "git.ref is required if git.url is set")
+		check(s.Git.CacheDir != "", "git.cacheDir is required if git.url is set")
+		check(s.Git.PollInterval > 0, "git.pollInterval must be positive")
+		check(s.ConfigDir == "" || !within(s.Git.CacheDir, s.ConfigDir), "git.cacheDir must not be within configDir")
+	}
+	if s.Bundle.URL != "" {
+		check(s.Bundle.PublicKeyFile != "", "bundle.publicKeyFile is required if bundle.url is set")
+		check(s.Bundle.PollInterval > 0, "bundle.pollInterval must be positive")
+		check(s.Bundle.MaxFetchFailure >= 0, "bundle.maxFetchFailure must not be negative")
+	}
+	check(s.Kubernetes.ResyncPeriod >= 0, "kubernetes.resyncPeriod must not be negative")
+	if len(s.Upstream.Addresses) > 0 {
+		for _, address := range s.Upstream.Addresses {
+			check(strings.TrimSpace(address) != "", "upstream.addresses must not contain empty addresses")
+		}
+		check(s.Upstream.NodeID != "", "upstream.nodeID is required if upstream.addresses are set")
+		for address := range s.Upstream.Precedences {
+			check(contains(s.Upstream.Addresses, address), "upstream.precedences of %s, which is no upstream address", address)
+		}
+		check((s.Upstream.CertFile == "") == (s.Upstream.KeyFile == ""), "upstream.certFile and upstream.keyFile must be set together")
+		check(s.Upstream.CertFile == "" || s.Upstream.CAFile != "", "upstream.certFile needs upstream.caFile")
+		// the token must not be sent over connections which aren't encrypted
+		check(s.Upstream.TokenFile == "" || s.Upstream.CAFile != "", "upstream.tokenFile needs upstream.caFile")
+	}
+	if s.VCAP.Dir != "" {
+		check(s.VCAP.TemplateDir != "", "vcap.templateDir is required if vcap.dir is set")
+		check(s.ConfigDir == "" || !within(s.VCAP.Dir, s.ConfigDir), "vcap.dir must not be within configDir")
+		check(s.ConfigDir == "" || s.VCAP.TemplateDir == "" || !within(s.VCAP.TemplateDir, s.ConfigDir), "vcap.templateDir must not be within configDir")
+	}
+	check(s.GRPC.Address != "", "grpc.address is required")
+	check(s.GRPC.MaxConcurrentStreams > 0, "grpc.maxConcurrentStreams must be positive")
+	check(s.GRPC.MaxRecvMsgSize > 0, "grpc.maxRecvMsgSize must be positive")
+	check(s.GRPC.MaxStreamsPerIdentity >= 0, "grpc.maxStreamsPerIdentity must not be negative")
+	check(s.GRPC.Keepalive.Time >= 0, "grpc.keepalive.time must not be negative")
+	check(s.GRPC.Keepalive.Timeout >= 0, "grpc.keepalive.timeout must not be negative")
+	check(s.GRPC.Keepalive.MaxConnectionIdle >= 0, "grpc.keepalive.maxConnectionIdle must not be negative")
+	check(s.GRPC.Keepalive.MaxConnectionAge >= 0, "grpc.keepalive.maxConnectionAge must not be negative")
+	check(s.GRPC.Keepalive.MaxConnectionAgeGrace >= 0, "grpc.keepalive.maxConnectionAgeGrace must not be negative")
+	check(s.GRPC.Keepalive.Enforcement.MinTime >= 0, "grpc.keepalive.enforcement.minTime must not be negative")
+	switch s.TLS.Mode {
+	case TLSModeNone:
+	case TLSModeSimple, TLSModeMutual:
+		check(s.TLS.CertFile != "", "tls.certFile is required in %s mode", s.TLS.Mode)
+		check(s.TLS.KeyFile != "", "tls.keyFile is required in %s mode", s.TLS.Mode)
+		check(s.TLS.Mode == TLSModeSimple || s.TLS.CAFile != "", "tls.caFile is required in %s mode", s.TLS.Mode)
+	case TLSModeAuto:
+		check(s.TLS.AutoDir != "", "tls.autoDir is required in %s mode", s.TLS.Mode)
+		check(len(s.TLS.AutoHosts) > 0, "tls.autoHosts are required in %s mode", s.TLS.Mode)
+	default:
+		check(false, "tls.mode must be one of %s, %s, %s, %s", TLSModeNone, TLSModeSimple, TLSModeMutual, TLSModeAuto)
+	}
+	check(s.HTTP.Address != "", "http.address is required")
+	check(s.Admin.Address != "", "admin.address is required")
+	check(s.Broker.TemplateFile == "" || s.API.Address != "", "broker.templateFile needs api.address")
+	if s.API.Address != "" {
+		check(s.Auth.TokensEnabled(), "api.address needs auth.tokenFiles or auth.jwksFiles")
+		check(len(s.API.Identities) > 0, "api.identities are required if api.address is set")
+		check(s.API.StoreDir != "" || s.ConfigDir != "", "api.storeDir is required without configDir")
+		check(s.API.StoreDir == "" || s.ConfigDir == "" || !within(s.API.StoreDir, s.ConfigDir),
+			"api.storeDir must not be within configDir, leave it empty to store configs in configDir")
+	}
+	for _, identity := range s.Auth.AllowedIdentities {
+		check(strings.TrimSpace(identity) != "", "auth.allowedIdentities must not contain empty identities")
+	}
+	check(!s.Auth.RequireToken || s.Auth.TokensEnabled(), "auth.requireToken needs auth.tokenFiles or auth.jwksFiles")
+	check(len(s.Auth.JWKSFiles) > 0 || s.Auth.JWTIssuer == "" && s.Auth.JWTAudience == "",
+		"auth.jwtIssuer and auth.jwtAudience need auth.jwksFiles")
+	check(s.Watcher.HistorySize > 0, "watcher.historySize must be positive")
+	check(s.Watcher.MinPublishInterval >= 0, "watcher.minPublishInterval must not be negative")
+	check(s.Watcher.PublishRate >= 0, "watcher.publishRate must not be negative")
+	check(s.Watcher.PublishBurst > 0, "watcher.publishBurst must be positive")
+	check(s.Readiness.MaxValidationFailure >= 0, "readiness.maxValidationFailure must not be negative")
+	check(s.Rollback.NackThreshold >= 0 && s.Rollback.NackThreshold <= 1, "rollback.nackThreshold must be between 0 and 1")
+	if _, err := regexp.Compile(s.Canary.NodeID); err != nil {
+		check(false, "canary.nodeID is no valid regular expression: %v", err)
+	}
+	for key := range s.Canary.Annotations {
+		check(key != "", "canary.annotations must not contain empty keys")
+	}
+	check(s.Canary.Soak >= 0, "canary.soak must not be negative")
+	if _, err := logging.ParseLevels(s.Logging.Levels); err != nil {
+		check(false, "logging.levels are invalid: %v", err)
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid settings: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
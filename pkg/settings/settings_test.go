@@ -0,0 +1,335 @@
+package settings
+
+import (
+	"flag"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDefaultsNeedConfigDir(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s := Defaults()
+	g.Expect(s.Validate()).To(MatchError(ContainSubstring("configDir is required")))
+	s.ConfigDir = "config"
+	g.Expect(s.Validate()).To(Succeed())
+}
+
+func TestValidate(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s := Defaults()
+	s.ConfigDir = "config"
+	s.TLS.Mode = "ISTIO_MUTUAL"
+	s.GRPC.MaxConcurrentStreams = 0
+	s.Rollback.NackThreshold = 2
+	s.Canary.NodeID = "("
+	s.Logging.Levels = "unknown:debug"
+	err := s.Validate()
+	g.Expect(err).To(MatchError(ContainSubstring("tls.mode")))
+	g.Expect(err).To(MatchError(ContainSubstring("grpc.maxConcurrentStreams")))
+	g.Expect(err).To(MatchError(ContainSubstring("rollback.nackThreshold")))
+	g.Expect(err).To(MatchError(ContainSubstring("canary.nodeID")))
+	g.Expect(err).To(MatchError(ContainSubstring("logging.levels")))
+
+	s = Defaults()
+	s.ConfigDir = "config"
+	s.TLS.CertFile = ""
+	g.Expect(s.Validate()).To(MatchError(ContainSubstring("tls.certFile")))
+	s.TLS.Mode = TLSModeNone
+	g.Expect(s.Validate()).To(Succeed())
+}
+
+func TestValidateTLSModes(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s := Defaults()
+	s.ConfigDir = "config"
+	s.TLS.Mode = TLSModeSimple
+	s.TLS.CAFile = ""
+	g.Expect(s.Validate()).To(Succeed())
+	s.TLS.KeyFile = ""
+	g.Expect(s.Validate()).To(MatchError(ContainSubstring("tls.keyFile")))
+
+	s.TLS.Mode = TLSModeAuto
+	g.Expect(s.Validate()).To(Succeed())
+	s.TLS.AutoHosts = nil
+	g.Expect(s.Validate()).To(MatchError(ContainSubstring("tls.autoHosts")))
+}
+
+func TestValidateAuth(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s := Defaults()
+	s.ConfigDir = "config"
+	s.Auth.RequireToken = true
+	s.Auth.JWTIssuer = "https://issuer"
+	err := s.Validate()
+	g.Expect(err).To(MatchError(ContainSubstring("auth.requireToken")))
+	g.Expect(err).To(MatchError(ContainSubstring("auth.jwtIssuer")))
+
+	s.Auth.JWKSFiles = []string{"jwks.json"}
+	g.Expect(s.Auth.TokensEnabled()).To(BeTrue())
+	g.Expect(s.Validate()).To(Succeed())
+}
+
+func TestValidateAPI(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s := Defaults()
+	s.ConfigDir = "config"
+	s.Broker.TemplateFile = "binding.yaml"
+	g.Expect(s.Validate()).To(MatchError(ContainSubstring("broker.templateFile needs api.address")))
+	s.API.Address = ":18082"
+	s.API.StoreDir = "config/api"
+	err := s.Validate()
+	g.Expect(err).To(MatchError(ContainSubstring("api.address needs auth.tokenFiles")))
+	g.Expect(err).To(MatchError(ContainSubstring("api.identities")))
+	g.Expect(err).To(MatchError(ContainSubstring("api.storeDir")))
+
+	s.Auth.TokenFiles = []string{"tokens"}
+	s.API.Identities = []string{"service-manager"}
+	s.API.StoreDir = "config-api"
+	g.Expect(s.Validate()).To(Succeed())
+	s.API.StoreDir = ""
+	g.Expect(s.Validate()).To(Succeed())
+}
+
+func TestValidateGit(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s := Defaults()
+	s.Git.URL = "https://github.com/example/mesh.git"
+	g.Expect(s.Validate()).To(Succeed())
+	s.Git.PollInterval = 0
+	s.API.Address = ":18082"
+	s.API.Identities = []string{"service-manager"}
+	s.Auth.TokenFiles = []string{"tokens"}
+	err := s.Validate()
+	g.Expect(err).To(MatchError(ContainSubstring("git.pollInterval")))
+	g.Expect(err).To(MatchError(ContainSubstring("api.storeDir is required")))
+
+	s.Git.PollInterval = Duration(time.Minute)
+	s.API.StoreDir = "config-api"
+	g.Expect(s.Validate()).To(Succeed())
+	s.ConfigDir = "config"
+	s.Git.CacheDir = "config/git"
+	g.Expect(s.Validate()).To(MatchError(ContainSubstring("git.cacheDir must not be within configDir")))
+}
+
+func TestValidateBundle(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s := Defaults()
+	s.Bundle.URL = "https://example.com/mesh.tar.gz"
+	s.Bundle.PollInterval = 0
+	err := s.Validate()
+	g.Expect(err).To(MatchError(ContainSubstring("bundle.publicKeyFile is required")))
+	g.Expect(err).To(MatchError(ContainSubstring("bundle.pollInterval")))
+	s.Bundle.PublicKeyFile = "bundle.pub"
+	s.Bundle.PollInterval = Duration(time.Minute)
+	g.Expect(s.Validate()).To(Succeed())
+}
+
+func TestValidateKubernetes(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s := Defaults()
+	s.Kubernetes.Enabled = true
+	g.Expect(s.Validate()).To(Succeed())
+	s.Kubernetes.ResyncPeriod = Duration(-time.Minute)
+	g.Expect(s.Validate()).To(MatchError(ContainSubstring("kubernetes.resyncPeriod")))
+}
+
+func TestValidateUpstream(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s := Defaults()
+	s.Upstream.Addresses = []string{"galley:9901"}
+	g.Expect(s.Validate()).To(Succeed())
+	s.Upstream.CertFile = "client.crt"
+	err := s.Validate()
+	g.Expect(err).To(MatchError(ContainSubstring("upstream.certFile and upstream.keyFile")))
+	g.Expect(err).To(MatchError(ContainSubstring("upstream.certFile needs upstream.caFile")))
+	s.Upstream.KeyFile = "client.key"
+	s.Upstream.TokenFile = "token"
+	g.Expect(s.Validate()).To(MatchError(ContainSubstring("upstream.tokenFile needs upstream.caFile")))
+	s.Upstream.CAFile = "ca.crt"
+	g.Expect(s.Validate()).To(Succeed())
+
+	// upstream servers serving the same resources get different precedences
+	s.Upstream.Addresses = append(s.Upstream.Addresses, "mcp.example.com:443")
+	s.Upstream.Precedences = map[string]int{"galley:9901": -2, "galley:9902": -3}
+	g.Expect(s.Validate()).To(MatchError(ContainSubstring("upstream.precedences of galley:9902, which is no upstream address")))
+	delete(s.Upstream.Precedences, "galley:9902")
+	g.Expect(s.Validate()).To(Succeed())
+	g.Expect(s.Upstream.PrecedenceOf("galley:9901")).To(Equal(-2))
+	g.Expect(s.Upstream.PrecedenceOf("mcp.example.com:443")).To(Equal(-1))
+}
+
+func TestValidateVCAP(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s := Defaults()
+	s.VCAP.Dir = "services"
+	g.Expect(s.Validate()).To(MatchError(ContainSubstring("vcap.templateDir is required")))
+	s.VCAP.TemplateDir = "templates"
+	g.Expect(s.Validate()).To(Succeed())
+	s.ConfigDir = "."
+	g.Expect(s.Validate()).To(MatchError(ContainSubstring("vcap.dir must not be within configDir")))
+}
+
+func TestValidateKeepalive(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s := Defaults()
+	s.ConfigDir = "config"
+	s.GRPC.Keepalive.Time = Duration(30 * time.Second)
+	s.GRPC.Keepalive.Enforcement.MinTime = Duration(-time.Minute)
+	s.GRPC.Keepalive.MaxConnectionAge = Duration(-time.Minute)
+	s.GRPC.MaxStreamsPerIdentity = -1
+	err := s.Validate()
+	g.Expect(err).To(MatchError(ContainSubstring("grpc.keepalive.enforcement.minTime must not be negative")))
+	g.Expect(err).To(MatchError(ContainSubstring("grpc.keepalive.maxConnectionAge")))
+	g.Expect(err).To(MatchError(ContainSubstring("grpc.maxStreamsPerIdentity")))
+
+	// the minimum interval of client pings doesn't depend on the interval of server pings
+	s.GRPC.Keepalive.Enforcement.MinTime = Duration(5 * time.Minute)
+	s.GRPC.Keepalive.MaxConnectionAge = Duration(30 * time.Minute)
+	s.GRPC.MaxStreamsPerIdentity = 2
+	g.Expect(s.Validate()).To(Succeed())
+}
+
+func TestLoad(t *testing.T) {
+	g := NewGomegaWithT(t)
+	file := writeSettings(t, `
+configDir: /etc/istio-config
+grpc:
+  address: ":19000"
+  maxStreamsPerIdentity: 4
+  keepalive:
+    time: 30s
+    maxConnectionAge: 30m
+    maxConnectionAgeGrace: 1m
+    enforcement:
+      minTime: 10s
+      permitWithoutStream: true
+canary:
+  annotations:
+    canary: "true"
+`)
+	defer os.RemoveAll(filepath.Dir(file))
+	s := Defaults()
+	g.Expect(s.Load(file)).To(Succeed())
+	g.Expect(s.ConfigDir).To(Equal("/etc/istio-config"))
+	g.Expect(s.GRPC.Address).To(Equal(":19000"))
+	g.Expect(s.GRPC.MaxStreamsPerIdentity).To(Equal(4))
+	g.Expect(s.GRPC.Keepalive.Time).To(Equal(Duration(30 * time.Second)))
+	g.Expect(s.GRPC.Keepalive.MaxConnectionAge).To(Equal(Duration(30 * time.Minute)))
+	g.Expect(s.GRPC.Keepalive.MaxConnectionAgeGrace).To(Equal(Duration(time.Minute)))
+	g.Expect(s.GRPC.Keepalive.Enforcement).To(Equal(KeepaliveEnforcementSettings{MinTime: Duration(10 * time.Second), PermitWithoutStream: true}))
+	g.Expect(s.GRPC.MaxConcurrentStreams).To(Equal(uint32(1024)))
+	g.Expect(s.Canary.Annotations).To(Equal(map[string]string{"canary": "true"}))
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	g := NewGomegaWithT(t)
+	file := writeSettings(t, "grpc:\n  adress: \":19000\"\n")
+	defer os.RemoveAll(filepath.Dir(file))
+	g.Expect(Defaults().Load(file)).To(HaveOccurred())
+
+	file = writeSettings(t, "canary:\n  soak: forever\n")
+	defer os.RemoveAll(filepath.Dir(file))
+	g.Expect(Defaults().Load(file)).To(HaveOccurred())
+}
+
+func TestYAMLRoundTrip(t *testing.T) {
+	g := NewGomegaWithT(t)
+	s := Defaults()
+	s.ConfigDir = "config"
+	s.Auth.AllowedIdentities = []string{"spiffe://cluster.local/ns/istio-system/sa/pilot"}
+	s.Canary.Annotations = map[string]string{"canary": "true"}
+	out, err := s.YAML()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).To(ContainSubstring("soak: 1m0s"))
+
+	file := writeSettings(t, string(out))
+	defer os.RemoveAll(filepath.Dir(file))
+	loaded := &Settings{}
+	g.Expect(loaded.Load(file)).To(Succeed())
+	g.Expect(loaded.Auth.AllowedIdentities).To(Equal(s.Auth.AllowedIdentities))
+	g.Expect(loaded.Canary.Soak).To(Equal(s.Canary.Soak))
+	reloaded, err := loaded.YAML()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(reloaded)).To(Equal(string(out)))
+}
+
+func TestResolvePrecedence(t *testing.T) {
+	g := NewGomegaWithT(t)
+	file := writeSettings(t, `
+configDir: from-file
+httpAddr: ignored
+`)
+	defer os.RemoveAll(filepath.Dir(file))
+	_, err := resolve(nil, map[string]string{"MCP_SETTINGS": file})
+	g.Expect(err).To(MatchError(ContainSubstring("httpAddr")))
+
+	file = writeSettings(t, `
+configDir: from-file
+http:
+  address: ":8080"
+admin:
+  address: ":8081"
+`)
+	defer os.RemoveAll(filepath.Dir(file))
+	s, err := resolve(
+		[]string{"-settings", file, "-adminAddr", ":9091", "-incremental=false", "-allowedIdentities", "a, b"},
+		map[string]string{"MCP_HTTP_ADDR": ":9080", "MCP_ADMIN_ADDR": ":7071", "MCP_CANARY_ANNOTATIONS": "canary=true"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(s.ConfigDir).To(Equal("from-file"))
+	g.Expect(s.HTTP.Address).To(Equal(":9080"))
+	g.Expect(s.Admin.Address).To(Equal(":9091"))
+	g.Expect(s.Watcher.Incremental).To(BeFalse())
+	g.Expect(s.Auth.AllowedIdentities).To(Equal([]string{"a", "b"}))
+	g.Expect(s.Canary.Annotations).To(Equal(map[string]string{"canary": "true"}))
+}
+
+func TestResolveInvalidValues(t *testing.T) {
+	g := NewGomegaWithT(t)
+	_, err := resolve([]string{"-configDir", "config"}, map[string]string{"MCP_HISTORY_SIZE": "many"})
+	g.Expect(err).To(MatchError(ContainSubstring("MCP_HISTORY_SIZE")))
+	_, err = resolve([]string{"-configDir", "config", "-canarySoak", "forever"}, nil)
+	g.Expect(err).To(MatchError(ContainSubstring("-canarySoak")))
+	_, err = resolve([]string{"-configDir", "config", "-publishBurst", "0"}, nil)
+	g.Expect(err).To(MatchError(ContainSubstring("watcher.publishBurst")))
+	_, err = resolve([]string{"-configDir", "config", "-upstreamAddrs", "galley:9901", "-upstreamNodeID", "mcp", "-upstreamPrecedences", "galley:9901=low"}, nil)
+	g.Expect(err).To(MatchError(ContainSubstring("-upstreamPrecedences")))
+	s, err := resolve([]string{"-configDir", "config", "-upstreamAddrs", "galley:9901", "-upstreamNodeID", "mcp", "-upstreamPrecedences", "galley:9901=-2"}, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(s.Upstream.Precedences).To(Equal(map[string]int{"galley:9901": -2}))
+}
+
+func TestEnvName(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(EnvName("configDir")).To(Equal("MCP_CONFIG_DIR"))
+	g.Expect(EnvName("tlsCAFile")).To(Equal("MCP_TLS_CA_FILE"))
+	g.Expect(EnvName("canaryNodeID")).To(Equal("MCP_CANARY_NODE_ID"))
+	g.Expect(EnvName("logJSON")).To(Equal("MCP_LOG_JSON"))
+}
+
+func resolve(args []string, env map[string]string) (*Settings, error) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := RegisterFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	return f.Resolve(func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	})
+}
+
+func writeSettings(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "settings.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
@@ -0,0 +1,468 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"github.com/ghodss/yaml"
+	"io/ioutil"
+	"istio.io/istio/pilot/pkg/config/kube/crd"
+	"istio.io/istio/pilot/pkg/model"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//FileSuffix is the suffix of the files written by a Store. Other files of its directory are ignored.
+const FileSuffix = ".api.yaml"
+
+//Store keeps istio configs in a directory, one YAML file per config. Configs are identified by type, namespace
+//and name. Every write assigns a new resource version to the config, which must be given to replace or delete it
+//conditionally.
+type Store struct {
+	dir     string
+	mutex   sync.RWMutex
+	configs map[string]model.Config
+	files   map[string]string
+	//version is the latest resource version assigned
+	version   int64
+	listeners []func()
+	//check is called with the configs the store would have after a write, see SetCheck
+	check func(set *config.ConfigSet) error
+}
+
+//Ensure that Store can be served by a config watcher
+var _ config.Source = &Store{}
+
+//notFoundError is returned if a config doesn't exist
+type notFoundError struct {
+	error
+}
+
+//conflictError is returned if a config already exists or has another resource version than expected
+type conflictError struct {
+	error
+}
+
+//IsNotFound returns true if err is returned because a config doesn't exist
+func IsNotFound(err error) bool {
+	_, ok := err.(*notFoundError)
+	return ok
+}
+
+//IsConflict returns true if err is returned because a config already exists or was changed concurrently
+func IsConflict(err error) bool {
+	_, ok := err.(*conflictError)
+	return ok
+}
+
+//Open creates a Store reading the configs already written to dir. The directory is created if missing.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		dir:     dir,
+		configs: make(map[string]model.Config),
+		files:   make(map[string]string),
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+FileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		configs, _, err := crd.ParseInputs(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("invalid file %s: %v", file, err)
+		}
+		if len(configs) != 1 {
+			return nil, fmt.Errorf("invalid file %s: expected one config, found %d", file, len(configs))
+		}
+		c := configs[0]
+		if expected := fileName(c.Type, c.Namespace, c.Name); filepath.Base(file) != expected {
+			return nil, fmt.Errorf("invalid file %s: the config must be stored as %s", file, expected)
+		}
+		version, err := strconv.ParseInt(c.ResourceVersion, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file %s: invalid resource version %q", file, c.ResourceVersion)
+		}
+		if version > s.version {
+			s.version = version
+		}
+		s.configs[key(c.Type, c.Namespace, c.Name)] = c
+		s.files[filepath.Base(file)] = hash(content)
+	}
+	return s, nil
+}
+
+//Name returns the directory of the store
+func (s *Store) Name() string {
+	return s.dir
+}
+
+//Read returns the configs of the store
+func (s *Store) Read() (*config.ConfigSet, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	set := &config.ConfigSet{Files: make(map[string]string, len(s.files))}
+	for _, c := range s.configs {
+		set.Configs = append(set.Configs, sourceConfig(c))
+	}
+	for file, hash := range s.files {
+		set.Files[file] = hash
+	}
+	return set, nil
+}
+
+//SetCheck sets a function checking the configs the store would have after a write before it is persisted,
+//e.g. against the configs of the other sources of a watcher. Writes failing a check with a *config.ValidationError
+//are rejected as conflict.
+func (s *Store) SetCheck(check func(set *config.ConfigSet) error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.check = check
+}
+
+//Watch calls changed after every write until stop is closed
+func (s *Store) Watch(changed func(), stop <-chan struct{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	index := len(s.listeners)
+	s.listeners = append(s.listeners, changed)
+	go func() {
+		<-stop
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.listeners[index] = nil
+	}()
+	return nil
+}
+
+//List returns the configs of a type in a namespace ordered by namespace and name. An empty namespace lists
+//the configs of all namespaces.
+func (s *Store) List(ctype string, namespace string) []model.Config {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	result := []model.Config{}
+	for _, c := range s.configs {
+		if c.Type == ctype && (namespace == "" || c.Namespace == namespace) {
+			result = append(result, c)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return config.ConfigName(result[i].Namespace, result[i].Name) < config.ConfigName(result[j].Namespace, result[j].Name)
+	})
+	return result
+}
+
+//Get returns a config
+func (s *Store) Get(ctype string, namespace string, name string) (model.Config, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	c, ok := s.configs[key(ctype, namespace, name)]
+	if !ok {
+		return model.Config{}, &notFoundError{fmt.Errorf("%s %s not found", ctype, config.ConfigName(namespace, name))}
+	}
+	return c, nil
+}
+
+//Create adds a config which must not exist yet and returns it with its resource version
+func (s *Store) Create(c model.Config) (model.Config, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.configs[key(c.Type, c.Namespace, c.Name)]; ok {
+		return model.Config{}, &conflictError{fmt.Errorf("%s %s already exists", c.Type, config.ConfigName(c.Namespace, c.Name))}
+	}
+	if err := s.checkWrite(c); err != nil {
+		return model.Config{}, err
+	}
+	c, err := s.write(c)
+	if err != nil {
+		return model.Config{}, err
+	}
+	s.notify()
+	return c, nil
+}
+
+//CreateAll adds configs which must not exist yet. Either all or none of them are added and the watchers
+//of the store are notified once, so that they don't serve a part of the configs.
+func (s *Store) CreateAll(configs []model.Config) ([]model.Config, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range configs {
+		if _, ok := s.configs[key(c.Type, c.Namespace, c.Name)]; ok {
+			return nil, &conflictError{fmt.Errorf("%s %s already exists", c.Type, config.ConfigName(c.Namespace, c.Name))}
+		}
+	}
+	if err := s.checkWrite(configs...); err != nil {
+		return nil, err
+	}
+	created := make([]model.Config, 0, len(configs))
+	for _, c := range configs {
+		c, err := s.write(c)
+		if err != nil {
+			for _, c := range created {
+				s.remove(c.Type, c.Namespace, c.Name)
+			}
+			return nil, err
+		}
+		created = append(created, c)
+	}
+	s.notify()
+	return created, nil
+}
+
+//Update replaces an existing config. If the resource version of c is set, it must match the stored one.
+func (s *Store) Update(c model.Config) (model.Config, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.configs[key(c.Type, c.Namespace, c.Name)]
+	if !ok {
+		return model.Config{}, &notFoundError{fmt.Errorf("%s %s not found", c.Type, config.ConfigName(c.Namespace, c.Name))}
+	}
+	if c.ResourceVersion != "" && c.ResourceVersion != current.ResourceVersion {
+		return model.Config{}, &conflictError{fmt.Errorf("%s %s has resource version %s, not %s",
+			c.Type, config.ConfigName(c.Namespace, c.Name), current.ResourceVersion, c.ResourceVersion)}
+	}
+	if err := s.checkWrite(c); err != nil {
+		return model.Config{}, err
+	}
+	c, err := s.write(c)
+	if err != nil {
+		return model.Config{}, err
+	}
+	s.notify()
+	return c, nil
+}
+
+//Delete removes a config. If resourceVersion is set, it must match the stored one.
+func (s *Store) Delete(ctype string, namespace string, name string, resourceVersion string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.configs[key(ctype, namespace, name)]
+	if !ok {
+		return &notFoundError{fmt.Errorf("%s %s not found", ctype, config.ConfigName(namespace, name))}
+	}
+	if resourceVersion != "" && resourceVersion != current.ResourceVersion {
+		return &conflictError{fmt.Errorf("%s %s has resource version %s, not %s",
+			ctype, config.ConfigName(namespace, name), current.ResourceVersion, resourceVersion)}
+	}
+	if err := s.remove(ctype, namespace, name); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+//DeleteAll removes configs regardless of their resource version. Missing configs are skipped.
+//The watchers of the store are notified once.
+func (s *Store) DeleteAll(configs []model.Config) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var err error
+	for _, c := range configs {
+		if _, ok := s.configs[key(c.Type, c.Namespace, c.Name)]; !ok {
+			continue
+		}
+		if removeErr := s.remove(c.Type, c.Namespace, c.Name); removeErr != nil {
+			err = removeErr
+		}
+	}
+	s.notify()
+	return err
+}
+
+//Select returns the configs of all types with an annotation
+func (s *Store) Select(annotation string, value string) []model.Config {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	result := []model.Config{}
+	for _, c := range s.configs {
+		if c.Annotations[annotation] == value {
+			result = append(result, c)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return key(result[i].Type, result[i].Namespace, result[i].Name) < key(result[j].Type, result[j].Namespace, result[j].Name)
+	})
+	return result
+}
+
+//remove deletes the file of a config
+func (s *Store) remove(ctype string, namespace string, name string) error {
+	file := fileName(ctype, namespace, name)
+	if err := os.Remove(filepath.Join(s.dir, file)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	delete(s.configs, key(ctype, namespace, name))
+	delete(s.files, file)
+	return nil
+}
+
+//checkWrite validates configs and passes the configs of the store with them written to the check set by SetCheck
+func (s *Store) checkWrite(configs ...model.Config) error {
+	for _, c := range configs {
+		if err := validate(c); err != nil {
+			return err
+		}
+	}
+	if s.check == nil {
+		return nil
+	}
+	written := make(map[string]model.Config, len(s.configs)+len(configs))
+	for k, c := range s.configs {
+		written[k] = c
+	}
+	for _, c := range configs {
+		written[key(c.Type, c.Namespace, c.Name)] = c
+	}
+	set := &config.ConfigSet{}
+	for _, c := range written {
+		set.Configs = append(set.Configs, sourceConfig(c))
+	}
+	err := s.check(set)
+	if _, conflict := err.(*config.ValidationError); conflict {
+		return &conflictError{err}
+	}
+	return err
+}
+
+//write persists c, validated by checkWrite, with the next resource version. The file is replaced atomically, so
+//that neither the store nor a config watcher of the directory reads a partially written file.
+func (s *Store) write(c model.Config) (model.Config, error) {
+	schema, _ := model.IstioConfigTypes.GetByType(c.Type)
+	c.ResourceVersion = strconv.FormatInt(s.version+1, 10)
+	object, err := ConvertConfig(schema, c)
+	if err != nil {
+		return model.Config{}, err
+	}
+	content, err := json.Marshal(object)
+	if err != nil {
+		return model.Config{}, err
+	}
+	if content, err = yaml.JSONToYAML(content); err != nil {
+		return model.Config{}, err
+	}
+	file := fileName(c.Type, c.Namespace, c.Name)
+	if err := writeFile(filepath.Join(s.dir, file), content); err != nil {
+		return model.Config{}, err
+	}
+	s.version++
+	s.configs[key(c.Type, c.Namespace, c.Name)] = c
+	s.files[file] = hash(content)
+	return c, nil
+}
+
+//ConvertConfig converts a config to its kubernetes object like crd.ConvertConfig, but keeps an empty namespace
+//instead of replacing it with the default namespace
+func ConvertConfig(schema model.ProtoSchema, c model.Config) (crd.IstioObject, error) {
+	object, err := crd.ConvertConfig(schema, c)
+	if err != nil {
+		return nil, err
+	}
+	meta := object.GetObjectMeta()
+	meta.Namespace = c.Namespace
+	object.SetObjectMeta(meta)
+	return object, nil
+}
+
+//notify calls the listeners of Watch after a write
+func (s *Store) notify() {
+	for _, listener := range s.listeners {
+		if listener != nil {
+			listener()
+		}
+	}
+}
+
+//writeFile writes a hidden temporary file and renames it to filename once it is synced
+func writeFile(filename string, content []byte) error {
+	dir := filepath.Dir(filename)
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+//syncDir persists the entries of a directory after files were renamed or removed
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+//validate returns an error if c isn't a valid config of a known type. The namespace must be a DNS label, so that
+//it can't be mistaken for a part of the name in the file name.
+func validate(c model.Config) error {
+	schema, ok := model.IstioConfigTypes.GetByType(c.Type)
+	if !ok {
+		return fmt.Errorf("unknown config type %s", c.Type)
+	}
+	if c.Namespace != "" {
+		if problems := validation.IsDNS1123Label(c.Namespace); len(problems) > 0 {
+			return fmt.Errorf("invalid namespace %q: %s", c.Namespace, strings.Join(problems, ", "))
+		}
+	}
+	if err := schema.Validate(c.Name, c.Namespace, c.Spec); err != nil {
+		return fmt.Errorf("invalid %s %s: %v", c.Type, c.Name, err)
+	}
+	return nil
+}
+
+//sourceConfig returns a stored config the way the store provides it as config.Source, named with its namespace
+func sourceConfig(c model.Config) config.Config {
+	return config.Config{Type: c.Type, Name: config.ConfigName(c.Namespace, c.Name), Spec: c.Spec, Origin: fileName(c.Type, c.Namespace, c.Name), Labels: c.Labels}
+}
+
+func key(ctype string, namespace string, name string) string {
+	return ctype + "/" + namespace + "/" + name
+}
+
+//fileName returns the file of a config, e.g. gateway.mesh_pinger.api.yaml or gateway.pinger.api.yaml without
+//namespace. Names must be valid DNS subdomains and namespaces DNS labels, neither contains an underscore.
+func fileName(ctype string, namespace string, name string) string {
+	if namespace == "" {
+		return ctype + "." + name + FileSuffix
+	}
+	return ctype + "." + namespace + "_" + name + FileSuffix
+}
+
+func hash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,234 @@
+package store
+
+import (
+	"errors"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func gateway(name string, host string) model.Config {
+	return model.Config{
+		ConfigMeta: model.ConfigMeta{Type: model.Gateway.Type, Name: name},
+		Spec: &networking.Gateway{Servers: []*networking.Server{{
+			Hosts: []string{host},
+			Port:  &networking.Port{Number: 9000, Name: "http", Protocol: "HTTP"},
+		}}},
+	}
+}
+
+func TestStore(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "store")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	s, err := Open(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	changes := 0
+	stop := make(chan struct{})
+	defer close(stop)
+	g.Expect(s.Watch(func() { changes++ }, stop)).To(Succeed())
+
+	created, err := s.Create(gateway("pinger", "pinger.example.com"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(created.ResourceVersion).To(Equal("1"))
+	_, err = s.Create(gateway("pinger", "pinger.example.com"))
+	g.Expect(IsConflict(err)).To(BeTrue())
+	_, err = s.Create(gateway("invalid", ""))
+	g.Expect(err).To(MatchError(ContainSubstring("invalid gateway invalid")))
+	g.Expect(changes).To(Equal(1))
+
+	update := gateway("pinger", "other.example.com")
+	update.ResourceVersion = "7"
+	_, err = s.Update(update)
+	g.Expect(IsConflict(err)).To(BeTrue())
+	update.ResourceVersion = created.ResourceVersion
+	updated, err := s.Update(update)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(updated.ResourceVersion).To(Equal("2"))
+	_, err = s.Update(gateway("missing", "missing.example.com"))
+	g.Expect(IsNotFound(err)).To(BeTrue())
+
+	_, err = s.Create(gateway("test", "test.example.com"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(s.List(model.Gateway.Type, "")).To(HaveLen(2))
+	g.Expect(s.List(model.VirtualService.Type, "")).To(BeEmpty())
+	set, err := s.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Configs).To(HaveLen(2))
+	g.Expect(set.Files).To(HaveKey("gateway.pinger" + FileSuffix))
+
+	g.Expect(IsConflict(s.Delete(model.Gateway.Type, "", "test", "1"))).To(BeTrue())
+	g.Expect(s.Delete(model.Gateway.Type, "", "test", "3")).To(Succeed())
+	g.Expect(IsNotFound(s.Delete(model.Gateway.Type, "", "test", ""))).To(BeTrue())
+	g.Expect(changes).To(Equal(4))
+
+	// the configs and resource versions survive a restart
+	s, err = Open(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	reopened, err := s.Get(model.Gateway.Type, "", "pinger")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(reopened.ResourceVersion).To(Equal("2"))
+	g.Expect(reopened.Spec).To(Equal(updated.Spec))
+	_, err = s.Get(model.Gateway.Type, "", "test")
+	g.Expect(IsNotFound(err)).To(BeTrue())
+	created, err = s.Create(gateway("test", "test.example.com"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(created.ResourceVersion).To(Equal("3"))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(files).To(HaveLen(2))
+}
+
+func TestNamespaces(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "store")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	s, err := Open(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// configs of the same name in different namespaces don't replace each other
+	pinger, meshPinger, otherPinger := gateway("pinger", "pinger.example.com"), gateway("pinger", "mesh.example.com"), gateway("pinger", "other.example.com")
+	meshPinger.Namespace = "mesh"
+	otherPinger.Namespace = "other"
+	for _, c := range []model.Config{pinger, meshPinger, otherPinger} {
+		_, err = s.Create(c)
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+	_, err = s.Create(meshPinger)
+	g.Expect(IsConflict(err)).To(BeTrue())
+	invalid := gateway("pinger", "invalid.example.com")
+	invalid.Namespace = "mesh_1"
+	_, err = s.Create(invalid)
+	g.Expect(err).To(MatchError(ContainSubstring("invalid namespace")))
+	g.Expect(s.List(model.Gateway.Type, "")).To(HaveLen(3))
+	listed := s.List(model.Gateway.Type, "mesh")
+	g.Expect(listed).To(HaveLen(1))
+	g.Expect(listed[0].Spec).To(Equal(meshPinger.Spec))
+	set, err := s.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Files).To(HaveKey("gateway.pinger" + FileSuffix))
+	g.Expect(set.Files).To(HaveKey("gateway.mesh_pinger" + FileSuffix))
+	g.Expect(set.Files).To(HaveKey("gateway.other_pinger" + FileSuffix))
+
+	g.Expect(s.Delete(model.Gateway.Type, "mesh", "pinger", "")).To(Succeed())
+	s, err = Open(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = s.Get(model.Gateway.Type, "mesh", "pinger")
+	g.Expect(IsNotFound(err)).To(BeTrue())
+	reopened, err := s.Get(model.Gateway.Type, "other", "pinger")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(reopened.Spec).To(Equal(otherPinger.Spec))
+	reopened, err = s.Get(model.Gateway.Type, "", "pinger")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(reopened.Spec).To(Equal(pinger.Spec))
+}
+
+func TestOpenInvalidFile(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "store")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "other.yaml"), []byte("invalid: ["), 0644)).To(Succeed())
+	_, err = Open(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "gateway.pinger"+FileSuffix), []byte("invalid: ["), 0644)).To(Succeed())
+	_, err = Open(dir)
+	g.Expect(err).To(MatchError(ContainSubstring("gateway.pinger")))
+}
+
+func TestCreateAllAndDeleteAll(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "store")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	s, err := Open(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	changes := 0
+	stop := make(chan struct{})
+	defer close(stop)
+	g.Expect(s.Watch(func() { changes++ }, stop)).To(Succeed())
+
+	// either all or none of the configs are created
+	_, err = s.CreateAll([]model.Config{gateway("pinger", "pinger.example.com"), gateway("invalid", "")})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(s.List(model.Gateway.Type, "")).To(BeEmpty())
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(files).To(BeEmpty())
+
+	pinger, test := gateway("pinger", "pinger.example.com"), gateway("test", "test.example.com")
+	pinger.Annotations = map[string]string{"binding": "1"}
+	test.Annotations = map[string]string{"binding": "1"}
+	created, err := s.CreateAll([]model.Config{pinger, test})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(created).To(HaveLen(2))
+	g.Expect(changes).To(Equal(1))
+	g.Expect(s.Select("binding", "1")).To(HaveLen(2))
+	g.Expect(s.Select("binding", "2")).To(BeEmpty())
+
+	g.Expect(s.DeleteAll(created)).To(Succeed())
+	g.Expect(changes).To(Equal(2))
+	g.Expect(s.List(model.Gateway.Type, "")).To(BeEmpty())
+}
+
+func TestCheck(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "store")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	s, err := Open(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	var checked *config.ConfigSet
+	checkErr := config.NewValidationError("", errors.New("gateway test is also provided by source config"))
+	s.SetCheck(func(set *config.ConfigSet) error {
+		checked = set
+		return checkErr
+	})
+
+	// the check gets the configs the store would have after the write
+	_, err = s.CreateAll([]model.Config{gateway("pinger", "pinger.example.com"), gateway("test", "test.example.com")})
+	g.Expect(IsConflict(err)).To(BeTrue())
+	g.Expect(err).To(MatchError(ContainSubstring("also provided by source config")))
+	g.Expect(checked.Configs).To(HaveLen(2))
+	g.Expect(s.List(model.Gateway.Type, "")).To(BeEmpty())
+
+	// invalid configs aren't checked
+	checked = nil
+	_, err = s.Create(gateway("invalid", ""))
+	g.Expect(err).To(MatchError(ContainSubstring("invalid gateway invalid")))
+	g.Expect(checked).To(BeNil())
+
+	checkErr = nil
+	created, err := s.Create(gateway("pinger", "pinger.example.com"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(checked.Configs).To(HaveLen(1))
+	g.Expect(checked.Configs[0].Origin).To(Equal("gateway.pinger" + FileSuffix))
+
+	// configs are provided with their namespace like the configs of the other sources
+	namespaced := gateway("mesh-pinger", "mesh.example.com")
+	namespaced.Namespace = "mesh"
+	_, err = s.Create(namespaced)
+	g.Expect(err).NotTo(HaveOccurred())
+	set, err := s.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	names := []string{set.Configs[0].Name, set.Configs[1].Name}
+	g.Expect(names).To(ConsistOf("pinger", "mesh/mesh-pinger"))
+
+	// other errors aren't conflicts
+	checkErr = errors.New("can't read source config")
+	_, err = s.Update(created)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(IsConflict(err)).To(BeFalse())
+	current, err := s.Get(model.Gateway.Type, "", "pinger")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(current.ResourceVersion).To(Equal("1"))
+}
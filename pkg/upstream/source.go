@@ -0,0 +1,242 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/logging"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"istio.io/istio/pkg/mcp/monitoring"
+	"istio.io/istio/pkg/mcp/sink"
+	"sort"
+	"sync"
+	"time"
+)
+
+//syncTimeout limits the time WaitForSync waits for the resources of all collections
+const syncTimeout = 30 * time.Second
+
+//partialSyncDelay is the time after the first received collection after which the collections the upstream server
+//doesn't serve, e.g. because they are empty, are taken as empty
+const partialSyncDelay = 5 * time.Second
+
+//Options configures an upstream Source
+type Options struct {
+	//Address of the upstream MCP server
+	Address string
+	//DialOptions configure the connection, e.g. its transport credentials
+	DialOptions []grpc.DialOption
+	//NodeID identifies this server as sink of the upstream server
+	NodeID   string
+	Reporter monitoring.Reporter
+}
+
+//Source reads the supported collections of an upstream MCP server, e.g. Galley or another instance of this
+//server, as MCP sink. The latest resources received are kept while the upstream server is unavailable.
+type Source struct {
+	options Options
+	conn    *grpc.ClientConn
+	client  *sink.Client
+	cancel  context.CancelFunc
+	synced  chan struct{}
+	//partialSyncDelay is a field, so that tests can shorten it
+	partialSyncDelay time.Duration
+	syncOnce         sync.Once
+
+	mutex     sync.Mutex
+	started   bool
+	changed   func()
+	resources map[string]map[string]*sink.Object
+}
+
+//Ensure that Source can be served and synced by a config watcher and receive the resources of a sink
+var (
+	_ config.Source = &Source{}
+	_ config.Syncer = &Source{}
+	_ sink.Updater  = &Source{}
+)
+
+//NewSource creates a Source. The upstream server is connected on the first Read, Watch or WaitForSync.
+func NewSource(options *Options) (*Source, error) {
+	if options.Address == "" || options.NodeID == "" || options.Reporter == nil {
+		return nil, errors.New("upstream address, node id and reporter are required")
+	}
+	conn, err := grpc.Dial(options.Address, options.DialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	s := &Source{
+		options:          *options,
+		conn:             conn,
+		synced:           make(chan struct{}),
+		partialSyncDelay: partialSyncDelay,
+		resources:        make(map[string]map[string]*sink.Object),
+	}
+	collections := make([]sink.CollectionOptions, 0, len(config.Types()))
+	for _, ctype := range config.Types() {
+		collection, _ := config.Collection(ctype)
+		collections = append(collections, sink.CollectionOptions{Name: collection})
+	}
+	s.client = sink.NewClient(mcp.NewResourceSourceClient(conn), &sink.Options{
+		CollectionOptions: collections,
+		Updater:           s,
+		ID:                options.NodeID,
+		Reporter:          options.Reporter,
+	})
+	return s, nil
+}
+
+//Name returns the address of the upstream server
+func (s *Source) Name() string {
+	return s.options.Address
+}
+
+//Read returns the latest resources of the upstream server. It fails without waiting until the resources of all
+//collections were received, or partialSyncDelay passed after the first collection. The files are reported as
+//<collection>/<name> with the resource version as hash.
+func (s *Source) Read() (*config.ConfigSet, error) {
+	s.start()
+	select {
+	case <-s.synced:
+	default:
+		return nil, fmt.Errorf("no resources received from upstream server %s yet", s.options.Address)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	set := &config.ConfigSet{Files: make(map[string]string)}
+	for collection, objects := range s.resources {
+		ctype, _ := config.TypeOfCollection(collection)
+		for name, object := range objects {
+			origin := collection + "/" + name
+			set.Files[origin] = object.Metadata.Version
+			set.Configs = append(set.Configs, config.Config{
+				Type:        ctype,
+				Name:        name,
+				Spec:        object.Body,
+				Origin:      origin,
+				Annotations: object.Metadata.Annotations,
+				Labels:      object.Metadata.Labels,
+			})
+		}
+	}
+	sort.Slice(set.Configs, func(i, j int) bool { return set.Configs[i].Origin < set.Configs[j].Origin })
+	return set, nil
+}
+
+//Watch calls changed whenever resources are received and once Read returns them, it disconnects once stop is closed
+func (s *Source) Watch(changed func(), stop <-chan struct{}) error {
+	s.mutex.Lock()
+	s.changed = changed
+	s.mutex.Unlock()
+	s.start()
+	go func() {
+		<-stop
+		s.cancel()
+		if err := s.conn.Close(); err != nil {
+			logging.Watcher.Warn("Can't close upstream connection", zap.String("address", s.options.Address), logging.Error(err))
+		}
+	}()
+	return nil
+}
+
+//WaitForSync connects to the upstream server and waits until Read returns its resources
+func (s *Source) WaitForSync() error {
+	s.start()
+	timer := time.NewTimer(syncTimeout)
+	defer timer.Stop()
+	select {
+	case <-s.synced:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("no resources received from upstream server %s within %s", s.options.Address, syncTimeout)
+	}
+}
+
+//Apply takes over the resources of a collection received from the upstream server
+func (s *Source) Apply(change *sink.Change) error {
+	ctype, ok := config.TypeOfCollection(change.Collection)
+	if !ok {
+		return fmt.Errorf("unsupported collection %s", change.Collection)
+	}
+	s.mutex.Lock()
+	if len(s.resources) == 0 {
+		time.AfterFunc(s.partialSyncDelay, s.markSynced)
+	}
+	objects, received := s.resources[change.Collection]
+	if !change.Incremental || !received {
+		objects = make(map[string]*sink.Object, len(change.Objects))
+	}
+	for _, object := range change.Objects {
+		if object.Metadata == nil || object.Metadata.Name == "" {
+			s.mutex.Unlock()
+			return fmt.Errorf("%s without name received", ctype)
+		}
+		objects[object.Metadata.Name] = object
+	}
+	for _, name := range change.Removed {
+		delete(objects, name)
+	}
+	s.resources[change.Collection] = objects
+	allReceived := len(s.resources) == len(config.Types())
+	changed := s.changed
+	s.mutex.Unlock()
+	logging.Watcher.Debug("Received upstream resources", zap.String("address", s.options.Address),
+		zap.String("collection", change.Collection), zap.Int("resources", len(objects)), zap.String("version", change.SystemVersionInfo))
+	if allReceived {
+		s.markSynced()
+	}
+	if changed != nil {
+		changed()
+	}
+	return nil
+}
+
+//markSynced lets Read return the resources received. The watcher is notified, as Read failed until now.
+func (s *Source) markSynced() {
+	s.syncOnce.Do(func() {
+		close(s.synced)
+		s.mutex.Lock()
+		changed := s.changed
+		s.mutex.Unlock()
+		if changed != nil {
+			changed()
+		}
+	})
+}
+
+//start runs the sink client once
+func (s *Source) start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	go s.client.Run(ctx)
+}
+
+//tokenCredentials sends a bearer token with every request
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+//WithToken authenticates the connection with a bearer token. The connection must be encrypted, the settings
+//reject a token without CA.
+func WithToken(token string) grpc.DialOption {
+	return grpc.WithPerRPCCredentials(tokenCredentials(token))
+}
+
+//Ensure that tokenCredentials can be sent by grpc
+var _ credentials.PerRPCCredentials = tokenCredentials("")
@@ -0,0 +1,142 @@
+package upstream
+
+import (
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	mcpserver "github.com/Peripli/service-manager-istio-mcp-server/pkg/server"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"istio.io/istio/galley/pkg/metadata"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/mcp/server"
+	"istio.io/istio/pkg/mcp/source"
+	mcptestmon "istio.io/istio/pkg/mcp/testing/monitoring"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//serve serves the configs of a directory over MCP and returns the address
+func serve(t *testing.T, dir string) (string, func()) {
+	watcher, err := config.NewConfigWatcher(dir, &config.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var collections []source.CollectionOptions
+	for _, ctype := range config.Types() {
+		collection, _ := config.Collection(ctype)
+		collections = append(collections, source.CollectionOptions{Name: collection})
+	}
+	mcpServer := mcpserver.New(&mcpserver.Options{
+		Watcher:     watcher,
+		Collections: collections,
+		Reporter:    mcptestmon.NewInMemoryStatsContext(),
+		AuthChecker: server.NewAllowAllChecker(),
+	})
+	grpcServer := grpc.NewServer()
+	mcp.RegisterResourceSourceServer(grpcServer, mcpServer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go grpcServer.Serve(listener)
+	return listener.Addr().String(), grpcServer.Stop
+}
+
+func copyFile(t *testing.T, from string, to string) {
+	content, err := ioutil.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(to, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSource(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "upstream")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	copyFile(t, "../../test/config/istio-pinger.yaml", filepath.Join(dir, "istio-pinger.yaml"))
+	address, stop := serve(t, dir)
+	defer stop()
+
+	_, err = NewSource(&Options{Address: address})
+	g.Expect(err).To(HaveOccurred())
+	source, err := NewSource(&Options{
+		Address:     address,
+		DialOptions: []grpc.DialOption{grpc.WithInsecure(), WithToken("secret")},
+		NodeID:      "downstream",
+		Reporter:    mcptestmon.NewInMemoryStatsContext(),
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	// the upstream server doesn't serve the empty destination rules
+	source.partialSyncDelay = 100 * time.Millisecond
+	g.Expect(source.WaitForSync()).To(Succeed())
+	set, err := source.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Configs).To(HaveLen(3))
+	g.Expect(set.Files).To(HaveKey(metadata.IstioNetworkingV1alpha3Gateways.Collection.String() + "/pinger-gateway"))
+
+	// the configs of the upstream server are served again
+	serviceEntries := metadata.IstioNetworkingV1alpha3Serviceentries.Collection.String()
+	watcher, err := config.NewWatcher([]config.Source{source}, &config.Options{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(watcher.Snapshot().Resources(serviceEntries)).To(HaveLen(1))
+
+	copyFile(t, "../../test/config/sub/istio-test.yaml", filepath.Join(dir, "istio-test.yaml"))
+	g.Eventually(func() int { return len(watcher.Snapshot().Resources(serviceEntries)) }, "5s").Should(Equal(2))
+}
+
+func TestSourcePartialSync(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "upstream")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	serviceEntry := `apiVersion: networking.istio.io/v1alpha3
+kind: ServiceEntry
+metadata:
+  name: pinger
+spec:
+  hosts:
+  - istio-pinger.istio
+  ports:
+  - number: 8081
+    name: pinger
+    protocol: TCP
+  resolution: STATIC
+  endpoints:
+  - address: 10.0.81.2
+`
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "service-entry.yaml"), []byte(serviceEntry), 0644)).To(Succeed())
+	address, stop := serve(t, dir)
+	defer stop()
+
+	// the upstream server doesn't serve the empty gateways and virtual services
+	source, err := NewSource(&Options{
+		Address:     address,
+		DialOptions: []grpc.DialOption{grpc.WithInsecure()},
+		NodeID:      "downstream",
+		Reporter:    mcptestmon.NewInMemoryStatsContext(),
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	source.partialSyncDelay = 100 * time.Millisecond
+	changed := make(chan struct{}, 10)
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	g.Expect(source.Watch(func() { changed <- struct{}{} }, stopWatch)).To(Succeed())
+
+	// reads don't wait for the resources
+	_, err = source.Read()
+	g.Expect(err).To(MatchError(ContainSubstring("no resources received")))
+	g.Expect(source.WaitForSync()).To(Succeed())
+	g.Eventually(changed).Should(Receive())
+	set, err := source.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Configs).To(HaveLen(1))
+	g.Expect(set.Configs[0].Type).To(Equal(model.ServiceEntry.Type))
+}
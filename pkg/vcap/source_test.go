@@ -0,0 +1,147 @@
+package vcap
+
+import (
+	"github.com/Peripli/service-manager-istio-mcp-server/pkg/config"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSource(t *testing.T) {
+	g := NewGomegaWithT(t)
+	source := NewSource("../../test/vcap/services", "../../test/vcap/templates")
+	set, err := source.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// the redis service has no template
+	names := make(map[string]string)
+	for _, c := range set.Configs {
+		names[c.Type+"/"+c.Name] = c.Origin
+	}
+	g.Expect(names).To(Equal(map[string]string{
+		model.ServiceEntry.Type + "/postgresql-orders-db":            "orders-db.json",
+		model.Gateway.Type + "/user-provided-pinger-backend-gateway": "vcap-services.json",
+		model.VirtualService.Type + "/user-provided-pinger-backend":  "vcap-services.json",
+		model.ServiceEntry.Type + "/user-provided-pinger-backend":    "vcap-services.json",
+	}))
+	g.Expect(set.Files).To(HaveKey("orders-db.json"))
+	g.Expect(set.Files).To(HaveKey("vcap-services.json"))
+	g.Expect(set.Files).To(HaveKey(filepath.Join("templates", "postgresql.yaml")))
+
+	for _, c := range set.Configs {
+		if c.Type == model.ServiceEntry.Type && c.Name == "user-provided-pinger-backend" {
+			serviceEntry := c.Spec.(*networking.ServiceEntry)
+			g.Expect(serviceEntry.Ports[0].Number).To(Equal(uint32(8443)))
+			g.Expect(serviceEntry.Endpoints[0].Address).To(Equal("pinger.internal.example.com"))
+		}
+	}
+
+	// the configs are generated deterministically
+	again, err := source.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(again).To(Equal(set))
+}
+
+func TestSourceInvalid(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "vcap")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	source := NewSource(dir, "../../test/vcap/templates")
+	write := func(content string) {
+		g.Expect(ioutil.WriteFile(filepath.Join(dir, "services.json"), []byte(content), 0644)).To(Succeed())
+	}
+
+	write(`{"postgresql": [{"name": "orders", "credentials": {"hostname": "orders.example.com"}}]}`)
+	_, err = source.Read()
+	g.Expect(err).To(BeAssignableToTypeOf(&config.ValidationError{}))
+	g.Expect(err.(*config.ValidationError).File).To(Equal("services.json"))
+	g.Expect(err).To(MatchError(ContainSubstring("port")))
+
+	write(`{"postgresql": [{"name": "Orders", "credentials": {"hostname": "a.example.com", "port": 1}},
+		{"name": "orders", "credentials": {"hostname": "b.example.com", "port": 2}}]}`)
+	_, err = source.Read()
+	g.Expect(err).To(MatchError(ContainSubstring("same resource name postgresql-orders")))
+
+	write(`{"name": "orders", "credentials": {}}`)
+	_, err = source.Read()
+	g.Expect(err).To(MatchError(ContainSubstring("label of service orders is missing")))
+
+	write(`[`)
+	_, err = source.Read()
+	g.Expect(err).To(BeAssignableToTypeOf(&config.ValidationError{}))
+
+	_, err = NewSource(filepath.Join(dir, "missing"), "../../test/vcap/templates").Read()
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err).NotTo(BeAssignableToTypeOf(&config.ValidationError{}))
+}
+
+func TestSourceQuotesCredentials(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "vcap")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	source := NewSource(dir, "../../test/vcap/templates")
+
+	// a credential can't add an endpoint to the rendered service entry, it stays one invalid address
+	hostile := `{"postgresql": [{"name": "orders", "credentials": {"hostname": "orders.example.com\n  - address: evil.example.com", "port": 5432}}]}`
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "services.json"), []byte(hostile), 0644)).To(Succeed())
+	_, err = source.Read()
+	g.Expect(err).To(BeAssignableToTypeOf(&config.ValidationError{}))
+	g.Expect(err).To(MatchError(ContainSubstring(`endpoint address "orders.example.com\n  - address: evil.example.com"`)))
+
+	// quoted numbers are still numbers
+	quoted := `{"postgresql": [{"name": "orders", "credentials": {"hostname": "orders.example.com", "port": "5432"}}]}`
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "services.json"), []byte(quoted), 0644)).To(Succeed())
+	set, err := source.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Configs[0].Spec.(*networking.ServiceEntry).Ports[0].Number).To(Equal(uint32(5432)))
+}
+
+func TestSourceWatch(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "vcap")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	templateDir := filepath.Join(dir, "templates")
+	servicesDir := filepath.Join(dir, "services")
+	g.Expect(os.Mkdir(templateDir, 0755)).To(Succeed())
+	g.Expect(os.Mkdir(servicesDir, 0755)).To(Succeed())
+	source := NewSource(servicesDir, templateDir)
+	changed := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	g.Expect(source.Watch(func() { changed <- struct{}{} }, stop)).To(Succeed())
+
+	content, err := ioutil.ReadFile("../../test/vcap/services/orders-db.json")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(servicesDir, "orders-db.json"), content, 0644)).To(Succeed())
+	g.Eventually(changed, time.Second).Should(Receive())
+	set, err := source.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Configs).To(BeEmpty())
+
+	content, err = ioutil.ReadFile("../../test/vcap/templates/postgresql.yaml")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(templateDir, "postgresql.yaml"), content, 0644)).To(Succeed())
+	g.Eventually(changed, time.Second).Should(Receive())
+	set, err = source.Read()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(set.Configs).To(HaveLen(1))
+}
+
+func TestResourceName(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(resourceName("user-provided", "Pinger Backend")).To(Equal("user-provided-pinger-backend"))
+	g.Expect(resourceName("p.mysql", "_orders_")).To(Equal("p-mysql-orders"))
+	long := resourceName("postgresql", strings.Repeat("orders", 20))
+	g.Expect(long).To(HaveLen(maxNameLength))
+	g.Expect(long).To(HavePrefix("postgresql-ordersorders"))
+	g.Expect(long).NotTo(Equal(resourceName("postgresql", strings.Repeat("orders", 21))))
+}